@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "go.uber.org/automaxprocs"
 
@@ -10,8 +16,17 @@ import (
 	"github.com/teslamotors/fleet-telemetry/config"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/connections"
 	"github.com/teslamotors/fleet-telemetry/server/monitoring"
 	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// shutdownTimeout bounds the time given to the vehicles to disconnect on shutdown
+	shutdownTimeout = 30 * time.Second
+	// ackDrainTimeout bounds the time given to the acks left in the ack channel to be processed once the producers are closed
+	ackDrainTimeout = 5 * time.Second
 )
 
 func main() {
@@ -47,12 +62,38 @@ func main() {
 			}
 		}()
 	}
-	panic(startServer(config, airbrakeNotifier, logger))
+	if err = startServer(config, airbrakeNotifier, logger); err != nil {
+		panic(err)
+	}
 }
 
 func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logger *logrus.Logger) (err error) {
 	logger.ActivityLog("starting_server", nil)
 	registry := streaming.NewSocketRegistry()
+	sessionStore, err := config.NewSessionStore()
+	if err != nil {
+		return err
+	}
+	if sessionStore != nil {
+		registry.SetSessionStore(sessionStore)
+		defer func() {
+			if closeErr := sessionStore.Close(); closeErr != nil {
+				logger.ErrorLog("session_store_close_error", closeErr, nil)
+			}
+		}()
+	}
+
+	connectionStore, err := config.NewConnectionStore()
+	if err != nil {
+		return err
+	}
+	if connectionStore != nil {
+		defer func() {
+			if closeErr := connectionStore.Close(); closeErr != nil {
+				logger.ErrorLog("connection_store_close_error", closeErr, nil)
+			}
+		}()
+	}
 
 	airbrakeHandler := airbrake.NewAirbrakeHandler(airbrakeNotifier)
 
@@ -62,15 +103,33 @@ func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logg
 	if config.Monitoring != nil {
 		monitoring.StartServerMetrics(config, logger, registry)
 	}
+	if config.ConnectionsAPI != nil {
+		if err = connections.StartConnectionsServer(config, registry, logger); err != nil {
+			return err
+		}
+	}
 
 	dispatchers, producerRules, err := config.ConfigureProducers(airbrakeHandler, logger)
 	if err != nil {
 		return err
 	}
-	server, _, err := streaming.InitServer(config, airbrakeHandler, producerRules, logger, registry)
+	regionalProducers, regionalRules, err := config.ConfigureRegionalProducers(airbrakeHandler, dispatchers, logger)
 	if err != nil {
 		return err
 	}
+	server, socketServer, err := streaming.InitServer(config, airbrakeHandler, producerRules, logger, registry)
+	if err != nil {
+		return err
+	}
+	socketServer.RegionDispatchRules = regionalRules
+	if connectionStore != nil {
+		// the connections left in the store are reconciled again by the next run if this fails
+		if reconcileErr := socketServer.ReconcileConnections(connectionStore, config); reconcileErr != nil {
+			logger.ErrorLog("last_will_reconcile_error", reconcileErr, nil)
+		}
+		registry.SetConnectionStore(connectionStore)
+	}
+	go shutdownOnSignal(server, socketServer, logger)
 
 	if config.TLSPassThrough != nil {
 		err = server.ListenAndServe()
@@ -81,6 +140,10 @@ func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logg
 		err = server.ListenAndServeTLS(config.TLS.ServerCert, config.TLS.ServerKey)
 	}
 
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
 	for dispatcher, producer := range dispatchers {
 		logger.ActivityLog("attempting_to_close", logrus.LogInfo{"dispatcher": dispatcher})
 		// We don't care if this fails. If it does, we'll just continue on.
@@ -88,6 +151,32 @@ func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logg
 			logger.ErrorLog("producer_close_error", dispatcherCloseErr, logrus.LogInfo{"dispatcher": dispatcher})
 		}
 	}
+	for region, producer := range regionalProducers {
+		logger.ActivityLog("attempting_to_close", logrus.LogInfo{"dispatcher": telemetry.Kafka, "region": region})
+		if dispatcherCloseErr := producer.Close(); dispatcherCloseErr != nil {
+			logger.ErrorLog("producer_close_error", dispatcherCloseErr, logrus.LogInfo{"dispatcher": telemetry.Kafka, "region": region})
+		}
+	}
+	// the producers are closed so no ack is written to the ack channel anymore
+	ackCtx, cancel := context.WithTimeout(context.Background(), ackDrainTimeout)
+	defer cancel()
+	if ackErr := socketServer.CloseAcks(ackCtx); ackErr != nil {
+		logger.ErrorLog("ack_drain_error", ackErr, nil)
+	}
 	logger.ActivityLog("stopped_server", nil)
 	return err
 }
+
+// shutdownOnSignal drains the server when the process is asked to terminate
+func shutdownOnSignal(server *http.Server, socketServer *streaming.Server, logger *logrus.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	received := <-signals
+	logger.ActivityLog("shutdown_signal_received", logrus.LogInfo{"signal": received.String()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := socketServer.Shutdown(ctx, server); err != nil {
+		logger.ErrorLog("shutdown_error", err, nil)
+	}
+}
@@ -2,15 +2,20 @@ package config
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	_ "embed" //Used for default CAs
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/pubsub"
@@ -19,19 +24,45 @@ import (
 	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	githublogrus "github.com/sirupsen/logrus"
 
+	"github.com/teslamotors/fleet-telemetry/datastore/bigquery"
+	"github.com/teslamotors/fleet-telemetry/datastore/eventhubs"
 	"github.com/teslamotors/fleet-telemetry/datastore/googlepubsub"
 	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
 	"github.com/teslamotors/fleet-telemetry/datastore/kinesis"
+	"github.com/teslamotors/fleet-telemetry/datastore/pulsar"
 	"github.com/teslamotors/fleet-telemetry/datastore/simple"
 	"github.com/teslamotors/fleet-telemetry/datastore/zmq"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/protos"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
 const (
 	airbrakeProjectKeyEnv = "AIRBRAKE_PROJECT_KEY"
+
+	// PartialOutageAccept accepts connections during a partial outage and drops the records of affected topics
+	PartialOutageAccept = "accept"
+
+	// PartialOutageReject rejects connections during a partial outage
+	PartialOutageReject = "reject"
+
+	// IdentityChangeNewDevice treats a reconnect with a changed identity as a new device
+	IdentityChangeNewDevice = "new_device"
+
+	// IdentityChangeLink links a reconnect with a changed identity to the previous session
+	IdentityChangeLink = "link"
+
+	sequenceSourceClock = "clock"
+
+	sessionStoreRedis = "redis"
+
+	lastWillFile  = "file"
+	lastWillRedis = "redis"
+	lastWillNoop  = "noop"
 )
 
 // Config object for server
@@ -53,15 +84,52 @@ type Config struct {
 	// is already handling mTLS on behalf of this service.
 	TLSPassThrough *TLSPassThrough `json:"tls_pass_through,omitempty"`
 
+	// IdentityCertPosition selects the certificate of the client chain the device identity is derived from, leaf or
+	// chain-root. When empty, the leaf of pass through chains and the last certificate presented over TLS are used
+	IdentityCertPosition IdentityCertPosition `json:"identity_cert_position,omitempty"`
+
+	// IdentitySAN reads the device identity from a subject alternative name of the client certificate, the subject
+	// common name is used when the certificate has no matching subject alternative name
+	IdentitySAN *IdentitySAN `json:"identity_san,omitempty"`
+
+	// CertificateLogRedaction redacts components of the client certificates from the connection logs
+	CertificateLogRedaction *CertificateLogRedaction `json:"certificate_log_redaction,omitempty"`
+
+	// TLSPassThroughVerification verifies the certificate chains forwarded by the reverse proxy against
+	// the CA pool of the server instead of trusting the proxy
+	TLSPassThroughVerification *TLSPassThroughVerification `json:"tls_pass_through_verification,omitempty"`
+
+	// CertificateRevocation rejects the client certificates listed on a certificate revocation list
+	CertificateRevocation *CertificateRevocation `json:"certificate_revocation,omitempty"`
+
+	// CertificateExpiryWarningDays is the number of days before the expiry of a client certificate from which its
+	// connections log a warning, defaults to 30
+	CertificateExpiryWarningDays int `json:"certificate_expiry_warning_days,omitempty"`
+
+	// AllowAnonymousIdentity keeps the connections of clients whose identity could not be extracted from their certificate
+	// open instead of closing them, for test environments without client certificates
+	AllowAnonymousIdentity bool `json:"allow_anonymous_identity,omitempty"`
+
 	// UseDefaultEngCA overrides default CA to eng
 	UseDefaultEngCA bool `json:"use_default_eng_ca"`
 
 	// RateLimit is a configuration for the ratelimit
 	RateLimit *RateLimit `json:"rate_limit,omitempty"`
 
+	// PerDeviceMessagesPerSecond is the rate of messages accepted from each device across its connections, messages
+	// above it are dropped without closing the connection. Unlimited when 0
+	PerDeviceMessagesPerSecond float64 `json:"per_device_messages_per_second,omitempty"`
+
+	// PerDeviceBurst is the number of messages a device can send at once above its rate, defaults to one second of messages
+	PerDeviceBurst int `json:"per_device_burst,omitempty"`
+
 	// ReliableAckSources is a mapping of record types to a dispatcher that will be used for reliable ack
 	ReliableAckSources map[string]telemetry.Dispatcher `json:"reliable_ack_sources,omitempty"`
 
+	// AckWorkers is the number of goroutines responding to the vehicles with the reliable acks, defaults to 1.
+	// The acks of a connection are not ordered when more than one worker is configured
+	AckWorkers int `json:"ack_workers,omitempty"`
+
 	// Kafka is a configuration for the standard librdkafka configuration properties
 	// seen here: https://raw.githubusercontent.com/confluentinc/librdkafka/master/CONFIGURATION.md
 	// we extract the "topic" key as the default topic for the producer
@@ -70,12 +138,24 @@ type Config struct {
 	// Kinesis is a configuration for AWS Kinesis
 	Kinesis *Kinesis `json:"kinesis,omitempty"`
 
+	// RegionRouting routes records of devices to region local dispatchers
+	RegionRouting *RegionRouting `json:"region_routing,omitempty"`
+
 	// Pubsub is a configuration for the Google Pubsub
 	Pubsub *Pubsub `json:"pubsub,omitempty"`
 
 	// ZMQ configures a zeromq socket
 	ZMQ *zmq.Config `json:"zmq,omitempty"`
 
+	// BigQuery configures the streaming inserts into Google BigQuery
+	BigQuery *bigquery.Config `json:"bigquery,omitempty"`
+
+	// EventHubs configures the batched sends to Azure Event Hubs
+	EventHubs *eventhubs.Config `json:"eventhubs,omitempty"`
+
+	// Pulsar configures the batched publishes to Apache Pulsar
+	Pulsar *pulsar.Config `json:"pulsar,omitempty"`
+
 	// Namespace defines a prefix for the kafka/pubsub topic
 	Namespace string `json:"namespace,omitempty"`
 
@@ -94,6 +174,160 @@ type Config struct {
 	// Records is a mapping of topics (records type) to a reference dispatch implementation (i,e: kafka)
 	Records map[string][]telemetry.Dispatcher `json:"records,omitempty"`
 
+	// DefaultTopic is applied to records received without a topic. When empty, such records are rejected
+	DefaultTopic string `json:"default_topic,omitempty"`
+
+	// DecodeDeadLetterTopic receives the raw messages which failed to decode with the decode error in their metadata,
+	// such messages are only rejected when empty. The dispatchers of the topic are configured in records
+	DecodeDeadLetterTopic string `json:"decode_dead_letter_topic,omitempty"`
+
+	// DecodeDeadLetterPerSecond is the number of messages dispatched to the decode dead-letter topic each second
+	// across the connections, the messages failing to decode above it are only rejected. Unlimited when 0
+	DecodeDeadLetterPerSecond int `json:"decode_dead_letter_per_second,omitempty"`
+
+	// TraceIDHeader is the request header the trace id of a connection is read from, defaults to X-Trace-Id. A trace
+	// id is generated for the connections without one, it is carried in the metadata of the records of the connection
+	TraceIDHeader string `json:"trace_id_header,omitempty"`
+
+	// SignalChangeDetection when set only dispatches V records when their signals changed
+	SignalChangeDetection *SignalChangeDetection `json:"signal_change_detection,omitempty"`
+
+	// ConnectivityTopic is the topic the connectivity events of the connections are dispatched to, defaults to connectivity.
+	// The dispatchers of the topic are configured in records
+	ConnectivityTopic string `json:"connectivity_topic,omitempty"`
+
+	// ConnectivityBatching dispatches the connectivity events in batches rather than one record per event when set
+	ConnectivityBatching *ConnectivityBatching `json:"connectivity_batching,omitempty"`
+
+	// UnknownNetworkInterface is the network interface of the connectivity events of connections not reporting one, defaults to unknown
+	UnknownNetworkInterface string `json:"unknown_network_interface,omitempty"`
+
+	// FieldPresence maps record types to the fields counted as populated or absent in field_presence_total.
+	// Fields of V records are signal names, fields of alerts, errors and connectivity records are proto field names
+	FieldPresence map[string][]string `json:"field_presence,omitempty"`
+
+	// ConnectionWarmup ramps up the rate of accepted connections after startup
+	ConnectionWarmup *ConnectionWarmup `json:"connection_warmup,omitempty"`
+
+	// Compression selects the compression of the payloads of each record type before dispatch
+	Compression *Compression `json:"compression,omitempty"`
+
+	// InboundCompression decompresses the frames sent by the vehicles before they are deserialized
+	InboundCompression *InboundCompression `json:"inbound_compression,omitempty"`
+
+	// Transforms is a mapping of record types to the rules rewriting their decoded records before dispatch,
+	// requires TransmitDecodedRecords
+	Transforms map[string][]telemetry.TransformRule `json:"transforms,omitempty"`
+
+	// MessageTransformFailurePolicy is applied to records whose transformers registered in code fail, skip dispatches
+	// them untransformed and fatal rejects them. Defaults to skip
+	MessageTransformFailurePolicy string `json:"message_transform_failure_policy,omitempty"`
+
+	// CloseReasons is the reason text sent to the vehicles in the websocket close frame for each shutdown cause
+	CloseReasons *CloseReasons `json:"close_reasons,omitempty"`
+
+	// ConnectionsAPI serves the live connection events over gRPC
+	ConnectionsAPI *ConnectionsAPI `json:"connections_api,omitempty"`
+
+	// AllowedOrigins is the list of hosts browsers may open websockets from, any origin is accepted when empty.
+	// Connections without origin, such as the ones of the vehicles, are always accepted
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+
+	// WebsocketReadBufferSize is the size in bytes of the read buffer of the connections, defaults to 1024
+	WebsocketReadBufferSize int `json:"websocket_read_buffer_size,omitempty"`
+
+	// WebsocketWriteBufferSize is the size in bytes of the write buffer of the connections, defaults to 1024
+	WebsocketWriteBufferSize int `json:"websocket_write_buffer_size,omitempty"`
+
+	// WebsocketHandshakeTimeoutSeconds bounds the websocket upgrade of the connections, unbounded when 0
+	WebsocketHandshakeTimeoutSeconds int `json:"websocket_handshake_timeout_sec,omitempty"`
+
+	// WebsocketSubprotocols are the wire versions supported by the server, such as tesla.telemetry.v1, in order of
+	// preference. Connections requesting only other versions are closed, connections requesting none use the legacy format
+	WebsocketSubprotocols []string `json:"websocket_subprotocols,omitempty"`
+
+	// ReadDeadline closes the connections on which nothing is received for too long
+	ReadDeadline *ReadDeadline `json:"read_deadline,omitempty"`
+
+	// IdleConnectionTimeoutSeconds closes the connections on which no message is received for that long, even if
+	// they answer the pings, no connection is closed for being idle when 0
+	IdleConnectionTimeoutSeconds int `json:"idle_connection_timeout_sec,omitempty"`
+
+	// Keepalive pings the connections and closes those not answering with a pong in time
+	Keepalive *Keepalive `json:"keepalive,omitempty"`
+
+	// OutboundQueue bounds the queue of the messages written to each connection by its writer, acks and server pushes
+	OutboundQueue *OutboundQueue `json:"outbound_queue,omitempty"`
+
+	// MaxConnections is the number of concurrent connections above which new connections are rejected with a 503
+	// before the websocket upgrade and the status endpoint reports the server as overloaded, unlimited when 0
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// ConnectionsEndpoint serves the connected devices as JSON on /connections, it is disabled when nil as it
+	// exposes the device ids on the port of the vehicles
+	ConnectionsEndpoint *ConnectionsEndpoint `json:"connections_endpoint,omitempty"`
+
+	// StatusIdentity adds the active pass through mode and the identity extracted from the client certificate of the
+	// request to the /status response, for operators to check that the certificates reach the server through the proxy
+	StatusIdentity bool `json:"status_identity,omitempty"`
+
+	// EnableDebugInject serves /debug/inject where stream messages are dispatched as if a vehicle sent them, to test the
+	// dispatch pipelines without vehicle. It is disabled by default, the requests must carry the token of DebugInject
+	EnableDebugInject bool `json:"enable_debug_inject,omitempty"`
+
+	// DebugInject are the options of the endpoint enabled by EnableDebugInject
+	DebugInject *DebugInject `json:"debug_inject,omitempty"`
+
+	// ReliableAckEndpoint serves the reliable ack state of the record types on /reliable_acks, where operators can
+	// disable and enable the reliable acks of record types at runtime. It is disabled when nil
+	ReliableAckEndpoint *ReliableAckEndpoint `json:"reliable_ack_endpoint,omitempty"`
+
+	// ConnectionChurn counts the connections opened and closed by device type
+	ConnectionChurn bool `json:"connection_churn,omitempty"`
+
+	// SourceIPLimit bounds the concurrent connections of each source ip
+	SourceIPLimit *SourceIPLimit `json:"source_ip_limit,omitempty"`
+
+	// ReconnectTracking detects devices reconnecting, including after a certificate reissue changed their identity
+	ReconnectTracking *ReconnectTracking `json:"reconnect_tracking,omitempty"`
+
+	// LastSeen tracks the last record or disconnect of each device and serves it on /last_seen, it is disabled when nil
+	LastSeen *LastSeen `json:"last_seen,omitempty"`
+
+	// Sequencing stamps records with a monotonic per device sequence number
+	Sequencing *Sequencing `json:"sequencing,omitempty"`
+
+	// SessionStore persists the connection metadata of the devices so reconnect tracking and sequence numbers survive restarts
+	SessionStore *SessionStore `json:"session_store,omitempty"`
+
+	// LastWill keeps the connections open in a durable store so that those left open when the server died are
+	// reported disconnected when it starts again
+	LastWill *LastWill `json:"last_will,omitempty"`
+
+	// Affinity configures the load balancer stickiness hint sent in the websocket upgrade response
+	Affinity *Affinity `json:"affinity,omitempty"`
+
+	// PartialOutage is the policy applied to connections while some of the dispatchers are unhealthy
+	PartialOutage *PartialOutage `json:"partial_outage,omitempty"`
+
+	// RecordCache bounds the cache of decoded records reused between the rate limiter and the dispatch
+	RecordCache *RecordCache `json:"record_cache,omitempty"`
+
+	// DiscardUnknownFields is a list of record types for which proto fields unknown to the server are removed
+	// before dispatch. They are passed through to the dispatchers of protobuf encoded records otherwise
+	DiscardUnknownFields []string `json:"discard_unknown_fields,omitempty"`
+
+	// Gateway trusts the device id of the records sent by gateways aggregating several devices over one connection
+	Gateway *Gateway `json:"gateway,omitempty"`
+
+	// SerializerVariants is a mapping of the organizational units of the client certificates to the serializer
+	// settings of their connections, connections without a matching unit use the default settings
+	SerializerVariants map[string]*SerializerVariant `json:"serializer_variants,omitempty"`
+
+	// SessionEndSentinels is the list of record types on which a sentinel record is dispatched when a device
+	// that sent records of that type disconnects
+	SessionEndSentinels []string `json:"session_end_sentinels,omitempty"`
+
 	// TransmitDecodedRecords if true decodes proto message before dispatching it to supported datastores
 	TransmitDecodedRecords bool `json:"transmit_decoded_records,omitempty"`
 
@@ -105,6 +339,14 @@ type Config struct {
 
 	// Airbrake config
 	Airbrake *Airbrake
+
+	// successRatios tracks the health of the configured dispatchers
+	successRatios map[telemetry.Dispatcher]*metrics.SuccessRatio
+	// dispatcherHealth is the last health snapshot of the dispatchers, refreshed every dispatcherHealthRefresh
+	dispatcherHealth atomic.Pointer[dispatcherHealth]
+
+	// partitionSkewGauge is the gauge of the partition skew trackers of the dispatchers, registered with the first
+	partitionSkewGauge adapter.Gauge
 }
 
 // Airbrake config
@@ -132,6 +374,398 @@ type RateLimit struct {
 	MessageIntervalTimeSecond time.Duration
 }
 
+// SignalChangeDetection config to suppress V records whose signals did not change
+type SignalChangeDetection struct {
+	// Deltas is a mapping of signal names to the minimum change required to dispatch them again, 0 dispatches on any change
+	Deltas map[string]float64 `json:"deltas,omitempty"`
+
+	// MaxDevices bounds the number of devices for which the last dispatched values are kept
+	MaxDevices int `json:"max_devices,omitempty"`
+}
+
+// ConnectionWarmup config to smooth the reconnection surge after a restart
+type ConnectionWarmup struct {
+	// DurationSeconds is the time after startup during which accepted connections are rate limited
+	DurationSeconds int `json:"duration_seconds,omitempty"`
+
+	// InitialRate is the number of connections per second accepted at startup
+	InitialRate float64 `json:"initial_rate,omitempty"`
+
+	// TargetRate is the number of connections per second accepted at the end of the warm-up
+	TargetRate float64 `json:"target_rate,omitempty"`
+}
+
+const (
+	// MessageTransformSkip dispatches the records whose message transformers failed untransformed
+	MessageTransformSkip = "skip"
+	// MessageTransformFatal rejects the records whose message transformers failed
+	MessageTransformFatal = "fatal"
+)
+
+// CloseReasons config for the reasons sent in the websocket close frames, firmware picks its reconnect strategy from them
+type CloseReasons struct {
+	// Draining is sent when the server shuts down, defaults to server_draining
+	Draining string `json:"draining,omitempty"`
+
+	// Maintenance is sent when connections are closed for maintenance, defaults to maintenance
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// Gateway config for the connections of gateways forwarding the records of several devices
+type Gateway struct {
+	// Senders is the allowlist of the device ids of the gateway certificates whose records keep their own device id
+	Senders []string `json:"senders,omitempty"`
+}
+
+// SerializerVariant config overriding the serializer settings of the connections of a device generation
+type SerializerVariant struct {
+	// DefaultTopic replaces default_topic when set
+	DefaultTopic string `json:"default_topic,omitempty"`
+
+	// DiscardUnknownFields replaces discard_unknown_fields when set
+	DiscardUnknownFields []string `json:"discard_unknown_fields,omitempty"`
+}
+
+// ConnectionsAPI config for the gRPC service streaming connection events to fleet monitoring tools
+type ConnectionsAPI struct {
+	// Port of the gRPC server
+	Port int `json:"port,omitempty"`
+
+	// Token is the bearer token clients send in the authorization metadata
+	Token string `json:"token,omitempty"`
+
+	// SubscriberBuffer is the number of events buffered per client before events are dropped, defaults to 1000
+	SubscriberBuffer int `json:"subscriber_buffer,omitempty"`
+
+	// TLS holds the server_cert and server_key of the gRPC server, the certificate of the telemetry server is used when not set
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+// Compression config for the payloads dispatched to the datastores
+type Compression struct {
+	// Records is a mapping of record types to their compression mode: none, gzip or auto
+	Records map[string]telemetry.CompressionMode `json:"records,omitempty"`
+
+	// MaxRatio is the compressed to original size ratio above which payloads are dispatched uncompressed, defaults to 0.9
+	MaxRatio float64 `json:"max_ratio,omitempty"`
+}
+
+// InboundCompression config for the frames sent by the vehicles
+type InboundCompression struct {
+	// Scheme is the compression of the frames: none, gzip, zstd or detect to decompress the frames starting with
+	// the gzip or zstd magic number
+	Scheme telemetry.InboundCompression `json:"scheme,omitempty"`
+
+	// MaxDecompressedBytes is the size above which decompressed frames are dropped, defaults to 4MiB
+	MaxDecompressedBytes int `json:"max_decompressed_bytes,omitempty"`
+}
+
+// ConnectionsEndpoint config for the admin endpoint listing the connected devices
+type ConnectionsEndpoint struct {
+	// Token is the bearer token the requests to the endpoint must carry
+	Token string `json:"token"`
+}
+
+// ReliableAckEndpoint config for the admin endpoint of the reliable acks
+type ReliableAckEndpoint struct {
+	// Token is the bearer token the requests to the endpoint must carry
+	Token string `json:"token"`
+}
+
+// ReadDeadline config for the deadline of the reads of the connections, reset on every message and pong received
+type ReadDeadline struct {
+	// TimeoutSeconds is the time without message or pong after which the connection is closed, defaults to 600
+	TimeoutSeconds int `json:"timeout_sec,omitempty"`
+
+	// Disabled keeps silent connections open
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// DefaultTraceIDHeader is the request header the trace id of the connections is read from when not configured
+const DefaultTraceIDHeader = "X-Trace-Id"
+
+// TraceIDHeaderName returns the request header the trace id of the connections is read from
+func (c *Config) TraceIDHeaderName() string {
+	if c.TraceIDHeader == "" {
+		return DefaultTraceIDHeader
+	}
+	return c.TraceIDHeader
+}
+
+// DefaultReadTimeout is the read deadline of the connections when not configured
+const DefaultReadTimeout = 10 * time.Minute
+
+// ReadTimeout returns the time without message or pong after which connections are closed, 0 when disabled
+func (c *Config) ReadTimeout() time.Duration {
+	if c.ReadDeadline == nil {
+		return DefaultReadTimeout
+	}
+	if c.ReadDeadline.Disabled {
+		return 0
+	}
+	if c.ReadDeadline.TimeoutSeconds <= 0 {
+		return DefaultReadTimeout
+	}
+	return time.Duration(c.ReadDeadline.TimeoutSeconds) * time.Second
+}
+
+// Keepalive config for the pings sent to the connections, detecting those silently dropped by the network
+type Keepalive struct {
+	// PingIntervalSeconds is the time between the pings sent to the connections, no ping is sent when 0
+	PingIntervalSeconds int `json:"ping_interval_sec,omitempty"`
+
+	// PongTimeoutSeconds is the time after a ping within which a pong or message must be received, defaults to the ping interval
+	PongTimeoutSeconds int `json:"pong_timeout_sec,omitempty"`
+}
+
+// PingInterval returns the time between the pings sent to the connections, 0 when disabled
+func (c *Config) PingInterval() time.Duration {
+	if c.Keepalive == nil || c.Keepalive.PingIntervalSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(c.Keepalive.PingIntervalSeconds) * time.Second
+}
+
+// PongTimeout returns the time after a ping after which connections not answering are closed
+func (c *Config) PongTimeout() time.Duration {
+	if c.Keepalive == nil || c.Keepalive.PongTimeoutSeconds <= 0 {
+		return c.PingInterval()
+	}
+	return time.Duration(c.Keepalive.PongTimeoutSeconds) * time.Second
+}
+
+// IdleConnectionTimeout returns the time without message after which connections are closed, 0 when disabled
+func (c *Config) IdleConnectionTimeout() time.Duration {
+	if c.IdleConnectionTimeoutSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(c.IdleConnectionTimeoutSeconds) * time.Second
+}
+
+// ReconnectTracking config for detecting reconnects of a client certificate key
+type ReconnectTracking struct {
+	// WindowSeconds is the time after a connection during which a new connection is a reconnect, defaults to 300
+	WindowSeconds int `json:"window_seconds,omitempty"`
+
+	// MaxSessions bounds the number of sessions tracked, defaults to 100000
+	MaxSessions int `json:"max_sessions,omitempty"`
+
+	// IdentityChangePolicy is either "new_device" (default) or "link"
+	IdentityChangePolicy string `json:"identity_change_policy,omitempty"`
+}
+
+// DebugInject config for the injection of stream messages
+type DebugInject struct {
+	// Token is the bearer token the requests to the endpoint must carry
+	Token string `json:"token"`
+}
+
+// LastSeen config for the tracking of the last activity of the devices
+type LastSeen struct {
+	// Token is the bearer token the requests to the endpoint must carry
+	Token string `json:"token"`
+
+	// MaxDevices bounds the number of devices tracked, the least recently seen are evicted first, defaults to 1000000
+	MaxDevices int `json:"max_devices,omitempty"`
+
+	// TTLSeconds is the time after which devices not seen are forgotten, defaults to 604800
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+// Sequencing config for the per device sequence numbers stamped on records
+type Sequencing struct {
+	// Source of the sequence numbers, only clock is supported
+	Source string `json:"source,omitempty"`
+
+	// MaxDevices bounds the number of devices for which the last sequence number is kept
+	MaxDevices int `json:"max_devices,omitempty"`
+}
+
+// CertificateRevocation config for the certificate revocation list checked when extracting the identity of the clients
+type CertificateRevocation struct {
+	// CRL is the path or http(s) url of the certificate revocation list, DER or PEM encoded
+	CRL string `json:"crl,omitempty"`
+
+	// RefreshIntervalSeconds is the time after which the list is loaded again, defaults to 3600
+	RefreshIntervalSeconds int `json:"refresh_interval_seconds,omitempty"`
+}
+
+// ConnectivityBatching config for the batches of connectivity events, a batch is dispatched once it holds max events
+// or once the flush interval elapsed, whichever comes first
+type ConnectivityBatching struct {
+	// MaxEvents is the number of events at which a batch is dispatched, defaults to 100
+	MaxEvents int `json:"max_events,omitempty"`
+
+	// FlushIntervalMs is the interval in milliseconds at which the pending events are dispatched, defaults to 1000
+	FlushIntervalMs int `json:"flush_interval_ms,omitempty"`
+}
+
+// SourceIPLimit config for the number of concurrent connections accepted from a source ip
+type SourceIPLimit struct {
+	// MaxConnections is the number of concurrent connections of a source ip above which connections are rejected, unlimited when 0
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For header resolves the source ip of the connections
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+// SessionStore config for the external store of the connection metadata of the devices
+type SessionStore struct {
+	// Type of the store, only redis is supported
+	Type string `json:"type,omitempty"`
+
+	// Address is the host:port of the store
+	Address string `json:"address,omitempty"`
+
+	// Password authenticates to the store
+	Password string `json:"password,omitempty"`
+
+	// DB is the redis database of the sessions
+	DB int `json:"db,omitempty"`
+
+	// KeyPrefix is prepended to the device ids to build the keys of the sessions, defaults to fleet-telemetry:session:
+	KeyPrefix string `json:"key_prefix,omitempty"`
+
+	// TTLSeconds is the time sessions are kept after the device was last seen, defaults to 3600
+	TTLSeconds int `json:"ttl_sec,omitempty"`
+
+	// TimeoutMs bounds every request to the store, defaults to 500
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+
+	// TLS connects to the store over TLS when set, ca_file verifies its certificate and server_cert and server_key
+	// authenticate the client
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+// LastWill config for the durable store of the connections open on the server
+type LastWill struct {
+	// Type of the store, file, redis or noop
+	Type string `json:"type,omitempty"`
+
+	// Path is the file of the connections of a file store, it must not be shared with other servers
+	Path string `json:"path,omitempty"`
+
+	// SyncIntervalMs is the interval at which the changes of a file store are synced to disk, defaults to 1000
+	SyncIntervalMs int `json:"sync_interval_ms,omitempty"`
+
+	// Address is the host:port of a redis store
+	Address string `json:"address,omitempty"`
+
+	// Password authenticates to the redis store
+	Password string `json:"password,omitempty"`
+
+	// DB is the redis database of the connections
+	DB int `json:"db,omitempty"`
+
+	// Key is the redis hash of the connections, defaults to fleet-telemetry:connections:<hostname>. It must not be
+	// shared with other servers
+	Key string `json:"key,omitempty"`
+
+	// TimeoutMs bounds every request to the redis store, defaults to 500
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+
+	// TLS connects to the redis store over TLS when set
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+// Affinity config for the advisory token letting stateful load balancers keep a device on the same pod
+type Affinity struct {
+	// HeaderName is the response header carrying the affinity token
+	HeaderName string `json:"header_name,omitempty"`
+
+	// CookieName is the cookie carrying the affinity token
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// Format of the affinity token, defaults to hash
+	Format AffinityTokenFormat `json:"format,omitempty"`
+
+	// Salt is prepended to the device id before hashing it
+	Salt string `json:"salt,omitempty"`
+}
+
+// AffinityTokenFormat is the format of the affinity token derived from the device id
+type AffinityTokenFormat string
+
+const (
+	// AffinityHash is the hex encoded sha256 hash of the salted device id
+	AffinityHash AffinityTokenFormat = "hash"
+	// AffinityDeviceID is the device id itself
+	AffinityDeviceID AffinityTokenFormat = "device_id"
+)
+
+// UnmarshalJSON validates the affinity token format
+func (f *AffinityTokenFormat) UnmarshalJSON(data []byte) error {
+	var temp string
+	if err := json.Unmarshal(data, &temp); err != nil {
+		return err
+	}
+	*f = AffinityTokenFormat(temp)
+	switch *f {
+	case AffinityHash, AffinityDeviceID:
+		return nil
+	default:
+		return errors.New("invalid value for AffinityTokenFormat")
+	}
+}
+
+// Token returns the affinity token of the device
+func (a *Affinity) Token(deviceID string) string {
+	if a.Format == AffinityDeviceID {
+		return deviceID
+	}
+	sum := sha256.Sum256([]byte(a.Salt + deviceID))
+	return hex.EncodeToString(sum[:])
+}
+
+// PartialOutage config to choose between availability and completeness when some dispatchers are unhealthy
+type PartialOutage struct {
+	// Policy is either "accept" or "reject"
+	Policy string `json:"policy,omitempty"`
+
+	// MinSuccessRatio is the dispatcher success ratio under which a dispatcher is unhealthy, defaults to 0.5
+	MinSuccessRatio float64 `json:"min_success_ratio,omitempty"`
+}
+
+// dispatcherHealthRefresh is how long the health of the dispatchers checked on each record is cached
+const dispatcherHealthRefresh = time.Second
+
+// RecordCache config for the per socket decoded record cache
+type RecordCache struct {
+	// MaxEntries is the maximum number of decoded records cached per socket
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// MaxAgeMs is the maximum lifetime of a cached decoded record in milliseconds
+	MaxAgeMs int `json:"max_age_ms,omitempty"`
+}
+
+// RegionRouting config to route records to region local dispatchers for data residency
+type RegionRouting struct {
+	// IssuerRegions is a mapping of certificate issuer common names to the region of their devices
+	IssuerRegions map[string]string `json:"issuer_regions,omitempty"`
+
+	// Kafka is a mapping of regions to the configuration of their local kafka cluster,
+	// records of devices in other regions are dispatched to the default kafka cluster
+	Kafka map[string]*confluent.ConfigMap `json:"kafka,omitempty"`
+}
+
+// RegionForIssuer returns the region of devices with certificates from the issuer, empty if unknown
+func (c *Config) RegionForIssuer(issuer string) string {
+	if c.RegionRouting == nil {
+		return ""
+	}
+	return c.RegionRouting.IssuerRegions[issuer]
+}
+
+// SerializerVariantForUnits returns the first of the organizational units with a serializer variant, empty if none
+func (c *Config) SerializerVariantForUnits(units []string) string {
+	for _, unit := range units {
+		if _, ok := c.SerializerVariants[unit]; ok {
+			return unit
+		}
+	}
+	return ""
+}
+
 // Pubsub config for the Google pubsub
 type Pubsub struct {
 	// GCP Project ID
@@ -145,6 +779,8 @@ type Kinesis struct {
 	MaxRetries   *int              `json:"max_retries,omitempty"`
 	OverrideHost string            `json:"override_host"`
 	Streams      map[string]string `json:"streams,omitempty"`
+	// Envelope wraps the payloads in a JSON envelope carrying the record metadata, as kinesis records have none
+	Envelope bool `json:"envelope,omitempty"`
 }
 
 //go:embed files/eng_ca.crt
@@ -162,20 +798,118 @@ type TLS struct {
 
 type TLSPassThrough string
 
+// OutboundQueue config for the queue of the messages written to each connection
+type OutboundQueue struct {
+	// Size is the number of messages queued per connection, defaults to 1000
+	Size int `json:"size,omitempty"`
+
+	// DropPolicy is applied to the messages queued while the queue is full, defaults to block
+	DropPolicy OutboundDropPolicy `json:"drop_policy,omitempty"`
+}
+
+// OutboundDropPolicy is the handling of the messages queued to a full outbound queue
+type OutboundDropPolicy string
+
 const (
-	RFC9440                    TLSPassThrough = "rfc9440"
-	AWSApplicationLoadBalancer TLSPassThrough = "aws_alb"
+	// OutboundBlock waits for the writer to make room in the queue
+	OutboundBlock OutboundDropPolicy = "block"
+	// OutboundDropNewest drops the message queued
+	OutboundDropNewest OutboundDropPolicy = "drop_newest"
+	// OutboundDropOldest drops the oldest message of the queue to make room for the message queued
+	OutboundDropOldest OutboundDropPolicy = "drop_oldest"
 )
 
-func (t *TLSPassThrough) IsValid() bool {
-	switch *t {
-	case RFC9440, AWSApplicationLoadBalancer:
+// IsValid returns whether the drop policy is supported, empty defaults to block
+func (p OutboundDropPolicy) IsValid() bool {
+	switch p {
+	case "", OutboundBlock, OutboundDropNewest, OutboundDropOldest:
+		return true
+	default:
+		return false
+	}
+}
+
+// IdentityCertPosition is the position in the client chain of the certificate identifying the device
+type IdentityCertPosition string
+
+const (
+	// IdentityCertLeaf derives the identity from the leaf certificate
+	IdentityCertLeaf IdentityCertPosition = "leaf"
+	// IdentityCertChainRoot derives the identity from the last certificate of the chain
+	IdentityCertChainRoot IdentityCertPosition = "chain-root"
+)
+
+// IsValid returns whether the position is supported, empty keeps the default of each extraction path
+func (p IdentityCertPosition) IsValid() bool {
+	switch p {
+	case "", IdentityCertLeaf, IdentityCertChainRoot:
 		return true
 	default:
 		return false
 	}
 }
 
+// IdentitySAN config to read the device identity from a subject alternative name of the client certificate
+type IdentitySAN struct {
+	// Type is the type of subject alternative name, dns, uri or email
+	Type string `json:"type,omitempty"`
+
+	// Prefix selects the subject alternative names starting with it and is stripped from the device id
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// CertificateLogComponent is a component of the client certificate logged on connection
+type CertificateLogComponent string
+
+const (
+	// CertificateLogSubject is the common name of the subject of the client certificate
+	CertificateLogSubject CertificateLogComponent = "subject"
+	// CertificateLogIssuer is the common name of the issuer of the client certificate
+	CertificateLogIssuer CertificateLogComponent = "issuer"
+	// CertificateLogValidity is the validity period of the client certificate
+	CertificateLogValidity CertificateLogComponent = "validity"
+	// CertificateLogChain are the subject common names of the verified chains
+	CertificateLogChain CertificateLogComponent = "chain"
+)
+
+// IsValid returns whether the component is logged
+func (c CertificateLogComponent) IsValid() bool {
+	switch c {
+	case CertificateLogSubject, CertificateLogIssuer, CertificateLogValidity, CertificateLogChain:
+		return true
+	default:
+		return false
+	}
+}
+
+// CertificateLogRedaction config for the client certificate components redacted from the connection logs
+type CertificateLogRedaction struct {
+	// Components are the client certificate components logged as [redacted]
+	Components []CertificateLogComponent `json:"components,omitempty"`
+
+	// Debug logs every component, overriding the redaction
+	Debug bool `json:"debug,omitempty"`
+}
+
+// TLSPassThroughVerification config for the verification of pass through certificate chains
+type TLSPassThroughVerification struct {
+	// Strict rejects connections failing verification, failures are only reported otherwise
+	Strict bool `json:"strict,omitempty"`
+}
+
+const (
+	RFC9440                    TLSPassThrough = "rfc9440"
+	AWSApplicationLoadBalancer TLSPassThrough = "aws_alb"
+	GCPApplicationLoadBalancer TLSPassThrough = "gcp_alb"
+)
+
+// TLSPassThroughModes are the supported values of tls_pass_through, the server has a certificate extractor for each
+var TLSPassThroughModes = []TLSPassThrough{RFC9440, AWSApplicationLoadBalancer, GCPApplicationLoadBalancer}
+
+func (t *TLSPassThrough) IsValid() bool {
+	return slices.Contains(TLSPassThroughModes, *t)
+}
+
 func (t *TLSPassThrough) UnmarshalJSON(data []byte) error {
 	var temp string
 	if err := json.Unmarshal(data, &temp); err != nil {
@@ -190,12 +924,34 @@ func (t *TLSPassThrough) UnmarshalJSON(data []byte) error {
 
 // AirbrakeTLSConfig return the TLS config needed for connecting with airbrake server
 func (c *Config) AirbrakeTLSConfig() (*tls.Config, error) {
-	if c.Airbrake.TLS == nil {
+	return clientTLSConfig(c.Airbrake.TLS)
+}
+
+// ConnectionsAPITLSConfig returns the TLS config of the connections API server, it serves the certificate of the
+// telemetry server unless connections_api has its own
+func (c *Config) ConnectionsAPITLSConfig() (*tls.Config, error) {
+	certificates := c.ConnectionsAPI.TLS
+	if certificates == nil {
+		certificates = c.TLS
+	}
+	if certificates == nil || certificates.ServerCert == "" || certificates.ServerKey == "" {
+		return nil, errors.New("connections_api requires a server_cert and server_key in its tls config or the one of the server")
+	}
+	cert, err := tls.LoadX509KeyPair(certificates.ServerCert, certificates.ServerKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't properly load cert pair (%s, %s): %s", certificates.ServerCert, certificates.ServerKey, err.Error())
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// clientTLSConfig returns the TLS config of a client connection, nil when not configured
+func clientTLSConfig(config *TLS) (*tls.Config, error) {
+	if config == nil {
 		return nil, nil
 	}
-	caPath := c.Airbrake.TLS.CAFile
-	certPath := c.Airbrake.TLS.ServerCert
-	keyPath := c.Airbrake.TLS.ServerKey
+	caPath := config.CAFile
+	certPath := config.ServerCert
+	keyPath := config.ServerKey
 	tlsConfig := &tls.Config{}
 	if certPath != "" && keyPath != "" {
 		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
@@ -227,38 +983,76 @@ func (c *Config) ExtractServiceTLSConfig(logger *logrus.Logger) (*tls.Config, er
 		return nil, errors.New("tls config is empty - telemetry server is mTLS only, make sure to provide certificates in the config")
 	}
 
-	var caFileBytes []byte
-	var caEnv string
-	if c.UseDefaultEngCA {
-		caEnv = "eng"
-		caFileBytes = make([]byte, len(defaultEngCA))
-		copy(caFileBytes, defaultEngCA)
-	} else {
-		caEnv = "prod"
-		caFileBytes = make([]byte, len(defaultProdCA))
-		copy(caFileBytes, defaultProdCA)
+	caCertPool, err := c.ClientCAPool(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		ClientCAs:  caCertPool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// ClientCAPool returns the pool of CAs trusted to issue client certificates, the default CA of
+// the environment and the custom CA file if configured
+func (c *Config) ClientCAPool(logger *logrus.Logger) (*x509.CertPool, error) {
+	cas, err := c.ClientCAs(logger)
+	if err != nil {
+		return nil, err
 	}
 	caCertPool := x509.NewCertPool()
-	ok := caCertPool.AppendCertsFromPEM(caFileBytes)
-	if !ok {
+	for _, ca := range cas {
+		caCertPool.AddCert(ca)
+	}
+	return caCertPool, nil
+}
+
+// ClientCAs returns the certificates of the CAs trusted to issue client certificates, the default CA of
+// the environment and the custom CA file if configured
+func (c *Config) ClientCAs(logger *logrus.Logger) ([]*x509.Certificate, error) {
+	caEnv, caFileBytes := "prod", defaultProdCA
+	if c.UseDefaultEngCA {
+		caEnv, caFileBytes = "eng", defaultEngCA
+	}
+	cas := parseCertificates(caFileBytes)
+	if len(cas) == 0 {
 		return nil, fmt.Errorf("tls ca not properly loaded for %s environment", caEnv)
 	}
-	if c.TLS.CAFile != "" {
+	if c.TLS != nil && c.TLS.CAFile != "" {
 		customCaFileBytes, err := os.ReadFile(c.TLS.CAFile)
 		if err != nil {
 			return nil, err
 		}
-		ok := caCertPool.AppendCertsFromPEM(customCaFileBytes)
-		if !ok {
+		customCas := parseCertificates(customCaFileBytes)
+		if len(customCas) == 0 {
 			return nil, fmt.Errorf("custom ca not properly loaded: %s", c.TLS.CAFile)
 		}
+		cas = append(cas, customCas...)
 		logger.ActivityLog("custom_ca_file_appened", logrus.LogInfo{"ca_file_path": c.TLS.CAFile})
 	}
+	return cas, nil
+}
 
-	return &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
-	}, nil
+// parseCertificates returns the certificates of the PEM blocks, skipping the invalid ones as x509.CertPool does
+func parseCertificates(pemCerts []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs
 }
 
 func (c *Config) configureLogger(logger *logrus.Logger) {
@@ -275,6 +1069,186 @@ func (c *Config) configureMetricsCollector(logger *logrus.Logger) {
 	c.MetricCollector = metrics.NewCollector(c.Monitoring, logger)
 }
 
+func (c *Config) successRatioWindow() time.Duration {
+	if c.Monitoring == nil || c.Monitoring.SuccessRatioWindowSeconds <= 0 {
+		return metrics.DefaultSuccessRatioWindow
+	}
+	return time.Duration(c.Monitoring.SuccessRatioWindowSeconds) * time.Second
+}
+
+// NewSuccessRatio returns the success ratio of the dispatcher, whose health is checked by UnhealthyDispatchers.
+// Producers not configured by ConfigureProducers track their health with it and must be created before serving
+func (c *Config) NewSuccessRatio(dispatcher telemetry.Dispatcher) *metrics.SuccessRatio {
+	successRatio := metrics.NewSuccessRatio(c.MetricCollector, c.dispatcherInstance(string(dispatcher)), c.successRatioWindow())
+	if c.successRatios == nil {
+		c.successRatios = make(map[telemetry.Dispatcher]*metrics.SuccessRatio)
+	}
+	c.successRatios[dispatcher] = successRatio
+	return successRatio
+}
+
+// minSuccessRatio returns the success ratio under which a dispatcher is unhealthy
+func (c *Config) minSuccessRatio() float64 {
+	if c.PartialOutage == nil || c.PartialOutage.MinSuccessRatio <= 0 {
+		return metrics.DefaultMinSuccessRatio
+	}
+	return c.PartialOutage.MinSuccessRatio
+}
+
+// UnhealthyDispatchers returns the dispatchers whose success ratio is under min_success_ratio, including the region
+// local kafka clusters, and whether only some of the dispatchers are unhealthy
+func (c *Config) UnhealthyDispatchers() (map[telemetry.Dispatcher]bool, bool) {
+	minSuccessRatio := c.minSuccessRatio()
+	var unhealthy map[telemetry.Dispatcher]bool
+	for dispatcher, successRatio := range c.successRatios {
+		if !successRatio.Healthy(minSuccessRatio) {
+			if unhealthy == nil {
+				unhealthy = make(map[telemetry.Dispatcher]bool)
+			}
+			unhealthy[dispatcher] = true
+		}
+	}
+	return unhealthy, len(unhealthy) > 0 && len(unhealthy) < len(c.successRatios)
+}
+
+// DispatcherReadiness returns the unhealthy dispatchers sorted by name and whether connections are accepted with
+// them, which is when none is unhealthy or only some are under the accept partial outage policy
+func (c *Config) DispatcherReadiness() ([]string, bool) {
+	unhealthy, partial := c.UnhealthyDispatchers()
+	names := make([]string, 0, len(unhealthy))
+	for dispatcher := range unhealthy {
+		names = append(names, string(dispatcher))
+	}
+	slices.Sort(names)
+	accepted := len(unhealthy) == 0 || (partial && c.PartialOutage != nil && c.PartialOutage.Policy == PartialOutageAccept)
+	return names, accepted
+}
+
+// dispatcherHealth is a snapshot of the dispatchers under the partial outage threshold
+type dispatcherHealth struct {
+	unhealthy map[telemetry.Dispatcher]bool
+	partial   bool
+	takenAt   time.Time
+}
+
+// CachedUnhealthyDispatchers returns the result of UnhealthyDispatchers cached for dispatcherHealthRefresh,
+// for the callers checking the health of the dispatchers on each record
+func (c *Config) CachedUnhealthyDispatchers() (map[telemetry.Dispatcher]bool, bool) {
+	if c.PartialOutage == nil {
+		return nil, false
+	}
+	now := time.Now()
+	if health := c.dispatcherHealth.Load(); health != nil && now.Sub(health.takenAt) < dispatcherHealthRefresh {
+		return health.unhealthy, health.partial
+	}
+	unhealthy, partial := c.UnhealthyDispatchers()
+	c.dispatcherHealth.Store(&dispatcherHealth{unhealthy: unhealthy, partial: partial, takenAt: now})
+	return unhealthy, partial
+}
+
+// RegionalDispatcher returns the name the dispatcher is tracked under for the devices of the region,
+// kafka is replaced by the region local cluster when one is configured
+func (c *Config) RegionalDispatcher(dispatcher telemetry.Dispatcher, region string) telemetry.Dispatcher {
+	if dispatcher != telemetry.Kafka || region == "" || c.RegionRouting == nil {
+		return dispatcher
+	}
+	if _, ok := c.RegionRouting.Kafka[region]; !ok {
+		return dispatcher
+	}
+	return telemetry.Dispatcher(fmt.Sprintf("%s_%s", telemetry.Kafka, region))
+}
+
+// newLatencySLO returns the produce latency SLO of the dispatcher reported under name, nil when no target is configured
+func (c *Config) newLatencySLO(dispatcher telemetry.Dispatcher, name string) *metrics.LatencySLO {
+	if c.Monitoring == nil {
+		return nil
+	}
+	target := time.Duration(c.Monitoring.LatencySLOTargetsMs[string(dispatcher)]) * time.Millisecond
+	return metrics.NewLatencySLO(c.MetricCollector, c.dispatcherInstance(name), target, c.successRatioWindow())
+}
+
+// newPayloadSize returns the payload size observer of the dispatcher reported under name
+func (c *Config) newPayloadSize(name telemetry.Dispatcher) *metrics.PayloadSize {
+	return metrics.NewPayloadSize(c.MetricCollector, c.dispatcherInstance(string(name)))
+}
+
+func (c *Config) newPartitionSkew(dispatcher telemetry.Dispatcher, logger *logrus.Logger) *metrics.PartitionSkew {
+	if c.Monitoring == nil {
+		return nil
+	}
+	if c.Monitoring.PartitionSkewThreshold <= 0 {
+		return nil
+	}
+	if c.partitionSkewGauge == nil {
+		c.partitionSkewGauge = metrics.RegisterPartitionSkewGauge(c.MetricCollector)
+	}
+	window := time.Duration(c.Monitoring.PartitionSkewWindowSeconds) * time.Second
+	return metrics.NewPartitionSkew(c.partitionSkewGauge, c.dispatcherInstance(string(dispatcher)), c.Monitoring.PartitionSkewThreshold, window, logger)
+}
+
+// kafkaOptions returns the options of the kafka producer of the dispatcher, kafka or a regional kafka cluster
+func (c *Config) kafkaOptions(dispatcher telemetry.Dispatcher, airbrakeHandler *airbrake.Handler, reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) kafka.Options {
+	return kafka.Options{
+		Namespace:          c.Namespace,
+		Instance:           c.dispatcherInstance(string(dispatcher)),
+		PrometheusEnabled:  c.prometheusEnabled(),
+		MetricsCollector:   c.MetricCollector,
+		SuccessRatio:       c.NewSuccessRatio(dispatcher),
+		LatencySLO:         c.newLatencySLO(telemetry.Kafka, string(dispatcher)),
+		PayloadSize:        c.newPayloadSize(dispatcher),
+		PartitionSkew:      c.newPartitionSkew(dispatcher, logger),
+		AirbrakeHandler:    airbrakeHandler,
+		AckChan:            c.AckChan,
+		ReliableAckTxTypes: reliableAckTxTypes,
+		Logger:             logger,
+	}
+}
+
+// dispatcherInstance returns the instance name labelling the metrics of the dispatcher
+func (c *Config) dispatcherInstance(dispatcher string) string {
+	if c.Monitoring != nil {
+		if instance, ok := c.Monitoring.DispatcherInstances[dispatcher]; ok {
+			return instance
+		}
+	}
+	return dispatcher
+}
+
+// validateDispatcherInstances checks the instance names refer to configured dispatchers and are unique
+func (c *Config) validateDispatcherInstances() error {
+	if c.Monitoring == nil || len(c.Monitoring.DispatcherInstances) == 0 {
+		return nil
+	}
+	dispatchers := make(map[string]bool)
+	for _, recordDispatchers := range c.Records {
+		for _, dispatcher := range recordDispatchers {
+			dispatchers[string(dispatcher)] = true
+		}
+	}
+	if c.RegionRouting != nil {
+		for region := range c.RegionRouting.Kafka {
+			dispatchers[fmt.Sprintf("%s_%s", telemetry.Kafka, region)] = true
+		}
+	}
+	for dispatcher, instance := range c.Monitoring.DispatcherInstances {
+		if !dispatchers[dispatcher] {
+			return fmt.Errorf("dispatcher_instances %s is not a configured dispatcher", dispatcher)
+		}
+		if instance == "" {
+			return fmt.Errorf("dispatcher_instances %s has an empty instance name", dispatcher)
+		}
+	}
+	instances := make(map[string]string)
+	for dispatcher := range dispatchers {
+		instance := c.dispatcherInstance(dispatcher)
+		if other, ok := instances[instance]; ok {
+			return fmt.Errorf("dispatcher_instances %s is used by both %s and %s", instance, other, dispatcher)
+		}
+		instances[instance] = dispatcher
+	}
+	return nil
+}
+
 func (c *Config) prometheusEnabled() bool {
 	if c.Monitoring != nil && c.Monitoring.PrometheusMetricsPort > 0 {
 		return true
@@ -282,12 +1256,52 @@ func (c *Config) prometheusEnabled() bool {
 	return false
 }
 
+// ConfigureAckChan creates the acknowledgment channel when reliable acks are configured without one
+func (c *Config) ConfigureAckChan(logger *logrus.Logger) {
+	if c.AckChan != nil || len(c.ReliableAckSources) == 0 {
+		return
+	}
+	c.AckChan = make(chan *telemetry.Record)
+	logger.ActivityLog("reliable_ack_channel_created", nil)
+}
+
 // ConfigureProducers validates and establishes connections to the producers (kafka/pubsub/logger)
 func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *logrus.Logger) (map[telemetry.Dispatcher]telemetry.Producer, map[string][]telemetry.Producer, error) {
 	reliableAckSources, err := c.configureReliableAckSources()
 	if err != nil {
 		return nil, nil, err
 	}
+	c.ConfigureAckChan(logger)
+
+	if _, ok := c.Records[c.DefaultTopic]; c.DefaultTopic != "" && !ok {
+		return nil, nil, fmt.Errorf("default_topic %s has no record mapping", c.DefaultTopic)
+	}
+	if _, ok := c.Records[c.DecodeDeadLetterTopic]; c.DecodeDeadLetterTopic != "" && !ok {
+		return nil, nil, fmt.Errorf("decode_dead_letter_topic %s has no record mapping", c.DecodeDeadLetterTopic)
+	}
+	if err := c.validateDispatcherInstances(); err != nil {
+		return nil, nil, err
+	}
+	for unit, variant := range c.SerializerVariants {
+		if variant == nil {
+			return nil, nil, fmt.Errorf("serializer variant %s is empty", unit)
+		}
+		if _, ok := c.Records[variant.DefaultTopic]; variant.DefaultTopic != "" && !ok {
+			return nil, nil, fmt.Errorf("default_topic %s of serializer variant %s has no record mapping", variant.DefaultTopic, unit)
+		}
+	}
+
+	if c.ReconnectTracking != nil {
+		switch c.ReconnectTracking.IdentityChangePolicy {
+		case "", IdentityChangeNewDevice, IdentityChangeLink:
+		default:
+			return nil, nil, fmt.Errorf("reconnect_tracking identity_change_policy %s should be either %s or %s", c.ReconnectTracking.IdentityChangePolicy, IdentityChangeNewDevice, IdentityChangeLink)
+		}
+	}
+
+	if c.PartialOutage != nil && c.PartialOutage.Policy != PartialOutageAccept && c.PartialOutage.Policy != PartialOutageReject {
+		return nil, nil, fmt.Errorf("partial_outage policy %s should be either %s or %s", c.PartialOutage.Policy, PartialOutageAccept, PartialOutageReject)
+	}
 
 	producers := make(map[telemetry.Dispatcher]telemetry.Producer)
 	producers[telemetry.Logger] = simple.NewProtoLogger(c.LoggerConfig, logger)
@@ -304,7 +1318,7 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 			return nil, nil, errors.New("expected Kafka to be configured")
 		}
 		convertKafkaConfig(c.Kafka)
-		kafkaProducer, err := kafka.NewProducer(c.Kafka, c.Namespace, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kafka], logger)
+		kafkaProducer, err := kafka.NewProducer(c.Kafka, c.kafkaOptions(telemetry.Kafka, airbrakeHandler, reliableAckSources[telemetry.Kafka], logger))
 		if err != nil {
 			return nil, nil, err
 		}
@@ -315,7 +1329,7 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 		if c.Pubsub == nil {
 			return nil, nil, errors.New("expected Pubsub to be configured")
 		}
-		googleProducer, err := googlepubsub.NewProducer(c.prometheusEnabled(), c.Pubsub.ProjectID, c.Namespace, c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Pubsub], logger)
+		googleProducer, err := googlepubsub.NewProducer(c.prometheusEnabled(), c.Pubsub.ProjectID, c.Namespace, c.dispatcherInstance(string(telemetry.Pubsub)), c.MetricCollector, c.NewSuccessRatio(telemetry.Pubsub), c.newLatencySLO(telemetry.Pubsub, string(telemetry.Pubsub)), c.newPayloadSize(telemetry.Pubsub), airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Pubsub], logger)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -331,7 +1345,7 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 			maxRetries = *c.Kinesis.MaxRetries
 		}
 		streamMapping := c.CreateKinesisStreamMapping(recordNames)
-		kinesis, err := kinesis.NewProducer(maxRetries, streamMapping, c.Kinesis.OverrideHost, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kinesis], logger)
+		kinesis, err := kinesis.NewProducer(maxRetries, streamMapping, c.Kinesis.OverrideHost, c.Kinesis.Envelope, c.dispatcherInstance(string(telemetry.Kinesis)), c.prometheusEnabled(), c.MetricCollector, c.NewSuccessRatio(telemetry.Kinesis), c.newLatencySLO(telemetry.Kinesis, string(telemetry.Kinesis)), c.newPayloadSize(telemetry.Kinesis), c.newPartitionSkew(telemetry.Kinesis, logger), airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kinesis], logger)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -342,13 +1356,46 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 		if c.ZMQ == nil {
 			return nil, nil, errors.New("expected ZMQ to be configured")
 		}
-		zmqProducer, err := zmq.NewProducer(context.Background(), c.ZMQ, c.MetricCollector, c.Namespace, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.ZMQ], logger)
+		zmqProducer, err := zmq.NewProducer(context.Background(), c.ZMQ, c.MetricCollector, c.NewSuccessRatio(telemetry.ZMQ), c.newLatencySLO(telemetry.ZMQ, string(telemetry.ZMQ)), c.newPayloadSize(telemetry.ZMQ), c.Namespace, c.dispatcherInstance(string(telemetry.ZMQ)), airbrakeHandler, c.AckChan, reliableAckSources[telemetry.ZMQ], logger)
 		if err != nil {
 			return nil, nil, err
 		}
 		producers[telemetry.ZMQ] = zmqProducer
 	}
 
+	if _, ok := requiredDispatchers[telemetry.BigQuery]; ok {
+		if c.BigQuery == nil {
+			return nil, nil, errors.New("expected BigQuery to be configured")
+		}
+		bigqueryProducer, err := bigquery.NewProducer(c.BigQuery, c.Namespace, c.dispatcherInstance(string(telemetry.BigQuery)), c.MetricCollector, c.NewSuccessRatio(telemetry.BigQuery), c.newLatencySLO(telemetry.BigQuery, string(telemetry.BigQuery)), c.newPayloadSize(telemetry.BigQuery), airbrakeHandler, c.AckChan, reliableAckSources[telemetry.BigQuery], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.BigQuery] = bigqueryProducer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.EventHubs]; ok {
+		if c.EventHubs == nil {
+			return nil, nil, errors.New("expected EventHubs to be configured")
+		}
+		eventHubsProducer, err := eventhubs.NewProducer(c.EventHubs, c.Namespace, c.dispatcherInstance(string(telemetry.EventHubs)), c.MetricCollector, c.NewSuccessRatio(telemetry.EventHubs), c.newLatencySLO(telemetry.EventHubs, string(telemetry.EventHubs)), c.newPayloadSize(telemetry.EventHubs), airbrakeHandler, c.AckChan, reliableAckSources[telemetry.EventHubs], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.EventHubs] = eventHubsProducer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.Pulsar]; ok {
+		if c.Pulsar == nil {
+			return nil, nil, errors.New("expected Pulsar to be configured")
+		}
+		pulsarProducer, err := pulsar.NewProducer(c.Pulsar, c.Namespace, c.dispatcherInstance(string(telemetry.Pulsar)), c.MetricCollector, c.NewSuccessRatio(telemetry.Pulsar), c.newLatencySLO(telemetry.Pulsar, string(telemetry.Pulsar)), c.newPayloadSize(telemetry.Pulsar), airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Pulsar], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.Pulsar] = pulsarProducer
+	}
+
 	dispatchProducerRules := make(map[string][]telemetry.Producer)
 	for recordName, dispatchRules := range c.Records {
 		var dispatchFuncs []telemetry.Producer
@@ -365,6 +1412,43 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 	return producers, dispatchProducerRules, nil
 }
 
+// ConfigureRegionalProducers establishes connections to the region local kafka clusters and returns
+// them with the dispatch rules of each region, in which kafka is replaced by the region local cluster
+func (c *Config) ConfigureRegionalProducers(airbrakeHandler *airbrake.Handler, producers map[telemetry.Dispatcher]telemetry.Producer, logger *logrus.Logger) (map[string]telemetry.Producer, map[string]map[string][]telemetry.Producer, error) {
+	if c.RegionRouting == nil {
+		return nil, nil, nil
+	}
+	reliableAckSources, err := c.configureReliableAckSources()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	regionalProducers := make(map[string]telemetry.Producer)
+	regionalRules := make(map[string]map[string][]telemetry.Producer)
+	for region, kafkaConfig := range c.RegionRouting.Kafka {
+		convertKafkaConfig(kafkaConfig)
+		regional := c.RegionalDispatcher(telemetry.Kafka, region)
+		kafkaProducer, err := kafka.NewProducer(kafkaConfig, c.kafkaOptions(regional, airbrakeHandler, reliableAckSources[telemetry.Kafka], logger))
+		if err != nil {
+			return nil, nil, err
+		}
+		regionalProducers[region] = kafkaProducer
+
+		rules := make(map[string][]telemetry.Producer)
+		for recordName, dispatchRules := range c.Records {
+			for _, dispatchRule := range dispatchRules {
+				if dispatchRule == telemetry.Kafka {
+					rules[recordName] = append(rules[recordName], kafkaProducer)
+				} else {
+					rules[recordName] = append(rules[recordName], producers[dispatchRule])
+				}
+			}
+		}
+		regionalRules[region] = rules
+	}
+	return regionalProducers, regionalRules, nil
+}
+
 func (c *Config) configureReliableAckSources() (map[telemetry.Dispatcher]map[string]interface{}, error) {
 	reliableAckSources := make(map[telemetry.Dispatcher]map[string]interface{}, 0)
 	for txType, dispatchRule := range c.ReliableAckSources {
@@ -394,6 +1478,153 @@ func (c *Config) configureReliableAckSources() (map[telemetry.Dispatcher]map[str
 	return reliableAckSources, nil
 }
 
+// NewChangeDetector returns a change detector if signal change detection is configured
+func (c *Config) NewChangeDetector() (*telemetry.ChangeDetector, error) {
+	if c.SignalChangeDetection == nil {
+		return nil, nil
+	}
+	deltas := make(map[protos.Field]float64)
+	for signal, delta := range c.SignalChangeDetection.Deltas {
+		field, ok := protos.Field_value[signal]
+		if !ok {
+			return nil, fmt.Errorf("unknown signal for change detection: %s", signal)
+		}
+		if delta < 0 {
+			return nil, fmt.Errorf("negative change detection delta for signal: %s", signal)
+		}
+		deltas[protos.Field(field)] = delta
+	}
+	return telemetry.NewChangeDetector(deltas, c.SignalChangeDetection.MaxDevices), nil
+}
+
+// NewFieldPresence returns the observer of the presence of the record fields if field presence is configured
+func (c *Config) NewFieldPresence() (*telemetry.FieldPresence, error) {
+	if len(c.FieldPresence) == 0 {
+		return nil, nil
+	}
+	return telemetry.NewFieldPresence(c.FieldPresence)
+}
+
+// metadataDispatchers are the dispatchers sending the metadata of the records along with their payload
+var metadataDispatchers = []telemetry.Dispatcher{telemetry.Kafka, telemetry.Pubsub, telemetry.EventHubs, telemetry.Pulsar, telemetry.Logger}
+
+// carriesMetadata returns true if the dispatcher sends the metadata of the records along with their payload
+func (c *Config) carriesMetadata(dispatcher telemetry.Dispatcher) bool {
+	if dispatcher == telemetry.Kinesis {
+		return c.Kinesis != nil && c.Kinesis.Envelope
+	}
+	return slices.Contains(metadataDispatchers, dispatcher)
+}
+
+// NewCompressor returns the compressor of the record payloads if compression is configured
+func (c *Config) NewCompressor() (*telemetry.Compressor, error) {
+	if c.Compression == nil {
+		return nil, nil
+	}
+	for recordType, mode := range c.Compression.Records {
+		switch mode {
+		case telemetry.CompressionNone:
+		case telemetry.CompressionGzip, telemetry.CompressionAuto:
+			// consumers only know a payload is compressed from the content_encoding metadata
+			for _, dispatcher := range c.Records[recordType] {
+				if !c.carriesMetadata(dispatcher) {
+					return nil, fmt.Errorf("compression of record %s requires dispatchers carrying metadata, %s does not", recordType, dispatcher)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown compression mode for record %s: %s", recordType, mode)
+		}
+	}
+	return telemetry.NewCompressor(c.Compression.Records, c.Compression.MaxRatio), nil
+}
+
+// NewDecompressor returns the decompressor of the frames sent by the vehicles if they are compressed
+func (c *Config) NewDecompressor() (*telemetry.Decompressor, error) {
+	if c.InboundCompression == nil {
+		return nil, nil
+	}
+	if !c.InboundCompression.Scheme.IsValid() {
+		return nil, fmt.Errorf("invalid inbound_compression scheme %s", c.InboundCompression.Scheme)
+	}
+	return telemetry.NewDecompressor(c.InboundCompression.Scheme, c.InboundCompression.MaxDecompressedBytes), nil
+}
+
+// NewTransformer returns the transformer of the decoded records if transforms are configured
+func (c *Config) NewTransformer() (*telemetry.Transformer, error) {
+	if len(c.Transforms) == 0 {
+		return nil, nil
+	}
+	if !c.TransmitDecodedRecords {
+		return nil, errors.New("transforms require transmit_decoded_records")
+	}
+	return telemetry.NewTransformer(c.Transforms)
+}
+
+// NewSequenceSource returns the source of the per device sequence numbers if sequencing is configured
+func (c *Config) NewSequenceSource() (telemetry.SequenceSource, error) {
+	if c.Sequencing == nil {
+		return nil, nil
+	}
+	switch c.Sequencing.Source {
+	case "", sequenceSourceClock:
+		return telemetry.NewClockSequence(c.Sequencing.MaxDevices), nil
+	default:
+		return nil, fmt.Errorf("unknown sequence source: %s", c.Sequencing.Source)
+	}
+}
+
+// NewSessionStore returns the external store of the connection metadata if configured
+func (c *Config) NewSessionStore() (sessionstore.Store, error) {
+	if c.SessionStore == nil {
+		return nil, nil
+	}
+	tlsConfig, err := clientTLSConfig(c.SessionStore.TLS)
+	if err != nil {
+		return nil, err
+	}
+	switch c.SessionStore.Type {
+	case "", sessionStoreRedis:
+		return sessionstore.NewRedisStore(sessionstore.RedisOptions{
+			Address:   c.SessionStore.Address,
+			Password:  c.SessionStore.Password,
+			DB:        c.SessionStore.DB,
+			KeyPrefix: c.SessionStore.KeyPrefix,
+			TTL:       time.Duration(c.SessionStore.TTLSeconds) * time.Second,
+			Timeout:   time.Duration(c.SessionStore.TimeoutMs) * time.Millisecond,
+			TLS:       tlsConfig,
+		})
+	default:
+		return nil, fmt.Errorf("unknown session store type: %s", c.SessionStore.Type)
+	}
+}
+
+// NewConnectionStore returns the durable store of the connections open on the server if configured
+func (c *Config) NewConnectionStore() (sessionstore.ConnectionStore, error) {
+	if c.LastWill == nil {
+		return nil, nil
+	}
+	switch c.LastWill.Type {
+	case lastWillFile:
+		return sessionstore.NewFileConnectionStore(c.LastWill.Path, time.Duration(c.LastWill.SyncIntervalMs)*time.Millisecond)
+	case lastWillRedis:
+		tlsConfig, err := clientTLSConfig(c.LastWill.TLS)
+		if err != nil {
+			return nil, err
+		}
+		return sessionstore.NewRedisConnectionStore(c.LastWill.Key, sessionstore.RedisOptions{
+			Address:  c.LastWill.Address,
+			Password: c.LastWill.Password,
+			DB:       c.LastWill.DB,
+			Timeout:  time.Duration(c.LastWill.TimeoutMs) * time.Millisecond,
+			TLS:      tlsConfig,
+		})
+	case lastWillNoop:
+		return sessionstore.NopConnectionStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown last_will type: %s", c.LastWill.Type)
+	}
+}
+
 // parseValidDispatchers removes no-op dispatcher from the input i.e. Logger
 func parseValidDispatchers(input []telemetry.Dispatcher) []telemetry.Dispatcher {
 	var result []telemetry.Dispatcher
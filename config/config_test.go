@@ -3,6 +3,7 @@ package config
 import (
 	"io"
 	"os"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -62,6 +63,26 @@ var _ = Describe("Test full application config", func() {
 		}
 	})
 
+	Context("ConnectionsAPITLSConfig", func() {
+		It("uses the certificate of the server by default", func() {
+			config.ConnectionsAPI = &ConnectionsAPI{}
+			_, err := config.ConnectionsAPITLSConfig()
+			Expect(err).To(MatchError(ContainSubstring("(your_own_cert.crt, your_own_key.key)")))
+		})
+
+		It("uses its own certificate when configured", func() {
+			config.ConnectionsAPI = &ConnectionsAPI{TLS: &TLS{ServerCert: "grpc.crt", ServerKey: "grpc.key"}}
+			_, err := config.ConnectionsAPITLSConfig()
+			Expect(err).To(MatchError(ContainSubstring("(grpc.crt, grpc.key)")))
+		})
+
+		It("fails without a certificate", func() {
+			config = &Config{ConnectionsAPI: &ConnectionsAPI{}}
+			_, err := config.ConnectionsAPITLSConfig()
+			Expect(err).To(MatchError(ContainSubstring("connections_api requires a server_cert and server_key")))
+		})
+	})
+
 	Context("ExtractServiceTLSConfig", func() {
 		It("fails when TLS is nil", func() {
 			config = &Config{}
@@ -206,6 +227,325 @@ var _ = Describe("Test full application config", func() {
 
 	})
 
+	Context("configure read deadline", func() {
+		It("defaults to a generous timeout", func() {
+			Expect(config.ReadTimeout()).To(Equal(DefaultReadTimeout))
+			config.ReadDeadline = &ReadDeadline{}
+			Expect(config.ReadTimeout()).To(Equal(DefaultReadTimeout))
+		})
+
+		It("can be configured or disabled", func() {
+			config.ReadDeadline = &ReadDeadline{TimeoutSeconds: 30}
+			Expect(config.ReadTimeout()).To(Equal(30 * time.Second))
+			config.ReadDeadline.Disabled = true
+			Expect(config.ReadTimeout()).To(BeZero())
+		})
+	})
+
+	Context("configure keepalive", func() {
+		It("is disabled by default", func() {
+			Expect(config.PingInterval()).To(BeZero())
+			config.Keepalive = &Keepalive{}
+			Expect(config.PingInterval()).To(BeZero())
+		})
+
+		It("defaults the pong timeout to the ping interval", func() {
+			config.Keepalive = &Keepalive{PingIntervalSeconds: 30}
+			Expect(config.PingInterval()).To(Equal(30 * time.Second))
+			Expect(config.PongTimeout()).To(Equal(30 * time.Second))
+			config.Keepalive.PongTimeoutSeconds = 10
+			Expect(config.PongTimeout()).To(Equal(10 * time.Second))
+		})
+	})
+
+	Context("configure idle connection timeout", func() {
+		It("is disabled by default", func() {
+			Expect(config.IdleConnectionTimeout()).To(BeZero())
+			config.IdleConnectionTimeoutSeconds = 300
+			Expect(config.IdleConnectionTimeout()).To(Equal(5 * time.Minute))
+		})
+	})
+
+	Context("configure dispatcher instances", func() {
+		BeforeEach(func() {
+			config.RegionRouting = &RegionRouting{Kafka: map[string]*confluent.ConfigMap{"cn": {}}}
+		})
+
+		It("names the dispatchers by default", func() {
+			Expect(config.validateDispatcherInstances()).To(Succeed())
+			Expect(config.dispatcherInstance("kafka_cn")).To(Equal("kafka_cn"))
+
+			config.Monitoring.DispatcherInstances = map[string]string{"kafka": "kafka-us"}
+			Expect(config.validateDispatcherInstances()).To(Succeed())
+			Expect(config.dispatcherInstance("kafka")).To(Equal("kafka-us"))
+		})
+
+		It("fails when instance names collide", func() {
+			config.Monitoring.DispatcherInstances = map[string]string{"kafka": "kafka_cn"}
+			Expect(config.validateDispatcherInstances()).To(MatchError(ContainSubstring("dispatcher_instances kafka_cn is used by both")))
+		})
+
+		It("fails when the dispatcher is not configured", func() {
+			config.Monitoring.DispatcherInstances = map[string]string{"kinesis": "kinesis-us"}
+			Expect(config.validateDispatcherInstances()).To(MatchError("dispatcher_instances kinesis is not a configured dispatcher"))
+		})
+	})
+
+	Context("configure default topic", func() {
+		It("fails when default topic has no record mapping", func() {
+			config.DefaultTopic = "alerts"
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("default_topic alerts has no record mapping"))
+			Expect(producers).To(BeNil())
+		})
+
+		It("fails when the decode dead-letter topic has no record mapping", func() {
+			config.DecodeDeadLetterTopic = "dead_letters"
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("decode_dead_letter_topic dead_letters has no record mapping"))
+			Expect(producers).To(BeNil())
+		})
+
+		It("fails when the default topic of a serializer variant has no record mapping", func() {
+			config.SerializerVariants = map[string]*SerializerVariant{"gen2": {DefaultTopic: "alerts"}}
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("default_topic alerts of serializer variant gen2 has no record mapping"))
+			Expect(producers).To(BeNil())
+		})
+
+		It("selects the serializer variant from the organizational units", func() {
+			config.SerializerVariants = map[string]*SerializerVariant{"gen2": {}}
+			Expect(config.SerializerVariantForUnits([]string{"fleet", "gen2"})).To(Equal("gen2"))
+			Expect(config.SerializerVariantForUnits([]string{"fleet"})).To(BeEmpty())
+		})
+	})
+
+	Context("configure signal change detection", func() {
+		It("is disabled by default", func() {
+			detector, err := config.NewChangeDetector()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(detector).To(BeNil())
+		})
+
+		It("fails on unknown signals", func() {
+			config.SignalChangeDetection = &SignalChangeDetection{Deltas: map[string]float64{"NotASignal": 1}}
+			_, err := config.NewChangeDetector()
+			Expect(err).To(MatchError("unknown signal for change detection: NotASignal"))
+		})
+
+		It("creates a detector", func() {
+			config.SignalChangeDetection = &SignalChangeDetection{Deltas: map[string]float64{"Odometer": 1}}
+			detector, err := config.NewChangeDetector()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(detector).NotTo(BeNil())
+		})
+	})
+
+	Context("configure region routing", func() {
+		It("is disabled by default", func() {
+			regionalProducers, regionalRules, err := config.ConfigureRegionalProducers(airbrake.NewAirbrakeHandler(nil), nil, log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(regionalProducers).To(BeNil())
+			Expect(regionalRules).To(BeNil())
+			Expect(config.RegionForIssuer("Tesla China Product Access Issuing CA")).To(BeEmpty())
+		})
+
+		It("routes kafka records to the region cluster", func() {
+			config.Records = map[string][]telemetry.Dispatcher{"V": {"kafka", "logger"}}
+			config.RegionRouting = &RegionRouting{
+				IssuerRegions: map[string]string{"Tesla China Product Access Issuing CA": "cn"},
+				Kafka:         map[string]*confluent.ConfigMap{"cn": {"bootstrap.servers": "some.cn.broker:9093"}},
+			}
+			var (
+				err       error
+				producers map[telemetry.Dispatcher]telemetry.Producer
+			)
+			producers, _, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+
+			regionalProducers, regionalRules, err := config.ConfigureRegionalProducers(airbrake.NewAirbrakeHandler(nil), producers, log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(regionalProducers).To(HaveKey("cn"))
+			Expect(regionalRules["cn"]["V"]).To(Equal([]telemetry.Producer{regionalProducers["cn"], producers[telemetry.Logger]}))
+			Expect(config.RegionForIssuer("Tesla China Product Access Issuing CA")).To(Equal("cn"))
+
+			for _, producer := range producers {
+				Expect(producer.Close()).To(Succeed())
+			}
+			Expect(regionalProducers["cn"].Close()).To(Succeed())
+		})
+	})
+
+	Context("configure sequencing", func() {
+		It("is disabled by default", func() {
+			source, err := config.NewSequenceSource()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(source).To(BeNil())
+		})
+
+		It("defaults to the clock source", func() {
+			config.Sequencing = &Sequencing{}
+			source, err := config.NewSequenceSource()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(source).To(BeAssignableToTypeOf(&telemetry.ClockSequence{}))
+		})
+
+		It("rejects unknown sources", func() {
+			config.Sequencing = &Sequencing{Source: "redis"}
+			_, err := config.NewSequenceSource()
+			Expect(err).To(MatchError("unknown sequence source: redis"))
+		})
+	})
+
+	Context("configure compression", func() {
+		It("compresses the record types dispatched with their metadata", func() {
+			config.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka, telemetry.Pubsub}}
+			config.Compression = &Compression{Records: map[string]telemetry.CompressionMode{"V": telemetry.CompressionGzip}}
+			compressor, err := config.NewCompressor()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(compressor).NotTo(BeNil())
+		})
+
+		It("rejects the compression of record types dispatched without their metadata", func() {
+			config.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka, telemetry.Kinesis}}
+			config.Compression = &Compression{Records: map[string]telemetry.CompressionMode{"V": telemetry.CompressionAuto}}
+			_, err := config.NewCompressor()
+			Expect(err).To(MatchError("compression of record V requires dispatchers carrying metadata, kinesis does not"))
+		})
+
+		It("compresses the record types dispatched to kinesis with envelope", func() {
+			config.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Kinesis}}
+			config.Kinesis = &Kinesis{Envelope: true}
+			config.Compression = &Compression{Records: map[string]telemetry.CompressionMode{"V": telemetry.CompressionGzip}}
+			_, err := config.NewCompressor()
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("configure transforms", func() {
+		It("is disabled by default", func() {
+			transformer, err := config.NewTransformer()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(transformer).To(BeNil())
+		})
+
+		It("requires decoded records", func() {
+			config.Transforms = map[string][]telemetry.TransformRule{"V": {{Field: "a", Expression: "1"}}}
+			_, err := config.NewTransformer()
+			Expect(err).To(MatchError("transforms require transmit_decoded_records"))
+		})
+
+		It("fails on invalid expressions", func() {
+			config.TransmitDecodedRecords = true
+			config.Transforms = map[string][]telemetry.TransformRule{"V": {{Field: "a", Expression: "os.Exit(1)"}}}
+			_, err := config.NewTransformer()
+			Expect(err).To(MatchError(ContainSubstring("invalid transform for record V")))
+		})
+	})
+
+	Context("configure affinity", func() {
+		It("hashes the device id by default", func() {
+			affinity := &Affinity{HeaderName: "X-Affinity", Salt: "salt"}
+			Expect(affinity.Token("device-1")).To(HaveLen(64))
+			Expect(affinity.Token("device-1")).To(Equal(affinity.Token("device-1")))
+			Expect(affinity.Token("device-1")).NotTo(Equal(affinity.Token("device-2")))
+		})
+
+		It("uses the device id", func() {
+			affinity := &Affinity{HeaderName: "X-Affinity", Format: AffinityDeviceID}
+			Expect(affinity.Token("device-1")).To(Equal("device-1"))
+		})
+
+		It("rejects unknown formats", func() {
+			var format AffinityTokenFormat
+			Expect(format.UnmarshalJSON([]byte(`"plain"`))).To(MatchError("invalid value for AffinityTokenFormat"))
+		})
+	})
+
+	Context("configure partial outage", func() {
+		It("rejects unknown policies", func() {
+			config.PartialOutage = &PartialOutage{Policy: "maybe"}
+			_, _, err := config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("partial_outage policy maybe should be either accept or reject"))
+		})
+
+		It("reports unhealthy dispatchers", func() {
+			config.MetricCollector = metrics.NewCollector(nil, log)
+			config.PartialOutage = &PartialOutage{Policy: PartialOutageAccept, MinSuccessRatio: 0.9}
+			config.NewSuccessRatio(telemetry.Kafka).Failure()
+			pubsubRatio := config.NewSuccessRatio(telemetry.Pubsub)
+
+			unhealthy, partial := config.UnhealthyDispatchers()
+			Expect(unhealthy).To(Equal(map[telemetry.Dispatcher]bool{telemetry.Kafka: true}))
+			Expect(partial).To(BeTrue())
+
+			pubsubRatio.Failure()
+			unhealthy, partial = config.UnhealthyDispatchers()
+			Expect(unhealthy).To(HaveLen(2))
+			Expect(partial).To(BeFalse())
+		})
+
+		It("caches the health of the dispatchers checked per record", func() {
+			config.MetricCollector = metrics.NewCollector(nil, log)
+			config.PartialOutage = &PartialOutage{Policy: PartialOutageAccept, MinSuccessRatio: 0.9}
+			config.NewSuccessRatio(telemetry.Kafka).Failure()
+			pubsubRatio := config.NewSuccessRatio(telemetry.Pubsub)
+
+			unhealthy, partial := config.CachedUnhealthyDispatchers()
+			Expect(unhealthy).To(Equal(map[telemetry.Dispatcher]bool{telemetry.Kafka: true}))
+			Expect(partial).To(BeTrue())
+
+			pubsubRatio.Failure()
+			unhealthy, partial = config.CachedUnhealthyDispatchers()
+			Expect(unhealthy).To(HaveLen(1))
+			Expect(partial).To(BeTrue())
+
+			config.dispatcherHealth.Load().takenAt = time.Now().Add(-dispatcherHealthRefresh)
+			unhealthy, partial = config.CachedUnhealthyDispatchers()
+			Expect(unhealthy).To(HaveLen(2))
+			Expect(partial).To(BeFalse())
+		})
+
+		It("names the region local kafka clusters as tracked", func() {
+			config.RegionRouting = &RegionRouting{Kafka: map[string]*confluent.ConfigMap{"eu": {}}}
+			Expect(config.RegionalDispatcher(telemetry.Kafka, "eu")).To(Equal(telemetry.Dispatcher("kafka_eu")))
+			Expect(config.RegionalDispatcher(telemetry.Kafka, "us")).To(Equal(telemetry.Kafka))
+			Expect(config.RegionalDispatcher(telemetry.Kafka, "")).To(Equal(telemetry.Kafka))
+			Expect(config.RegionalDispatcher(telemetry.Pubsub, "eu")).To(Equal(telemetry.Pubsub))
+		})
+
+		It("drops no record by default", func() {
+			config.MetricCollector = metrics.NewCollector(nil, log)
+			config.NewSuccessRatio(telemetry.Kafka).Failure()
+			config.NewSuccessRatio(telemetry.Pubsub)
+			unhealthy, partial := config.CachedUnhealthyDispatchers()
+			Expect(unhealthy).To(BeEmpty())
+			Expect(partial).To(BeFalse())
+		})
+
+		It("reports the readiness of the dispatchers", func() {
+			config.MetricCollector = metrics.NewCollector(nil, log)
+			config.NewSuccessRatio(telemetry.Kafka).Failure()
+			config.NewSuccessRatio("kafka_eu").Failure()
+			pulsarRatio := config.NewSuccessRatio(telemetry.Pulsar)
+			pulsarRatio.Success()
+			pulsarRatio.Failure()
+			config.NewSuccessRatio(telemetry.Pubsub)
+
+			unhealthy, accepted := config.DispatcherReadiness()
+			Expect(unhealthy).To(Equal([]string{"kafka", "kafka_eu"}))
+			Expect(accepted).To(BeFalse())
+
+			config.PartialOutage = &PartialOutage{Policy: PartialOutageAccept, MinSuccessRatio: 0.9}
+			unhealthy, accepted = config.DispatcherReadiness()
+			Expect(unhealthy).To(Equal([]string{"kafka", "kafka_eu", "pulsar"}))
+			Expect(accepted).To(BeTrue())
+		})
+	})
+
 	Context("configure kinesis", func() {
 		It("returns an error if kinesis isn't included", func() {
 			log, _ := logrus.NoOpLogger()
@@ -307,6 +647,27 @@ var _ = Describe("Test full application config", func() {
 		})
 	})
 
+	Context("ConfigureAckChan", func() {
+		It("creates the channel when reliable acks are configured", func() {
+			log, hook := logrus.NoOpLogger()
+			config = &Config{ReliableAckSources: map[string]telemetry.Dispatcher{"V": telemetry.Kafka}}
+			config.ConfigureAckChan(log)
+			Expect(config.AckChan).NotTo(BeNil())
+			Expect(hook.LastEntry().Message).To(Equal("reliable_ack_channel_created"))
+
+			ackChan := config.AckChan
+			config.ConfigureAckChan(log)
+			Expect(config.AckChan).To(Equal(ackChan))
+		})
+
+		It("does not create the channel without reliable acks", func() {
+			log, _ := logrus.NoOpLogger()
+			config = &Config{}
+			config.ConfigureAckChan(log)
+			Expect(config.AckChan).To(BeNil())
+		})
+	})
+
 	Context("configureLogger", func() {
 		It("Should properly configure logger", func() {
 			log, _ := logrus.NoOpLogger()
@@ -0,0 +1,196 @@
+// Package batch queues the records of the producers sending them in batches, such as BigQuery, Event Hubs and
+// Pulsar, and hands the batches of each destination to the producer from a single goroutine
+package batch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// DefaultQueueSize is the number of records queued to a batcher when not configured
+	DefaultQueueSize = 10000
+)
+
+var (
+	// ErrClosed is returned when a record is queued to a closed batcher
+	ErrClosed = errors.New("batcher_closed")
+	// ErrQueueFull is returned when a record is dropped from the full queue of a batcher
+	ErrQueueFull = errors.New("queue_full")
+)
+
+// Item is a record queued with its encoded form and the size the encoded form adds to its batch
+type Item[T any] struct {
+	Record *telemetry.Record
+	Value  T
+	Size   int
+	// QueuedAt is the time the record was queued to the producer, the start of its dispatch latency
+	QueuedAt time.Time
+}
+
+// Options bound the batches and the queue of a batcher
+type Options struct {
+	// MaxItems is the number of items of a full batch
+	MaxItems int
+	// MaxBytes is the size of a full batch, batches are only bounded by their items when 0. An item larger than
+	// MaxBytes is sent alone
+	MaxBytes int
+	// FlushInterval is the longest time items wait for their batch to fill up
+	FlushInterval time.Duration
+	// QueueSize is the number of items queued before they are dropped, defaults to DefaultQueueSize
+	QueueSize int
+}
+
+// Batcher groups the items queued for each destination into batches sent when full, after the flush interval and
+// on close. Queuing never blocks: items queued while the queue is full are rejected with ErrQueueFull, so that a
+// slow destination does not stall the connections producing the records
+type Batcher[T any] struct {
+	options     Options
+	destination func(record *telemetry.Record) string
+	send        func(destination string, batch []Item[T])
+
+	// mutex is held for reading while queuing so that the queue is never closed during a send
+	mutex  sync.RWMutex
+	closed bool
+	items  chan Item[T]
+	// flushes asks the goroutine sending the batches to send the items queued, it closes the channel sent once done
+	flushes chan chan struct{}
+	done    chan struct{}
+}
+
+// New returns a batcher sending the batches of the destination of the records with send, from a single goroutine
+func New[T any](options Options, destination func(record *telemetry.Record) string, send func(destination string, batch []Item[T])) *Batcher[T] {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.MaxItems <= 0 {
+		options.MaxItems = 1
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Second
+	}
+	b := &Batcher[T]{
+		options:     options,
+		destination: destination,
+		send:        send,
+		items:       make(chan Item[T], options.QueueSize),
+		flushes:     make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add queues the item, it returns ErrClosed once the batcher is closed and ErrQueueFull when the queue is full
+func (b *Batcher[T]) Add(item Item[T]) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	select {
+	case b.items <- item:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Flush sends the items queued before it was called and waits for their batches to be sent, or the context to be done
+func (b *Batcher[T]) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case b.flushes <- flushed:
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the items queued and waits for their batches to be sent
+func (b *Batcher[T]) Close() {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.items)
+	}
+	b.mutex.Unlock()
+	<-b.done
+}
+
+// pending is the batch of a destination being filled
+type pending[T any] struct {
+	items []Item[T]
+	bytes int
+}
+
+func (b *Batcher[T]) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.options.FlushInterval)
+	defer ticker.Stop()
+
+	batches := make(map[string]*pending[T])
+	flush := func(destination string) {
+		if batch, ok := batches[destination]; ok {
+			delete(batches, destination)
+			b.send(destination, batch.items)
+		}
+	}
+	flushAll := func() {
+		for destination := range batches {
+			flush(destination)
+		}
+	}
+	add := func(item Item[T]) {
+		destination := b.destination(item.Record)
+		batch, ok := batches[destination]
+		if ok && b.options.MaxBytes > 0 && batch.bytes+item.Size > b.options.MaxBytes {
+			flush(destination)
+			ok = false
+		}
+		if !ok {
+			batch = &pending[T]{}
+			batches[destination] = batch
+		}
+		batch.items = append(batch.items, item)
+		batch.bytes += item.Size
+		if len(batch.items) >= b.options.MaxItems || (b.options.MaxBytes > 0 && batch.bytes >= b.options.MaxBytes) {
+			flush(destination)
+		}
+	}
+	for {
+		select {
+		case item, ok := <-b.items:
+			if !ok {
+				flushAll()
+				return
+			}
+			add(item)
+		case flushed := <-b.flushes:
+			// the items queued before the flush was requested are in the queue
+			for queued := len(b.items); queued > 0; queued-- {
+				item, ok := <-b.items
+				if !ok {
+					break
+				}
+				add(item)
+			}
+			flushAll()
+			close(flushed)
+		case <-ticker.C:
+			flushAll()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package batch_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/batch"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type sent struct {
+	destination string
+	values      []string
+}
+
+type recorder struct {
+	mutex   sync.Mutex
+	batches []sent
+	// block holds the sends until closed when set
+	block chan struct{}
+}
+
+func (r *recorder) send(destination string, items []batch.Item[string]) {
+	if r.block != nil {
+		<-r.block
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		values = append(values, item.Value)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.batches = append(r.batches, sent{destination: destination, values: values})
+}
+
+func (r *recorder) sent() []sent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]sent(nil), r.batches...)
+}
+
+func byTxType(record *telemetry.Record) string {
+	return record.TxType
+}
+
+func item(txType string, value string, size int) batch.Item[string] {
+	return batch.Item[string]{Record: &telemetry.Record{TxType: txType}, Value: value, Size: size, QueuedAt: time.Now()}
+}
+
+var _ = Describe("Batcher", func() {
+	It("sends the batches once full", func() {
+		r := &recorder{}
+		b := batch.New(batch.Options{MaxItems: 2, FlushInterval: time.Hour}, byTxType, r.send)
+		defer b.Close()
+
+		Expect(b.Add(item("V", "a", 1))).To(Succeed())
+		Expect(b.Add(item("alerts", "b", 1))).To(Succeed())
+		Expect(b.Add(item("V", "c", 1))).To(Succeed())
+
+		Eventually(r.sent).Should(Equal([]sent{{destination: "V", values: []string{"a", "c"}}}))
+	})
+
+	It("sends the batches after the flush interval", func() {
+		r := &recorder{}
+		b := batch.New(batch.Options{MaxItems: 10, FlushInterval: 10 * time.Millisecond}, byTxType, r.send)
+		defer b.Close()
+
+		Expect(b.Add(item("V", "a", 1))).To(Succeed())
+
+		Eventually(r.sent).Should(Equal([]sent{{destination: "V", values: []string{"a"}}}))
+	})
+
+	It("bounds the batches by their size", func() {
+		r := &recorder{}
+		b := batch.New(batch.Options{MaxItems: 10, MaxBytes: 10, FlushInterval: time.Hour}, byTxType, r.send)
+
+		Expect(b.Add(item("V", "a", 6))).To(Succeed())
+		Expect(b.Add(item("V", "b", 6))).To(Succeed())
+		Expect(b.Add(item("V", "c", 20))).To(Succeed())
+		Expect(b.Add(item("V", "d", 4))).To(Succeed())
+		b.Close()
+
+		Expect(r.sent()).To(Equal([]sent{
+			{destination: "V", values: []string{"a"}},
+			{destination: "V", values: []string{"b"}},
+			{destination: "V", values: []string{"c"}},
+			{destination: "V", values: []string{"d"}},
+		}))
+	})
+
+	It("sends the items queued on close and rejects the later ones", func() {
+		r := &recorder{}
+		b := batch.New(batch.Options{MaxItems: 10, FlushInterval: time.Hour}, byTxType, r.send)
+
+		Expect(b.Add(item("V", "a", 1))).To(Succeed())
+		b.Close()
+		b.Close()
+
+		Expect(r.sent()).To(Equal([]sent{{destination: "V", values: []string{"a"}}}))
+		Expect(b.Add(item("V", "b", 1))).To(MatchError(batch.ErrClosed))
+	})
+
+	It("sends the items queued on flush", func() {
+		r := &recorder{}
+		b := batch.New(batch.Options{MaxItems: 10, FlushInterval: time.Hour}, byTxType, r.send)
+		defer b.Close()
+
+		Expect(b.Add(item("V", "a", 1))).To(Succeed())
+		Expect(b.Add(item("alerts", "b", 1))).To(Succeed())
+		Expect(b.Flush(context.Background())).To(Succeed())
+
+		Expect(r.sent()).To(ConsistOf(
+			sent{destination: "V", values: []string{"a"}},
+			sent{destination: "alerts", values: []string{"b"}},
+		))
+	})
+
+	It("stops waiting for the flush once the context is done", func() {
+		r := &recorder{block: make(chan struct{})}
+		b := batch.New(batch.Options{MaxItems: 10, FlushInterval: time.Hour}, byTxType, r.send)
+
+		Expect(b.Add(item("V", "a", 1))).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		Expect(b.Flush(ctx)).To(MatchError(context.DeadlineExceeded))
+
+		close(r.block)
+		b.Close()
+		Expect(b.Flush(context.Background())).To(Succeed())
+	})
+
+	It("drops the items queued while the queue is full", func() {
+		r := &recorder{block: make(chan struct{})}
+		b := batch.New(batch.Options{MaxItems: 1, FlushInterval: time.Hour, QueueSize: 1}, byTxType, r.send)
+
+		Expect(b.Add(item("V", "a", 1))).To(Succeed())
+		Eventually(func() error { return b.Add(item("V", "b", 1)) }).Should(Succeed())
+		Expect(b.Add(item("V", "c", 1))).To(MatchError(batch.ErrQueueFull))
+
+		close(r.block)
+		b.Close()
+		Expect(r.sent()).To(Equal([]sent{
+			{destination: "V", values: []string{"a"}},
+			{destination: "V", values: []string{"b"}},
+		}))
+	})
+
+	It("does not race queuing with closing", func() {
+		r := &recorder{}
+		b := batch.New(batch.Options{MaxItems: 5, FlushInterval: time.Millisecond, QueueSize: 5}, byTxType, r.send)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					_ = b.Add(item("V", "a", 1))
+				}
+			}()
+		}
+		b.Close()
+		wg.Wait()
+	})
+})
@@ -0,0 +1,391 @@
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/batch"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// DefaultBatchSize is the number of rows per streaming insert when not configured
+	DefaultBatchSize = 500
+	// DefaultFlushInterval is the longest time rows wait for their batch when not configured
+	DefaultFlushInterval = time.Second
+	// DefaultMaxRetries is the number of retries of the rows stopped by the invalid rows of their batch when not configured
+	DefaultMaxRetries = 3
+	// DefaultInsertTimeout bounds an insert and the retries of its transient errors when not configured
+	DefaultInsertTimeout = 30 * time.Second
+
+	// invalidReason is the reason of the rows rejected because they do not match the table schema
+	invalidReason = "invalid"
+)
+
+// Config contains the data necessary to configure a BigQuery producer.
+type Config struct {
+	// ProjectID is the GCP project of the dataset.
+	ProjectID string `json:"gcp_project_id"`
+
+	// Dataset receives the rows of the records.
+	Dataset string `json:"dataset"`
+
+	// Tables maps record types to their table, records are inserted into the <namespace>_<record type> table otherwise.
+	Tables map[string]string `json:"tables,omitempty"`
+
+	// BatchSize is the number of rows per streaming insert.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// FlushIntervalMs is the longest time rows wait for their batch to fill up.
+	FlushIntervalMs int `json:"flush_interval_ms,omitempty"`
+
+	// QueueSize is the number of rows waiting for their insert before the new ones are dropped.
+	QueueSize int `json:"queue_size,omitempty"`
+
+	// InsertTimeoutMs bounds an insert, the client retries rate limited and server errors until then.
+	InsertTimeoutMs int `json:"insert_timeout_ms,omitempty"`
+
+	// MaxRetries is the number of retries of the rows stopped by the invalid rows of their batch.
+	MaxRetries *int `json:"max_retries,omitempty"`
+
+	// DeadLetterTable receives the rows not matching the schema of their table, they are dropped when empty.
+	DeadLetterTable string `json:"dead_letter_table,omitempty"`
+
+	// OverrideHost replaces the BigQuery endpoint, for emulators.
+	OverrideHost string `json:"override_host,omitempty"`
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	errorCount        adapter.Counter
+	rowsInsertedCount adapter.Counter
+	deadLetterCount   adapter.Counter
+	reliableAckCount  adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+
+	rowOptions = protojson.MarshalOptions{UseProtoNames: true}
+)
+
+// row is the streaming insert of a record, its txid deduplicates the retries
+type row struct {
+	insertID string
+	columns  map[string]bq.Value
+}
+
+// Save implements the bigquery.ValueSaver interface
+func (r *row) Save() (map[string]bq.Value, string, error) {
+	return r.columns, r.insertID, nil
+}
+
+// Producer implements the telemetry.Producer interface by streaming the decoded records into BigQuery tables
+type Producer struct {
+	client             *bq.Client
+	config             *Config
+	namespace          string
+	instance           string
+	maxRetries         int
+	insertTimeout      time.Duration
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+
+	batcher   *batch.Batcher[*row]
+	closeOnce sync.Once
+}
+
+// NewProducer creates a BigQuery producer with the given config.
+func NewProducer(config *Config, namespace string, instance string, metricsCollector metrics.MetricCollector, successRatio *metrics.SuccessRatio, latencySLO *metrics.LatencySLO, payloadSize *metrics.PayloadSize, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger, opts ...option.ClientOption) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+	if config.ProjectID == "" || config.Dataset == "" {
+		return nil, errors.New("bigquery requires gcp_project_id and dataset")
+	}
+	if config.OverrideHost != "" {
+		opts = append(opts, option.WithEndpoint(config.OverrideHost))
+	}
+	client, err := bq.NewClient(context.Background(), config.ProjectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery_connect_error %s", err)
+	}
+
+	p := &Producer{
+		client:             client,
+		config:             config,
+		namespace:          namespace,
+		instance:           instance,
+		maxRetries:         DefaultMaxRetries,
+		insertTimeout:      time.Duration(config.InsertTimeoutMs) * time.Millisecond,
+		successRatio:       successRatio,
+		latencySLO:         latencySLO,
+		payloadSize:        payloadSize,
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+	}
+	if config.MaxRetries != nil {
+		p.maxRetries = *config.MaxRetries
+	}
+	if p.insertTimeout <= 0 {
+		p.insertTimeout = DefaultInsertTimeout
+	}
+	options := batch.Options{
+		MaxItems:      config.BatchSize,
+		FlushInterval: time.Duration(config.FlushIntervalMs) * time.Millisecond,
+		QueueSize:     config.QueueSize,
+	}
+	if options.MaxItems <= 0 {
+		options.MaxItems = DefaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	p.batcher = batch.New(options, func(record *telemetry.Record) string { return p.table(record.TxType) }, p.insert)
+	return p, nil
+}
+
+// Produce queues the row of the record for the next streaming insert into its table, the row is dropped when the
+// queue is full
+func (p *Producer) Produce(entry *telemetry.Record) {
+	queuedAt := time.Now()
+	entry.SetProduceTime(telemetry.BigQuery, queuedAt)
+	columns, size, err := p.toColumns(entry)
+	if err != nil {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType, "reason": "encode"})
+		p.ReportError("bigquery_row_encode_error", err, logrus.LogInfo{"record_type": entry.TxType, "txid": entry.Txid})
+		return
+	}
+	item := batch.Item[*row]{Record: entry, Value: &row{insertID: entry.Txid, columns: columns}, QueuedAt: queuedAt}
+	if err = p.batcher.Add(item); err != nil {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType, "reason": err.Error()})
+		return
+	}
+	p.payloadSize.Observe(entry.TxType, size)
+}
+
+// toColumns maps the fields of the decoded record to the columns of its row, using the proto field names. It also
+// returns the size of the encoded row
+func (p *Producer) toColumns(entry *telemetry.Record) (map[string]bq.Value, int, error) {
+	message := entry.GetProtoMessage()
+	if message == nil {
+		return nil, 0, fmt.Errorf("record type %s cannot be decoded", entry.TxType)
+	}
+	data, err := rowOptions.Marshal(message)
+	if err != nil {
+		return nil, 0, err
+	}
+	columns := make(map[string]bq.Value)
+	if err = json.Unmarshal(data, &columns); err != nil {
+		return nil, 0, err
+	}
+	return columns, len(data), nil
+}
+
+func (p *Producer) table(recordType string) string {
+	if table, ok := p.config.Tables[recordType]; ok {
+		return table
+	}
+	return telemetry.BuildTopicName(p.namespace, recordType)
+}
+
+// insert streams the batch into the table, the client retries the transient errors until the insert timeout.
+// Rows not matching the schema are dead-lettered and the rows they stopped are retried
+func (p *Producer) insert(table string, items []batch.Item[*row]) {
+	inserter := p.client.Dataset(p.config.Dataset).Table(table).Inserter()
+	for attempt := 0; len(items) > 0; attempt++ {
+		rows := make([]*row, 0, len(items))
+		for _, item := range items {
+			rows = append(rows, item.Value)
+		}
+		err := p.put(inserter, rows)
+		var rowErrors bq.PutMultiError
+		if err != nil && !errors.As(err, &rowErrors) {
+			p.fail(items, "request", err)
+			return
+		}
+
+		rejected := make(map[int]bq.RowInsertionError, len(rowErrors))
+		for _, rowError := range rowErrors {
+			rejected[rowError.RowIndex] = rowError
+		}
+		var retry []batch.Item[*row]
+		for index, item := range items {
+			rowError, ok := rejected[index]
+			switch {
+			case !ok:
+				p.succeed(item)
+			case invalid(rowError):
+				p.deadLetter(item, rowError)
+			default:
+				retry = append(retry, item)
+			}
+		}
+		if len(retry) > 0 && attempt >= p.maxRetries {
+			p.fail(retry, "stopped", errors.New("rows not inserted after retries"))
+			return
+		}
+		items = retry
+	}
+}
+
+func (p *Producer) put(inserter *bq.Inserter, rows []*row) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.insertTimeout)
+	defer cancel()
+	return inserter.Put(ctx, rows)
+}
+
+func (p *Producer) succeed(item batch.Item[*row]) {
+	p.successRatio.Success()
+	p.latencySLO.Observe(time.Since(item.QueuedAt))
+	p.ProcessReliableAck(item.Record)
+	metricsRegistry.rowsInsertedCount.Inc(map[string]string{"instance": p.instance, "record_type": item.Record.TxType})
+}
+
+func (p *Producer) fail(items []batch.Item[*row], reason string, err error) {
+	for _, item := range items {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": item.Record.TxType, "reason": reason})
+	}
+	p.ReportError("bigquery_insert_error", err, logrus.LogInfo{"rows": len(items), "reason": reason})
+}
+
+// deadLetter inserts the row rejected by its table into the dead letter table
+func (p *Producer) deadLetter(item batch.Item[*row], rowError bq.RowInsertionError) {
+	record := item.Record
+	p.successRatio.Failure()
+	metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": record.TxType, "reason": "schema_mismatch"})
+	message := ""
+	if len(rowError.Errors) > 0 {
+		message = errorMessage(rowError.Errors[0])
+	}
+	if p.config.DeadLetterTable == "" {
+		p.ReportError("bigquery_schema_mismatch", errors.New(message), logrus.LogInfo{"record_type": record.TxType, "txid": record.Txid})
+		return
+	}
+
+	columns, err := json.Marshal(item.Value.columns)
+	if err != nil {
+		p.ReportError("bigquery_dead_letter_error", err, logrus.LogInfo{"record_type": record.TxType, "txid": record.Txid})
+		return
+	}
+	deadLetter := &row{
+		insertID: item.Value.insertID,
+		columns: map[string]bq.Value{
+			"record_type": record.TxType,
+			"txid":        record.Txid,
+			"vin":         record.Vin,
+			"error":       message,
+			"row":         string(columns),
+		},
+	}
+	if err = p.put(p.client.Dataset(p.config.Dataset).Table(p.config.DeadLetterTable).Inserter(), []*row{deadLetter}); err != nil {
+		p.ReportError("bigquery_dead_letter_error", err, logrus.LogInfo{"record_type": record.TxType, "txid": record.Txid})
+		return
+	}
+	metricsRegistry.deadLetterCount.Inc(map[string]string{"instance": p.instance, "record_type": record.TxType})
+}
+
+// invalid returns true if the row was rejected for itself rather than stopped because of other rows
+func invalid(rowError bq.RowInsertionError) bool {
+	for _, err := range rowError.Errors {
+		var bqError *bq.Error
+		if errors.As(err, &bqError) && bqError.Reason == invalidReason {
+			return true
+		}
+	}
+	return false
+}
+
+// errorMessage returns the message of the row error without the location and reason decorations
+func errorMessage(err error) string {
+	var bqError *bq.Error
+	if errors.As(err, &bqError) {
+		return bqError.Message
+	}
+	return err.Error()
+}
+
+// Flush sends the pending rows
+func (p *Producer) Flush(ctx context.Context) error {
+	return p.batcher.Flush(ctx)
+}
+
+// Close inserts the pending rows
+func (p *Producer) Close() error {
+	p.batcher.Close()
+	var err error
+	p.closeOnce.Do(func() { err = p.client.Close() })
+	return err
+}
+
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok && !entry.AckedOnReceipt {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "bigquery_err",
+		Help:   "The number of rows which could not be inserted into BigQuery.",
+		Labels: []string{"instance", "record_type", "reason"},
+	})
+
+	metricsRegistry.rowsInsertedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "bigquery_rows_inserted_total",
+		Help:   "The number of rows inserted into BigQuery.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.deadLetterCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "bigquery_dead_letter_total",
+		Help:   "The number of rows not matching their table schema inserted into the dead letter table.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "bigquery_reliable_ack_total",
+		Help:   "The number of records inserted into BigQuery for which we sent a reliable ACK.",
+		Labels: []string{"instance", "record_type"},
+	})
+}
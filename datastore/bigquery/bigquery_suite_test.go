@@ -0,0 +1,13 @@
+package bigquery_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestBigQuery(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "BigQuery Suite Tests")
+}
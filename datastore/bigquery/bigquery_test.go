@@ -0,0 +1,172 @@
+package bigquery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	bigqueryapi "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/bigquery"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type insertRequest struct {
+	table string
+	rows  []*bigqueryapi.TableDataInsertAllRequestRows
+}
+
+var _ = Describe("Producer", func() {
+	var (
+		mutex     sync.Mutex
+		requests  []insertRequest
+		responses []func(w http.ResponseWriter, request insertRequest)
+		ackChan   chan *telemetry.Record
+		producer  telemetry.Producer
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		responses = nil
+		ackChan = make(chan *telemetry.Record, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request := insertRequest{table: strings.Split(r.URL.Path, "/")[8]}
+			body := &bigqueryapi.TableDataInsertAllRequest{}
+			Expect(json.NewDecoder(r.Body).Decode(body)).To(Succeed())
+			request.rows = body.Rows
+
+			mutex.Lock()
+			requests = append(requests, request)
+			var respond func(w http.ResponseWriter, request insertRequest)
+			if len(responses) > 0 {
+				respond, responses = responses[0], responses[1:]
+			}
+			mutex.Unlock()
+
+			if respond != nil {
+				respond(w, request)
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		}))
+		DeferCleanup(server.Close)
+
+		logger, _ := logrus.NoOpLogger()
+		config := &bigquery.Config{ProjectID: "project", Dataset: "dataset", BatchSize: 2, FlushIntervalMs: 10, DeadLetterTable: "dead_letters"}
+		var err error
+		producer, err = bigquery.NewProducer(config, "tesla", "bigquery", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"connectivity": true}, logger,
+			option.WithEndpoint(server.URL+"/bigquery/v2/"), option.WithoutAuthentication())
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+	})
+
+	newRecord := func(txid string) *telemetry.Record {
+		payload, err := proto.Marshal(&protos.VehicleConnectivity{Vin: "42", ConnectionId: txid, CreatedAt: timestamppb.Now()})
+		Expect(err).NotTo(HaveOccurred())
+		streamMessage := messages.StreamMessage{TXID: []byte(txid), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("connectivity"), Payload: payload}
+		message, err := streamMessage.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{"connectivity": nil}, logger)
+		record, err := telemetry.NewRecord(serializer, message, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	recorded := func() []insertRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]insertRequest(nil), requests...)
+	}
+
+	It("inserts batches of rows named after the proto fields", func() {
+		producer.Produce(newRecord("1"))
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded).Should(HaveLen(1))
+		request := recorded()[0]
+		Expect(request.table).To(Equal("tesla_connectivity"))
+		Expect(request.rows).To(HaveLen(2))
+		Expect(request.rows[0].InsertId).To(Equal("1"))
+		Expect(request.rows[0].Json).To(HaveKeyWithValue("connection_id", "1"))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("flushes partial batches on close", func() {
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+		Expect(recorded()).To(HaveLen(1))
+	})
+
+	It("retries transient errors", func() {
+		responses = append(responses, func(w http.ResponseWriter, _ insertRequest) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+		producer.Produce(newRecord("1"))
+		producer.Produce(newRecord("2"))
+
+		// the client backs off up to a second before its first retry
+		Eventually(recorded, 3*time.Second).Should(HaveLen(2))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("drops the rows produced while the queue is full", func() {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			<-release
+			_, _ = w.Write([]byte(`{}`))
+		}))
+		defer server.Close()
+
+		logger, _ := logrus.NoOpLogger()
+		config := &bigquery.Config{ProjectID: "project", Dataset: "dataset", BatchSize: 1, FlushIntervalMs: 10, QueueSize: 1}
+		blocked, err := bigquery.NewProducer(config, "tesla", "bigquery", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"connectivity": true}, logger,
+			option.WithEndpoint(server.URL+"/bigquery/v2/"), option.WithoutAuthentication())
+		Expect(err).NotTo(HaveOccurred())
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 10; i++ {
+				blocked.Produce(newRecord("1"))
+			}
+		}()
+		Eventually(done).Should(BeClosed())
+		close(release)
+		Expect(blocked.Close()).To(Succeed())
+		Expect(len(ackChan)).To(BeNumerically("<", 10))
+	})
+
+	It("dead-letters rows not matching the schema and retries the stopped rows", func() {
+		responses = append(responses, func(w http.ResponseWriter, _ insertRequest) {
+			_, _ = w.Write([]byte(`{"insertErrors": [
+				{"index": 0, "errors": [{"reason": "invalid", "message": "no such field"}]},
+				{"index": 1, "errors": [{"reason": "stopped"}]}
+			]}`))
+		})
+		producer.Produce(newRecord("1"))
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded).Should(HaveLen(3))
+		requests := recorded()
+		Expect(requests[1].table).To(Equal("dead_letters"))
+		Expect(requests[1].rows[0].Json).To(HaveKeyWithValue("error", "no such field"))
+		Expect(requests[2].table).To(Equal("tesla_connectivity"))
+		Expect(requests[2].rows[0].InsertId).To(Equal("2"))
+		Eventually(ackChan).Should(HaveLen(1))
+	})
+})
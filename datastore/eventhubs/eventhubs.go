@@ -0,0 +1,536 @@
+package eventhubs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/batch"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// DefaultBatchSize is the number of events per send when not configured
+	DefaultBatchSize = 100
+	// DefaultFlushInterval is the longest time events wait for their batch when not configured
+	DefaultFlushInterval = time.Second
+	// DefaultMaxRetries is the number of retries of transient send errors when not configured
+	DefaultMaxRetries = 3
+	// DefaultMaxBatchBytes is the size of the body of a send when not configured, the largest batch Event Hubs
+	// accepts on its basic tier
+	DefaultMaxBatchBytes = 256 * 1024
+	// DefaultAuthorityHost is the Azure Active Directory endpoint issuing the tokens when not configured
+	DefaultAuthorityHost = "https://login.microsoftonline.com"
+
+	retryBackoff   = 100 * time.Millisecond
+	requestTimeout = 30 * time.Second
+	sasTokenTTL    = time.Hour
+	// tokenRefreshMargin renews the AAD tokens before they expire
+	tokenRefreshMargin = time.Minute
+	eventHubsScope     = "https://eventhubs.azure.net/.default"
+	batchContentType   = "application/vnd.microsoft.servicebus.json"
+)
+
+// PartitionKeyStrategy selects the partition key of the events
+type PartitionKeyStrategy string
+
+const (
+	// PartitionKeyDeviceID keeps the events of a device in order on one partition
+	PartitionKeyDeviceID PartitionKeyStrategy = "device_id"
+	// PartitionKeyTxid spreads the events of a device across the partitions
+	PartitionKeyTxid PartitionKeyStrategy = "txid"
+	// PartitionKeyNone lets Event Hubs balance the events across the partitions
+	PartitionKeyNone PartitionKeyStrategy = "none"
+)
+
+// Config contains the data necessary to configure an Event Hubs producer.
+type Config struct {
+	// ConnectionString is the shared access connection string of the namespace or of an event hub.
+	ConnectionString string `json:"connection_string,omitempty"`
+
+	// Namespace is the fully qualified host of the namespace, required with AAD authentication.
+	Namespace string `json:"namespace,omitempty"`
+
+	// AAD authenticates with the client credentials of an Azure Active Directory application instead of the connection string.
+	AAD *AAD `json:"aad,omitempty"`
+
+	// EventHubs maps record types to their event hub. Records are sent to the event hub of the connection string
+	// otherwise, or to the <namespace>_<record type> event hub if it has none.
+	EventHubs map[string]string `json:"event_hubs,omitempty"`
+
+	// PartitionKey is the partition key strategy: device_id (default), txid or none.
+	PartitionKey PartitionKeyStrategy `json:"partition_key,omitempty"`
+
+	// BatchSize is the number of events per send.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// FlushIntervalMs is the longest time events wait for their batch to fill up.
+	FlushIntervalMs int `json:"flush_interval_ms,omitempty"`
+
+	// MaxBatchBytes is the largest body of a send, events larger than it are dropped.
+	MaxBatchBytes int `json:"max_batch_bytes,omitempty"`
+
+	// QueueSize is the number of events waiting for their send before the new ones are dropped.
+	QueueSize int `json:"queue_size,omitempty"`
+
+	// MaxRetries is the number of retries of sends failing with transient errors.
+	MaxRetries *int `json:"max_retries,omitempty"`
+
+	// OverrideHost replaces the https://<namespace> endpoint, for emulators.
+	OverrideHost string `json:"override_host,omitempty"`
+}
+
+// AAD contains the client credentials of an Azure Active Directory application
+type AAD struct {
+	TenantID     string `json:"tenant_id"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+
+	// AuthorityHost replaces the Azure Active Directory endpoint, for sovereign clouds.
+	AuthorityHost string `json:"authority_host,omitempty"`
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	errorCount        adapter.Counter
+	publishCount      adapter.Counter
+	publishBytesTotal adapter.Counter
+	reliableAckCount  adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// event is an event of a batch, the body is the base64 encoded payload of the record
+type event struct {
+	Body             string            `json:"Body"`
+	BrokerProperties map[string]string `json:"BrokerProperties,omitempty"`
+	UserProperties   map[string]string `json:"UserProperties,omitempty"`
+}
+
+// Producer implements the telemetry.Producer interface by sending the records to Event Hubs in batches
+type Producer struct {
+	client             *http.Client
+	endpoint           string
+	authorizer         authorizer
+	config             *Config
+	defaultHub         string
+	namespace          string
+	instance           string
+	maxRetries         int
+	maxBatchBytes      int
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+
+	batcher *batch.Batcher[[]byte]
+}
+
+// NewProducer creates an Event Hubs producer with the given config.
+func NewProducer(config *Config, namespace string, instance string, metricsCollector metrics.MetricCollector, successRatio *metrics.SuccessRatio, latencySLO *metrics.LatencySLO, payloadSize *metrics.PayloadSize, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+	switch config.PartitionKey {
+	case "", PartitionKeyDeviceID, PartitionKeyTxid, PartitionKeyNone:
+	default:
+		return nil, fmt.Errorf("eventhubs partition_key %s should be one of %s, %s or %s", config.PartitionKey, PartitionKeyDeviceID, PartitionKeyTxid, PartitionKeyNone)
+	}
+
+	client := &http.Client{Timeout: requestTimeout}
+	p := &Producer{
+		client:             client,
+		config:             config,
+		namespace:          namespace,
+		instance:           instance,
+		maxRetries:         DefaultMaxRetries,
+		maxBatchBytes:      config.MaxBatchBytes,
+		successRatio:       successRatio,
+		latencySLO:         latencySLO,
+		payloadSize:        payloadSize,
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+	}
+
+	host := config.Namespace
+	switch {
+	case config.AAD != nil:
+		if host == "" || config.AAD.TenantID == "" || config.AAD.ClientID == "" || config.AAD.ClientSecret == "" {
+			return nil, errors.New("eventhubs aad requires namespace, tenant_id, client_id and client_secret")
+		}
+		p.authorizer = newAADAuthorizer(client, config.AAD)
+	case config.ConnectionString != "":
+		connection, err := parseConnectionString(config.ConnectionString)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			host = connection.host
+		}
+		p.defaultHub = connection.entityPath
+		p.authorizer = connection
+	default:
+		return nil, errors.New("eventhubs requires a connection_string or aad credentials")
+	}
+	p.endpoint = "https://" + host
+	if config.OverrideHost != "" {
+		p.endpoint = strings.TrimSuffix(config.OverrideHost, "/")
+	}
+
+	if config.MaxRetries != nil {
+		p.maxRetries = *config.MaxRetries
+	}
+	if p.maxBatchBytes <= 0 {
+		p.maxBatchBytes = DefaultMaxBatchBytes
+	}
+	options := batch.Options{
+		MaxItems: config.BatchSize,
+		// the events of a body are separated by commas and enclosed in brackets
+		MaxBytes:      p.maxBatchBytes - 1,
+		FlushInterval: time.Duration(config.FlushIntervalMs) * time.Millisecond,
+		QueueSize:     config.QueueSize,
+	}
+	if options.MaxItems <= 0 {
+		options.MaxItems = DefaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	p.batcher = batch.New(options, func(record *telemetry.Record) string { return p.eventHub(record.TxType) }, p.send)
+	p.logger.ActivityLog("eventhubs_registered", logrus.LogInfo{"endpoint": p.endpoint, "namespace": namespace})
+	return p, nil
+}
+
+// Produce queues the event of the record for the next send to its event hub, the event is dropped when it does not
+// fit in a send or when the queue is full
+func (p *Producer) Produce(entry *telemetry.Record) {
+	queuedAt := time.Now()
+	entry.SetProduceTime(telemetry.EventHubs, queuedAt)
+	value := event{
+		Body:           base64.StdEncoding.EncodeToString(entry.Payload()),
+		UserProperties: entry.Metadata(),
+	}
+	if key := p.partitionKey(entry); key != "" {
+		value.BrokerProperties = map[string]string{"PartitionKey": key}
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		p.fail(p.eventHub(entry.TxType), []*telemetry.Record{entry}, "encode", err)
+		return
+	}
+	if len(encoded)+2 > p.maxBatchBytes {
+		p.fail(p.eventHub(entry.TxType), []*telemetry.Record{entry}, "too_large", fmt.Errorf("event of %d bytes exceeds max_batch_bytes", len(encoded)))
+		return
+	}
+	if err = p.batcher.Add(batch.Item[[]byte]{Record: entry, Value: encoded, Size: len(encoded) + 1, QueuedAt: queuedAt}); err != nil {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType, "reason": err.Error()})
+		return
+	}
+	p.payloadSize.Observe(entry.TxType, len(encoded))
+}
+
+func (p *Producer) partitionKey(entry *telemetry.Record) string {
+	switch p.config.PartitionKey {
+	case PartitionKeyTxid:
+		return entry.Txid
+	case PartitionKeyNone:
+		return ""
+	default:
+		return entry.Vin
+	}
+}
+
+func (p *Producer) eventHub(recordType string) string {
+	if hub, ok := p.config.EventHubs[recordType]; ok {
+		return hub
+	}
+	if p.defaultHub != "" {
+		return p.defaultHub
+	}
+	return telemetry.BuildTopicName(p.namespace, recordType)
+}
+
+// send posts the batch to the event hub, retrying transient errors. The records are acked once
+// Event Hubs confirmed the batch was accepted
+func (p *Producer) send(hub string, items []batch.Item[[]byte]) {
+	body := make([]byte, 0, p.maxBatchBytes)
+	records := make([]*telemetry.Record, 0, len(items))
+	body = append(body, '[')
+	for i, item := range items {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, item.Value...)
+		records = append(records, item.Record)
+	}
+	body = append(body, ']')
+
+	for attempt := 0; ; attempt++ {
+		err := p.post(hub, body)
+		if err == nil {
+			break
+		}
+		if attempt >= p.maxRetries || !transient(err) {
+			p.fail(hub, records, "request", err)
+			return
+		}
+		time.Sleep(retryBackoff << attempt)
+	}
+
+	for _, item := range items {
+		p.successRatio.Success()
+		p.latencySLO.Observe(time.Since(item.QueuedAt))
+		p.ProcessReliableAck(item.Record)
+		metricsRegistry.publishCount.Inc(map[string]string{"instance": p.instance, "record_type": item.Record.TxType})
+		metricsRegistry.publishBytesTotal.Add(int64(item.Record.Length()), map[string]string{"instance": p.instance, "record_type": item.Record.TxType})
+	}
+	p.logger.Log(logrus.DEBUG, "eventhubs_batch_dispatched", logrus.LogInfo{"event_hub": hub, "events": len(items), "bytes": len(body)})
+}
+
+func (p *Producer) post(hub string, body []byte) error {
+	resource := p.endpoint + "/" + url.PathEscape(hub)
+	token, err := p.authorizer.token(resource)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, resource+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", token)
+	request.Header.Set("Content-Type", batchContentType)
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return &statusError{code: response.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	return nil
+}
+
+func (p *Producer) fail(hub string, records []*telemetry.Record, reason string, err error) {
+	for _, record := range records {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": record.TxType, "reason": reason})
+	}
+	p.ReportError("eventhubs_send_error", err, logrus.LogInfo{"event_hub": hub, "events": len(records), "reason": reason})
+}
+
+// statusError is a send rejected by Event Hubs
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("eventhubs responded %d: %s", e.code, e.message)
+}
+
+// transient returns true for errors worth retrying: throttling, server errors and network errors
+func transient(err error) bool {
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.code == http.StatusTooManyRequests || statusErr.code >= http.StatusInternalServerError
+}
+
+// Flush sends the pending events
+func (p *Producer) Flush(ctx context.Context) error {
+	return p.batcher.Flush(ctx)
+}
+
+// Close sends the pending events
+func (p *Producer) Close() error {
+	p.batcher.Close()
+	return nil
+}
+
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok && !entry.AckedOnReceipt {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+// authorizer returns the Authorization header of the requests to an event hub
+type authorizer interface {
+	token(resource string) (string, error)
+}
+
+// connectionString holds the shared access key of a connection string, it signs SAS tokens
+type connectionString struct {
+	host       string
+	entityPath string
+	keyName    string
+	key        string
+}
+
+func parseConnectionString(value string) (*connectionString, error) {
+	connection := &connectionString{}
+	for _, part := range strings.Split(value, ";") {
+		key, val, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Endpoint":
+			endpoint, err := url.Parse(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid eventhubs connection_string endpoint: %w", err)
+			}
+			connection.host = endpoint.Host
+		case "SharedAccessKeyName":
+			connection.keyName = val
+		case "SharedAccessKey":
+			connection.key = val
+		case "EntityPath":
+			connection.entityPath = val
+		}
+	}
+	if connection.host == "" || connection.keyName == "" || connection.key == "" {
+		return nil, errors.New("eventhubs connection_string requires Endpoint, SharedAccessKeyName and SharedAccessKey")
+	}
+	return connection, nil
+}
+
+// token signs a shared access signature of the resource
+func (c *connectionString) token(resource string) (string, error) {
+	encoded := url.QueryEscape(resource)
+	expiry := strconv.FormatInt(time.Now().Add(sasTokenTTL).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(c.key))
+	mac.Write([]byte(encoded + "\n" + expiry))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", encoded, url.QueryEscape(signature), expiry, c.keyName), nil
+}
+
+// aadAuthorizer obtains tokens with the client credentials of an application, caching them until they expire
+type aadAuthorizer struct {
+	client   *http.Client
+	tokenURL string
+	form     url.Values
+
+	mutex     sync.Mutex
+	bearer    string
+	expiresAt time.Time
+}
+
+func newAADAuthorizer(client *http.Client, aad *AAD) *aadAuthorizer {
+	authorityHost := aad.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = DefaultAuthorityHost
+	}
+	return &aadAuthorizer{
+		client:   client,
+		tokenURL: strings.TrimSuffix(authorityHost, "/") + "/" + url.PathEscape(aad.TenantID) + "/oauth2/v2.0/token",
+		form: url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {aad.ClientID},
+			"client_secret": {aad.ClientSecret},
+			"scope":         {eventHubsScope},
+		},
+	}
+}
+
+func (a *aadAuthorizer) token(string) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.bearer != "" && time.Now().Before(a.expiresAt) {
+		return a.bearer, nil
+	}
+	response, err := a.client.PostForm(a.tokenURL, a.form)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", &statusError{code: response.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", errors.New("aad token response has no access_token")
+	}
+	a.bearer = "Bearer " + body.AccessToken
+	a.expiresAt = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - tokenRefreshMargin)
+	return a.bearer, nil
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "eventhubs_err",
+		Help:   "The number of records which could not be sent to Event Hubs.",
+		Labels: []string{"instance", "record_type", "reason"},
+	})
+
+	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "eventhubs_publish_total",
+		Help:   "The number of records sent to Event Hubs.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.publishBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "eventhubs_publish_total_bytes",
+		Help:   "The number of bytes sent to Event Hubs.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "eventhubs_reliable_ack_total",
+		Help:   "The number of records sent to Event Hubs for which we sent a reliable ACK.",
+		Labels: []string{"instance", "record_type"},
+	})
+}
@@ -0,0 +1,13 @@
+package eventhubs_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestEventHubs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Event Hubs Suite Tests")
+}
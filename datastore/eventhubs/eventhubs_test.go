@@ -0,0 +1,212 @@
+package eventhubs_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/eventhubs"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type event struct {
+	Body             string
+	BrokerProperties map[string]string
+	UserProperties   map[string]string
+}
+
+type sendRequest struct {
+	path          string
+	authorization string
+	events        []event
+}
+
+var _ = Describe("Producer", func() {
+	var (
+		mutex     sync.Mutex
+		requests  []sendRequest
+		responses []int
+		server    *httptest.Server
+		ackChan   chan *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		responses = nil
+		ackChan = make(chan *telemetry.Record, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token") {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.Form.Get("grant_type")).To(Equal("client_credentials"))
+				_, _ = w.Write([]byte(`{"access_token": "aad-token", "expires_in": 3600}`))
+				return
+			}
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/vnd.microsoft.servicebus.json"))
+			request := sendRequest{path: r.URL.Path, authorization: r.Header.Get("Authorization")}
+			Expect(json.NewDecoder(r.Body).Decode(&request.events)).To(Succeed())
+
+			mutex.Lock()
+			requests = append(requests, request)
+			status := http.StatusCreated
+			if len(responses) > 0 {
+				status, responses = responses[0], responses[1:]
+			}
+			mutex.Unlock()
+			w.WriteHeader(status)
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	newProducer := func(config *eventhubs.Config) telemetry.Producer {
+		config.OverrideHost = server.URL
+		config.BatchSize = 2
+		config.FlushIntervalMs = 10
+		logger, _ := logrus.NoOpLogger()
+		producer, err := eventhubs.NewProducer(config, "tesla", "eventhubs", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"connectivity": true}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+		return producer
+	}
+
+	newRecord := func(txid string) *telemetry.Record {
+		payload, err := proto.Marshal(&protos.VehicleConnectivity{Vin: "42", ConnectionId: txid, CreatedAt: timestamppb.Now()})
+		Expect(err).NotTo(HaveOccurred())
+		streamMessage := messages.StreamMessage{TXID: []byte(txid), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("connectivity"), Payload: payload}
+		message, err := streamMessage.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{"connectivity": nil}, logger)
+		record, err := telemetry.NewRecord(serializer, message, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	recorded := func() []sendRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]sendRequest(nil), requests...)
+	}
+
+	const connectionString = "Endpoint=sb://example.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=c2VjcmV0;EntityPath=telemetry"
+
+	It("sends batches of events partitioned by device id", func() {
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString})
+		first := newRecord("1")
+		producer.Produce(first)
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded).Should(HaveLen(1))
+		request := recorded()[0]
+		Expect(request.path).To(Equal("/telemetry/messages"))
+		Expect(request.authorization).To(HavePrefix("SharedAccessSignature sr="))
+		Expect(request.authorization).To(ContainSubstring("&skn=send"))
+		Expect(request.events).To(HaveLen(2))
+		Expect(request.events[0].BrokerProperties).To(HaveKeyWithValue("PartitionKey", "42"))
+		Expect(request.events[0].UserProperties).To(HaveKeyWithValue("txid", "1"))
+		Expect(request.events[0].Body).To(Equal(base64.StdEncoding.EncodeToString(first.Payload())))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("does not ack the records acked on receipt", func() {
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString})
+		record := newRecord("1")
+		record.AckedOnReceipt = true
+		producer.Produce(record)
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded).Should(HaveLen(1))
+		Eventually(ackChan).Should(HaveLen(1))
+		Consistently(ackChan, 100*time.Millisecond).Should(HaveLen(1))
+	})
+
+	It("sends the records to the event hubs of their record type", func() {
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString, EventHubs: map[string]string{"connectivity": "connections"}, PartitionKey: eventhubs.PartitionKeyNone})
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+
+		requests := recorded()
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].path).To(Equal("/connections/messages"))
+		Expect(requests[0].events[0].BrokerProperties).To(BeEmpty())
+	})
+
+	It("authenticates with aad client credentials", func() {
+		producer := newProducer(&eventhubs.Config{Namespace: "example.servicebus.windows.net", AAD: &eventhubs.AAD{TenantID: "tenant", ClientID: "client", ClientSecret: "secret", AuthorityHost: server.URL}})
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+
+		requests := recorded()
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].path).To(Equal("/tesla_connectivity/messages"))
+		Expect(requests[0].authorization).To(Equal("Bearer aad-token"))
+	})
+
+	It("retries transient errors", func() {
+		responses = append(responses, http.StatusServiceUnavailable)
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString})
+		producer.Produce(newRecord("1"))
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded, time.Second).Should(HaveLen(2))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("bounds the size of the batches", func() {
+		first := newRecord("1")
+		encoded, err := json.Marshal(event{Body: base64.StdEncoding.EncodeToString(first.Payload()), BrokerProperties: map[string]string{"PartitionKey": "42"}, UserProperties: first.Metadata()})
+		Expect(err).NotTo(HaveOccurred())
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString, MaxBatchBytes: 2*len(encoded) + 2})
+		producer.Produce(first)
+		producer.Produce(newRecord("2"))
+		Expect(producer.Close()).To(Succeed())
+
+		requests := recorded()
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].events).To(HaveLen(1))
+		Expect(requests[1].events).To(HaveLen(1))
+		Expect(ackChan).To(HaveLen(2))
+	})
+
+	It("drops the events larger than a batch", func() {
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString, MaxBatchBytes: 64})
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+
+		Expect(recorded()).To(BeEmpty())
+		Expect(ackChan).To(BeEmpty())
+	})
+
+	It("does not ack rejected batches", func() {
+		responses = append(responses, http.StatusUnauthorized)
+		producer := newProducer(&eventhubs.Config{ConnectionString: connectionString})
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+
+		Expect(recorded()).To(HaveLen(1))
+		Expect(ackChan).To(BeEmpty())
+	})
+
+	It("requires credentials", func() {
+		logger, _ := logrus.NoOpLogger()
+		_, err := eventhubs.NewProducer(&eventhubs.Config{}, "tesla", "eventhubs", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, nil, logger)
+		Expect(err).To(MatchError("eventhubs requires a connection_string or aad credentials"))
+
+		_, err = eventhubs.NewProducer(&eventhubs.Config{ConnectionString: "Endpoint=sb://example.servicebus.windows.net/"}, "tesla", "eventhubs", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, nil, logger)
+		Expect(err).To(MatchError(ContainSubstring("requires Endpoint, SharedAccessKeyName and SharedAccessKey")))
+	})
+})
@@ -22,7 +22,11 @@ type Producer struct {
 	pubsubClient       *pubsub.Client
 	projectID          string
 	namespace          string
+	instance           string
 	metricsCollector   metrics.MetricCollector
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
 	prometheusEnabled  bool
 	logger             *logrus.Logger
 	airbrakeHandler    *airbrake.Handler
@@ -57,7 +61,7 @@ func configurePubsub(projectID string) (*pubsub.Client, error) {
 }
 
 // NewProducer establishes the pubsub connection and define the dispatch method
-func NewProducer(prometheusEnabled bool, projectID string, namespace string, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+func NewProducer(prometheusEnabled bool, projectID string, namespace string, instance string, metricsCollector metrics.MetricCollector, successRatio *metrics.SuccessRatio, latencySLO *metrics.LatencySLO, payloadSize *metrics.PayloadSize, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
 	registerMetricsOnce(metricsCollector)
 	pubsubClient, err := configurePubsub(projectID)
 	if err != nil {
@@ -67,9 +71,13 @@ func NewProducer(prometheusEnabled bool, projectID string, namespace string, met
 	p := &Producer{
 		projectID:          projectID,
 		namespace:          namespace,
+		instance:           instance,
 		pubsubClient:       pubsubClient,
 		prometheusEnabled:  prometheusEnabled,
 		metricsCollector:   metricsCollector,
+		successRatio:       successRatio,
+		latencySLO:         latencySLO,
+		payloadSize:        payloadSize,
 		logger:             logger,
 		airbrakeHandler:    airbrakeHandler,
 		ackChan:            ackChan,
@@ -89,29 +97,37 @@ func (p *Producer) Produce(entry *telemetry.Record) {
 
 	if err != nil {
 		p.ReportError("pubsub_topic_creation_error", err, logInfo)
-		metricsRegistry.notConnectedTotal.Inc(map[string]string{"record_type": entry.TxType})
+		p.successRatio.Failure()
+		metricsRegistry.notConnectedTotal.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 		return
 	}
 
 	if exists, err := pubsubTopic.Exists(ctx); !exists || err != nil {
 		p.ReportError("pubsub_topic_check_error", err, logInfo)
-		metricsRegistry.notConnectedTotal.Inc(map[string]string{"record_type": entry.TxType})
+		p.successRatio.Failure()
+		metricsRegistry.notConnectedTotal.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 		return
 	}
 
-	entry.ProduceTime = time.Now()
+	produceTime := time.Now()
+	entry.SetProduceTime(telemetry.Pubsub, produceTime)
+	data := entry.Payload()
 	result := pubsubTopic.Publish(ctx, &pubsub.Message{
-		Data:       entry.Payload(),
+		Data:       data,
 		Attributes: entry.Metadata(),
 	})
 	if _, err = result.Get(ctx); err != nil {
+		p.successRatio.Failure()
 		p.ReportError("pubsub_err", err, logInfo)
-		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 		return
 	}
+	p.successRatio.Success()
+	p.latencySLO.Observe(time.Since(produceTime))
+	p.payloadSize.Observe(entry.TxType, len(data))
 	p.ProcessReliableAck(entry)
-	metricsRegistry.publishBytesTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
-	metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
+	metricsRegistry.publishBytesTotal.Add(int64(entry.Length()), map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	metricsRegistry.publishCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 
 }
 
@@ -120,12 +136,18 @@ func (p *Producer) Close() error {
 	return p.pubsubClient.Close()
 }
 
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
 // ProcessReliableAck sends to ackChan if reliable ack is configured
 func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
 	_, ok := p.reliableAckTxTypes[entry.TxType]
-	if ok {
+	if ok && !entry.AckedOnReceipt {
 		p.ackChan <- entry
-		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 	}
 }
 
@@ -156,30 +178,30 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 	metricsRegistry.notConnectedTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "pubsub_not_connected_total",
 		Help:   "The number of times pubsub has not been connected when attempting to produce.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "pubsub_publish_total",
 		Help:   "The number of messages published to pubsub.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.publishBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "pubsub_publish_total_bytes",
 		Help:   "The number of bytes published to pubsub.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "pubsub_err",
 		Help:   "The number of errors while publishing to pubsub.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "pubsub_reliable_ack_total",
 		Help:   "The number of records produced to pubsub for which we sent a reliable ACK.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 }
@@ -1,7 +1,9 @@
 package kafka
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,13 +20,24 @@ import (
 type Producer struct {
 	kafkaProducer      *kafka.Producer
 	namespace          string
+	instance           string
 	prometheusEnabled  bool
 	metricsCollector   metrics.MetricCollector
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
+	partitionSkew      *metrics.PartitionSkew
 	logger             *logrus.Logger
 	airbrakeHandler    *airbrake.Handler
 	deliveryChan       chan kafka.Event
 	ackChan            chan (*telemetry.Record)
 	reliableAckTxTypes map[string]interface{}
+
+	// eventsDone is closed once the delivery reports are handled, after the delivery channel is closed
+	eventsDone chan struct{}
+	// stopMetrics stops the report of the producer queue sizes
+	stopMetrics chan struct{}
+	closeOnce   sync.Once
 }
 
 // Metrics stores metrics reported from this package
@@ -38,14 +51,41 @@ type Metrics struct {
 	producerQueueSize adapter.Gauge
 }
 
+const (
+	// metadataTimeoutMs bounds the lookup of the number of partitions of a topic
+	metadataTimeoutMs = 5000
+	// flushPollMs is the longest time a flush waits for the delivery reports before checking its context
+	flushPollMs = 100
+	// closeFlushTimeout bounds the delivery of the records still queued when the producer closes
+	closeFlushTimeout = 5 * time.Second
+)
+
 var (
 	metricsRegistry Metrics
 	metricsOnce     sync.Once
 )
 
+// Options are the dependencies of a Producer
+type Options struct {
+	// Namespace prefixes the topics the records are produced to
+	Namespace string
+	// Instance distinguishes the producer from the other kafka producers in the instance label of its metrics
+	Instance           string
+	PrometheusEnabled  bool
+	MetricsCollector   metrics.MetricCollector
+	SuccessRatio       *metrics.SuccessRatio
+	LatencySLO         *metrics.LatencySLO
+	PayloadSize        *metrics.PayloadSize
+	PartitionSkew      *metrics.PartitionSkew
+	AirbrakeHandler    *airbrake.Handler
+	AckChan            chan (*telemetry.Record)
+	ReliableAckTxTypes map[string]interface{}
+	Logger             *logrus.Logger
+}
+
 // NewProducer establishes the kafka connection and define the dispatch method
-func NewProducer(config *kafka.ConfigMap, namespace string, prometheusEnabled bool, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
-	registerMetricsOnce(metricsCollector)
+func NewProducer(config *kafka.ConfigMap, options Options) (telemetry.Producer, error) {
+	registerMetricsOnce(options.MetricsCollector)
 
 	kafkaProducer, err := kafka.NewProducer(config)
 	if err != nil {
@@ -54,19 +94,28 @@ func NewProducer(config *kafka.ConfigMap, namespace string, prometheusEnabled bo
 
 	producer := &Producer{
 		kafkaProducer:      kafkaProducer,
-		namespace:          namespace,
-		metricsCollector:   metricsCollector,
-		prometheusEnabled:  prometheusEnabled,
-		logger:             logger,
-		airbrakeHandler:    airbrakeHandler,
+		namespace:          options.Namespace,
+		instance:           options.Instance,
+		metricsCollector:   options.MetricsCollector,
+		prometheusEnabled:  options.PrometheusEnabled,
+		successRatio:       options.SuccessRatio,
+		latencySLO:         options.LatencySLO,
+		payloadSize:        options.PayloadSize,
+		partitionSkew:      options.PartitionSkew,
+		logger:             options.Logger,
+		airbrakeHandler:    options.AirbrakeHandler,
 		deliveryChan:       make(chan kafka.Event),
-		ackChan:            ackChan,
-		reliableAckTxTypes: reliableAckTxTypes,
+		ackChan:            options.AckChan,
+		reliableAckTxTypes: options.ReliableAckTxTypes,
+		eventsDone:         make(chan struct{}),
+		stopMetrics:        make(chan struct{}),
 	}
 
+	producer.partitionSkew.WithPartitionCount(producer.partitionCount, metrics.DefaultPartitionCountRefresh)
+
 	go producer.handleProducerEvents()
 	go producer.reportProducerMetrics()
-	producer.logger.ActivityLog("kafka_registered", logrus.LogInfo{"namespace": namespace})
+	producer.logger.ActivityLog("kafka_registered", logrus.LogInfo{"namespace": options.Namespace, "instance": options.Instance})
 	return producer, nil
 }
 
@@ -85,13 +134,15 @@ func (p *Producer) Produce(entry *telemetry.Record) {
 
 	// Note: confluent kafka supports the concept of one channel per connection, so we could add those here and get rid of reliableAckWorkers
 	// ex.: https://github.com/confluentinc/confluent-kafka-go/blob/master/examples/producer_custom_channel_example/producer_custom_channel_example.go#L79
-	entry.ProduceTime = time.Now()
+	entry.SetProduceTime(telemetry.Kafka, time.Now())
 	if err := p.kafkaProducer.Produce(msg, p.deliveryChan); err != nil {
+		p.successRatio.Failure()
 		p.logError(err)
 		return
 	}
-	metricsRegistry.producerCount.Inc(map[string]string{"record_type": entry.TxType})
-	metricsRegistry.bytesTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+	metricsRegistry.producerCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	metricsRegistry.bytesTotal.Add(int64(entry.Length()), map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	p.payloadSize.Observe(entry.TxType, len(msg.Value))
 }
 
 // ReportError to airbrake and logger
@@ -110,13 +161,25 @@ func headersFromRecord(record *telemetry.Record) (headers []kafka.Header) {
 	return
 }
 
+// partitionCount returns the number of partitions of the topic, 0 when unknown
+func (p *Producer) partitionCount(topic string) int {
+	metadata, err := p.kafkaProducer.GetMetadata(&topic, false, metadataTimeoutMs)
+	if err != nil {
+		p.logger.ErrorLog("kafka_metadata_error", err, logrus.LogInfo{"topic": topic})
+		return 0
+	}
+	return len(metadata.Topics[topic].Partitions)
+}
+
 func (p *Producer) handleProducerEvents() {
+	defer close(p.eventsDone)
 	for e := range p.deliveryChan {
 		switch ev := e.(type) {
 		case kafka.Error:
 			p.logError(fmt.Errorf("producer_error %v", ev))
 		case *kafka.Message:
 			if ev.TopicPartition.Error != nil {
+				p.successRatio.Failure()
 				p.logError(fmt.Errorf("topic_partition_error %v", ev))
 				continue
 			}
@@ -125,44 +188,82 @@ func (p *Producer) handleProducerEvents() {
 				p.logError(fmt.Errorf("opaque_record_missing %v", ev))
 				continue
 			}
+			p.successRatio.Success()
+			p.latencySLO.Observe(time.Since(entry.ProduceTime(telemetry.Kafka)))
+			p.partitionSkew.Observe(*ev.TopicPartition.Topic, strconv.Itoa(int(ev.TopicPartition.Partition)))
 			p.ProcessReliableAck(entry)
-			metricsRegistry.producerAckCount.Inc(map[string]string{"record_type": entry.TxType})
-			metricsRegistry.bytesAckTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+			metricsRegistry.producerAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+			metricsRegistry.bytesAckTotal.Add(int64(entry.Length()), map[string]string{"instance": p.instance, "record_type": entry.TxType})
 		default:
 			p.logger.ActivityLog("kafka_event_ignored", logrus.LogInfo{"event": ev.String()})
 		}
 	}
 }
 
-// Close the producer
+// Flush waits for the delivery reports of the records queued to the producer, or the context to be done
+func (p *Producer) Flush(ctx context.Context) error {
+	for p.kafkaProducer.Flush(flushPollMs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close delivers the records queued, closes the producer and waits for the delivery reports to be handled, so that
+// no reliable ack is sent to the ack channel once it returns
 func (p *Producer) Close() error {
-	p.kafkaProducer.Close()
+	p.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+		defer cancel()
+		if err := p.Flush(ctx); err != nil {
+			p.logger.ErrorLog("kafka_close_flush_error", err, logrus.LogInfo{"instance": p.instance, "queued": p.kafkaProducer.Len()})
+		}
+		close(p.stopMetrics)
+		p.partitionSkew.Close()
+		// the producer no longer reports deliveries once closed
+		p.kafkaProducer.Close()
+		close(p.deliveryChan)
+		<-p.eventsDone
+	})
 	return nil
 }
 
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
 // ProcessReliableAck sends to ackChan if reliable ack is configured
 func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
 	_, ok := p.reliableAckTxTypes[entry.TxType]
-	if ok {
+	if ok && !entry.AckedOnReceipt {
 		p.ackChan <- entry
-		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 	}
 }
 
 func (p *Producer) logError(err error) {
 	p.ReportError("kafka_err", err, nil)
-	metricsRegistry.errorCount.Inc(map[string]string{})
+	metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance})
 }
 
 func (p *Producer) reportProducerMetrics() {
 	interval := 5 * time.Second
 	t := time.NewTicker(interval)
-	for range t.C {
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stopMetrics:
+			return
+		case <-t.C:
+		}
 		total := p.kafkaProducer.Len()
 		eventsCount := len(p.kafkaProducer.Events())
-		metricsRegistry.producerQueueSize.Set(int64(total), map[string]string{"type": "total"})
-		metricsRegistry.producerQueueSize.Set(int64(eventsCount), map[string]string{"type": "events"})
-		metricsRegistry.producerQueueSize.Set(int64(total-eventsCount), map[string]string{"type": "buffer"})
+		metricsRegistry.producerQueueSize.Set(int64(total), map[string]string{"instance": p.instance, "type": "total"})
+		metricsRegistry.producerQueueSize.Set(int64(eventsCount), map[string]string{"instance": p.instance, "type": "events"})
+		metricsRegistry.producerQueueSize.Set(int64(total-eventsCount), map[string]string{"instance": p.instance, "type": "buffer"})
 	}
 }
 
@@ -174,42 +275,42 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 	metricsRegistry.producerCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kafka_produce_total",
 		Help:   "The number of records produced to Kafka.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.bytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kafka_produce_total_bytes",
 		Help:   "The number of bytes produced to Kafka.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.producerAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kafka_produce_ack_total",
 		Help:   "The number of records produced to Kafka for which we got an ACK.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kafka_reliable_ack_total",
 		Help:   "The number of records produced to Kafka for which we sent a reliable ACK.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.bytesAckTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kafka_produce_ack_total_bytes",
 		Help:   "The number of bytes produced to Kafka for which we got an ACK.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kafka_err",
 		Help:   "The number of errors while producing to Kafka.",
-		Labels: []string{},
+		Labels: []string{"instance"},
 	})
 
 	metricsRegistry.producerQueueSize = metricsCollector.RegisterGauge(adapter.CollectorOptions{
 		Name:   "kafka_produce_queue_size",
 		Help:   "Total pending messages to produce",
-		Labels: []string{"type"},
+		Labels: []string{"instance", "type"},
 	})
 }
@@ -1,6 +1,7 @@
 package kinesis
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
@@ -21,8 +22,14 @@ type Producer struct {
 	kinesis            *kinesis.Kinesis
 	logger             *logrus.Logger
 	prometheusEnabled  bool
+	instance           string
 	metricsCollector   metrics.MetricCollector
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
+	partitionSkew      *metrics.PartitionSkew
 	streams            map[string]string
+	envelope           bool
 	airbrakeHandler    *airbrake.Handler
 	ackChan            chan (*telemetry.Record)
 	reliableAckTxTypes map[string]interface{}
@@ -41,8 +48,15 @@ var (
 	metricsOnce     sync.Once
 )
 
-// NewProducer configures and tests the kinesis connection
-func NewProducer(maxRetries int, streams map[string]string, overrideHost string, prometheusEnabled bool, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+// envelope wraps a payload with the metadata of its record, the payload is base64 encoded
+type envelope struct {
+	Payload  []byte            `json:"payload"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// NewProducer configures and tests the kinesis connection, payloads are wrapped in an envelope with their
+// metadata when envelope is true
+func NewProducer(maxRetries int, streams map[string]string, overrideHost string, envelope bool, instance string, prometheusEnabled bool, metricsCollector metrics.MetricCollector, successRatio *metrics.SuccessRatio, latencySLO *metrics.LatencySLO, payloadSize *metrics.PayloadSize, partitionSkew *metrics.PartitionSkew, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
 	registerMetricsOnce(metricsCollector)
 
 	config := &aws.Config{
@@ -65,55 +79,92 @@ func NewProducer(maxRetries int, streams map[string]string, overrideHost string,
 		return nil, fmt.Errorf("failed to list streams (test connection): %v", err)
 	}
 
-	return &Producer{
+	producer := &Producer{
 		kinesis:            service,
 		logger:             logger,
 		prometheusEnabled:  prometheusEnabled,
+		instance:           instance,
 		metricsCollector:   metricsCollector,
+		successRatio:       successRatio,
+		latencySLO:         latencySLO,
+		payloadSize:        payloadSize,
+		partitionSkew:      partitionSkew,
 		streams:            streams,
+		envelope:           envelope,
 		airbrakeHandler:    airbrakeHandler,
 		ackChan:            ackChan,
 		reliableAckTxTypes: reliableAckTxTypes,
-	}, nil
+	}
+	producer.partitionSkew.WithPartitionCount(producer.shardCount, metrics.DefaultPartitionCountRefresh)
+	return producer, nil
 }
 
 // Produce asynchronously sends the record payload to kineses
 func (p *Producer) Produce(entry *telemetry.Record) {
-	entry.ProduceTime = time.Now()
+	produceTime := time.Now()
+	entry.SetProduceTime(telemetry.Kinesis, produceTime)
 	stream, ok := p.streams[entry.TxType]
 	if !ok {
+		p.successRatio.Failure()
 		p.ReportError("kinesis_produce_stream_not_configured", nil, logrus.LogInfo{"record_type": entry.TxType})
 		return
 	}
+	data, err := p.data(entry)
+	if err != nil {
+		p.successRatio.Failure()
+		p.ReportError("kinesis_envelope_error", err, logrus.LogInfo{"record_type": entry.TxType})
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+		return
+	}
 	kinesisRecord := &kinesis.PutRecordInput{
-		Data:         entry.Payload(),
+		Data:         data,
 		StreamName:   aws.String(stream),
 		PartitionKey: aws.String(entry.Vin),
 	}
 
 	kinesisRecordOutput, err := p.kinesis.PutRecord(kinesisRecord)
 	if err != nil {
+		p.successRatio.Failure()
 		p.ReportError("kinesis_err", err, nil)
-		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 		return
 	}
+	p.successRatio.Success()
+	p.latencySLO.Observe(time.Since(produceTime))
+	p.payloadSize.Observe(entry.TxType, len(kinesisRecord.Data))
+	p.partitionSkew.Observe(stream, aws.StringValue(kinesisRecordOutput.ShardId))
 	p.ProcessReliableAck(entry)
 	p.logger.Log(logrus.DEBUG, "kinesis_message_dispatched", logrus.LogInfo{"vin": entry.Vin, "record_type": entry.TxType, "txid": entry.Txid, "shard_id": *kinesisRecordOutput.ShardId, "sequence_number": *kinesisRecordOutput.SequenceNumber})
-	metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
-	metricsRegistry.byteTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+	metricsRegistry.publishCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	metricsRegistry.byteTotal.Add(int64(entry.Length()), map[string]string{"instance": p.instance, "record_type": entry.TxType})
+}
+
+// data returns the data of the kinesis record of the entry
+func (p *Producer) data(entry *telemetry.Record) ([]byte, error) {
+	if !p.envelope {
+		return entry.Payload(), nil
+	}
+	return json.Marshal(envelope{Payload: entry.Payload(), Metadata: entry.Metadata()})
 }
 
 // Close the producer
 func (p *Producer) Close() error {
+	p.partitionSkew.Close()
 	return nil
 }
 
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
 // ProcessReliableAck sends to ackChan if reliable ack is configured
 func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
 	_, ok := p.reliableAckTxTypes[entry.TxType]
-	if ok {
+	if ok && !entry.AckedOnReceipt {
 		p.ackChan <- entry
-		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 	}
 }
 
@@ -131,24 +182,34 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kinesis_err",
 		Help:   "The number of errors while producing to Kinesis.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kinesis_publish_total",
 		Help:   "The number of messages published to Kinesis.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.byteTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kinesis_publish_total_bytes",
 		Help:   "The number of bytes published to Kinesis.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "kinesis_reliable_ack_total",
 		Help:   "The number of records produced to Kinesis for which we sent a reliable ACK.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 }
+
+// shardCount returns the number of open shards of the stream, 0 when unknown
+func (p *Producer) shardCount(stream string) int {
+	output, err := p.kinesis.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String(stream)})
+	if err != nil {
+		p.logger.ErrorLog("kinesis_describe_stream_error", err, logrus.LogInfo{"stream": stream})
+		return 0
+	}
+	return int(aws.Int64Value(output.StreamDescriptionSummary.OpenShardCount))
+}
@@ -0,0 +1,417 @@
+package pulsar
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/batch"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// DefaultTenant is the tenant of the topics when not configured
+	DefaultTenant = "public"
+	// DefaultNamespace is the Pulsar namespace of the topics when not configured
+	DefaultNamespace = "default"
+	// DefaultBatchSize is the number of messages per publish when not configured
+	DefaultBatchSize = 100
+	// DefaultFlushInterval is the longest time messages wait for their batch when not configured
+	DefaultFlushInterval = time.Second
+	// DefaultMaxRetries is the number of retries of transient publish errors when not configured
+	DefaultMaxRetries = 3
+
+	retryBackoff   = 100 * time.Millisecond
+	requestTimeout = 30 * time.Second
+)
+
+// PartitionKeyStrategy selects the key routing the messages to the partitions of their topic
+type PartitionKeyStrategy string
+
+const (
+	// PartitionKeyDeviceID keeps the messages of a device in order on one partition
+	PartitionKeyDeviceID PartitionKeyStrategy = "device_id"
+	// PartitionKeyTxid spreads the messages of a device across the partitions
+	PartitionKeyTxid PartitionKeyStrategy = "txid"
+	// PartitionKeyNone lets the broker balance the messages across the partitions
+	PartitionKeyNone PartitionKeyStrategy = "none"
+)
+
+// Config contains the data necessary to configure a Pulsar producer.
+type Config struct {
+	// ServiceURL is the http(s) url of the web service of the brokers, such as http://pulsar:8080.
+	ServiceURL string `json:"service_url"`
+
+	// Tenant is the tenant of the topics.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Namespace is the Pulsar namespace of the topics.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Topics maps record types to their topic, records are published to the <namespace>_<record type> topic otherwise.
+	Topics map[string]string `json:"topics,omitempty"`
+
+	// Token is the JWT authenticating the producer, the brokers must accept anonymous publishes without it.
+	Token string `json:"token,omitempty"`
+
+	// ProducerName identifies the producer to the brokers.
+	ProducerName string `json:"producer_name,omitempty"`
+
+	// PartitionKey is the partition key strategy: device_id (default), txid or none.
+	PartitionKey PartitionKeyStrategy `json:"partition_key,omitempty"`
+
+	// BatchSize is the number of messages per publish.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// FlushIntervalMs is the longest time messages wait for their batch to fill up.
+	FlushIntervalMs int `json:"flush_interval_ms,omitempty"`
+
+	// QueueSize is the number of messages waiting for their publish before the new ones are dropped.
+	QueueSize int `json:"queue_size,omitempty"`
+
+	// MaxRetries is the number of retries of publishes failing with transient errors.
+	MaxRetries *int `json:"max_retries,omitempty"`
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	errorCount       adapter.Counter
+	producerCount    adapter.Counter
+	bytesTotal       adapter.Counter
+	producerAckCount adapter.Counter
+	bytesAckTotal    adapter.Counter
+	reliableAckCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// message is a message of a publish, the payload is the base64 encoded payload of the record
+type message struct {
+	Key        string            `json:"key,omitempty"`
+	Payload    string            `json:"payload"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type publishRequest struct {
+	ProducerName string    `json:"producerName,omitempty"`
+	Messages     []message `json:"messages"`
+}
+
+// publishResponse holds the result of each message of a publish, in order
+type publishResponse struct {
+	MessagePublishResults []struct {
+		MessageID string `json:"messageId"`
+		ErrorCode int    `json:"errorCode"`
+		Error     string `json:"error"`
+	} `json:"messagePublishResults"`
+}
+
+// Producer implements the telemetry.Producer interface by publishing the records to Pulsar in batches
+// through the REST producer of the brokers
+type Producer struct {
+	client             *http.Client
+	endpoint           string
+	config             *Config
+	namespace          string
+	instance           string
+	maxRetries         int
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+
+	batcher *batch.Batcher[message]
+}
+
+// NewProducer creates a Pulsar producer with the given config.
+func NewProducer(config *Config, namespace string, instance string, metricsCollector metrics.MetricCollector, successRatio *metrics.SuccessRatio, latencySLO *metrics.LatencySLO, payloadSize *metrics.PayloadSize, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+	switch config.PartitionKey {
+	case "", PartitionKeyDeviceID, PartitionKeyTxid, PartitionKeyNone:
+	default:
+		return nil, fmt.Errorf("pulsar partition_key %s should be one of %s, %s or %s", config.PartitionKey, PartitionKeyDeviceID, PartitionKeyTxid, PartitionKeyNone)
+	}
+	serviceURL, err := url.Parse(config.ServiceURL)
+	if err != nil || (serviceURL.Scheme != "http" && serviceURL.Scheme != "https") || serviceURL.Host == "" {
+		return nil, fmt.Errorf("pulsar service_url %q should be the http(s) url of the brokers web service", config.ServiceURL)
+	}
+
+	tenant := config.Tenant
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	pulsarNamespace := config.Namespace
+	if pulsarNamespace == "" {
+		pulsarNamespace = DefaultNamespace
+	}
+	p := &Producer{
+		client:             &http.Client{Timeout: requestTimeout},
+		endpoint:           strings.TrimSuffix(config.ServiceURL, "/") + "/topics/persistent/" + url.PathEscape(tenant) + "/" + url.PathEscape(pulsarNamespace),
+		config:             config,
+		namespace:          namespace,
+		instance:           instance,
+		maxRetries:         DefaultMaxRetries,
+		successRatio:       successRatio,
+		latencySLO:         latencySLO,
+		payloadSize:        payloadSize,
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+	}
+	if config.MaxRetries != nil {
+		p.maxRetries = *config.MaxRetries
+	}
+	options := batch.Options{
+		MaxItems:      config.BatchSize,
+		FlushInterval: time.Duration(config.FlushIntervalMs) * time.Millisecond,
+		QueueSize:     config.QueueSize,
+	}
+	if options.MaxItems <= 0 {
+		options.MaxItems = DefaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	p.batcher = batch.New(options, func(record *telemetry.Record) string { return p.topic(record.TxType) }, p.publish)
+	p.logger.ActivityLog("pulsar_registered", logrus.LogInfo{"endpoint": p.endpoint, "namespace": namespace})
+	return p, nil
+}
+
+// Produce queues the record for the next publish to its topic, the record is dropped when the queue is full
+func (p *Producer) Produce(entry *telemetry.Record) {
+	queuedAt := time.Now()
+	entry.SetProduceTime(telemetry.Pulsar, queuedAt)
+	item := batch.Item[message]{Record: entry, QueuedAt: queuedAt, Value: message{
+		Key:        p.partitionKey(entry),
+		Payload:    base64.StdEncoding.EncodeToString(entry.Payload()),
+		Properties: entry.Metadata(),
+	}}
+	if err := p.batcher.Add(item); err != nil {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType, "reason": err.Error()})
+		return
+	}
+	metricsRegistry.producerCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	metricsRegistry.bytesTotal.Add(int64(entry.Length()), map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	p.payloadSize.Observe(entry.TxType, len(item.Value.Payload))
+}
+
+func (p *Producer) partitionKey(entry *telemetry.Record) string {
+	switch p.config.PartitionKey {
+	case PartitionKeyTxid:
+		return entry.Txid
+	case PartitionKeyNone:
+		return ""
+	default:
+		return entry.Vin
+	}
+}
+
+func (p *Producer) topic(recordType string) string {
+	if topic, ok := p.config.Topics[recordType]; ok {
+		return topic
+	}
+	return telemetry.BuildTopicName(p.namespace, recordType)
+}
+
+// publish sends the batch to the topic, retrying transient errors and the messages the brokers failed to persist.
+// The records are acked once the brokers acknowledged their message
+func (p *Producer) publish(topic string, items []batch.Item[message]) {
+	for attempt := 0; ; attempt++ {
+		failed, err := p.post(topic, items)
+		if err == nil && len(failed) == 0 {
+			return
+		}
+		reason := "request"
+		if err == nil {
+			err = fmt.Errorf("pulsar failed to persist %d messages", len(failed))
+			items = failed
+			reason = "persist"
+		}
+		if attempt >= p.maxRetries || !transient(err) {
+			p.fail(topic, items, reason, err)
+			return
+		}
+		time.Sleep(retryBackoff << attempt)
+	}
+}
+
+// post publishes the batch and acks its acknowledged records, it returns the messages the brokers failed to persist
+func (p *Producer) post(topic string, items []batch.Item[message]) ([]batch.Item[message], error) {
+	request := publishRequest{ProducerName: p.config.ProducerName, Messages: make([]message, 0, len(items))}
+	for _, item := range items {
+		request.Messages = append(request.Messages, item.Value)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, p.endpoint+"/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if p.config.Token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+p.config.Token)
+	}
+
+	response, err := p.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, &statusError{code: response.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	var results publishResponse
+	if err := json.NewDecoder(response.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	if len(results.MessagePublishResults) != len(items) {
+		return nil, fmt.Errorf("pulsar returned %d results for %d messages", len(results.MessagePublishResults), len(items))
+	}
+
+	var failed []batch.Item[message]
+	for i, result := range results.MessagePublishResults {
+		if result.ErrorCode != 0 {
+			p.logger.Log(logrus.DEBUG, "pulsar_message_error", logrus.LogInfo{"topic": topic, "txid": items[i].Record.Txid, "error_code": result.ErrorCode, "error": result.Error})
+			failed = append(failed, items[i])
+			continue
+		}
+		p.acked(items[i])
+	}
+	p.logger.Log(logrus.DEBUG, "pulsar_batch_dispatched", logrus.LogInfo{"topic": topic, "messages": len(items) - len(failed)})
+	return failed, nil
+}
+
+func (p *Producer) acked(item batch.Item[message]) {
+	record := item.Record
+	p.successRatio.Success()
+	p.latencySLO.Observe(time.Since(item.QueuedAt))
+	p.ProcessReliableAck(record)
+	metricsRegistry.producerAckCount.Inc(map[string]string{"instance": p.instance, "record_type": record.TxType})
+	metricsRegistry.bytesAckTotal.Add(int64(record.Length()), map[string]string{"instance": p.instance, "record_type": record.TxType})
+}
+
+func (p *Producer) fail(topic string, items []batch.Item[message], reason string, err error) {
+	for _, item := range items {
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": item.Record.TxType, "reason": reason})
+	}
+	p.ReportError("pulsar_publish_error", err, logrus.LogInfo{"topic": topic, "messages": len(items), "reason": reason})
+}
+
+// statusError is a publish rejected by the brokers
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("pulsar responded %d: %s", e.code, e.message)
+}
+
+// transient returns true for errors worth retrying: throttling, server errors, network errors and messages
+// the brokers failed to persist
+func transient(err error) bool {
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.code == http.StatusTooManyRequests || statusErr.code >= http.StatusInternalServerError
+}
+
+// Flush sends the pending messages
+func (p *Producer) Flush(ctx context.Context) error {
+	return p.batcher.Flush(ctx)
+}
+
+// Close publishes the pending messages
+func (p *Producer) Close() error {
+	p.batcher.Close()
+	return nil
+}
+
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok && !entry.AckedOnReceipt {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.producerCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pulsar_produce_total",
+		Help:   "The number of records produced to Pulsar.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.bytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pulsar_produce_total_bytes",
+		Help:   "The number of bytes produced to Pulsar.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.producerAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pulsar_produce_ack_total",
+		Help:   "The number of records produced to Pulsar for which we got an ACK.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.bytesAckTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pulsar_produce_ack_total_bytes",
+		Help:   "The number of bytes produced to Pulsar for which we got an ACK.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pulsar_reliable_ack_total",
+		Help:   "The number of records produced to Pulsar for which we sent a reliable ACK.",
+		Labels: []string{"instance", "record_type"},
+	})
+
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pulsar_err",
+		Help:   "The number of records which could not be produced to Pulsar.",
+		Labels: []string{"instance", "record_type", "reason"},
+	})
+}
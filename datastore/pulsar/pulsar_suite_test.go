@@ -0,0 +1,13 @@
+package pulsar_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPulsar(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pulsar Suite Tests")
+}
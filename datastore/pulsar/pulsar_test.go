@@ -0,0 +1,201 @@
+package pulsar_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/pulsar"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type message struct {
+	Key        string
+	Payload    string
+	Properties map[string]string
+}
+
+type publishRequest struct {
+	path          string
+	authorization string
+	producerName  string
+	messages      []message
+}
+
+var _ = Describe("Producer", func() {
+	var (
+		mutex    sync.Mutex
+		requests []publishRequest
+		// responses are the status and error code of each message of the next publishes
+		responses []func() (int, []int)
+		server    *httptest.Server
+		ackChan   chan *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		responses = nil
+		ackChan = make(chan *telemetry.Record, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+			var body struct {
+				ProducerName string    `json:"producerName"`
+				Messages     []message `json:"messages"`
+			}
+			Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+
+			mutex.Lock()
+			requests = append(requests, publishRequest{path: r.URL.Path, authorization: r.Header.Get("Authorization"), producerName: body.ProducerName, messages: body.Messages})
+			status, errorCodes := http.StatusOK, make([]int, len(body.Messages))
+			if len(responses) > 0 {
+				status, errorCodes = responses[0]()
+				responses = responses[1:]
+			}
+			mutex.Unlock()
+
+			w.WriteHeader(status)
+			if status != http.StatusOK {
+				return
+			}
+			results := make([]map[string]interface{}, 0, len(errorCodes))
+			for i, code := range errorCodes {
+				results = append(results, map[string]interface{}{"messageId": fmt.Sprintf("1:%d:-1", i), "errorCode": code})
+			}
+			Expect(json.NewEncoder(w).Encode(map[string]interface{}{"messagePublishResults": results})).To(Succeed())
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	newProducer := func(config *pulsar.Config) telemetry.Producer {
+		config.ServiceURL = server.URL
+		config.BatchSize = 2
+		config.FlushIntervalMs = 10
+		logger, _ := logrus.NoOpLogger()
+		producer, err := pulsar.NewProducer(config, "tesla", "pulsar", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"connectivity": true}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+		return producer
+	}
+
+	newRecord := func(txid string) *telemetry.Record {
+		payload, err := proto.Marshal(&protos.VehicleConnectivity{Vin: "42", ConnectionId: txid, CreatedAt: timestamppb.Now()})
+		Expect(err).NotTo(HaveOccurred())
+		streamMessage := messages.StreamMessage{TXID: []byte(txid), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("connectivity"), Payload: payload}
+		message, err := streamMessage.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{"connectivity": nil}, logger)
+		record, err := telemetry.NewRecord(serializer, message, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	recorded := func() []publishRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]publishRequest(nil), requests...)
+	}
+
+	It("publishes batches of messages keyed by device id", func() {
+		producer := newProducer(&pulsar.Config{Token: "jwt", ProducerName: "fleet-telemetry"})
+		first := newRecord("1")
+		producer.Produce(first)
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded).Should(HaveLen(1))
+		request := recorded()[0]
+		Expect(request.path).To(Equal("/topics/persistent/public/default/tesla_connectivity"))
+		Expect(request.authorization).To(Equal("Bearer jwt"))
+		Expect(request.producerName).To(Equal("fleet-telemetry"))
+		Expect(request.messages).To(HaveLen(2))
+		Expect(request.messages[0].Key).To(Equal("42"))
+		Expect(request.messages[0].Properties).To(HaveKeyWithValue("txid", "1"))
+		Expect(request.messages[0].Payload).To(Equal(base64.StdEncoding.EncodeToString(first.Payload())))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("publishes the records to the topics of their record type", func() {
+		producer := newProducer(&pulsar.Config{Tenant: "fleet", Namespace: "vehicles", Topics: map[string]string{"connectivity": "connections"}, PartitionKey: pulsar.PartitionKeyNone})
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+
+		requests := recorded()
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].path).To(Equal("/topics/persistent/fleet/vehicles/connections"))
+		Expect(requests[0].authorization).To(BeEmpty())
+		Expect(requests[0].messages[0].Key).To(BeEmpty())
+	})
+
+	It("retries transient errors", func() {
+		responses = append(responses, func() (int, []int) { return http.StatusServiceUnavailable, nil })
+		producer := newProducer(&pulsar.Config{})
+		producer.Produce(newRecord("1"))
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded, time.Second).Should(HaveLen(2))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("acks the persisted messages and retries the others", func() {
+		responses = append(responses, func() (int, []int) { return http.StatusOK, []int{0, 2} })
+		producer := newProducer(&pulsar.Config{})
+		producer.Produce(newRecord("1"))
+		producer.Produce(newRecord("2"))
+
+		Eventually(recorded, time.Second).Should(HaveLen(2))
+		retry := recorded()[1]
+		Expect(retry.messages).To(HaveLen(1))
+		Expect(retry.messages[0].Properties).To(HaveKeyWithValue("txid", "2"))
+		Eventually(ackChan).Should(HaveLen(2))
+	})
+
+	It("drops the records produced while the queue is full", func() {
+		release := make(chan struct{})
+		responses = append(responses, func() (int, []int) {
+			<-release
+			return http.StatusOK, []int{0, 0}
+		})
+		producer := newProducer(&pulsar.Config{QueueSize: 1})
+		for i := 0; i < 10; i++ {
+			producer.Produce(newRecord(fmt.Sprint(i)))
+		}
+		close(release)
+		Expect(producer.Close()).To(Succeed())
+
+		Expect(len(ackChan)).To(BeNumerically("<", 10))
+	})
+
+	It("does not ack rejected publishes", func() {
+		responses = append(responses, func() (int, []int) { return http.StatusUnauthorized, nil })
+		producer := newProducer(&pulsar.Config{})
+		producer.Produce(newRecord("1"))
+		Expect(producer.Close()).To(Succeed())
+
+		Expect(recorded()).To(HaveLen(1))
+		Expect(ackChan).To(BeEmpty())
+	})
+
+	It("requires the url of the brokers web service", func() {
+		logger, _ := logrus.NoOpLogger()
+		_, err := pulsar.NewProducer(&pulsar.Config{ServiceURL: "pulsar://pulsar:6650"}, "tesla", "pulsar", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, nil, logger)
+		Expect(err).To(MatchError(`pulsar service_url "pulsar://pulsar:6650" should be the http(s) url of the brokers web service`))
+
+		_, err = pulsar.NewProducer(&pulsar.Config{ServiceURL: server.URL, PartitionKey: "vin"}, "tesla", "pulsar", noop.NewCollector(), nil, nil, nil, airbrake.NewAirbrakeHandler(nil), ackChan, nil, logger)
+		Expect(err).To(MatchError(ContainSubstring("pulsar partition_key vin should be one of")))
+	})
+})
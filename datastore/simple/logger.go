@@ -68,6 +68,12 @@ func (p *Producer) recordToLogMap(record *telemetry.Record, vin string) (interfa
 		return errorMaps, nil
 	case *protos.VehicleConnectivity:
 		return transformers.VehicleConnectivityToMap(payload), nil
+	case *protos.VehicleConnectivityBatch:
+		eventMaps := make([]map[string]interface{}, len(payload.Events))
+		for i, event := range payload.Events {
+			eventMaps[i] = transformers.VehicleConnectivityToMap(event)
+		}
+		return eventMaps, nil
 	default:
 		return nil, fmt.Errorf("unknown txType: %s", record.TxType)
 	}
@@ -12,5 +12,6 @@ func VehicleConnectivityToMap(vehicleConnectivity *protos.VehicleConnectivity) m
 		"NetworkInterface": vehicleConnectivity.GetNetworkInterface(),
 		"Status":           vehicleConnectivity.GetStatus().String(),
 		"CreatedAt":        vehicleConnectivity.CreatedAt.AsTime().Unix(),
+		"DisconnectReason": vehicleConnectivity.GetDisconnectReason(),
 	}
 }
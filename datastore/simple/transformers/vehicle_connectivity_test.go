@@ -24,18 +24,20 @@ var _ = Describe("VehicleConnectivity", func() {
 				ConnectionId:     "connection1",
 				NetworkInterface: "wifi",
 				CreatedAt:        timestamppb.New(time.Now()),
-				Status:           protos.ConnectivityEvent_CONNECTED,
+				Status:           protos.ConnectivityEvent_DISCONNECTED,
+				DisconnectReason: "client_closed",
 			}
 		})
 
 		It("includes all expected data", func() {
 			result := transformers.VehicleConnectivityToMap(connectivity)
-			Expect(result).To(HaveLen(5))
+			Expect(result).To(HaveLen(6))
 			Expect(result["Vin"]).To(Equal("Vin1"))
 			Expect(result["ConnectionID"]).To(Equal("connection1"))
 			Expect(result["NetworkInterface"]).To(Equal("wifi"))
 			Expect(result["CreatedAt"]).To(BeNumerically("~", time.Now().Unix(), 1))
-			Expect(result["Status"]).To(Equal("CONNECTED"))
+			Expect(result["Status"]).To(Equal("DISCONNECTED"))
+			Expect(result["DisconnectReason"]).To(Equal("client_closed"))
 		})
 
 	})
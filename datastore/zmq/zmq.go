@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/pebbe/zmq4"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -61,8 +62,12 @@ const MonitorSocketAddr = "inproc://zmq_socket_monitor.rep"
 // bound zmq socket.
 type Producer struct {
 	namespace          string
+	instance           string
 	ctx                context.Context
 	sock               *zmq4.Socket
+	successRatio       *metrics.SuccessRatio
+	latencySLO         *metrics.LatencySLO
+	payloadSize        *metrics.PayloadSize
 	logger             *logrus.Logger
 	airbrakeHandler    *airbrake.Handler
 	ackChan            chan (*telemetry.Record)
@@ -74,15 +79,21 @@ func (p *Producer) Produce(rec *telemetry.Record) {
 	if p.ctx.Err() != nil {
 		return
 	}
+	produceTime := time.Now()
+	rec.SetProduceTime(telemetry.ZMQ, produceTime)
 	nBytes, err := p.sock.SendMessage(telemetry.BuildTopicName(p.namespace, rec.TxType), rec.Payload())
 	if err != nil {
-		metricsRegistry.errorCount.Inc(map[string]string{"record_type": rec.TxType})
+		p.successRatio.Failure()
+		metricsRegistry.errorCount.Inc(map[string]string{"instance": p.instance, "record_type": rec.TxType})
 		p.ReportError("zmq_dispatch_error", err, nil)
 		return
 	}
+	p.successRatio.Success()
+	p.latencySLO.Observe(time.Since(produceTime))
+	p.payloadSize.Observe(rec.TxType, nBytes)
 	p.ProcessReliableAck(rec)
-	metricsRegistry.byteTotal.Add(int64(nBytes), map[string]string{"record_type": rec.TxType})
-	metricsRegistry.publishCount.Inc(map[string]string{"record_type": rec.TxType})
+	metricsRegistry.byteTotal.Add(int64(nBytes), map[string]string{"instance": p.instance, "record_type": rec.TxType})
+	metricsRegistry.publishCount.Inc(map[string]string{"instance": p.instance, "record_type": rec.TxType})
 }
 
 // ReportError to airbrake and logger
@@ -102,18 +113,24 @@ func (p *Producer) Close() error {
 	return nil
 }
 
+// ReliableAcks returns true if the producer sends the reliable acks of the record type
+func (p *Producer) ReliableAcks(recordType string) bool {
+	_, ok := p.reliableAckTxTypes[recordType]
+	return ok
+}
+
 // ProcessReliableAck sends to ackChan if reliable ack is configured
 func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
 	_, ok := p.reliableAckTxTypes[entry.TxType]
-	if ok {
+	if ok && !entry.AckedOnReceipt {
 		p.ackChan <- entry
-		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"instance": p.instance, "record_type": entry.TxType})
 	}
 }
 
 // NewProducer creates a ZMQProducer with the given config.
-func NewProducer(ctx context.Context, config *Config, metrics metrics.MetricCollector, namespace string, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (producer telemetry.Producer, err error) {
-	registerMetricsOnce(metrics)
+func NewProducer(ctx context.Context, config *Config, metricsCollector metrics.MetricCollector, successRatio *metrics.SuccessRatio, latencySLO *metrics.LatencySLO, payloadSize *metrics.PayloadSize, namespace string, instance string, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (producer telemetry.Producer, err error) {
+	registerMetricsOnce(metricsCollector)
 	sock, err := zmq4.NewSocket(zmq4.PUB)
 	if err != nil {
 		return
@@ -177,8 +194,12 @@ func NewProducer(ctx context.Context, config *Config, metrics metrics.MetricColl
 
 	return &Producer{
 		namespace:          namespace,
+		instance:           instance,
 		ctx:                ctx,
 		sock:               sock,
+		successRatio:       successRatio,
+		latencySLO:         latencySLO,
+		payloadSize:        payloadSize,
 		logger:             logger,
 		airbrakeHandler:    airbrakeHandler,
 		ackChan:            ackChan,
@@ -229,25 +250,25 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "zmq_err",
 		Help:   "The number of errors while producing to ZMQ.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "zmq_publish_total",
 		Help:   "The number of messages published to ZMQ.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.byteTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "zmq_publish_total_bytes",
 		Help:   "The number of bytes published to ZMQ.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 
 	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "zmq_reliable_ack_total",
 		Help:   "The number of records produced to ZMQ for which we sent a reliable ACK.",
-		Labels: []string{"record_type"},
+		Labels: []string{"instance", "record_type"},
 	})
 }
 
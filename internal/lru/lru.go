@@ -0,0 +1,75 @@
+// Package lru provides a map bounded to a number of entries, evicting the least recently used entry when full
+package lru
+
+import "container/list"
+
+// Cache is a map of at most maxEntries entries, it is not safe for concurrent use
+type Cache[K comparable, V any] struct {
+	maxEntries int
+	entries    map[K]*list.Element
+	order      *list.List
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New returns an empty cache holding at most maxEntries entries
+func New[K comparable, V any](maxEntries int) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxEntries: maxEntries,
+		entries:    make(map[K]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get returns the value of the key and marks it as the most recently used
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*entry[K, V]).value, true
+}
+
+// Peek returns the value of the key without changing its recency
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return element.Value.(*entry[K, V]).value, true
+}
+
+// Add sets the value of the key and marks it as the most recently used, the least recently used entry
+// is evicted when the cache is full
+func (c *Cache[K, V]) Add(key K, value V) {
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	for c.order.Len() > 0 && c.order.Len() >= c.maxEntries {
+		c.Remove(c.order.Back().Value.(*entry[K, V]).key)
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+}
+
+// Remove drops the key from the cache
+func (c *Cache[K, V]) Remove(key K) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.order.Remove(element)
+	delete(c.entries, key)
+}
+
+// Len returns the number of entries in the cache
+func (c *Cache[K, V]) Len() int {
+	return c.order.Len()
+}
@@ -0,0 +1,64 @@
+package lru_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/internal/lru"
+)
+
+var _ = Describe("Cache", func() {
+	It("returns the values added", func() {
+		cache := lru.New[string, int](2)
+		cache.Add("a", 1)
+		cache.Add("a", 2)
+
+		value, ok := cache.Get("a")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal(2))
+		Expect(cache.Len()).To(Equal(1))
+
+		_, ok = cache.Get("b")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("evicts the least recently used entry when full", func() {
+		cache := lru.New[string, int](2)
+		cache.Add("a", 1)
+		cache.Add("b", 2)
+		_, _ = cache.Get("a")
+		cache.Add("c", 3)
+
+		Expect(cache.Len()).To(Equal(2))
+		_, ok := cache.Get("b")
+		Expect(ok).To(BeFalse())
+		_, ok = cache.Get("a")
+		Expect(ok).To(BeTrue())
+		_, ok = cache.Get("c")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("peeks without changing the recency of entries", func() {
+		cache := lru.New[string, int](2)
+		cache.Add("a", 1)
+		cache.Add("b", 2)
+		value, ok := cache.Peek("a")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal(1))
+		cache.Add("c", 3)
+
+		_, ok = cache.Peek("a")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("removes entries", func() {
+		cache := lru.New[string, int](2)
+		cache.Add("a", 1)
+		cache.Remove("a")
+		cache.Remove("missing")
+
+		_, ok := cache.Get("a")
+		Expect(ok).To(BeFalse())
+		Expect(cache.Len()).To(BeZero())
+	})
+})
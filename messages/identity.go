@@ -74,9 +74,31 @@ var (
 	}
 )
 
+const (
+	// SANTypeDNS reads the device id from the DNS names of the certificate
+	SANTypeDNS = "dns"
+	// SANTypeURI reads the device id from the URIs of the certificate
+	SANTypeURI = "uri"
+	// SANTypeEmail reads the device id from the email addresses of the certificate
+	SANTypeEmail = "email"
+)
+
+// DeviceIDSource selects the subject alternative name the device id is read from, the first one of the type
+// starting with the prefix is used with the prefix stripped
+type DeviceIDSource struct {
+	SANType string
+	Prefix  string
+}
+
 // CreateIdentityFromCert given the X509 Cert return a deviceID
 func CreateIdentityFromCert(fullCert *x509.Certificate) (clientType, deviceID string, err error) {
-	deviceID = strings.Replace(fullCert.Subject.CommonName, ".", "-", -1)
+	return CreateIdentityFromCertSource(fullCert, nil)
+}
+
+// CreateIdentityFromCertSource given the X509 Cert return a deviceID read from the source, falling back to the
+// subject common name when the source is nil or the certificate has no matching subject alternative name
+func CreateIdentityFromCertSource(fullCert *x509.Certificate, source *DeviceIDSource) (clientType, deviceID string, err error) {
+	deviceID = DeviceIDFromCert(fullCert, source)
 	if _, ok := knownOIDIssuers[fullCert.Issuer.CommonName]; ok {
 		return createIdentifyFromOID(fullCert, deviceID)
 	}
@@ -95,6 +117,41 @@ func CreateIdentityFromCert(fullCert *x509.Certificate) (clientType, deviceID st
 	return clientType, deviceID, nil
 }
 
+// DeviceIDFromCert returns the device id read from the source, or from the subject common name when the source
+// is nil or the certificate has no matching subject alternative name
+func DeviceIDFromCert(fullCert *x509.Certificate, source *DeviceIDSource) string {
+	name := fullCert.Subject.CommonName
+	if san, ok := source.subjectAltName(fullCert); ok {
+		name = san
+	}
+	return strings.Replace(name, ".", "-", -1)
+}
+
+// subjectAltName returns the first subject alternative name of the type starting with the prefix, stripped of it
+func (source *DeviceIDSource) subjectAltName(fullCert *x509.Certificate) (string, bool) {
+	if source == nil {
+		return "", false
+	}
+
+	var names []string
+	switch source.SANType {
+	case SANTypeDNS:
+		names = fullCert.DNSNames
+	case SANTypeURI:
+		for _, uri := range fullCert.URIs {
+			names = append(names, uri.String())
+		}
+	case SANTypeEmail:
+		names = fullCert.EmailAddresses
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, source.Prefix) && len(name) > len(source.Prefix) {
+			return strings.TrimPrefix(name, source.Prefix), true
+		}
+	}
+	return "", false
+}
+
 func createIdentifyFromOID(fullCert *x509.Certificate, deviceID string) (string, string, error) {
 	for _, oid := range fullCert.UnknownExtKeyUsage {
 		oidStr := oid.String()
@@ -0,0 +1,17 @@
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+// Histogram for Prometheus
+type Histogram struct {
+	histogram *prometheus.HistogramVec
+}
+
+// Observe records a new value
+func (c *Histogram) Observe(n int64, labels adapter.Labels) {
+	l := prometheus.Labels(labels)
+	c.histogram.With(l).Observe(float64(n))
+}
@@ -75,6 +75,24 @@ func (c *Collector) RegisterTimer(options adapter.CollectorOptions) adapter.Time
 	}
 }
 
+// RegisterHistogram registers a new histogram with Prometheus
+func (c *Collector) RegisterHistogram(options adapter.CollectorOptions) adapter.Histogram {
+	histogram := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    options.Name,
+			Help:    options.Help,
+			Buckets: options.Buckets,
+		},
+		options.Labels,
+	)
+
+	c.register(histogram)
+
+	return &Histogram{
+		histogram,
+	}
+}
+
 // Shutdown unregisters and safely shuts down
 func (c *Collector) Shutdown() {
 	close(c.stopChan)
@@ -115,6 +115,12 @@ var _ = Describe("Prometheus Metric Adapter", Ordered, func() {
 			metrics = getMetrics()
 			Expect(metrics).To(ContainSubstring("increment_counter 2"))
 		})
+
+		It("panics when registered twice", func() {
+			options := adapter.CollectorOptions{Name: "duplicate_counter", Help: "help text", Labels: []string{}}
+			metricCollector.RegisterCounter(options)
+			Expect(func() { prometheus.NewCollector().RegisterCounter(options) }).To(Panic())
+		})
 	})
 
 	Context("gauge", func() {
@@ -238,6 +244,22 @@ var _ = Describe("Prometheus Metric Adapter", Ordered, func() {
 		})
 	})
 
+	Context("histogram", func() {
+		It("reports the buckets", func() {
+			metricCollector.RegisterHistogram(adapter.CollectorOptions{
+				Name:    "histogram_with_label",
+				Help:    "help text",
+				Labels:  []string{"key"},
+				Buckets: []float64{10, 100},
+			}).Observe(50, map[string]string{"key": "value"})
+
+			metrics := getMetrics()
+			Expect(metrics).To(ContainSubstring("histogram_with_label_bucket{key=\"value\",le=\"10\"} 0"))
+			Expect(metrics).To(ContainSubstring("histogram_with_label_bucket{key=\"value\",le=\"100\"} 1"))
+			Expect(metrics).To(ContainSubstring("histogram_with_label_sum{key=\"value\"} 50"))
+		})
+	})
+
 	Context("Shutdown", func() {
 		It("shuts down", func() {
 			metricCollector.Shutdown()
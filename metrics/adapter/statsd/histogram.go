@@ -0,0 +1,18 @@
+package statsd
+
+import (
+	sd "github.com/smira/go-statsd"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+// Histogram for Statsd
+type Histogram struct {
+	client *sd.Client
+	name   string
+}
+
+// Observe records a new value
+func (s *Histogram) Observe(n int64, labels adapter.Labels) {
+	tags := getTags(labels)
+	s.client.Timing(s.name, n, tags...)
+}
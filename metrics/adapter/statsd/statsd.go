@@ -32,6 +32,14 @@ func (c *Collector) RegisterTimer(options adapter.CollectorOptions) adapter.Time
 	}
 }
 
+// RegisterHistogram creates a new histogram for Statsd, reported as timings whose distribution is computed by Statsd
+func (c *Collector) RegisterHistogram(options adapter.CollectorOptions) adapter.Histogram {
+	return &Histogram{
+		name:   options.Name,
+		client: c.client,
+	}
+}
+
 // RegisterCounter creates a new counter for Statsd
 func (c *Collector) RegisterCounter(options adapter.CollectorOptions) adapter.Counter {
 	return &Counter{
@@ -99,6 +99,18 @@ var _ = Describe("Statsd Metric Adapter", Ordered, func() {
 		})
 	})
 
+	Context("histogram", func() {
+		It("Observe", func() {
+			histogram := metricCollector.RegisterHistogram(adapter.CollectorOptions{
+				Name:   "histogram_with_label",
+				Help:   "help text",
+				Labels: []string{"key"},
+			})
+
+			histogram.Observe(5, map[string]string{"key": "value"})
+		})
+	})
+
 	Context("Shutdown", func() {
 		It("shuts down", func() {
 			metricCollector.Shutdown()
@@ -8,6 +8,8 @@ type CollectorOptions struct {
 	Name   string
 	Help   string
 	Labels []string
+	// Buckets are the upper bounds of the buckets of histograms, the collector defaults are used when empty
+	Buckets []float64
 }
 
 // Gauge can be set to anything
@@ -28,3 +30,8 @@ type Counter interface {
 type Timer interface {
 	Observe(int64, Labels)
 }
+
+// Histogram observes distributions in buckets
+type Histogram interface {
+	Observe(int64, Labels)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+var (
+	latencySLOViolationCount adapter.Counter
+	latencySLOViolationGauge adapter.Gauge
+	latencySLOOnce           sync.Once
+)
+
+// LatencySLO counts the produce operations exceeding a latency target and reports
+// the rate of violations over a rolling window as a percentage
+type LatencySLO struct {
+	target time.Duration
+	mutex  sync.Mutex
+	window *rollingWindow
+	labels adapter.Labels
+}
+
+// NewLatencySLO returns a latency SLO reported with the dispatcher label, nil if target is not positive
+func NewLatencySLO(metricsCollector MetricCollector, dispatcher string, target time.Duration, window time.Duration) *LatencySLO {
+	if target <= 0 {
+		return nil
+	}
+	latencySLOOnce.Do(func() {
+		latencySLOViolationCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+			Name:   "dispatcher_latency_slo_violation_total",
+			Help:   "The number of dispatches exceeding the produce latency target.",
+			Labels: []string{"dispatcher"},
+		})
+		latencySLOViolationGauge = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+			Name:   "dispatcher_latency_slo_violation_ratio",
+			Help:   "The percentage of dispatches exceeding the produce latency target over the rolling window.",
+			Labels: []string{"dispatcher"},
+		})
+	})
+
+	return &LatencySLO{
+		target: target,
+		window: newRollingWindow(window, DefaultSuccessRatioWindow),
+		labels: map[string]string{"dispatcher": dispatcher},
+	}
+}
+
+// Observe records the latency of a produce operation
+func (s *LatencySLO) Observe(latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	violation := latency > s.target
+	if violation {
+		latencySLOViolationCount.Inc(s.labels)
+	}
+	s.window.record(!violation)
+	latencySLOViolationGauge.Set(int64((1-s.window.ratio())*100), s.labels)
+}
+
+// ViolationRate returns the ratio of operations exceeding the target over the window
+func (s *LatencySLO) ViolationRate() float64 {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.window.rotate(time.Now().Unix())
+	return 1 - s.window.ratio()
+}
@@ -0,0 +1,29 @@
+package metrics_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+)
+
+var _ = Describe("LatencySLO", func() {
+	It("is disabled without target", func() {
+		slo := metrics.NewLatencySLO(noop.NewCollector(), "kafka", 0, time.Minute)
+		Expect(slo).To(BeNil())
+		Expect(func() { slo.Observe(time.Second) }).NotTo(Panic())
+		Expect(slo.ViolationRate()).To(BeEquivalentTo(0))
+	})
+
+	It("computes the rate of violations", func() {
+		slo := metrics.NewLatencySLO(noop.NewCollector(), "kafka", 50*time.Millisecond, time.Minute)
+		slo.Observe(10 * time.Millisecond)
+		slo.Observe(50 * time.Millisecond)
+		slo.Observe(20 * time.Millisecond)
+		slo.Observe(60 * time.Millisecond)
+		Expect(slo.ViolationRate()).To(BeEquivalentTo(0.25))
+	})
+})
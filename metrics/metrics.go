@@ -27,6 +27,23 @@ type MonitoringConfig struct {
 	// ProfilingPath is the variable that enable deep profiling is set
 	ProfilingPath string `json:"profiling_path,omitempty"`
 
+	// SuccessRatioWindowSeconds is the rolling window of the dispatcher success ratio, defaults to 60
+	SuccessRatioWindowSeconds int `json:"success_ratio_window_sec,omitempty"`
+
+	// LatencySLOTargetsMs is a mapping of dispatchers to their produce latency target in milliseconds
+	LatencySLOTargetsMs map[string]int `json:"latency_slo_targets_ms,omitempty"`
+
+	// PartitionSkewThreshold enables the partition skew of kafka and kinesis, a warning is logged when the busiest
+	// partition of a topic receives more than this multiple of an even share of its records
+	PartitionSkewThreshold float64 `json:"partition_skew_threshold,omitempty"`
+
+	// PartitionSkewWindowSeconds is the window over which the partition skew is measured, defaults to 60
+	PartitionSkewWindowSeconds int `json:"partition_skew_window_sec,omitempty"`
+
+	// DispatcherInstances is a mapping of dispatchers, or kafka_<region> for the regional kafka clusters, to the
+	// instance name labelling their metrics, the dispatcher name is used when not set
+	DispatcherInstances map[string]string `json:"dispatcher_instances,omitempty"`
+
 	ProfilerFile *os.File
 }
 
@@ -47,6 +64,7 @@ type MetricCollector interface {
 	RegisterCounter(adapter.CollectorOptions) adapter.Counter
 	RegisterGauge(adapter.CollectorOptions) adapter.Gauge
 	RegisterTimer(adapter.CollectorOptions) adapter.Timer
+	RegisterHistogram(adapter.CollectorOptions) adapter.Histogram
 	Shutdown()
 }
 
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+// DefaultPartitionCountRefresh is the interval at which the number of partitions of the topics is looked up again
+const DefaultPartitionCountRefresh = time.Minute
+
+// PartitionCountFunc returns the number of partitions of a topic, 0 when unknown
+type PartitionCountFunc func(topic string) int
+
+// PartitionSkew tracks the distribution of the records of each topic over its partitions and reports the
+// share of the busiest partition relative to an even distribution, 100 meaning the records are evenly spread
+type PartitionSkew struct {
+	gauge      adapter.Gauge
+	dispatcher string
+	threshold  float64
+	window     time.Duration
+	logger     *logrus.Logger
+
+	mutex  sync.Mutex
+	topics map[string]*partitionDistribution
+	// partitions caches the number of partitions of the topics, looked up in the background as the lookups
+	// call the brokers
+	partitions map[string]int
+	refresh    chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{}
+}
+
+type partitionDistribution struct {
+	start  time.Time
+	counts map[string]int64
+	total  int64
+}
+
+// RegisterPartitionSkewGauge registers the gauge reporting the skew of the topics of every dispatcher, it is
+// shared by their PartitionSkew trackers
+func RegisterPartitionSkewGauge(metricsCollector MetricCollector) adapter.Gauge {
+	return metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "partition_skew",
+		Help:   "The share of the records of a topic received by its busiest partition, as a percentage of an even share.",
+		Labels: []string{"dispatcher", "topic"},
+	})
+}
+
+// NewPartitionSkew returns a partition skew tracker of the dispatcher reporting to the gauge and warning when the
+// skew of a topic exceeds threshold over the window, nil if threshold is not positive
+func NewPartitionSkew(gauge adapter.Gauge, dispatcher string, threshold float64, window time.Duration, logger *logrus.Logger) *PartitionSkew {
+	if threshold <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = DefaultSuccessRatioWindow
+	}
+	return &PartitionSkew{
+		gauge:      gauge,
+		dispatcher: dispatcher,
+		threshold:  threshold,
+		window:     window,
+		logger:     logger,
+		topics:     make(map[string]*partitionDistribution),
+	}
+}
+
+// WithPartitionCount looks up the number of partitions of the topics observed every refresh interval, defaults to
+// DefaultPartitionCountRefresh, until the tracker is closed. Without it only the partitions which received records
+// are accounted for and a single hot partition goes unnoticed
+func (s *PartitionSkew) WithPartitionCount(partitionCount PartitionCountFunc, refreshInterval time.Duration) *PartitionSkew {
+	if s == nil || partitionCount == nil {
+		return s
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultPartitionCountRefresh
+	}
+	s.partitions = make(map[string]int)
+	s.refresh = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.refreshPartitionCounts(partitionCount, refreshInterval)
+	return s
+}
+
+// Close stops the lookups of the number of partitions and waits for the pending one, so that the client of the
+// lookups can be closed next
+func (s *PartitionSkew) Close() {
+	if s == nil || s.stop == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+// refreshPartitionCounts looks up the number of partitions of the topics observed every interval, and as soon as
+// a topic is first observed
+func (s *PartitionSkew) refreshPartitionCounts(partitionCount PartitionCountFunc, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.refresh:
+		case <-ticker.C:
+		}
+		s.mutex.Lock()
+		topics := make([]string, 0, len(s.partitions))
+		for topic := range s.partitions {
+			topics = append(topics, topic)
+		}
+		s.mutex.Unlock()
+
+		for _, topic := range topics {
+			count := partitionCount(topic)
+			s.mutex.Lock()
+			s.partitions[topic] = count
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// Observe records a record delivered to the partition of the topic, the skew of the topic
+// is reported at the end of each window
+func (s *PartitionSkew) Observe(topic string, partition string) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+
+	s.mutex.Lock()
+	distribution, ok := s.topics[topic]
+	if !ok {
+		distribution = &partitionDistribution{start: now, counts: make(map[string]int64)}
+		s.topics[topic] = distribution
+		s.lookupPartitions(topic)
+	}
+	distribution.counts[partition]++
+	distribution.total++
+	if now.Sub(distribution.start) < s.window {
+		s.mutex.Unlock()
+		return
+	}
+	s.topics[topic] = &partitionDistribution{start: now, counts: make(map[string]int64)}
+	partitions := max(len(distribution.counts), s.partitions[topic])
+	s.mutex.Unlock()
+
+	s.report(topic, distribution, partitions)
+}
+
+// lookupPartitions asks the background lookup for the number of partitions of a topic first observed, it must be
+// called with the mutex held
+func (s *PartitionSkew) lookupPartitions(topic string) {
+	if s.partitions == nil {
+		return
+	}
+	if _, ok := s.partitions[topic]; ok {
+		return
+	}
+	s.partitions[topic] = 0
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+		// a lookup is already pending
+	}
+}
+
+// report sets the skew of the window over the partitions of the topic
+func (s *PartitionSkew) report(topic string, distribution *partitionDistribution, partitions int) {
+	skew := Skew(distribution.counts, distribution.total, partitions)
+	s.gauge.Set(int64(skew*100), map[string]string{"dispatcher": s.dispatcher, "topic": topic})
+	if skew > s.threshold {
+		s.logger.Log(logrus.WARN, "partition_skew_detected", logrus.LogInfo{"dispatcher": s.dispatcher, "topic": topic, "skew": skew, "partitions": partitions, "records": distribution.total})
+	}
+}
+
+// Skew returns the share of the busiest partition divided by the even share of the partitions
+func Skew(counts map[string]int64, total int64, partitions int) float64 {
+	if total == 0 || partitions == 0 {
+		return 1
+	}
+	var busiest int64
+	for _, count := range counts {
+		if count > busiest {
+			busiest = count
+		}
+	}
+	return float64(busiest) * float64(partitions) / float64(total)
+}
@@ -0,0 +1,52 @@
+package metrics_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+)
+
+var _ = Describe("PartitionSkew", func() {
+	It("is disabled without threshold", func() {
+		logger, _ := logrus.NoOpLogger()
+		skew := metrics.NewPartitionSkew(metrics.RegisterPartitionSkewGauge(noop.NewCollector()), "kafka", 0, time.Minute, logger)
+		Expect(skew).To(BeNil())
+		Expect(func() {
+			skew.WithPartitionCount(nil, 0).Observe("topic", "0")
+			skew.Close()
+		}).NotTo(Panic())
+	})
+
+	It("computes the skew", func() {
+		counts := map[string]int64{"0": 6, "1": 2}
+		Expect(metrics.Skew(counts, 8, 2)).To(BeEquivalentTo(1.5))
+		Expect(metrics.Skew(counts, 8, 4)).To(BeEquivalentTo(3))
+		Expect(metrics.Skew(nil, 0, 4)).To(BeEquivalentTo(1))
+	})
+
+	It("warns when the skew exceeds the threshold over the partitions looked up in the background", func() {
+		logger, hook := logrus.NoOpLogger()
+		lookups := make(chan string, 10)
+		skew := metrics.NewPartitionSkew(metrics.RegisterPartitionSkewGauge(noop.NewCollector()), "kafka", 2, time.Nanosecond, logger).
+			WithPartitionCount(func(topic string) int {
+				lookups <- topic
+				return 4
+			}, time.Hour)
+		DeferCleanup(skew.Close)
+
+		// the lookup of the partitions of a topic first observed does not block its observation
+		skew.Observe("topic", "0")
+		Eventually(lookups).Should(Receive(Equal("topic")))
+		Eventually(func() int {
+			skew.Observe("topic", "0")
+			return len(hook.AllEntries())
+		}).ShouldNot(BeZero())
+		Expect(hook.LastEntry().Message).To(Equal("partition_skew_detected"))
+		Consistently(lookups, 50*time.Millisecond).ShouldNot(Receive())
+	})
+})
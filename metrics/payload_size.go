@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+// PayloadSizeBuckets are the upper bounds in bytes of the buckets of dispatch_payload_size_bytes
+var PayloadSizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+var (
+	payloadSizeHistogram adapter.Histogram
+	payloadSizeOnce      sync.Once
+)
+
+// PayloadSize observes the size of the serialized payloads a dispatcher sends to its sink
+type PayloadSize struct {
+	dispatcher string
+}
+
+// NewPayloadSize returns the payload size observer of the dispatcher
+func NewPayloadSize(metricsCollector MetricCollector, dispatcher string) *PayloadSize {
+	payloadSizeOnce.Do(func() {
+		payloadSizeHistogram = metricsCollector.RegisterHistogram(adapter.CollectorOptions{
+			Name:    "dispatch_payload_size_bytes",
+			Help:    "The size of the serialized payloads sent to each dispatcher, after compression and transforms.",
+			Labels:  []string{"dispatcher", "record_type"},
+			Buckets: PayloadSizeBuckets,
+		})
+	})
+	return &PayloadSize{dispatcher: dispatcher}
+}
+
+// Observe records the size in bytes of a payload of the record type as sent to the sink
+func (p *PayloadSize) Observe(recordType string, size int) {
+	if p == nil {
+		return
+	}
+	payloadSizeHistogram.Observe(int64(size), map[string]string{"dispatcher": p.dispatcher, "record_type": recordType})
+}
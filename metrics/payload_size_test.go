@@ -0,0 +1,46 @@
+package metrics_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+)
+
+type payloadSizeCollector struct {
+	*noop.Collector
+	observations []adapter.Labels
+	sizes        []int64
+}
+
+func (c *payloadSizeCollector) RegisterHistogram(adapter.CollectorOptions) adapter.Histogram {
+	return c
+}
+
+func (c *payloadSizeCollector) Observe(value int64, labels adapter.Labels) {
+	c.sizes = append(c.sizes, value)
+	c.observations = append(c.observations, labels)
+}
+
+var _ = Describe("PayloadSize", func() {
+	It("observes the payload sizes by dispatcher and record type", func() {
+		collector := &payloadSizeCollector{Collector: noop.NewCollector()}
+		kafka := metrics.NewPayloadSize(collector, "kafka_eu")
+		pubsub := metrics.NewPayloadSize(collector, "pubsub")
+
+		kafka.Observe("V", 120)
+		pubsub.Observe("alerts", 64)
+		Expect(collector.sizes).To(Equal([]int64{120, 64}))
+		Expect(collector.observations).To(Equal([]adapter.Labels{
+			{"dispatcher": "kafka_eu", "record_type": "V"},
+			{"dispatcher": "pubsub", "record_type": "alerts"},
+		}))
+	})
+
+	It("ignores observations without observer", func() {
+		var payloadSize *metrics.PayloadSize
+		Expect(func() { payloadSize.Observe("V", 10) }).NotTo(Panic())
+	})
+})
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"time"
+)
+
+// rollingWindow counts successful operations over a rolling window of one second buckets,
+// it is not safe for concurrent use
+type rollingWindow struct {
+	buckets    []ratioBucket
+	lastSecond int64
+	successes  int64
+	total      int64
+}
+
+type ratioBucket struct {
+	successes int64
+	total     int64
+}
+
+func newRollingWindow(window time.Duration, defaultWindow time.Duration) *rollingWindow {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = int(defaultWindow / time.Second)
+	}
+	return &rollingWindow{
+		buckets:    make([]ratioBucket, seconds),
+		lastSecond: time.Now().Unix(),
+	}
+}
+
+func (w *rollingWindow) record(success bool) {
+	w.rotate(time.Now().Unix())
+	bucket := &w.buckets[w.lastSecond%int64(len(w.buckets))]
+	bucket.total++
+	w.total++
+	if success {
+		bucket.successes++
+		w.successes++
+	}
+}
+
+// rotate expires the buckets which fell out of the window since the last call
+func (w *rollingWindow) rotate(second int64) {
+	if second <= w.lastSecond {
+		return
+	}
+	size := int64(len(w.buckets))
+	expired := second - w.lastSecond
+	if expired > size {
+		expired = size
+	}
+	for i := int64(1); i <= expired; i++ {
+		bucket := &w.buckets[(w.lastSecond+i)%size]
+		w.successes -= bucket.successes
+		w.total -= bucket.total
+		*bucket = ratioBucket{}
+	}
+	w.lastSecond = second
+}
+
+// ratio returns the ratio of successes over the window, 1 if nothing was recorded
+func (w *rollingWindow) ratio() float64 {
+	if w.total == 0 {
+		return 1
+	}
+	return float64(w.successes) / float64(w.total)
+}
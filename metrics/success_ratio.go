@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+const (
+	// DefaultSuccessRatioWindow is the rolling window used when none is configured
+	DefaultSuccessRatioWindow = 60 * time.Second
+
+	// DefaultMinSuccessRatio is the success ratio under which a dispatcher is unhealthy when not configured
+	DefaultMinSuccessRatio = 0.5
+)
+
+var (
+	successRatioGauge adapter.Gauge
+	successRatioOnce  sync.Once
+)
+
+// SuccessRatio tracks the ratio of successful operations over a rolling window
+// and reports it as a percentage through the dispatcher_success_ratio gauge
+type SuccessRatio struct {
+	mutex  sync.Mutex
+	window *rollingWindow
+	labels adapter.Labels
+}
+
+// NewSuccessRatio returns a rolling success ratio reported with the dispatcher label
+func NewSuccessRatio(metricsCollector MetricCollector, dispatcher string, window time.Duration) *SuccessRatio {
+	successRatioOnce.Do(func() {
+		successRatioGauge = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+			Name:   "dispatcher_success_ratio",
+			Help:   "The percentage of successful dispatches over the rolling window.",
+			Labels: []string{"dispatcher"},
+		})
+	})
+
+	return &SuccessRatio{
+		window: newRollingWindow(window, DefaultSuccessRatioWindow),
+		labels: map[string]string{"dispatcher": dispatcher},
+	}
+}
+
+// Success records a successful operation
+func (r *SuccessRatio) Success() {
+	r.record(true)
+}
+
+// Failure records a failed operation
+func (r *SuccessRatio) Failure() {
+	r.record(false)
+}
+
+// Ratio returns the success ratio over the window, 1 if nothing was recorded
+func (r *SuccessRatio) Ratio() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.window.rotate(time.Now().Unix())
+	return r.window.ratio()
+}
+
+// Healthy returns whether the ratio is at least minRatio, a nil ratio is healthy
+func (r *SuccessRatio) Healthy(minRatio float64) bool {
+	if r == nil {
+		return true
+	}
+	return r.Ratio() >= minRatio
+}
+
+func (r *SuccessRatio) record(success bool) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.window.record(success)
+	successRatioGauge.Set(int64(r.window.ratio()*100), r.labels)
+}
@@ -0,0 +1,50 @@
+package metrics_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+)
+
+var _ = Describe("SuccessRatio", func() {
+	It("defaults to fully successful", func() {
+		ratio := metrics.NewSuccessRatio(noop.NewCollector(), "kafka", time.Minute)
+		Expect(ratio.Ratio()).To(BeEquivalentTo(1))
+	})
+
+	It("computes the ratio of successes", func() {
+		ratio := metrics.NewSuccessRatio(noop.NewCollector(), "kafka", time.Minute)
+		for i := 0; i < 3; i++ {
+			ratio.Success()
+		}
+		ratio.Failure()
+		Expect(ratio.Ratio()).To(BeEquivalentTo(0.75))
+	})
+
+	It("expires records outside of the window", func() {
+		ratio := metrics.NewSuccessRatio(noop.NewCollector(), "kafka", time.Second)
+		ratio.Failure()
+		Expect(ratio.Ratio()).To(BeEquivalentTo(0))
+		Eventually(ratio.Ratio, 3*time.Second, 100*time.Millisecond).Should(BeEquivalentTo(1))
+	})
+
+	It("is unhealthy under the minimum ratio", func() {
+		ratio := metrics.NewSuccessRatio(noop.NewCollector(), "kafka", time.Minute)
+		ratio.Success()
+		ratio.Failure()
+		Expect(ratio.Healthy(metrics.DefaultMinSuccessRatio)).To(BeTrue())
+		Expect(ratio.Healthy(0.9)).To(BeFalse())
+		ratio.Failure()
+		Expect(ratio.Healthy(metrics.DefaultMinSuccessRatio)).To(BeFalse())
+	})
+
+	It("ignores nil ratio", func() {
+		var ratio *metrics.SuccessRatio
+		Expect(ratio.Success).NotTo(Panic())
+		Expect(ratio.Healthy(metrics.DefaultMinSuccessRatio)).To(BeTrue())
+	})
+})
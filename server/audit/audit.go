@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+)
+
+const (
+	// ActorSourceCertificate is used when the actor comes from the client certificate
+	ActorSourceCertificate = "certificate"
+	// ActorSourceJWT is used when the actor comes from the bearer token subject
+	ActorSourceJWT = "jwt"
+	// ActorSourceUnknown is used when the actor could not be identified
+	ActorSourceUnknown = "unknown"
+)
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	auditEventCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// Event is a structured audit entry for a privileged action
+type Event struct {
+	Actor       string
+	ActorSource string
+	Action      string
+	Resource    string
+	Time        time.Time
+	Details     logrus.LogInfo
+}
+
+// Auditor emits audit events for admin actions, every admin handler should go through it
+type Auditor struct {
+	logger *logrus.Logger
+}
+
+// NewAuditor returns an Auditor logging with the given logger
+func NewAuditor(metricsCollector metrics.MetricCollector, logger *logrus.Logger) *Auditor {
+	registerMetricsOnce(metricsCollector)
+	return &Auditor{logger: logger}
+}
+
+// Record emits an audit event for the action performed by the requester on the resource, the request is nil for
+// the actions not requested through an endpoint. The details cannot override the reserved keys of the event
+func (a *Auditor) Record(r *http.Request, action string, resource string, details logrus.LogInfo) Event {
+	actor, actorSource := extractActor(r)
+	event := Event{
+		Actor:       actor,
+		ActorSource: actorSource,
+		Action:      action,
+		Resource:    resource,
+		Time:        time.Now().UTC(),
+		Details:     details,
+	}
+
+	logInfo := logrus.LogInfo{}
+	for key, value := range details {
+		logInfo[key] = value
+	}
+	// the reserved keys are set last so that details cannot forge them
+	logInfo["audit"] = true
+	logInfo["actor"] = event.Actor
+	logInfo["actor_source"] = event.ActorSource
+	logInfo["action"] = event.Action
+	logInfo["resource"] = event.Resource
+	logInfo["time"] = event.Time.Format(time.RFC3339Nano)
+	a.logger.ActivityLog("audit_event", logInfo)
+	metricsRegistry.auditEventCount.Inc(map[string]string{"action": action})
+	return event
+}
+
+// extractActor identifies the requester from its client certificate or the subject of its bearer token.
+// The token is not verified here, authenticating the request is the responsibility of the admin handler.
+func extractActor(r *http.Request) (string, string) {
+	if r == nil {
+		return "", ActorSourceUnknown
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName, ActorSourceCertificate
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", ActorSourceUnknown
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ActorSourceUnknown
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ActorSourceUnknown
+	}
+	claims := struct {
+		Subject string `json:"sub"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return "", ActorSourceUnknown
+	}
+	return claims.Subject, ActorSourceJWT
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.auditEventCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "audit_event_total",
+		Help:   "The number of audit events emitted for admin actions.",
+		Labels: []string{"action"},
+	})
+}
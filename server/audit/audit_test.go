@@ -0,0 +1,79 @@
+package audit_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/audit"
+)
+
+var _ = Describe("Auditor", func() {
+	It("uses the client certificate as actor", func() {
+		logger, hook := logrus.NoOpLogger()
+		auditor := audit.NewAuditor(noop.NewCollector(), logger)
+		req := httptest.NewRequest("POST", "/drain", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "operator"}}}}
+
+		event := auditor.Record(req, "drain", "server", logrus.LogInfo{"reason": "deploy"})
+		Expect(event.Actor).To(Equal("operator"))
+		Expect(event.ActorSource).To(Equal(audit.ActorSourceCertificate))
+
+		entry := hook.LastEntry()
+		Expect(entry.Message).To(Equal("audit_event"))
+		Expect(entry.Data["action"]).To(Equal("drain"))
+		Expect(entry.Data["resource"]).To(Equal("server"))
+		Expect(entry.Data["reason"]).To(Equal("deploy"))
+	})
+
+	It("uses the bearer token subject as actor", func() {
+		logger, _ := logrus.NoOpLogger()
+		auditor := audit.NewAuditor(noop.NewCollector(), logger)
+		req := httptest.NewRequest("POST", "/disconnect", nil)
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin@example.com"}`))
+		req.Header.Set("Authorization", "Bearer header."+claims+".signature")
+
+		event := auditor.Record(req, "force_disconnect", "device-1", nil)
+		Expect(event.Actor).To(Equal("admin@example.com"))
+		Expect(event.ActorSource).To(Equal(audit.ActorSourceJWT))
+	})
+
+	It("records unknown actors", func() {
+		logger, _ := logrus.NoOpLogger()
+		auditor := audit.NewAuditor(noop.NewCollector(), logger)
+
+		event := auditor.Record(httptest.NewRequest("POST", "/dispatchers", nil), "disable_dispatcher", "kafka", nil)
+		Expect(event.Actor).To(BeEmpty())
+		Expect(event.ActorSource).To(Equal(audit.ActorSourceUnknown))
+	})
+
+	It("does not let the details override the reserved keys", func() {
+		logger, hook := logrus.NoOpLogger()
+		auditor := audit.NewAuditor(noop.NewCollector(), logger)
+		req := httptest.NewRequest("GET", "/last_seen", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "operator"}}}}
+
+		auditor.Record(req, "last_seen_lookup", "device-1", logrus.LogInfo{"actor": "someone", "action": "other", "audit": false, "found": true})
+		entry := hook.LastEntry()
+		Expect(entry.Data["actor"]).To(Equal("operator"))
+		Expect(entry.Data["action"]).To(Equal("last_seen_lookup"))
+		Expect(entry.Data["audit"]).To(BeTrue())
+		Expect(entry.Data["found"]).To(BeTrue())
+	})
+
+	It("records the actions not requested through an endpoint", func() {
+		logger, hook := logrus.NoOpLogger()
+		auditor := audit.NewAuditor(noop.NewCollector(), logger)
+
+		event := auditor.Record(nil, "drain", "server", nil)
+		Expect(event.ActorSource).To(Equal(audit.ActorSourceUnknown))
+		Expect(hook.LastEntry().Data["action"]).To(Equal("drain"))
+	})
+})
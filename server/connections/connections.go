@@ -0,0 +1,197 @@
+package connections
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+)
+
+// DefaultSubscriberBuffer is the number of events buffered per subscriber when not configured
+const DefaultSubscriberBuffer = 1000
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	subscriberCount     adapter.Gauge
+	unauthorizedCount   adapter.Counter
+	eventsStreamedCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// WatchServer is the interface of the fleet_telemetry.Connections gRPC service
+type WatchServer interface {
+	Watch(*emptypb.Empty, grpc.ServerStream) error
+}
+
+// serviceDesc describes the fleet_telemetry.Connections service, it streams the connected sockets followed
+// by the live connection events. Events are google.protobuf.Struct with the type, socket_id, device_id and time fields.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "fleet_telemetry.Connections",
+	HandlerType: (*WatchServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       watchHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// Server streams the connection events of the socket registry
+type Server struct {
+	registry *streaming.SocketRegistry
+	buffer   int
+	logger   *logrus.Logger
+}
+
+// NewServer returns a gRPC server exposing the connection events of the registry over TLS to clients
+// presenting the configured bearer token
+func NewServer(c *config.ConnectionsAPI, tlsConfig *tls.Config, metricsCollector metrics.MetricCollector, registry *streaming.SocketRegistry, logger *logrus.Logger) (*grpc.Server, error) {
+	if c.Token == "" {
+		return nil, errors.New("connections_api requires a token")
+	}
+	if tlsConfig == nil {
+		return nil, errors.New("connections_api requires tls, the token would be sent in clear")
+	}
+	registerMetricsOnce(metricsCollector)
+
+	buffer := c.SubscriberBuffer
+	if buffer <= 0 {
+		buffer = DefaultSubscriberBuffer
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)), grpc.StreamInterceptor(authInterceptor(c.Token)))
+	grpcServer.RegisterService(&serviceDesc, &Server{registry: registry, buffer: buffer, logger: logger})
+	return grpcServer, nil
+}
+
+// StartConnectionsServer serves the connection events on the configured port
+func StartConnectionsServer(c *config.Config, registry *streaming.SocketRegistry, logger *logrus.Logger) error {
+	tlsConfig, err := c.ConnectionsAPITLSConfig()
+	if err != nil {
+		return err
+	}
+	grpcServer, err := NewServer(c.ConnectionsAPI, tlsConfig, c.MetricCollector, registry, logger)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.ConnectionsAPI.Port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			logger.ErrorLog("connections_server_err", err, nil)
+		}
+	}()
+	logger.ActivityLog("connections_server_configured", logrus.LogInfo{"port": c.ConnectionsAPI.Port})
+	return nil
+}
+
+// Watch streams the connection events until the client goes away
+func (s *Server) Watch(_ *emptypb.Empty, stream grpc.ServerStream) error {
+	events, cancel := s.registry.Subscribe(s.buffer)
+	defer cancel()
+
+	metricsRegistry.subscriberCount.Inc(map[string]string{})
+	defer metricsRegistry.subscriberCount.Sub(1, map[string]string{})
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			message, err := structpb.NewStruct(map[string]interface{}{
+				"type":      string(event.Type),
+				"socket_id": event.SocketID,
+				"device_id": event.DeviceID,
+				"time":      event.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+			})
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(message); err != nil {
+				return err
+			}
+			metricsRegistry.eventsStreamedCount.Inc(map[string]string{"type": string(event.Type)})
+		}
+	}
+}
+
+func watchHandler(srv interface{}, stream grpc.ServerStream) error {
+	request := &emptypb.Empty{}
+	if err := stream.RecvMsg(request); err != nil {
+		return err
+	}
+	return srv.(WatchServer).Watch(request, stream)
+}
+
+// authInterceptor rejects streams without the bearer token in the authorization metadata
+func authInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !authorized(stream.Context(), token) {
+			metricsRegistry.unauthorizedCount.Inc(map[string]string{})
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return handler(srv, stream)
+	}
+}
+
+func authorized(ctx context.Context, token string) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, value := range md.Get("authorization") {
+		bearer := strings.TrimPrefix(value, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.subscriberCount = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "connections_api_subscribers",
+		Help:   "The number of clients watching connection events.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.unauthorizedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connections_api_unauthorized_total",
+		Help:   "The number of connection event streams rejected for an invalid token.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.eventsStreamedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connections_api_events_total",
+		Help:   "The number of connection events streamed to clients.",
+		Labels: []string{"type"},
+	})
+}
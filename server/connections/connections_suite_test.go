@@ -0,0 +1,13 @@
+package connections_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestConnections(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Connections Suite Tests")
+}
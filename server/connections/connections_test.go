@@ -0,0 +1,145 @@
+package connections_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/connections"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// newTLSConfigs returns the TLS config of a server with a self-signed certificate and the one of its clients
+func newTLSConfigs() (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, &tls.Config{RootCAs: roots}
+}
+
+var _ = Describe("Connections API", func() {
+	var (
+		conf         *config.ConnectionsAPI
+		registry     *streaming.SocketRegistry
+		logger       *logrus.Logger
+		serverTLS    *tls.Config
+		clientTLS    *tls.Config
+		address      string
+		socketConfig *config.Config
+	)
+
+	BeforeEach(func() {
+		conf = &config.ConnectionsAPI{Token: "secret"}
+		registry = streaming.NewSocketRegistry()
+		logger, _ = logrus.NoOpLogger()
+		serverTLS, clientTLS = newTLSConfigs()
+		socketConfig = &config.Config{MetricCollector: noop.NewCollector()}
+
+		grpcServer, err := connections.NewServer(conf, serverTLS, noop.NewCollector(), registry, logger)
+		Expect(err).NotTo(HaveOccurred())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() { _ = grpcServer.Serve(listener) }()
+		DeferCleanup(grpcServer.Stop)
+		address = listener.Addr().String()
+	})
+
+	// watch opens a Watch stream with the credentials and token
+	watch := func(creds credentials.TransportCredentials, token string) grpc.ClientStream {
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/fleet_telemetry.Connections/Watch")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.SendMsg(&emptypb.Empty{})).To(Succeed())
+		Expect(stream.CloseSend()).To(Succeed())
+		return stream
+	}
+
+	registerSocket := func(deviceID string) *streaming.SocketManager {
+		socket := streaming.NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: deviceID}, nil, socketConfig, logger)
+		registry.RegisterSocket(socket)
+		return socket
+	}
+
+	It("requires a token and tls", func() {
+		_, err := connections.NewServer(&config.ConnectionsAPI{}, serverTLS, noop.NewCollector(), registry, logger)
+		Expect(err).To(MatchError("connections_api requires a token"))
+
+		_, err = connections.NewServer(conf, nil, noop.NewCollector(), registry, logger)
+		Expect(err).To(MatchError(ContainSubstring("requires tls")))
+	})
+
+	It("streams the connected sockets then the live events", func() {
+		connected := registerSocket("device-1")
+		stream := watch(credentials.NewTLS(clientTLS), "secret")
+
+		event := &structpb.Struct{}
+		Expect(stream.RecvMsg(event)).To(Succeed())
+		Expect(event.AsMap()).To(HaveKeyWithValue("type", "connected"))
+		Expect(event.AsMap()).To(HaveKeyWithValue("device_id", "device-1"))
+		Expect(event.AsMap()).To(HaveKeyWithValue("socket_id", connected.UUID))
+
+		registry.DeregisterSocket(connected)
+		Expect(stream.RecvMsg(event)).To(Succeed())
+		Expect(event.AsMap()).To(HaveKeyWithValue("type", "disconnected"))
+		Expect(event.AsMap()).To(HaveKeyWithValue("socket_id", connected.UUID))
+	})
+
+	It("rejects streams without the token", func() {
+		for _, token := range []string{"", "wrong"} {
+			err := watch(credentials.NewTLS(clientTLS), token).RecvMsg(&structpb.Struct{})
+			Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		}
+	})
+
+	It("rejects plaintext connections", func() {
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+		_, err = conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/fleet_telemetry.Connections/Watch")
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+	})
+})
@@ -19,11 +19,27 @@ func (s *statusServer) Status() func(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+// Ready API reports whether the server accepts connections given the health of its dispatchers
+func (s *statusServer) Ready(c *config.Config) func(w http.ResponseWriter, _ *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		unhealthy, accepted := c.DispatcherReadiness()
+		switch {
+		case len(unhealthy) == 0:
+			_, _ = fmt.Fprint(w, "ok")
+		case accepted:
+			_, _ = fmt.Fprint(w, "degraded")
+		default:
+			http.Error(w, "dispatchers unavailable", http.StatusServiceUnavailable)
+		}
+	}
+}
+
 // StartStatusServer initializes the status server on http
 func StartStatusServer(config *config.Config, logger *logrus.Logger, airbrakeHandler *airbrake.Handler) {
 	statusServer := &statusServer{}
 	mux := http.NewServeMux()
 	mux.Handle("/status", airbrakeHandler.WithReporting(http.HandlerFunc(statusServer.Status())))
+	mux.Handle("/readyz", airbrakeHandler.WithReporting(http.HandlerFunc(statusServer.Ready(config))))
 	go func() {
 		if err := http.ListenAndServe(fmt.Sprintf(":%d", config.StatusPort), mux); err != nil {
 			logger.ErrorLog("status", err, nil)
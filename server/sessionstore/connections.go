@@ -0,0 +1,372 @@
+package sessionstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultConnectionsKey prefixes the hostname of the server, such as its pod name, in the redis hash of its
+// connections when not configured
+const DefaultConnectionsKey = "fleet-telemetry:connections"
+
+// Connection is a connection open on the server, kept until it closes so that the connections left open when
+// the server died can be reported disconnected by the next run
+type Connection struct {
+	DeviceID         string    `json:"device_id"`
+	SocketID         string    `json:"socket_id"`
+	SenderID         string    `json:"sender_id"`
+	Region           string    `json:"region,omitempty"`
+	NetworkInterface string    `json:"network_interface,omitempty"`
+	TraceID          string    `json:"trace_id,omitempty"`
+	ConnectedAt      time.Time `json:"connected_at"`
+}
+
+// ConnectionStore durably keeps the connections open on a single server. Every server needs its own store,
+// such as its own file or redis key, as the connections of the store are reported disconnected on startup
+type ConnectionStore interface {
+	// Add stores the connection once it opened
+	Add(connection *Connection) error
+	// Remove forgets the connection once it closed
+	Remove(socketID string) error
+	// List returns the connections stored, on startup those left open by the previous run
+	List() ([]*Connection, error)
+	// Clear forgets every connection
+	Clear() error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// NopConnectionStore keeps no connection
+type NopConnectionStore struct{}
+
+// Add does nothing
+func (NopConnectionStore) Add(_ *Connection) error { return nil }
+
+// Remove does nothing
+func (NopConnectionStore) Remove(_ string) error { return nil }
+
+// List returns no connection
+func (NopConnectionStore) List() ([]*Connection, error) { return nil, nil }
+
+// Clear does nothing
+func (NopConnectionStore) Clear() error { return nil }
+
+// Close does nothing
+func (NopConnectionStore) Close() error { return nil }
+
+// FileConnectionStore keeps the connections in a log file where every change is appended as a JSON line. The
+// changes are synced to disk in the background every sync interval and on close, so a crash of the server loses
+// none but a crash of the host may lose those of the last interval. The log is compacted on open and once it holds
+// many more changes than connections, replacing the file atomically so that it is never left partially written
+type FileConnectionStore struct {
+	path         string
+	syncInterval time.Duration
+
+	mutex       sync.Mutex
+	connections map[string]*Connection
+	file        *os.File
+	// entries is the number of changes in the log, compared to the number of connections to compact it
+	entries int
+	dirty   bool
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// DefaultFileSyncInterval is the interval at which the changes of a FileConnectionStore are synced to disk
+const DefaultFileSyncInterval = time.Second
+
+// minCompactEntries is the number of changes under which the log is never compacted
+const minCompactEntries = 1024
+
+// fileEntry is a change appended to the log, the connection opened or the socket id of the connection closed
+type fileEntry struct {
+	Add    *Connection `json:"add,omitempty"`
+	Remove string      `json:"remove,omitempty"`
+}
+
+// NewFileConnectionStore returns a FileConnectionStore holding the connections of the file, if it exists. Changes
+// are synced to disk every syncInterval, defaults to DefaultFileSyncInterval
+func NewFileConnectionStore(path string, syncInterval time.Duration) (*FileConnectionStore, error) {
+	if path == "" {
+		return nil, errors.New("file connection store requires a path")
+	}
+	if syncInterval <= 0 {
+		syncInterval = DefaultFileSyncInterval
+	}
+	s := &FileConnectionStore{
+		path:         path,
+		syncInterval: syncInterval,
+		connections:  make(map[string]*Connection),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	go s.syncLoop()
+	return s, nil
+}
+
+// load applies the changes of the log, a truncated last line left by a crash during a write is ignored
+func (s *FileConnectionStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		entry := fileEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return fmt.Errorf("malformed connection store %s: %w", s.path, err)
+		}
+		s.apply(entry)
+	}
+	return nil
+}
+
+// apply updates the connections with the change
+func (s *FileConnectionStore) apply(entry fileEntry) {
+	if entry.Add != nil {
+		s.connections[entry.Add.SocketID] = entry.Add
+	} else if entry.Remove != "" {
+		delete(s.connections, entry.Remove)
+	}
+}
+
+// Add stores the connection and appends it to the log
+func (s *FileConnectionStore) Add(connection *Connection) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connections[connection.SocketID] = connection
+	return s.append(fileEntry{Add: connection})
+}
+
+// Remove forgets the connection and appends its removal to the log
+func (s *FileConnectionStore) Remove(socketID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.connections[socketID]; !ok {
+		return nil
+	}
+	delete(s.connections, socketID)
+	return s.append(fileEntry{Remove: socketID})
+}
+
+// List returns the connections of the file
+func (s *FileConnectionStore) List() ([]*Connection, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	connections := make([]*Connection, 0, len(s.connections))
+	for _, connection := range s.connections {
+		connections = append(connections, connection)
+	}
+	return connections, nil
+}
+
+// Clear forgets every connection and replaces the file with an empty log
+func (s *FileConnectionStore) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connections = make(map[string]*Connection)
+	return s.compactLocked()
+}
+
+// Close syncs the changes to disk and closes the file
+func (s *FileConnectionStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
+
+// append writes the change at the end of the log, compacting it once it holds many more changes than connections.
+// It must be called with the mutex held
+func (s *FileConnectionStore) append(entry fileEntry) error {
+	if s.file == nil {
+		return errors.New("file connection store closed")
+	}
+	if s.entries >= minCompactEntries && s.entries >= 2*len(s.connections) {
+		return s.compactLocked()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.entries++
+	s.dirty = true
+	return nil
+}
+
+func (s *FileConnectionStore) compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked replaces the log with one change per connection and reopens it for appending, it must be called
+// with the mutex held
+func (s *FileConnectionStore) compactLocked() error {
+	var data []byte
+	for _, connection := range s.connections {
+		line, err := json.Marshal(fileEntry{Add: connection})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.Write(data); err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return err
+	}
+
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	s.entries = len(s.connections)
+	s.dirty = false
+	return nil
+}
+
+// syncLoop syncs the changes appended to the log to disk every sync interval until the store is closed
+func (s *FileConnectionStore) syncLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			if s.dirty && s.file != nil {
+				// a failed sync is retried on the next tick
+				s.dirty = s.file.Sync() != nil
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// RedisConnectionStore keeps the connections as the fields of a redis hash keyed by socket id, it shares the
+// connection handling of RedisStore
+type RedisConnectionStore struct {
+	key   string
+	redis *RedisStore
+}
+
+// NewRedisConnectionStore returns a RedisConnectionStore of the hash key, the connection is dialed on the first request.
+// The key defaults to DefaultConnectionsKey followed by the hostname so that every server keeps its own hash
+func NewRedisConnectionStore(key string, options RedisOptions) (*RedisConnectionStore, error) {
+	if options.Address == "" {
+		return nil, errors.New("redis connection store requires an address")
+	}
+	if key == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			return nil, fmt.Errorf("redis connection store requires a key without hostname: %v", err)
+		}
+		key = DefaultConnectionsKey + ":" + hostname
+	}
+	redis, err := NewRedisStore(options)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisConnectionStore{key: key, redis: redis}, nil
+}
+
+// Add stores the connection in the hash
+func (s *RedisConnectionStore) Add(connection *Connection) error {
+	value, err := json.Marshal(connection)
+	if err != nil {
+		return err
+	}
+	return s.redis.client.HSet(context.Background(), s.key, connection.SocketID, value).Err()
+}
+
+// Remove deletes the connection from the hash
+func (s *RedisConnectionStore) Remove(socketID string) error {
+	return s.redis.client.HDel(context.Background(), s.key, socketID).Err()
+}
+
+// List returns the connections of the hash
+func (s *RedisConnectionStore) List() ([]*Connection, error) {
+	fields, err := s.redis.client.HGetAll(context.Background(), s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	connections := make([]*Connection, 0, len(fields))
+	for _, value := range fields {
+		connection := &Connection{}
+		if err := json.Unmarshal([]byte(value), connection); err != nil {
+			return nil, err
+		}
+		connections = append(connections, connection)
+	}
+	return connections, nil
+}
+
+// Clear deletes the hash
+func (s *RedisConnectionStore) Clear() error {
+	return s.redis.client.Del(context.Background(), s.key).Err()
+}
+
+// Close closes the connections to redis
+func (s *RedisConnectionStore) Close() error {
+	return s.redis.Close()
+}
@@ -0,0 +1,166 @@
+package sessionstore_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
+)
+
+var _ = Describe("Connection stores", func() {
+	connection := func(socketID string) *sessionstore.Connection {
+		return &sessionstore.Connection{DeviceID: "device-" + socketID, SocketID: socketID, SenderID: "vehicle_device.device-" + socketID, ConnectedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	}
+
+	socketIDs := func(store sessionstore.ConnectionStore) []string {
+		connections, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		ids := []string{}
+		for _, connection := range connections {
+			ids = append(ids, connection.SocketID)
+		}
+		return ids
+	}
+
+	Describe("FileConnectionStore", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "connections.json")
+		})
+
+		It("requires a path", func() {
+			_, err := sessionstore.NewFileConnectionStore("", 0)
+			Expect(err).To(MatchError("file connection store requires a path"))
+		})
+
+		It("keeps the connections open across restarts", func() {
+			store, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(socketIDs(store)).To(BeEmpty())
+
+			Expect(store.Add(connection("1"))).To(Succeed())
+			Expect(store.Add(connection("2"))).To(Succeed())
+			Expect(store.Remove("1")).To(Succeed())
+			Expect(store.Remove("unknown")).To(Succeed())
+
+			// the previous run crashed without closing its store
+			restarted, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(restarted.Close)
+			connections, err := restarted.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(connections).To(ConsistOf(PointTo(Equal(*connection("2")))))
+
+			Expect(restarted.Clear()).To(Succeed())
+			Expect(restarted.Close()).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+			restarted, err = sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(restarted.Close)
+			Expect(socketIDs(restarted)).To(BeEmpty())
+		})
+
+		It("appends the changes to the file and compacts it on open", func() {
+			store, err := sessionstore.NewFileConnectionStore(path, time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Add(connection("1"))).To(Succeed())
+			Expect(store.Add(connection("2"))).To(Succeed())
+			Expect(store.Remove("1")).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			data, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Split(strings.TrimSpace(string(data)), "\n")).To(HaveLen(3))
+
+			store, err = sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			data, err = os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Split(strings.TrimSpace(string(data)), "\n")).To(HaveLen(1))
+			Expect(socketIDs(store)).To(ConsistOf("2"))
+		})
+
+		It("compacts the file once it holds many more changes than connections", func() {
+			store, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			for i := 0; i < 1000; i++ {
+				Expect(store.Add(connection(strconv.Itoa(i)))).To(Succeed())
+				Expect(store.Remove(strconv.Itoa(i))).To(Succeed())
+			}
+			Expect(store.Add(connection("last"))).To(Succeed())
+
+			data, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(strings.Split(strings.TrimSpace(string(data)), "\n"))).To(BeNumerically("<", 1024))
+			Expect(socketIDs(store)).To(ConsistOf("last"))
+		})
+
+		It("ignores a last change truncated by a crash", func() {
+			store, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Add(connection("1"))).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteString(`{"add":{"socket_id":`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			store, err = sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			Expect(socketIDs(store)).To(ConsistOf("1"))
+		})
+
+		It("fails on malformed files", func() {
+			Expect(os.WriteFile(path, []byte("{\n{}\n"), 0600)).To(Succeed())
+			_, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).To(MatchError(ContainSubstring("malformed connection store")))
+		})
+	})
+
+	Describe("RedisConnectionStore", func() {
+		It("requires an address", func() {
+			_, err := sessionstore.NewRedisConnectionStore("", sessionstore.RedisOptions{})
+			Expect(err).To(MatchError("redis connection store requires an address"))
+		})
+
+		It("keeps the connections in a hash", func() {
+			redis := newFakeRedis("")
+			store, err := sessionstore.NewRedisConnectionStore("", sessionstore.RedisOptions{Address: redis.listener.Addr().String()})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+
+			Expect(socketIDs(store)).To(BeEmpty())
+			Expect(store.Add(connection("1"))).To(Succeed())
+			hostname, err := os.Hostname()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(redis.lastCommand()[:3]).To(Equal([]string{"hset", sessionstore.DefaultConnectionsKey + ":" + hostname, "1"}))
+			Expect(store.Add(connection("2"))).To(Succeed())
+			Expect(store.Remove("1")).To(Succeed())
+
+			connections, err := store.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(connections).To(ConsistOf(PointTo(Equal(*connection("2")))))
+
+			Expect(store.Clear()).To(Succeed())
+			Expect(socketIDs(store)).To(BeEmpty())
+		})
+	})
+
+	It("keeps no connection without store", func() {
+		store := sessionstore.NopConnectionStore{}
+		Expect(store.Add(connection("1"))).To(Succeed())
+		Expect(socketIDs(store)).To(BeEmpty())
+	})
+})
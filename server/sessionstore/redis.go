@@ -0,0 +1,97 @@
+package sessionstore
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultTTL is the time sessions are kept after they were last saved when not configured
+	DefaultTTL = time.Hour
+	// DefaultTimeout bounds every request to the store when not configured
+	DefaultTimeout = 500 * time.Millisecond
+	// DefaultKeyPrefix is prepended to the device ids to build the keys of the sessions when not configured
+	DefaultKeyPrefix = "fleet-telemetry:session:"
+)
+
+// RedisOptions configures a RedisStore
+type RedisOptions struct {
+	Address   string
+	Password  string
+	DB        int
+	KeyPrefix string
+	TTL       time.Duration
+	Timeout   time.Duration
+	// TLS connects to redis over TLS when set
+	TLS *tls.Config
+}
+
+// RedisStore keeps the sessions in redis as JSON strings expiring after the TTL. Requests are not retried, a
+// failed request is returned to the caller and the connection dialed again by the next one
+type RedisStore struct {
+	options RedisOptions
+	client  *redis.Client
+}
+
+// NewRedisStore returns a RedisStore, the connection is dialed on the first request
+func NewRedisStore(options RedisOptions) (*RedisStore, error) {
+	if options.Address == "" {
+		return nil, errors.New("redis session store requires an address")
+	}
+	if options.KeyPrefix == "" {
+		options.KeyPrefix = DefaultKeyPrefix
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultTTL
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:            options.Address,
+		Password:        options.Password,
+		DB:              options.DB,
+		TLSConfig:       options.TLS,
+		DialTimeout:     options.Timeout,
+		ReadTimeout:     options.Timeout,
+		WriteTimeout:    options.Timeout,
+		MaxRetries:      -1,
+		DisableIdentity: true,
+	})
+	return &RedisStore{options: options, client: client}, nil
+}
+
+// Load returns the last session of the device, nil if none was stored or it expired
+func (s *RedisStore) Load(deviceID string) (*Session, error) {
+	value, err := s.client.Get(context.Background(), s.options.KeyPrefix+deviceID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(value, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Save stores the session of its device, replacing the previous one
+func (s *RedisStore) Save(session *Session) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(context.Background(), s.options.KeyPrefix+session.DeviceID, value, s.options.TTL).Err()
+}
+
+// Close closes the connections to redis
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
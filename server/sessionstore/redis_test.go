@@ -0,0 +1,230 @@
+package sessionstore_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
+)
+
+// fakeRedis serves GET, SET, AUTH and the hash commands of the RESP2 protocol from memory, recording the commands received
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mutex    sync.Mutex
+	values   map[string]string
+	hashes   map[string]map[string]string
+	commands [][]string
+}
+
+func newFakeRedis(password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	r := &fakeRedis{listener: listener, password: password, values: make(map[string]string), hashes: make(map[string]map[string]string)}
+	go r.serve()
+	DeferCleanup(listener.Close)
+	return r
+}
+
+// newFakeRedisTLS returns a fakeRedis served over TLS and the config of its clients
+func newFakeRedisTLS() (*fakeRedis, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	Expect(err).NotTo(HaveOccurred())
+	r := &fakeRedis{listener: listener, values: make(map[string]string), hashes: make(map[string]map[string]string)}
+	go r.serve()
+	DeferCleanup(listener.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	return r, &tls.Config{RootCAs: roots}
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		r.mutex.Lock()
+		r.commands = append(r.commands, args)
+		var reply string
+		switch command := strings.ToUpper(args[0]); {
+		case command == "AUTH" && args[len(args)-1] == r.password:
+			authenticated = true
+			reply = "+OK\r\n"
+		case command == "AUTH":
+			reply = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case command == "SET":
+			r.values[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case command == "GET":
+			value, ok := r.values[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			}
+		case command == "HSET":
+			if r.hashes[args[1]] == nil {
+				r.hashes[args[1]] = make(map[string]string)
+			}
+			r.hashes[args[1]][args[2]] = args[3]
+			reply = ":1\r\n"
+		case command == "HDEL":
+			delete(r.hashes[args[1]], args[2])
+			reply = ":1\r\n"
+		case command == "HGETALL":
+			reply = fmt.Sprintf("*%d\r\n", 2*len(r.hashes[args[1]]))
+			for field, value := range r.hashes[args[1]] {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+			}
+		case command == "DEL":
+			delete(r.hashes, args[1])
+			reply = ":1\r\n"
+		default:
+			// HELLO included, the clients fall back to the RESP2 protocol
+			reply = "-ERR unknown command\r\n"
+		}
+		r.mutex.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeRedis) lastCommand() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.commands[len(r.commands)-1]
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+var _ = Describe("RedisStore", func() {
+	It("requires an address", func() {
+		_, err := sessionstore.NewRedisStore(sessionstore.RedisOptions{})
+		Expect(err).To(MatchError("redis session store requires an address"))
+	})
+
+	It("saves and loads sessions", func() {
+		redis := newFakeRedis("secret")
+		store, err := sessionstore.NewRedisStore(sessionstore.RedisOptions{Address: redis.listener.Addr().String(), Password: "secret", TTL: time.Minute})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.Close)
+
+		session, err := store.Load("device-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(session).To(BeNil())
+
+		connectedAt := time.Now().UTC().Truncate(time.Second)
+		Expect(store.Save(&sessionstore.Session{DeviceID: "device-1", SocketID: "socket-1", LastSequence: 42, ConnectedAt: connectedAt})).To(Succeed())
+		command := redis.lastCommand()
+		Expect(command).To(HaveLen(5))
+		Expect(command[:2]).To(Equal([]string{"set", "fleet-telemetry:session:device-1"}))
+		Expect(command[2]).To(ContainSubstring(`"socket_id":"socket-1"`))
+		Expect(command[3:]).To(Equal([]string{"ex", "60"}))
+
+		session, err = store.Load("device-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(session.SocketID).To(Equal("socket-1"))
+		Expect(session.LastSequence).To(Equal(uint64(42)))
+		Expect(session.ConnectedAt).To(BeTemporally("==", connectedAt))
+	})
+
+	It("connects over TLS", func() {
+		redis, tlsConfig := newFakeRedisTLS()
+		store, err := sessionstore.NewRedisStore(sessionstore.RedisOptions{Address: redis.listener.Addr().String(), TLS: tlsConfig})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.Close)
+
+		Expect(store.Save(&sessionstore.Session{DeviceID: "device-1", SocketID: "socket-1"})).To(Succeed())
+		session, err := store.Load("device-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(session.SocketID).To(Equal("socket-1"))
+	})
+
+	It("returns the errors of redis", func() {
+		redis := newFakeRedis("secret")
+		store, err := sessionstore.NewRedisStore(sessionstore.RedisOptions{Address: redis.listener.Addr().String(), Password: "wrong"})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.Close)
+
+		_, err = store.Load("device-1")
+		Expect(err).To(MatchError(ContainSubstring("WRONGPASS")))
+	})
+
+	It("fails when redis is unreachable", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		address := listener.Addr().String()
+		Expect(listener.Close()).To(Succeed())
+
+		store, err := sessionstore.NewRedisStore(sessionstore.RedisOptions{Address: address})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Save(&sessionstore.Session{DeviceID: "device-1"})).NotTo(Succeed())
+	})
+})
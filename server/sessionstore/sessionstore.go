@@ -0,0 +1,27 @@
+package sessionstore
+
+import (
+	"time"
+)
+
+// Session is the connection metadata of a device kept across server restarts so that a device
+// reconnecting to a new pod resumes its reconnect tracking and sequence numbers
+type Session struct {
+	DeviceID       string    `json:"device_id"`
+	SocketID       string    `json:"socket_id"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	LastSequence   uint64    `json:"last_sequence,omitempty"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at,omitempty"`
+}
+
+// Store persists the sessions of the devices outside of the server, sessions expire after the
+// time to live of the store
+type Store interface {
+	// Load returns the last session of the device, nil if none was stored or it expired
+	Load(deviceID string) (*Session, error)
+	// Save stores the session of its device, replacing the previous one
+	Save(session *Session) error
+	// Close releases the connections of the store
+	Close() error
+}
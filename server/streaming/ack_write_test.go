@@ -0,0 +1,87 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// failingWriter accepts up to limit bytes and fails the writes past it
+type failingWriter struct {
+	written int
+	limit   int
+	closed  bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	n := min(len(p), w.limit-w.written)
+	w.written += n
+	if n < len(p) {
+		return n, errors.New("connection reset")
+	}
+	return n, nil
+}
+
+func (w *failingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+var _ = Describe("Ack writes", func() {
+	var (
+		sm     *SocketManager
+		writer *failingWriter
+	)
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		conf := &config.Config{MetricCollector: noop.NewCollector()}
+		sm = NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: "42"}, nil, conf, logger)
+		writer = &failingWriter{limit: 8}
+		sm.nextWriter = func(_ int) (io.WriteCloser, error) { return writer, nil }
+	})
+
+	It("writes acks", func() {
+		Expect(sm.writeAck(SocketMessage{websocket.BinaryMessage, []byte("12345678")})).To(Succeed())
+		Expect(writer.written).To(Equal(8))
+		Expect(writer.closed).To(BeTrue())
+	})
+
+	It("fails the connection on a write error mid-ack", func() {
+		err := sm.writeAck(SocketMessage{websocket.BinaryMessage, []byte("123456789012")})
+
+		var partialErr *partialWriteError
+		Expect(errors.As(err, &partialErr)).To(BeTrue())
+		Expect(partialErr.written).To(Equal(8))
+		Expect(writer.closed).To(BeTrue())
+		Expect(ackWriteErrorCause(err)).To(Equal("partial_write"))
+
+		sm.failAck(err)
+		Expect(sm.serverDisconnectReason()).To(Equal(DisconnectReasonAckWriteFailed))
+	})
+
+	It("classifies write errors", func() {
+		Expect(ackWriteErrorCause(websocket.ErrCloseSent)).To(Equal("closed"))
+		Expect(ackWriteErrorCause(&partialWriteError{err: errors.New("reset")})).To(Equal("error"))
+	})
+
+	It("fails the connection when the writer cannot be opened", func() {
+		sm.nextWriter = func(_ int) (io.WriteCloser, error) { return nil, websocket.ErrCloseSent }
+
+		err := sm.writeAck(SocketMessage{websocket.BinaryMessage, []byte("12345678")})
+		Expect(ackWriteErrorCause(err)).To(Equal("closed"))
+
+		sm.failAck(err)
+		Expect(sm.serverDisconnectReason()).To(Equal(DisconnectReasonAckWriteFailed))
+	})
+})
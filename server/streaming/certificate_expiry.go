@@ -0,0 +1,44 @@
+package streaming
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+// defaultCertificateExpiryWarningDays is the number of days before the expiry of a client certificate from which
+// its connections log a warning when not configured
+const defaultCertificateExpiryWarningDays = 30
+
+// errExpiredCertificate is returned when a client certificate forwarded by the reverse proxy is past its expiry
+var errExpiredCertificate = errors.New("expired_certificate_error")
+
+// clientCertDaysToExpiryBuckets are the upper bounds of the buckets of client_cert_days_to_expiry
+var clientCertDaysToExpiryBuckets = []float64{0, 1, 7, 14, 30, 60, 90, 180, 365, 730}
+
+// checkExpiry returns errExpiredCertificate for pass through certificates past their expiry as the reverse proxy may
+// not have validated them, expired certificates presented over TLS are already rejected by the handshake
+func (s *Server) checkExpiry(cert *x509.Certificate, passThrough bool) error {
+	if passThrough && time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("%w: common_name: %s, not_after: %s", errExpiredCertificate, cert.Subject.CommonName, cert.NotAfter)
+	}
+	return nil
+}
+
+// reportExpiry reports the days until the client certificate of a connection expires and warns about certificates
+// expiring within the warning days
+func (s *Server) reportExpiry(cert *x509.Certificate) {
+	daysToExpiry := int64(time.Until(cert.NotAfter) / (24 * time.Hour))
+	s.metrics.clientCertDaysToExpiry.Observe(daysToExpiry, map[string]string{})
+	if daysToExpiry < int64(s.certificateExpiryWarningDays) {
+		s.logger.Log(logrus.WARN, "client_certificate_expiring", logrus.LogInfo{
+			"common_name":    s.certificateLogValue(config.CertificateLogSubject, cert.Subject.CommonName),
+			"not_after":      s.certificateLogValue(config.CertificateLogValidity, cert.NotAfter.String()),
+			"days_to_expiry": daysToExpiry,
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package streaming
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+)
+
+var _ = Describe("Certificate log redaction", func() {
+	cert := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "device-1"},
+		Issuer:    pkix.Name{CommonName: "Tesla Motors Products CA"},
+		NotBefore: time.Unix(0, 0).UTC(),
+		NotAfter:  time.Unix(0, 0).UTC(),
+	}
+
+	initServer := func(redaction *config.CertificateLogRedaction) (*Server, error) {
+		logger, _ := logrus.NoOpLogger()
+		conf := &config.Config{CertificateLogRedaction: redaction, MetricCollector: noop.NewCollector()}
+		_, s, err := InitServer(conf, airbrake.NewAirbrakeHandler(nil), nil, logger, NewSocketRegistry())
+		return s, err
+	}
+
+	It("redacts the configured components", func() {
+		s, err := initServer(&config.CertificateLogRedaction{Components: []config.CertificateLogComponent{config.CertificateLogSubject, config.CertificateLogChain}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.clientCertificateLogInfo(cert)).To(Equal(logrus.LogInfo{
+			"Subject":   "[redacted]",
+			"Issuer":    "Tesla Motors Products CA",
+			"NotBefore": cert.NotBefore.String(),
+			"NotAfter":  cert.NotAfter.String(),
+		}))
+		Expect(s.chainLogValue([]string{"device-1", "Tesla Motors Products CA"})).To(Equal("[redacted]"))
+	})
+
+	It("logs every component in debug", func() {
+		s, err := initServer(&config.CertificateLogRedaction{Components: []config.CertificateLogComponent{config.CertificateLogSubject}, Debug: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.clientCertificateLogInfo(cert)).To(HaveKeyWithValue("Subject", "device-1"))
+		Expect(s.chainLogValue([]string{"device-1", "Tesla Motors Products CA"})).To(Equal("device-1|Tesla Motors Products CA"))
+	})
+
+	It("rejects unknown components", func() {
+		_, err := initServer(&config.CertificateLogRedaction{Components: []config.CertificateLogComponent{"serial"}})
+		Expect(err).To(MatchError("invalid certificate_log_redaction component serial"))
+	})
+})
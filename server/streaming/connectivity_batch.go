@@ -0,0 +1,177 @@
+package streaming
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// defaultConnectivityBatchMaxEvents is the number of events at which a batch is dispatched when not configured
+	defaultConnectivityBatchMaxEvents = 100
+	// defaultConnectivityBatchFlushInterval is the interval at which the pending events are dispatched when not configured
+	defaultConnectivityBatchFlushInterval = time.Second
+
+	// connectivityBatchTopic is the record type of the batches, apart from the connectivity records of single events
+	connectivityBatchTopic = "connectivity_batch"
+	// connectivityBatchSenderID is the sender of the batches, which hold the events of several devices
+	connectivityBatchSenderID = "server.connectivity_batch"
+)
+
+// connectivityBatch holds the pending events of the connections of a routing region, which share their dispatch rules
+type connectivityBatch struct {
+	region                 string
+	rules                  map[string][]telemetry.Producer
+	transmitDecodedRecords bool
+	events                 []*protos.VehicleConnectivity
+}
+
+// connectivityBatcher accumulates the connectivity events by routing region and hands the batches to flush once
+// they hold max events, every flush interval and when closed. Events added once closed are flushed right away
+type connectivityBatcher struct {
+	maxEvents int
+	interval  time.Duration
+	flush     func(batch *connectivityBatch)
+
+	mutex   sync.Mutex
+	batches map[string]*connectivityBatch
+	closed  bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// newConnectivityBatcher returns nil when the connectivity events are not batched
+func newConnectivityBatcher(c *config.ConnectivityBatching, flush func(batch *connectivityBatch)) *connectivityBatcher {
+	if c == nil {
+		return nil
+	}
+	maxEvents := defaultConnectivityBatchMaxEvents
+	if c.MaxEvents > 0 {
+		maxEvents = c.MaxEvents
+	}
+	interval := defaultConnectivityBatchFlushInterval
+	if c.FlushIntervalMs > 0 {
+		interval = time.Duration(c.FlushIntervalMs) * time.Millisecond
+	}
+	return &connectivityBatcher{
+		maxEvents: maxEvents,
+		interval:  interval,
+		flush:     flush,
+		batches:   make(map[string]*connectivityBatch),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// add appends the event to the batch of the region, which is dispatched with the latest rules of the region
+func (b *connectivityBatcher) add(region string, rules map[string][]telemetry.Producer, transmitDecodedRecords bool, event *protos.VehicleConnectivity) {
+	b.mutex.Lock()
+	batch, ok := b.batches[region]
+	if !ok {
+		batch = &connectivityBatch{region: region}
+		b.batches[region] = batch
+	}
+	batch.rules = rules
+	batch.transmitDecodedRecords = transmitDecodedRecords
+	batch.events = append(batch.events, event)
+	full := b.closed || len(batch.events) >= b.maxEvents
+	if full {
+		delete(b.batches, region)
+	}
+	b.mutex.Unlock()
+
+	if full {
+		b.flush(batch)
+	}
+}
+
+// flushAll dispatches the pending events of every region
+func (b *connectivityBatcher) flushAll() {
+	b.mutex.Lock()
+	batches := b.batches
+	b.batches = make(map[string]*connectivityBatch)
+	b.mutex.Unlock()
+
+	for _, batch := range batches {
+		b.flush(batch)
+	}
+}
+
+// run dispatches the pending events every flush interval until close
+func (b *connectivityBatcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.flushAll()
+		}
+	}
+}
+
+// close stops the periodic flushes and dispatches the pending events
+func (b *connectivityBatcher) close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	<-b.done
+	b.mutex.Lock()
+	b.closed = true
+	b.mutex.Unlock()
+	b.flushAll()
+}
+
+// dispatchConnectivityBatch dispatches the events of the batch as a single connectivity_batch record
+func (s *Server) dispatchConnectivityBatch(batch *connectivityBatch) {
+	if err := s.produceConnectivityBatch(batch); err != nil {
+		s.logger.ErrorLog("connectivity_batch_dispatch_error", err, logrus.LogInfo{"events": len(batch.events)})
+	}
+}
+
+func (s *Server) produceConnectivityBatch(batch *connectivityBatch) error {
+	payload, err := proto.Marshal(&protos.VehicleConnectivityBatch{Events: batch.events})
+	if err != nil {
+		return err
+	}
+
+	txid := uuid.New().String()
+	streamMessage := messages.StreamMessage{
+		TXID:         []byte(txid),
+		SenderID:     []byte(connectivityBatchSenderID),
+		MessageTopic: []byte(connectivityBatchTopic),
+		Payload:      payload,
+		CreatedAt:    uint32(time.Now().Unix()),
+	}
+	message, err := streamMessage.ToBytes()
+	if err != nil {
+		return err
+	}
+	// the batches of a region share their partition key so that they are consumed in order
+	partitionKey := connectivityBatchSenderID
+	if batch.region != "" {
+		partitionKey = fmt.Sprintf("%s.%s", connectivityBatchSenderID, batch.region)
+	}
+	serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{SenderID: connectivityBatchSenderID, DeviceID: partitionKey}, batch.rules, s.logger)
+	record, err := telemetry.NewRecord(serializer, message, txid, batch.transmitDecodedRecords)
+	if err != nil {
+		return err
+	}
+	for _, producer := range batch.rules[connectivityBatchTopic] {
+		producer.Produce(record)
+	}
+	s.metrics.connectivityBatchSize.Observe(int64(len(batch.events)), map[string]string{})
+	return nil
+}
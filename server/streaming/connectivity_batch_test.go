@@ -0,0 +1,90 @@
+package streaming
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+var _ = Describe("Connectivity batcher", func() {
+	var (
+		mutex   sync.Mutex
+		flushed []*connectivityBatch
+	)
+
+	flush := func(batch *connectivityBatch) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		flushed = append(flushed, batch)
+	}
+	flushedBatches := func() []*connectivityBatch {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return flushed
+	}
+	event := func(vin string) *protos.VehicleConnectivity {
+		return &protos.VehicleConnectivity{Vin: vin}
+	}
+
+	BeforeEach(func() {
+		flushed = nil
+	})
+
+	It("is disabled without configuration", func() {
+		Expect(newConnectivityBatcher(nil, flush)).To(BeNil())
+	})
+
+	It("defaults the batch size and flush interval", func() {
+		batcher := newConnectivityBatcher(&config.ConnectivityBatching{}, flush)
+		Expect(batcher.maxEvents).To(Equal(defaultConnectivityBatchMaxEvents))
+		Expect(batcher.interval).To(Equal(defaultConnectivityBatchFlushInterval))
+	})
+
+	It("flushes the batches reaching max events", func() {
+		batcher := newConnectivityBatcher(&config.ConnectivityBatching{MaxEvents: 2, FlushIntervalMs: 60000}, flush)
+		batcher.add("", nil, false, event("1"))
+		batcher.add("eu", nil, false, event("2"))
+		Expect(flushedBatches()).To(BeEmpty())
+
+		batcher.add("", nil, true, event("3"))
+		Expect(flushedBatches()).To(HaveLen(1))
+		Expect(flushedBatches()[0].events).To(Equal([]*protos.VehicleConnectivity{event("1"), event("3")}))
+		Expect(flushedBatches()[0].transmitDecodedRecords).To(BeTrue())
+	})
+
+	It("flushes the pending events every flush interval", func() {
+		batcher := newConnectivityBatcher(&config.ConnectivityBatching{MaxEvents: 10, FlushIntervalMs: 50}, flush)
+		go batcher.run()
+		DeferCleanup(batcher.close)
+
+		batcher.add("", nil, false, event("1"))
+		Eventually(flushedBatches).Should(HaveLen(1))
+		Consistently(flushedBatches, 150*time.Millisecond).Should(HaveLen(1))
+	})
+
+	It("flushes the pending events when closed", func() {
+		batcher := newConnectivityBatcher(&config.ConnectivityBatching{MaxEvents: 10, FlushIntervalMs: 60000}, flush)
+		go batcher.run()
+		batcher.add("", nil, false, event("1"))
+		batcher.add("eu", nil, false, event("2"))
+
+		batcher.close()
+		Expect(flushedBatches()).To(HaveLen(2))
+	})
+
+	It("flushes the events added once closed right away", func() {
+		batcher := newConnectivityBatcher(&config.ConnectivityBatching{MaxEvents: 10, FlushIntervalMs: 60000}, flush)
+		go batcher.run()
+		batcher.close()
+
+		batcher.add("eu", nil, false, event("1"))
+		Expect(flushedBatches()).To(HaveLen(1))
+		Expect(flushedBatches()[0].region).To(Equal("eu"))
+		Expect(flushedBatches()[0].events).To(Equal([]*protos.VehicleConnectivity{event("1")}))
+	})
+})
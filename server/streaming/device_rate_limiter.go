@@ -0,0 +1,91 @@
+package streaming
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// deviceRateLimiter bounds the messages of each device with a token bucket shared by the connections of the device.
+// The bucket of a device is kept while it has a connection registered, the connections hold their bucket so that
+// the limiter is only locked when they register and deregister
+type deviceRateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mutex   sync.Mutex
+	buckets map[string]*deviceBucket
+}
+
+type deviceBucket struct {
+	// connections is guarded by the mutex of the limiter
+	connections int
+
+	mutex     sync.Mutex
+	tokens    float64
+	updatedAt time.Time
+}
+
+// newDeviceRateLimiter returns nil when the messages are unlimited, the burst defaults to one second of messages
+func newDeviceRateLimiter(messagesPerSecond float64, burst int) *deviceRateLimiter {
+	if messagesPerSecond <= 0 {
+		return nil
+	}
+	limiter := &deviceRateLimiter{rate: messagesPerSecond, burst: float64(burst), now: time.Now, buckets: make(map[string]*deviceBucket)}
+	if burst <= 0 {
+		limiter.burst = math.Max(1, math.Ceil(messagesPerSecond))
+	}
+	return limiter
+}
+
+// acquire counts a connection of the device and returns its bucket, the bucket is created full for its first connection
+func (l *deviceRateLimiter) acquire(deviceID string) *deviceBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[deviceID]
+	if !ok {
+		bucket = &deviceBucket{tokens: l.burst, updatedAt: l.now()}
+		l.buckets[deviceID] = bucket
+	}
+	bucket.connections++
+	return bucket
+}
+
+// release uncounts a connection of the device, its bucket is removed with its last connection
+func (l *deviceRateLimiter) release(deviceID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[deviceID]
+	if !ok {
+		return
+	}
+	if bucket.connections <= 1 {
+		delete(l.buckets, deviceID)
+		return
+	}
+	bucket.connections--
+}
+
+// allow takes a token from the bucket of a connection, it returns false if the device exceeded its rate
+func (l *deviceRateLimiter) allow(bucket *deviceBucket) bool {
+	if bucket == nil {
+		// connections without device identity are not limited
+		return true
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := l.now()
+	if elapsed := now.Sub(bucket.updatedAt); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed.Seconds()*l.rate)
+		bucket.updatedAt = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
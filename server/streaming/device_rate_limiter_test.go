@@ -0,0 +1,70 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Device rate limiter", func() {
+	var now time.Time
+
+	newLimiter := func(messagesPerSecond float64, burst int) *deviceRateLimiter {
+		limiter := newDeviceRateLimiter(messagesPerSecond, burst)
+		now = time.Now()
+		limiter.now = func() time.Time { return now }
+		return limiter
+	}
+
+	It("is disabled without rate", func() {
+		Expect(newDeviceRateLimiter(0, 10)).To(BeNil())
+	})
+
+	It("defaults the burst to one second of messages", func() {
+		Expect(newDeviceRateLimiter(2.5, 0).burst).To(Equal(3.0))
+		Expect(newDeviceRateLimiter(0.1, 0).burst).To(Equal(1.0))
+	})
+
+	It("refills the bucket of each device at the configured rate", func() {
+		limiter := newLimiter(2, 2)
+		first := limiter.acquire("1")
+		second := limiter.acquire("2")
+
+		Expect(limiter.allow(first)).To(BeTrue())
+		Expect(limiter.allow(first)).To(BeTrue())
+		Expect(limiter.allow(first)).To(BeFalse())
+		Expect(limiter.allow(second)).To(BeTrue())
+
+		now = now.Add(500 * time.Millisecond)
+		Expect(limiter.allow(first)).To(BeTrue())
+		Expect(limiter.allow(first)).To(BeFalse())
+
+		now = now.Add(time.Hour)
+		Expect(limiter.allow(first)).To(BeTrue())
+		Expect(limiter.allow(first)).To(BeTrue())
+		Expect(limiter.allow(first)).To(BeFalse())
+	})
+
+	It("shares the bucket between the connections of a device", func() {
+		limiter := newLimiter(1, 1)
+		first := limiter.acquire("1")
+		second := limiter.acquire("1")
+		Expect(second).To(BeIdenticalTo(first))
+		Expect(limiter.allow(first)).To(BeTrue())
+
+		limiter.release("1")
+		Expect(limiter.buckets).To(HaveKey("1"))
+		Expect(limiter.allow(second)).To(BeFalse())
+
+		limiter.release("1")
+		Expect(limiter.buckets).To(BeEmpty())
+	})
+
+	It("does not limit the connections without bucket", func() {
+		limiter := newLimiter(1, 1)
+		Expect(limiter.allow(nil)).To(BeTrue())
+		Expect(limiter.allow(nil)).To(BeTrue())
+		Expect(limiter.buckets).To(BeEmpty())
+	})
+})
@@ -0,0 +1,90 @@
+package streaming
+
+import (
+	"time"
+)
+
+// keepaliveAction is what the deadline owner of a connection does when checking it
+type keepaliveAction int
+
+const (
+	// keepaliveWait waits until the next check
+	keepaliveWait keepaliveAction = iota
+	// keepalivePing pings the connection
+	keepalivePing
+	// keepaliveReadTimeout closes the connection on which nothing was received for the read timeout
+	keepaliveReadTimeout
+	// keepalivePongTimeout closes the connection which did not answer a ping within the pong timeout
+	keepalivePongTimeout
+	// keepaliveIdleTimeout closes the connection on which no data frame was received for the idle timeout
+	keepaliveIdleTimeout
+)
+
+// keepalive decides when a connection is pinged and when it is closed for the read, pong or idle timeout, from the
+// last time anything was received and the last time a data frame was received. It is only used by the deadline
+// owner of the connection, which holds the single read deadline and timer of the connection
+type keepalive struct {
+	readTimeout  time.Duration
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	idleTimeout  time.Duration
+
+	// lastPingAt is the time the last ping was sent, or the connection started
+	lastPingAt time.Time
+	// pingSentAt is the time of the ping awaiting an answer, zero when none is
+	pingSentAt time.Time
+}
+
+func newKeepalive(readTimeout, pingInterval, pongTimeout, idleTimeout time.Duration, start time.Time) *keepalive {
+	return &keepalive{
+		readTimeout:  readTimeout,
+		pingInterval: pingInterval,
+		pongTimeout:  pongTimeout,
+		idleTimeout:  idleTimeout,
+		lastPingAt:   start,
+	}
+}
+
+// next returns the action due at now and, unless the connection is closed, the time of the next check, zero
+// when there is nothing to check. Anything received after a ping, data or pong, answers it while only data
+// frames keep the connection from being idle
+func (k *keepalive) next(now, lastReadAt, lastFrameAt time.Time) (keepaliveAction, time.Time) {
+	if !k.pingSentAt.IsZero() && !lastReadAt.Before(k.pingSentAt) {
+		k.pingSentAt = time.Time{}
+	}
+
+	switch {
+	case k.idleTimeout > 0 && !now.Before(lastFrameAt.Add(k.idleTimeout)):
+		return keepaliveIdleTimeout, time.Time{}
+	case !k.pingSentAt.IsZero() && !now.Before(k.pingSentAt.Add(k.pongTimeout)):
+		return keepalivePongTimeout, time.Time{}
+	case k.readTimeout > 0 && !now.Before(lastReadAt.Add(k.readTimeout)):
+		return keepaliveReadTimeout, time.Time{}
+	}
+
+	action := keepaliveWait
+	// the next ping is not sent before the previous one is answered
+	if k.pingInterval > 0 && k.pingSentAt.IsZero() && !now.Before(k.lastPingAt.Add(k.pingInterval)) {
+		action = keepalivePing
+		k.lastPingAt, k.pingSentAt = now, now
+	}
+
+	var at time.Time
+	earliest := func(deadline time.Time) {
+		if at.IsZero() || deadline.Before(at) {
+			at = deadline
+		}
+	}
+	if k.idleTimeout > 0 {
+		earliest(lastFrameAt.Add(k.idleTimeout))
+	}
+	if k.readTimeout > 0 {
+		earliest(lastReadAt.Add(k.readTimeout))
+	}
+	if !k.pingSentAt.IsZero() {
+		earliest(k.pingSentAt.Add(k.pongTimeout))
+	} else if k.pingInterval > 0 {
+		earliest(k.lastPingAt.Add(k.pingInterval))
+	}
+	return action, at
+}
@@ -0,0 +1,95 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keepalive schedule", func() {
+	start := time.Unix(1000, 0)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	It("has nothing to check without timeout", func() {
+		action, next := newKeepalive(0, 0, 0, 0, start).next(at(60), start, start)
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next.IsZero()).To(BeTrue())
+	})
+
+	It("closes the connections on which nothing is received for the read timeout", func() {
+		keepalive := newKeepalive(10*time.Second, 0, 0, 0, start)
+		action, next := keepalive.next(at(5), start, start)
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next).To(Equal(at(10)))
+
+		action, next = keepalive.next(at(10), at(4), at(4))
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next).To(Equal(at(14)))
+
+		action, _ = keepalive.next(at(14), at(4), at(4))
+		Expect(action).To(Equal(keepaliveReadTimeout))
+	})
+
+	It("pings the connections every ping interval while they answer", func() {
+		keepalive := newKeepalive(0, 10*time.Second, 5*time.Second, 0, start)
+		action, next := keepalive.next(at(10), start, start)
+		Expect(action).To(Equal(keepalivePing))
+		Expect(next).To(Equal(at(15)))
+
+		// the pong answers the ping
+		action, next = keepalive.next(at(15), at(12), start)
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next).To(Equal(at(20)))
+
+		action, _ = keepalive.next(at(20), at(12), start)
+		Expect(action).To(Equal(keepalivePing))
+	})
+
+	It("closes the connections not answering a ping within the pong timeout", func() {
+		keepalive := newKeepalive(0, 10*time.Second, 5*time.Second, 0, start)
+		action, _ := keepalive.next(at(10), start, start)
+		Expect(action).To(Equal(keepalivePing))
+
+		action, _ = keepalive.next(at(15), start, start)
+		Expect(action).To(Equal(keepalivePongTimeout))
+	})
+
+	It("does not push back the pong timeout of an unanswered ping", func() {
+		keepalive := newKeepalive(0, 2*time.Second, 5*time.Second, 0, start)
+		action, next := keepalive.next(at(2), start, start)
+		Expect(action).To(Equal(keepalivePing))
+		Expect(next).To(Equal(at(7)))
+
+		action, next = keepalive.next(at(4), start, start)
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next).To(Equal(at(7)))
+
+		action, _ = keepalive.next(at(7), start, start)
+		Expect(action).To(Equal(keepalivePongTimeout))
+	})
+
+	It("closes the connections answering the pings without sending data for the idle timeout", func() {
+		keepalive := newKeepalive(0, 10*time.Second, 5*time.Second, 30*time.Second, start)
+		action, _ := keepalive.next(at(10), start, start)
+		Expect(action).To(Equal(keepalivePing))
+		action, _ = keepalive.next(at(20), at(11), start)
+		Expect(action).To(Equal(keepalivePing))
+
+		action, next := keepalive.next(at(25), at(21), start)
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next).To(Equal(at(30)))
+
+		action, _ = keepalive.next(at(30), at(21), start)
+		Expect(action).To(Equal(keepaliveIdleTimeout))
+	})
+
+	It("keeps the connections sending data open", func() {
+		keepalive := newKeepalive(0, 0, 0, 30*time.Second, start)
+		action, next := keepalive.next(at(30), at(25), at(25))
+		Expect(action).To(Equal(keepaliveWait))
+		Expect(next).To(Equal(at(55)))
+	})
+})
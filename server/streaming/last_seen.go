@@ -0,0 +1,116 @@
+package streaming
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/internal/lru"
+)
+
+const (
+	// DefaultLastSeenMaxDevices bounds the number of devices whose last activity is kept when not configured
+	DefaultLastSeenMaxDevices = 1000000
+
+	// DefaultLastSeenTTL is the time after which the last activity of a device is forgotten when not configured
+	DefaultLastSeenTTL = 7 * 24 * time.Hour
+
+	// LastSeenEventConnect is the event of devices last seen connecting
+	LastSeenEventConnect = "connect"
+	// LastSeenEventRecord is the event of devices last seen sending a record
+	LastSeenEventRecord = "record"
+	// LastSeenEventDisconnect is the event of devices last seen disconnecting
+	LastSeenEventDisconnect = "disconnect"
+)
+
+// LastSeen is the last activity of a device
+type LastSeen struct {
+	DeviceID string    `json:"device_id"`
+	LastSeen time.Time `json:"last_seen"`
+	Event    string    `json:"event"`
+}
+
+// lastSeenTracker keeps the last activity of the most recently seen devices, the least recently seen devices are
+// evicted when full and disconnected devices not seen for the ttl are forgotten. It is only updated when the devices
+// connect and disconnect, the activity of connected devices is read from their socket
+type lastSeenTracker struct {
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	devices *lru.Cache[string, *lastSeenEntry]
+}
+
+type lastSeenEntry struct {
+	lastSeen LastSeen
+	// socket is the connection of the device while it is connected
+	socket *SocketManager
+}
+
+func newLastSeenTracker(c *config.LastSeen) *lastSeenTracker {
+	if c == nil {
+		return nil
+	}
+	maxDevices := c.MaxDevices
+	if maxDevices <= 0 {
+		maxDevices = DefaultLastSeenMaxDevices
+	}
+	ttl := time.Duration(c.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = DefaultLastSeenTTL
+	}
+	return &lastSeenTracker{
+		ttl:     ttl,
+		devices: lru.New[string, *lastSeenEntry](maxDevices),
+	}
+}
+
+// connected tracks the socket of the device until it disconnects
+func (t *lastSeenTracker) connected(socket *SocketManager) {
+	if t == nil || socket.requestIdentity == nil || socket.requestIdentity.DeviceID == "" {
+		return
+	}
+	deviceID := socket.requestIdentity.DeviceID
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.devices.Add(deviceID, &lastSeenEntry{
+		lastSeen: LastSeen{DeviceID: deviceID, LastSeen: socket.connectedAt, Event: LastSeenEventConnect},
+		socket:   socket,
+	})
+}
+
+// disconnected records the disconnection of the device, unless it reconnected with another socket since
+func (t *lastSeenTracker) disconnected(socket *SocketManager, now time.Time) {
+	if t == nil || socket.requestIdentity == nil || socket.requestIdentity.DeviceID == "" {
+		return
+	}
+	deviceID := socket.requestIdentity.DeviceID
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if entry, ok := t.devices.Peek(deviceID); ok && entry.socket != nil && entry.socket != socket {
+		return
+	}
+	t.devices.Add(deviceID, &lastSeenEntry{lastSeen: LastSeen{DeviceID: deviceID, LastSeen: now, Event: LastSeenEventDisconnect}})
+}
+
+// lookup returns the last activity of the device, false if it is disconnected and was not seen within the ttl
+func (t *lastSeenTracker) lookup(deviceID string, now time.Time) (LastSeen, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, ok := t.devices.Peek(deviceID)
+	if !ok {
+		return LastSeen{}, false
+	}
+	if entry.socket != nil {
+		return entry.socket.lastActivity(), true
+	}
+	if now.Sub(entry.lastSeen.LastSeen) > t.ttl {
+		t.devices.Remove(deviceID)
+		return LastSeen{}, false
+	}
+	return entry.lastSeen, true
+}
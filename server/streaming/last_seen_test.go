@@ -0,0 +1,109 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Last seen tracker", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Now()
+	})
+
+	socket := func(deviceID string, connectedAt time.Time) *SocketManager {
+		return &SocketManager{recordPipeline: recordPipeline{requestIdentity: &telemetry.RequestIdentity{DeviceID: deviceID}}, connectedAt: connectedAt}
+	}
+
+	It("is disabled without configuration", func() {
+		tracker := newLastSeenTracker(nil)
+		Expect(tracker).To(BeNil())
+		tracker.connected(socket("device", now))
+		tracker.disconnected(socket("device", now), now)
+	})
+
+	It("reads the activity of connected devices from their socket", func() {
+		tracker := newLastSeenTracker(&config.LastSeen{})
+		sm := socket("device", now)
+		tracker.connected(sm)
+
+		lastSeen, ok := tracker.lookup("device", now.Add(time.Minute))
+		Expect(ok).To(BeTrue())
+		Expect(lastSeen).To(Equal(LastSeen{DeviceID: "device", LastSeen: now, Event: LastSeenEventConnect}))
+
+		sm.framesRead.Add(1)
+		sm.lastFrameAt.Store(now.Add(time.Second).UnixNano())
+		lastSeen, _ = tracker.lookup("device", now.Add(time.Minute))
+		Expect(lastSeen.LastSeen).To(BeTemporally("==", now.Add(time.Second)))
+		Expect(lastSeen.Event).To(Equal(LastSeenEventRecord))
+
+		tracker.disconnected(sm, now.Add(2*time.Second))
+		lastSeen, _ = tracker.lookup("device", now.Add(time.Minute))
+		Expect(lastSeen).To(Equal(LastSeen{DeviceID: "device", LastSeen: now.Add(2 * time.Second), Event: LastSeenEventDisconnect}))
+		_, ok = tracker.lookup("other", now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("ignores the disconnection of a replaced socket", func() {
+		tracker := newLastSeenTracker(&config.LastSeen{})
+		previous := socket("device", now)
+		tracker.connected(previous)
+		tracker.connected(socket("device", now.Add(time.Second)))
+		tracker.disconnected(previous, now.Add(2*time.Second))
+
+		lastSeen, _ := tracker.lookup("device", now)
+		Expect(lastSeen).To(Equal(LastSeen{DeviceID: "device", LastSeen: now.Add(time.Second), Event: LastSeenEventConnect}))
+	})
+
+	It("evicts the least recently seen devices when full", func() {
+		tracker := newLastSeenTracker(&config.LastSeen{MaxDevices: 2})
+		first := socket("first", now)
+		tracker.connected(first)
+		tracker.connected(socket("second", now))
+		tracker.disconnected(first, now)
+		tracker.connected(socket("third", now))
+
+		_, ok := tracker.lookup("second", now)
+		Expect(ok).To(BeFalse())
+		_, ok = tracker.lookup("first", now)
+		Expect(ok).To(BeTrue())
+		_, ok = tracker.lookup("third", now)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("forgets the disconnected devices not seen within the ttl", func() {
+		tracker := newLastSeenTracker(&config.LastSeen{TTLSeconds: 60})
+		tracker.disconnected(socket("device", now), now)
+
+		_, ok := tracker.lookup("device", now.Add(2*time.Minute))
+		Expect(ok).To(BeFalse())
+		Expect(tracker.devices.Len()).To(Equal(0))
+	})
+
+	It("falls back to the session store for devices not seen by the server", func() {
+		registry := NewSocketRegistry()
+		registry.SetSessionStore(&memorySessionStore{sessions: map[string]*sessionstore.Session{
+			"disconnected": {DeviceID: "disconnected", ConnectedAt: now.Add(-time.Hour), DisconnectedAt: now},
+			"interrupted":  {DeviceID: "interrupted", ConnectedAt: now.Add(-time.Hour)},
+		}})
+		s := &Server{registry: registry, lastSeen: newLastSeenTracker(&config.LastSeen{})}
+
+		lastSeen, source := s.lookupLastSeen("disconnected")
+		Expect(source).To(Equal("session_store"))
+		Expect(*lastSeen).To(Equal(LastSeen{DeviceID: "disconnected", LastSeen: now, Event: LastSeenEventDisconnect}))
+
+		lastSeen, _ = s.lookupLastSeen("interrupted")
+		Expect(*lastSeen).To(Equal(LastSeen{DeviceID: "interrupted", LastSeen: now.Add(-time.Hour), Event: LastSeenEventConnect}))
+
+		lastSeen, source = s.lookupLastSeen("unknown")
+		Expect(source).To(Equal("none"))
+		Expect(lastSeen).To(BeNil())
+	})
+})
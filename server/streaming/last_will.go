@@ -0,0 +1,42 @@
+package streaming
+
+import (
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// ReconcileConnections dispatches the disconnected connectivity events of the connections left in the store by
+// the previous run of the server, which died without closing them, then clears the store. It must be called
+// before the server accepts connections and before the store is set on the socket registry
+func (s *Server) ReconcileConnections(store sessionstore.ConnectionStore, config *config.Config) error {
+	connections, err := store.List()
+	if err != nil {
+		return err
+	}
+	for _, connection := range connections {
+		deviceType, _ := messages.ParseSenderID(connection.SenderID)
+		requestIdentity := &telemetry.RequestIdentity{DeviceID: connection.DeviceID, SenderID: connection.SenderID, DeviceType: deviceType, Region: connection.Region}
+		serializer, routingRegion := s.newSerializer(requestIdentity, config)
+		sm := &SocketManager{
+			UUID: connection.SocketID,
+			recordPipeline: recordPipeline{
+				traceID:                connection.TraceID,
+				requestIdentity:        requestIdentity,
+				routingRegion:          routingRegion,
+				transmitDecodedRecords: config.TransmitDecodedRecords,
+			},
+			requestInfo: map[string]interface{}{"network_interface": connection.NetworkInterface},
+		}
+		if err := s.dispatchConnectivityEvent(sm, serializer, protos.ConnectivityEvent_DISCONNECTED, DisconnectReasonLastWill); err != nil {
+			s.logger.ErrorLog("last_will_dispatch_error", err, logrus.LogInfo{"device_id": connection.DeviceID, "socket_id": connection.SocketID})
+			continue
+		}
+		s.metrics.lastWillDisconnectCount.Inc(map[string]string{})
+	}
+	s.logger.ActivityLog("last_will_reconciled", logrus.LogInfo{"count": len(connections)})
+	return store.Clear()
+}
@@ -0,0 +1,109 @@
+package streaming
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+var _ = Describe("Pass through extraction", func() {
+	var certPEM []byte
+
+	BeforeEach(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "device-1"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).NotTo(HaveOccurred())
+		certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	})
+
+	It("extracts the chain forwarded by the GCP load balancer", func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Client-Cert-Chain", url.QueryEscape(base64.StdEncoding.EncodeToString(certPEM)))
+
+		chain, err := extractCertGCPALB(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain).To(HaveLen(1))
+		Expect(chain[0].Subject.CommonName).To(Equal("device-1"))
+	})
+
+	It("keeps the plus signs of the unescaped GCP header", func() {
+		// the bytes preceding the PEM block are encoded as plus signs
+		encoded := base64.StdEncoding.EncodeToString(append([]byte{0xfb, 0xef, 0xbe, '\n'}, certPEM...))
+		Expect(encoded).To(HavePrefix("++++"))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Client-Cert-Chain", encoded)
+
+		chain, err := extractCertGCPALB(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain[0].Subject.CommonName).To(Equal("device-1"))
+	})
+
+	It("reports the stage failing to decode the GCP header", func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Client-Cert-Chain", "not base64")
+
+		_, err := extractCertGCPALB(r)
+		var parseErr *passThroughParseError
+		Expect(err).To(BeAssignableToTypeOf(parseErr))
+		Expect(err.(*passThroughParseError).stage).To(Equal("base64_decode"))
+	})
+
+	It("rejects chains without parseable certificates", func() {
+		_, err := parseCertificateChain(config.RFC9440, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE"}))
+		Expect(err).To(MatchError(errNoCertificates))
+		Expect(err.(*passThroughParseError).stage).To(Equal("x509_parse"))
+
+		_, err = parseCertificateChain(config.RFC9440, []byte("no pem"))
+		Expect(err).To(MatchError(errNoCertificates))
+		Expect(err.(*passThroughParseError).stage).To(Equal("pem_decode"))
+	})
+
+	It("rejects empty PEM bodies forwarded by the AWS load balancer", func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Amzn-Mtls-Clientcert", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE"}))))
+
+		chain, err := extractCertAWSALB(r)
+		Expect(err).To(MatchError(errNoCertificates))
+		Expect(chain).To(BeEmpty())
+	})
+
+	It("selects the identity certificate of the chain", func() {
+		leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}}
+		root := &x509.Certificate{Subject: pkix.Name{CommonName: "Tesla Motors Products CA"}}
+		chain := []*x509.Certificate{leaf, root}
+
+		Expect(identityCertificate(chain, "", true)).To(Equal(leaf))
+		Expect(identityCertificate(chain, "", false)).To(Equal(root))
+		Expect(identityCertificate(chain, config.IdentityCertLeaf, false)).To(Equal(leaf))
+		Expect(identityCertificate(chain, config.IdentityCertChainRoot, true)).To(Equal(root))
+	})
+})
+
+var _ = Describe("Pass through modes", func() {
+	It("extracts the certificates of every supported mode", func() {
+		Expect(config.TLSPassThroughModes).NotTo(BeEmpty())
+		for _, mode := range config.TLSPassThroughModes {
+			Expect(headerExtractConfigMap).To(HaveKey(mode), string(mode))
+		}
+		Expect(headerExtractConfigMap).To(HaveLen(len(config.TLSPassThroughModes)))
+	})
+})
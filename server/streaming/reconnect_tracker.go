@@ -0,0 +1,91 @@
+package streaming
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/internal/lru"
+)
+
+const (
+	// DefaultReconnectWindow is the time after which a connection is no longer a reconnect when not configured
+	DefaultReconnectWindow = 5 * time.Minute
+
+	// DefaultReconnectMaxSessions bounds the number of sessions tracked when not configured
+	DefaultReconnectMaxSessions = 100000
+)
+
+// reconnectTracker links connections to the previous session of their client certificate key,
+// which survives certificate reissues changing the identity of the device
+type reconnectTracker struct {
+	policy string
+	window time.Duration
+
+	mutex    sync.Mutex
+	sessions *lru.Cache[string, *reconnectSession]
+}
+
+type reconnectSession struct {
+	deviceID string
+	lastSeen time.Time
+}
+
+func newReconnectTracker(c *config.ReconnectTracking) *reconnectTracker {
+	if c == nil {
+		return nil
+	}
+	window := time.Duration(c.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = DefaultReconnectWindow
+	}
+	maxSessions := c.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultReconnectMaxSessions
+	}
+	return &reconnectTracker{
+		policy:   c.IdentityChangePolicy,
+		window:   window,
+		sessions: lru.New[string, *reconnectSession](maxSessions),
+	}
+}
+
+// track records a connection of the device with the given key, it returns whether the connection is a reconnect
+// of a previous session and whether the identity of the device changed since that session
+func (t *reconnectTracker) track(key string, deviceID string, now time.Time) (reconnect bool, identityChanged bool) {
+	if t == nil || key == "" || deviceID == "" {
+		return false, false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	session, ok := t.sessions.Get(key)
+	if !ok {
+		t.sessions.Add(key, &reconnectSession{deviceID: deviceID, lastSeen: now})
+		return false, false
+	}
+
+	reconnect = now.Sub(session.lastSeen) <= t.window
+	identityChanged = session.deviceID != deviceID
+	session.deviceID = deviceID
+	session.lastSeen = now
+	if identityChanged && t.policy != config.IdentityChangeLink {
+		reconnect = false
+	}
+	return reconnect, identityChanged
+}
+
+// restore tracks the session of the device seen before a restart, unless the key is already tracked
+func (t *reconnectTracker) restore(key string, deviceID string, lastSeen time.Time) {
+	if t == nil || key == "" || deviceID == "" {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.sessions.Get(key); !ok {
+		t.sessions.Add(key, &reconnectSession{deviceID: deviceID, lastSeen: lastSeen})
+	}
+}
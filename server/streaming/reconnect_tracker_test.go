@@ -0,0 +1,79 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+var _ = Describe("Reconnect tracker", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Now()
+	})
+
+	It("is disabled without configuration", func() {
+		tracker := newReconnectTracker(nil)
+		reconnect, identityChanged := tracker.track("key", "device", now)
+		Expect(reconnect).To(BeFalse())
+		Expect(identityChanged).To(BeFalse())
+	})
+
+	It("detects reconnects within the window", func() {
+		tracker := newReconnectTracker(&config.ReconnectTracking{WindowSeconds: 60})
+		reconnect, _ := tracker.track("key", "device", now)
+		Expect(reconnect).To(BeFalse())
+		reconnect, identityChanged := tracker.track("key", "device", now.Add(time.Minute))
+		Expect(reconnect).To(BeTrue())
+		Expect(identityChanged).To(BeFalse())
+		reconnect, _ = tracker.track("key", "device", now.Add(3*time.Minute))
+		Expect(reconnect).To(BeFalse())
+	})
+
+	It("ignores malformed identities", func() {
+		tracker := newReconnectTracker(&config.ReconnectTracking{})
+		tracker.track("", "device", now)
+		reconnect, _ := tracker.track("", "device", now)
+		Expect(reconnect).To(BeFalse())
+	})
+
+	It("treats changed identities as new devices by default", func() {
+		tracker := newReconnectTracker(&config.ReconnectTracking{})
+		tracker.track("key", "device", now)
+		reconnect, identityChanged := tracker.track("key", "reissued_device", now)
+		Expect(reconnect).To(BeFalse())
+		Expect(identityChanged).To(BeTrue())
+
+		reconnect, identityChanged = tracker.track("key", "reissued_device", now)
+		Expect(reconnect).To(BeTrue())
+		Expect(identityChanged).To(BeFalse())
+	})
+
+	It("links changed identities to the previous session", func() {
+		tracker := newReconnectTracker(&config.ReconnectTracking{IdentityChangePolicy: config.IdentityChangeLink})
+		tracker.track("key", "device", now)
+		reconnect, identityChanged := tracker.track("key", "reissued_device", now)
+		Expect(reconnect).To(BeTrue())
+		Expect(identityChanged).To(BeTrue())
+	})
+
+	It("evicts the least recently seen sessions", func() {
+		tracker := newReconnectTracker(&config.ReconnectTracking{MaxSessions: 1})
+		tracker.track("key", "device", now)
+		tracker.track("other_key", "other_device", now)
+		reconnect, _ := tracker.track("key", "device", now)
+		Expect(reconnect).To(BeFalse())
+	})
+
+	It("detects reconnects of restored sessions", func() {
+		tracker := newReconnectTracker(&config.ReconnectTracking{WindowSeconds: 60})
+		tracker.restore("key", "device", now.Add(-time.Minute))
+		tracker.restore("key", "device", now.Add(-time.Hour))
+		reconnect, _ := tracker.track("key", "device", now)
+		Expect(reconnect).To(BeTrue())
+	})
+})
@@ -0,0 +1,111 @@
+package streaming
+
+import (
+	"bytes"
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// DefaultRecordCacheMaxEntries is the number of decoded records cached per socket when not configured
+	DefaultRecordCacheMaxEntries = 8
+
+	// DefaultRecordCacheMaxAge is the lifetime of a cached decoded record when not configured
+	DefaultRecordCacheMaxAge = 5 * time.Second
+)
+
+// recordCache is a bounded LRU cache of decoded records keyed by the raw message,
+// it avoids decoding the same message twice when it goes through the rate limiter
+type recordCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	maxAge     time.Duration
+	entries    map[uint64]*list.Element
+	lru        *list.List
+	metrics    *Metrics
+}
+
+type recordCacheEntry struct {
+	key       uint64
+	message   []byte
+	record    *telemetry.Record
+	err       error
+	createdAt time.Time
+}
+
+func newRecordCache(maxEntries int, maxAge time.Duration, metrics *Metrics) *recordCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultRecordCacheMaxEntries
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultRecordCacheMaxAge
+	}
+	return &recordCache{
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		entries:    make(map[uint64]*list.Element),
+		lru:        list.New(),
+		metrics:    metrics,
+	}
+}
+
+// take returns and removes the decoded record of the message if it is cached and not expired,
+// cached records are only reused once so a retransmitted message is decoded again
+func (c *recordCache) take(message []byte) (*recordCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[hashMessage(message)]
+	if !ok {
+		c.metrics.recordCacheMissCount.Inc(map[string]string{})
+		return nil, false
+	}
+	entry := element.Value.(*recordCacheEntry)
+	if time.Since(entry.createdAt) > c.maxAge {
+		c.remove(element, "age")
+		c.metrics.recordCacheMissCount.Inc(map[string]string{})
+		return nil, false
+	}
+	if !bytes.Equal(entry.message, message) {
+		c.metrics.recordCacheMissCount.Inc(map[string]string{})
+		return nil, false
+	}
+
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.metrics.recordCacheHitCount.Inc(map[string]string{})
+	return entry, true
+}
+
+// add caches the decoded record of the message, evicting the least recently used entry when full
+func (c *recordCache) add(message []byte, record *telemetry.Record, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := hashMessage(message)
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back(), "size")
+	}
+	c.entries[key] = c.lru.PushFront(&recordCacheEntry{key: key, message: message, record: record, err: err, createdAt: time.Now()})
+}
+
+// remove drops the element from the cache, it must be called with the mutex held
+func (c *recordCache) remove(element *list.Element, reason string) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*recordCacheEntry).key)
+	c.metrics.recordCacheEvictionCount.Inc(map[string]string{"reason": reason})
+}
+
+func hashMessage(message []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(message)
+	return h.Sum64()
+}
@@ -0,0 +1,54 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Record cache", func() {
+	var socketMetrics *Metrics
+
+	BeforeEach(func() {
+		socketMetrics = socketMetricsFor(noop.NewCollector())
+	})
+
+	It("returns cached records once", func() {
+		cache := newRecordCache(2, time.Minute, socketMetrics)
+		record := &telemetry.Record{Txid: "1"}
+		cache.add([]byte("message"), record, nil)
+
+		entry, ok := cache.take([]byte("message"))
+		Expect(ok).To(BeTrue())
+		Expect(entry.record).To(Equal(record))
+
+		_, ok = cache.take([]byte("message"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("evicts least recently used records", func() {
+		cache := newRecordCache(2, time.Minute, socketMetrics)
+		cache.add([]byte("first"), &telemetry.Record{Txid: "1"}, nil)
+		cache.add([]byte("second"), &telemetry.Record{Txid: "2"}, nil)
+		cache.add([]byte("third"), &telemetry.Record{Txid: "3"}, nil)
+
+		_, ok := cache.take([]byte("first"))
+		Expect(ok).To(BeFalse())
+		_, ok = cache.take([]byte("third"))
+		Expect(ok).To(BeTrue())
+	})
+
+	It("expires old records", func() {
+		cache := newRecordCache(2, time.Millisecond, socketMetrics)
+		cache.add([]byte("message"), &telemetry.Record{Txid: "1"}, nil)
+		time.Sleep(5 * time.Millisecond)
+
+		_, ok := cache.take([]byte("message"))
+		Expect(ok).To(BeFalse())
+		Expect(cache.lru.Len()).To(Equal(0))
+	})
+})
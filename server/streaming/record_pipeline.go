@@ -0,0 +1,301 @@
+package streaming
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/beefsack/go-rate"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// recordPipeline decodes the messages of a client and dispatches their records to the producers. It is embedded in
+// the manager of each connection and used alone for the records injected without connection
+type recordPipeline struct {
+	config          *config.Config
+	logger          *logrus.Logger
+	metrics         *Metrics
+	requestIdentity *telemetry.RequestIdentity
+	// socketID is the id of the connection set on the records, debugInjectSocketID for the injected records
+	socketID string
+	// traceID is set on the records, see SocketManager
+	traceID                string
+	transmitDecodedRecords bool
+	changeDetector         *telemetry.ChangeDetector
+	recordCache            *recordCache
+	routingRegion          string
+	sequenceSource         telemetry.SequenceSource
+	compressor             *telemetry.Compressor
+	transformer            *telemetry.Transformer
+	fieldPresence          *telemetry.FieldPresence
+	messageTransformers    *telemetry.MessageTransformers
+	messageTransformFatal  bool
+	// reliableAcks are the record types acked once dispatched, shared with the server which can change them at runtime
+	reliableAcks *reliableAckPolicy
+	// deadLetterLimiter bounds the messages dispatched to the decode dead-letter topic across the connections, nil when unlimited
+	deadLetterLimiter *rate.RateLimiter
+	// lastSequence is the last sequence number assigned to the records, saved with the session of the connection
+	lastSequence atomic.Uint64
+	// recordsStats sums the size of the records by record type
+	recordsStats map[string]int
+	// respond acks the record to the client, or responds with the error it was rejected with
+	respond func(record *telemetry.Record, err error)
+}
+
+// newRecordPipeline returns the pipeline of the records of the client, without the processing steps set by the server
+func newRecordPipeline(requestIdentity *telemetry.RequestIdentity, config *config.Config, logger *logrus.Logger, socketID string, traceID string) recordPipeline {
+	cacheMaxEntries, cacheMaxAge := 0, time.Duration(0)
+	if config.RecordCache != nil {
+		cacheMaxEntries = config.RecordCache.MaxEntries
+		cacheMaxAge = time.Duration(config.RecordCache.MaxAgeMs) * time.Millisecond
+	}
+	socketMetrics := socketMetricsFor(config.MetricCollector)
+	return recordPipeline{
+		config:                 config,
+		logger:                 logger,
+		metrics:                socketMetrics,
+		requestIdentity:        requestIdentity,
+		socketID:               socketID,
+		traceID:                traceID,
+		transmitDecodedRecords: config.TransmitDecodedRecords,
+		recordCache:            newRecordCache(cacheMaxEntries, cacheMaxAge, socketMetrics),
+		reliableAcks:           newReliableAckPolicy(config.ReliableAckSources),
+		recordsStats:           make(map[string]int),
+	}
+}
+
+// ParseAndProcessRecord reads incoming client message and dispatches to relevant producer
+func (p *recordPipeline) ParseAndProcessRecord(serializer *telemetry.BinarySerializer, message []byte) {
+	record, err := p.decodeRecord(serializer, message)
+	logInfo := logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType}
+
+	if err != nil {
+		if err == telemetry.ErrMessageTooBig {
+			p.respond(record, err)
+			p.metrics.recordTooBigCount.Inc(map[string]string{})
+			return
+		}
+
+		if err == telemetry.ErrMissingTopic {
+			p.metrics.missingTopicCount.Inc(map[string]string{"action": "rejected"})
+			p.respond(record, err)
+			return
+		}
+
+		switch typedError := err.(type) {
+		case *telemetry.UnauthorizedSenderIDError:
+			logInfo["sender_id"] = typedError.ReceivedSenderID
+			logInfo["expected_sender_id"] = typedError.ExpectedSenderID
+			p.logger.ErrorLog("unauthorized_sender_id", nil, logInfo)
+			p.metrics.unauthorizedSenderCount.Inc(map[string]string{})
+			p.respond(record, nil) // respond to the client message was accepted so they are not resending it over and over
+			return
+		case *telemetry.UnknownMessageType:
+			logInfo["msg_txid"] = typedError.Txid
+			logInfo["msg_type"] = string(typedError.GuessedType)
+			p.logger.ErrorLog("unknown_message_type_error", err, logInfo)
+			p.metrics.unknownMessageTypeErrorCount.Inc(map[string]string{"msg_type": string(typedError.GuessedType)})
+			p.respond(record, nil) // respond to the client message was accepted so they are not resending it over and over
+		default:
+			p.deadLetterDecodeError(serializer, message, record, err)
+			p.respond(record, err)
+			return
+		}
+	}
+	p.handleRecord(serializer, record)
+}
+
+// handleRecord dispatches the decoded record to its producers and acks it unless it is acked reliably
+func (p *recordPipeline) handleRecord(serializer *telemetry.BinarySerializer, record *telemetry.Record) {
+	if record.MissingTopic() {
+		p.metrics.missingTopicCount.Inc(map[string]string{"action": "defaulted"})
+	}
+	if record.HasUnknownFields() {
+		p.metrics.unknownFieldsCount.Inc(map[string]string{"record_type": record.TxType})
+	}
+	if p.fieldPresence != nil {
+		p.fieldPresence.Observe(record, func(field string, present bool) {
+			p.metrics.fieldPresenceCount.Inc(map[string]string{"record_type": record.TxType, "field": field, "present": strconv.FormatBool(present)})
+		})
+	}
+	if serializer.Gateway {
+		// only the allowlisted gateways are counted, which bounds the device ids to the devices behind them
+		p.metrics.gatewayRecordCount.Inc(map[string]string{"gateway": p.requestIdentity.DeviceID, "device_id": record.Vin, "forwarded": strconv.FormatBool(record.Vin != p.requestIdentity.DeviceID)})
+	}
+
+	// write the record out to kafka
+	p.reportRecordSize(record.TxType, record.Length())
+	if p.changeDetector != nil && p.changeDetector.Unchanged(record) {
+		p.metrics.unchangedRecordCount.Inc(map[string]string{"record_type": record.TxType})
+		p.respond(record, nil)
+		return
+	}
+	if p.droppedDuringOutage(record) {
+		// the record is not acked so the client resends it once the dispatchers recover
+		p.metrics.partialOutageDroppedCount.Inc(map[string]string{"record_type": record.TxType})
+		return
+	}
+	if err := p.transformMessage(record); err != nil {
+		p.respond(record, err)
+		return
+	}
+	p.transform(record)
+	p.assignSequence(record)
+	p.compress(record)
+	// the reliable ack policy is read once per record, before its dispatch, so that a toggle while the record is
+	// dispatched neither loses its ack nor sends it twice
+	reliableAck := p.reliableAck(record)
+	if !reliableAck {
+		record.AckedOnReceipt = true
+	}
+	p.processRecord(record)
+
+	// respond instantly to the client if we are not doing reliable ACKs
+	if !reliableAck {
+		p.respond(record, nil)
+	}
+}
+
+// deadLetterDecodeError dispatches the raw message which failed to decode to the decode dead-letter topic when configured
+func (p *recordPipeline) deadLetterDecodeError(serializer *telemetry.BinarySerializer, message []byte, failed *telemetry.Record, err error) {
+	topic := p.config.DecodeDeadLetterTopic
+	if topic == "" {
+		return
+	}
+	recordType := failed.TxType
+	if recordType == "" {
+		recordType = "unknown"
+	}
+	if p.deadLetterLimiter != nil {
+		if ok, _ := p.deadLetterLimiter.Try(); !ok {
+			p.metrics.decodeDeadLetterLimitedCount.Inc(map[string]string{"record_type": recordType})
+			return
+		}
+	}
+	record := telemetry.NewDecodeErrorRecord(serializer, topic, message, failed, err, p.socketID)
+	p.metrics.decodeDeadLetterCount.Inc(map[string]string{"record_type": recordType})
+	record.Dispatch()
+}
+
+// decodeRecord returns the record previously decoded for this message if cached, or decodes it
+func (p *recordPipeline) decodeRecord(serializer *telemetry.BinarySerializer, message []byte) (*telemetry.Record, error) {
+	if entry, ok := p.recordCache.take(message); ok {
+		return entry.record, entry.err
+	}
+	record, err := telemetry.NewRecord(serializer, message, p.socketID, p.transmitDecodedRecords)
+	record.TraceID = p.traceID
+	return record, err
+}
+
+// transform applies the transform rules of the record type, records failing their transform are dispatched unchanged
+func (p *recordPipeline) transform(record *telemetry.Record) {
+	if p.transformer == nil || !p.transformer.Applies(record.TxType) {
+		return
+	}
+	if err := p.transformer.Transform(record); err != nil {
+		p.logger.ErrorLog("transform_error", err, logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType})
+		p.metrics.transformErrorCount.Inc(map[string]string{"record_type": record.TxType})
+		return
+	}
+	p.metrics.transformCount.Inc(map[string]string{"record_type": record.TxType})
+}
+
+// transformMessage applies the message transformers registered for the record type, the error is only
+// returned when the failure policy rejects the record
+func (p *recordPipeline) transformMessage(record *telemetry.Record) error {
+	if p.messageTransformers == nil || !p.messageTransformers.Applies(record.TxType) {
+		return nil
+	}
+	err := p.messageTransformers.Transform(record)
+	if err == nil {
+		p.metrics.messageTransformCount.Inc(map[string]string{"record_type": record.TxType})
+		return nil
+	}
+	policy := config.MessageTransformSkip
+	if p.messageTransformFatal {
+		policy = config.MessageTransformFatal
+	}
+	p.logger.ErrorLog("message_transform_error", err, logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType, "policy": policy})
+	p.metrics.messageTransformErrorCount.Inc(map[string]string{"record_type": record.TxType, "policy": policy})
+	if p.messageTransformFatal {
+		return err
+	}
+	return nil
+}
+
+// assignSequence stamps the record with the next sequence number of the device, records are
+// dispatched without sequence number if the sequence source fails
+func (p *recordPipeline) assignSequence(record *telemetry.Record) {
+	if p.sequenceSource == nil {
+		return
+	}
+	sequence, err := p.sequenceSource.Next(record.Vin)
+	if err != nil {
+		p.logger.ErrorLog("sequence_error", err, logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType})
+		p.metrics.sequenceErrorCount.Inc(map[string]string{"record_type": record.TxType})
+		return
+	}
+	record.Sequence = sequence
+	p.lastSequence.Store(sequence)
+}
+
+// compress compresses the payload of the record if configured for its record type
+func (p *recordPipeline) compress(record *telemetry.Record) {
+	if p.compressor == nil {
+		return
+	}
+	result, err := p.compressor.Compress(record)
+	if err != nil {
+		p.logger.ErrorLog("compression_error", err, logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType})
+		return
+	}
+	if result.CompressedBytes == 0 {
+		return
+	}
+	p.metrics.compressionBytesTotal.Add(int64(result.OriginalBytes), map[string]string{"record_type": record.TxType, "stage": "original"})
+	p.metrics.compressionBytesTotal.Add(int64(result.CompressedBytes), map[string]string{"record_type": record.TxType, "stage": "compressed"})
+	p.metrics.compressionCount.Inc(map[string]string{"record_type": record.TxType, "compressed": strconv.FormatBool(result.Compressed)})
+}
+
+// droppedDuringOutage returns true if the record is dispatched to an unhealthy dispatcher
+// while connections are accepted during a partial outage, the kafka cluster of the region of the connection
+// is checked in place of the default one
+func (p *recordPipeline) droppedDuringOutage(record *telemetry.Record) bool {
+	if p.config.PartialOutage == nil || p.config.PartialOutage.Policy != config.PartialOutageAccept {
+		return false
+	}
+	unhealthy, partial := p.config.CachedUnhealthyDispatchers()
+	if !partial {
+		return false
+	}
+	for _, dispatcher := range p.config.Records[record.TxType] {
+		if unhealthy[p.config.RegionalDispatcher(dispatcher, p.routingRegion)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *recordPipeline) reliableAck(record *telemetry.Record) bool {
+	_, enabled := p.reliableAcks.source(record.TxType)
+	return enabled
+}
+
+func (p *recordPipeline) processRecord(record *telemetry.Record) {
+	record.Dispatch()
+	p.metrics.dispatchCount.Inc(map[string]string{"record_type": record.TxType})
+	if p.routingRegion != "" && !record.Routed() {
+		p.metrics.regionDispatchCount.Inc(map[string]string{"region": p.routingRegion, "record_type": record.TxType})
+	}
+}
+
+// reportRecordSize adds the size of the record to the stats and metrics of its record type
+func (p *recordPipeline) reportRecordSize(recordType string, byteSize int) {
+	p.recordsStats[recordType] += byteSize
+
+	p.metrics.recordSizeBytesTotal.Add(int64(byteSize), map[string]string{"record_type": recordType})
+	p.metrics.recordCount.Inc(map[string]string{"record_type": recordType})
+}
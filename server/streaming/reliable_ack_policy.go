@@ -0,0 +1,74 @@
+package streaming
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"sync/atomic"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// reliableAckPolicy holds the record types acked once dispatched by their reliable ack source. The record types
+// configured at startup can be disabled at runtime, their records are then acked as soon as they are received. Like
+// the dispatch rules on reload, the disabled record types are an immutable snapshot replaced as a whole, and each
+// record reads it once when it is received
+type reliableAckPolicy struct {
+	sources  map[string]telemetry.Dispatcher
+	disabled atomic.Pointer[map[string]bool]
+}
+
+// ReliableAckState is the reliable ack state of a record type
+type ReliableAckState struct {
+	RecordType string `json:"record_type"`
+	Dispatcher string `json:"dispatcher"`
+	Enabled    bool   `json:"enabled"`
+}
+
+func newReliableAckPolicy(sources map[string]telemetry.Dispatcher) *reliableAckPolicy {
+	policy := &reliableAckPolicy{sources: sources}
+	policy.disabled.Store(&map[string]bool{})
+	return policy
+}
+
+// source returns the reliable ack source of the record type, false if its records are acked on receipt
+func (p *reliableAckPolicy) source(recordType string) (telemetry.Dispatcher, bool) {
+	dispatcher, ok := p.sources[recordType]
+	if !ok {
+		return "", false
+	}
+	return dispatcher, !(*p.disabled.Load())[recordType]
+}
+
+// set enables or disables the reliable acks of the record type, it returns whether the state changed
+func (p *reliableAckPolicy) set(recordType string, enabled bool) (bool, error) {
+	if _, ok := p.sources[recordType]; !ok {
+		return false, fmt.Errorf("no reliable ack source configured for record type %s", recordType)
+	}
+	for {
+		current := p.disabled.Load()
+		if (*current)[recordType] == !enabled {
+			return false, nil
+		}
+		snapshot := maps.Clone(*current)
+		if enabled {
+			delete(snapshot, recordType)
+		} else {
+			snapshot[recordType] = true
+		}
+		if p.disabled.CompareAndSwap(current, &snapshot) {
+			return true, nil
+		}
+	}
+}
+
+// states returns the reliable ack state of the configured record types, sorted by record type
+func (p *reliableAckPolicy) states() []ReliableAckState {
+	disabled := *p.disabled.Load()
+	states := make([]ReliableAckState, 0, len(p.sources))
+	for recordType, dispatcher := range p.sources {
+		states = append(states, ReliableAckState{RecordType: recordType, Dispatcher: string(dispatcher), Enabled: !disabled[recordType]})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].RecordType < states[j].RecordType })
+	return states
+}
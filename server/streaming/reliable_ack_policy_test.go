@@ -0,0 +1,38 @@
+package streaming
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Reliable ack policy", func() {
+	It("disables and enables the reliable acks of the configured record types", func() {
+		policy := newReliableAckPolicy(map[string]telemetry.Dispatcher{"V": telemetry.Kafka, "alerts": telemetry.Kinesis})
+		dispatcher, enabled := policy.source("V")
+		Expect(dispatcher).To(Equal(telemetry.Kafka))
+		Expect(enabled).To(BeTrue())
+
+		Expect(policy.set("V", false)).To(BeTrue())
+		Expect(policy.set("V", false)).To(BeFalse())
+		_, enabled = policy.source("V")
+		Expect(enabled).To(BeFalse())
+		Expect(policy.states()).To(Equal([]ReliableAckState{
+			{RecordType: "V", Dispatcher: "kafka", Enabled: false},
+			{RecordType: "alerts", Dispatcher: "kinesis", Enabled: true},
+		}))
+
+		Expect(policy.set("V", true)).To(BeTrue())
+		_, enabled = policy.source("V")
+		Expect(enabled).To(BeTrue())
+	})
+
+	It("rejects record types without reliable ack source", func() {
+		policy := newReliableAckPolicy(nil)
+		_, enabled := policy.source("V")
+		Expect(enabled).To(BeFalse())
+		_, err := policy.set("V", true)
+		Expect(err).To(MatchError("no reliable ack source configured for record type V"))
+	})
+})
@@ -0,0 +1,150 @@
+package streaming
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// totalCounter sums the increments of a counter
+type totalCounter struct {
+	total atomic.Int64
+}
+
+func (c *totalCounter) Add(n int64, _ adapter.Labels) { c.total.Add(n) }
+func (c *totalCounter) Inc(_ adapter.Labels)          { c.total.Add(1) }
+
+// lastGauge keeps the last value set to a gauge
+type lastGauge struct {
+	value atomic.Int64
+}
+
+func (g *lastGauge) Add(n int64, _ adapter.Labels) { g.value.Add(n) }
+func (g *lastGauge) Sub(n int64, _ adapter.Labels) { g.value.Add(-n) }
+func (g *lastGauge) Inc(_ adapter.Labels)          { g.value.Add(1) }
+func (g *lastGauge) Set(n int64, _ adapter.Labels) { g.value.Store(n) }
+
+var _ = Describe("Reliable ack queue", func() {
+	var (
+		server     *Server
+		dropped    *totalCounter
+		slow, fast *SocketManager
+		serializer *telemetry.BinarySerializer
+	)
+
+	newSocket := func(deviceID string) *SocketManager {
+		logger, _ := logrus.NoOpLogger()
+		conf := &config.Config{MetricCollector: noop.NewCollector(), OutboundQueue: &config.OutboundQueue{Size: 1}}
+		socket := NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: deviceID}, nil, conf, logger)
+		server.registry.RegisterSocket(socket)
+		return socket
+	}
+
+	ack := func(socket *SocketManager, txid string) {
+		server.ackChan <- &telemetry.Record{TxType: "V", Txid: txid, SocketID: socket.UUID, Serializer: serializer}
+	}
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		dropped = &totalCounter{}
+		server = &Server{
+			registry:           NewSocketRegistry(),
+			logger:             logger,
+			metrics:            newServerMetrics(noop.NewCollector()),
+			ackChan:            make(chan *telemetry.Record),
+			reliableAckSources: newReliableAckPolicy(map[string]telemetry.Dispatcher{"V": telemetry.Kafka}),
+		}
+		server.metrics.reliableAckDroppedCount = dropped
+		serializer = telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, nil, logger)
+		// the writer of the slow socket is not running, its queue fills up and is never drained
+		slow, fast = newSocket("slow"), newSocket("fast")
+		server.startAckWorkers(1)
+	})
+
+	AfterEach(func() {
+		close(server.ackChan)
+		Eventually(server.acksDone).Should(BeClosed())
+	})
+
+	It("drops the acks of a socket whose queue is full without stalling the other sockets", func() {
+		ack(slow, "1")
+		ack(slow, "2")
+		ack(slow, "3")
+		ack(fast, "4")
+
+		Eventually(fast.writeChan).Should(Receive())
+		Expect(slow.writeChan).To(HaveLen(1))
+		Eventually(dropped.total.Load).Should(Equal(int64(2)))
+	})
+
+	It("queues the acks of a socket once its writer drained the queue", func() {
+		ack(slow, "1")
+		Eventually(slow.writeChan).Should(Receive())
+		ack(slow, "2")
+		Eventually(slow.writeChan).Should(Receive())
+		Expect(dropped.total.Load()).To(BeZero())
+	})
+})
+
+var _ = Describe("Ack workers", func() {
+	var server *Server
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		server = &Server{
+			registry:           NewSocketRegistry(),
+			logger:             logger,
+			metrics:            newServerMetrics(noop.NewCollector()),
+			ackChan:            make(chan *telemetry.Record, 10),
+			reliableAckSources: newReliableAckPolicy(map[string]telemetry.Dispatcher{"V": telemetry.Kafka}),
+		}
+	})
+
+	It("defaults to a single worker", func() {
+		server.startAckWorkers(0)
+		Expect(server.ackWorkers).To(Equal(1))
+		close(server.ackChan)
+		Eventually(server.acksDone).Should(BeClosed())
+	})
+
+	It("drains the ack channel with every worker until it is closed", func() {
+		logger, _ := logrus.NoOpLogger()
+		conf := &config.Config{MetricCollector: noop.NewCollector(), OutboundQueue: &config.OutboundQueue{Size: 10}}
+		socket := NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: "42"}, nil, conf, logger)
+		server.registry.RegisterSocket(socket)
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, nil, logger)
+
+		server.startAckWorkers(4)
+		Expect(server.ackWorkers).To(Equal(4))
+		for i := 0; i < 10; i++ {
+			server.ackChan <- &telemetry.Record{TxType: "V", Txid: "txid", SocketID: socket.UUID, Serializer: serializer}
+		}
+		close(server.ackChan)
+		Eventually(server.acksDone).Should(BeClosed())
+		Expect(socket.writeChan).To(HaveLen(10))
+	})
+
+	It("samples the depth of the ack channel while no ack is processed", func() {
+		depth := &lastGauge{}
+		server.metrics.ackChannelDepth = depth
+		server.acksDone = make(chan struct{})
+		for i := 0; i < 3; i++ {
+			server.ackChan <- &telemetry.Record{TxType: "V"}
+		}
+		go server.sampleAckChannelDepth(time.Millisecond)
+		Eventually(depth.value.Load).Should(Equal(int64(3)))
+
+		<-server.ackChan
+		Eventually(depth.value.Load).Should(Equal(int64(2)))
+		close(server.acksDone)
+	})
+})
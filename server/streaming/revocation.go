@@ -0,0 +1,187 @@
+package streaming
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+const (
+	// defaultCRLRefreshInterval is the time after which the certificate revocation list is loaded again when not configured
+	defaultCRLRefreshInterval = time.Hour
+	// crlFetchTimeout bounds the download of a certificate revocation list served over http
+	crlFetchTimeout = 30 * time.Second
+	// crlRetryBackoff is the time after which a failed load is retried, doubled on each consecutive failure up
+	// to the refresh interval
+	crlRetryBackoff = 30 * time.Second
+)
+
+// errRevokedCertificate is returned when a client certificate is on the certificate revocation list
+var errRevokedCertificate = errors.New("revoked_certificate_error")
+
+// revocationList holds the serial numbers of the certificates revoked by the issuer of a certificate revocation list,
+// which must be signed by one of the CAs trusted to issue client certificates. The list is loaded again in the
+// background by the first check past the refresh interval or its next update, the previous list is kept until a
+// load succeeds and failed loads are retried with a backoff
+type revocationList struct {
+	source          string
+	refreshInterval time.Duration
+	cas             []*x509.Certificate
+	client          *http.Client
+	logger          *logrus.Logger
+	now             func() time.Time
+
+	mutex   sync.RWMutex
+	issuer  []byte
+	serials map[string]bool
+	// refreshAt is the time the list is loaded again, the earliest of the refresh interval and its next update
+	// once loaded, the retry time of the last failed load otherwise
+	refreshAt time.Time
+	failures  int
+
+	refreshing atomic.Bool
+}
+
+// newRevocationList loads the configured certificate revocation list, it returns nil when revocation is not checked
+func newRevocationList(c *config.CertificateRevocation, cas []*x509.Certificate, logger *logrus.Logger) (*revocationList, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.CRL == "" {
+		return nil, errors.New("certificate_revocation requires a crl")
+	}
+	list := &revocationList{
+		source:          c.CRL,
+		refreshInterval: defaultCRLRefreshInterval,
+		cas:             cas,
+		client:          &http.Client{Timeout: crlFetchTimeout},
+		logger:          logger,
+		now:             time.Now,
+	}
+	if c.RefreshIntervalSeconds > 0 {
+		list.refreshInterval = time.Duration(c.RefreshIntervalSeconds) * time.Second
+	}
+	if err := list.load(); err != nil {
+		return nil, fmt.Errorf("load certificate revocation list %s: %w", c.CRL, err)
+	}
+	return list, nil
+}
+
+// revoked returns true if the certificate was revoked by the issuer of the list, the list is refreshed when due
+func (l *revocationList) revoked(cert *x509.Certificate) bool {
+	l.refreshIfDue()
+	return l.listed(cert)
+}
+
+// listed returns true if the certificate is on the list as last loaded
+func (l *revocationList) listed(cert *x509.Certificate) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return bytes.Equal(cert.RawIssuer, l.issuer) && l.serials[cert.SerialNumber.String()]
+}
+
+func (l *revocationList) refreshIfDue() {
+	l.mutex.RLock()
+	due := !l.now().Before(l.refreshAt)
+	l.mutex.RUnlock()
+	if !due || !l.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer l.refreshing.Store(false)
+		if err := l.load(); err != nil {
+			l.logger.ErrorLog("certificate_revocation_list_refresh_error", err, logrus.LogInfo{"crl": l.source})
+		}
+	}()
+}
+
+func (l *revocationList) load() error {
+	crl, err := l.parse()
+	if err != nil {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		backoff := min(crlRetryBackoff<<min(l.failures, 16), l.refreshInterval)
+		l.failures++
+		l.refreshAt = l.now().Add(backoff)
+		return err
+	}
+	serials := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		serials[entry.SerialNumber.String()] = true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.issuer = crl.RawIssuer
+	l.serials = serials
+	l.failures = 0
+	l.refreshAt = l.now().Add(l.refreshInterval)
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(l.refreshAt) {
+		l.refreshAt = crl.NextUpdate
+	}
+	return nil
+}
+
+// parse fetches the list and checks that it was signed by a trusted CA and is not past its next update
+func (l *revocationList) parse() (*x509.RevocationList, error) {
+	raw, err := l.fetch()
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.checkSignature(crl); err != nil {
+		return nil, err
+	}
+	if !crl.NextUpdate.IsZero() && l.now().After(crl.NextUpdate) {
+		return nil, fmt.Errorf("certificate revocation list expired at %s", crl.NextUpdate.Format(time.RFC3339))
+	}
+	return crl, nil
+}
+
+// checkSignature returns an error unless the list is signed by one of the trusted CAs named as its issuer
+func (l *revocationList) checkSignature(crl *x509.RevocationList) error {
+	err := errors.New("certificate revocation list not issued by a trusted ca")
+	for _, ca := range l.cas {
+		if !bytes.Equal(ca.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		if err = crl.CheckSignatureFrom(ca); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// fetch reads the list from its url when served over http, from its file otherwise
+func (l *revocationList) fetch() ([]byte, error) {
+	if !strings.HasPrefix(l.source, "http://") && !strings.HasPrefix(l.source, "https://") {
+		return os.ReadFile(l.source)
+	}
+	resp, err := l.client.Get(l.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,197 @@
+package streaming
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+var _ = Describe("Revocation list", func() {
+	var (
+		issuer    *x509.Certificate
+		issuerKey *rsa.PrivateKey
+		logger    *logrus.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		issuerKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Tesla Motors Products CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &issuerKey.PublicKey, issuerKey)
+		Expect(err).NotTo(HaveOccurred())
+		issuer, err = x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+		logger, _ = logrus.NoOpLogger()
+	})
+
+	crlWithNextUpdate := func(nextUpdate time.Time, serials ...int64) []byte {
+		entries := make([]x509.RevocationListEntry, 0, len(serials))
+		for _, serial := range serials {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1), NextUpdate: nextUpdate, RevokedCertificateEntries: entries}, issuer, issuerKey)
+		Expect(err).NotTo(HaveOccurred())
+		return der
+	}
+	crl := func(serials ...int64) []byte {
+		return crlWithNextUpdate(time.Time{}, serials...)
+	}
+
+	certificate := func(serial int64, issuedBy *x509.Certificate) *x509.Certificate {
+		return &x509.Certificate{SerialNumber: big.NewInt(serial), RawIssuer: issuedBy.RawSubject}
+	}
+
+	It("is disabled without config", func() {
+		list, err := newRevocationList(nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list).To(BeNil())
+	})
+
+	It("requires a crl", func() {
+		_, err := newRevocationList(&config.CertificateRevocation{}, []*x509.Certificate{issuer}, logger)
+		Expect(err).To(MatchError("certificate_revocation requires a crl"))
+	})
+
+	It("fails on invalid lists", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "crl.der")
+		Expect(os.WriteFile(path, []byte("invalid"), 0600)).To(Succeed())
+		_, err := newRevocationList(&config.CertificateRevocation{CRL: path}, []*x509.Certificate{issuer}, logger)
+		Expect(err).To(MatchError(ContainSubstring("load certificate revocation list " + path)))
+	})
+
+	It("rejects the serials revoked by the issuer of a pem file", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "crl.pem")
+		Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl(2)}), 0600)).To(Succeed())
+		list, err := newRevocationList(&config.CertificateRevocation{CRL: path}, []*x509.Certificate{issuer}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(list.revoked(certificate(2, issuer))).To(BeTrue())
+		Expect(list.revoked(certificate(3, issuer))).To(BeFalse())
+		other := &x509.Certificate{RawSubject: []byte("other issuer")}
+		Expect(list.revoked(certificate(2, other))).To(BeFalse())
+	})
+
+	It("refreshes the list from its url past the refresh interval", func() {
+		var served atomic.Value
+		served.Store(crl(2))
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write(served.Load().([]byte))
+		}))
+		DeferCleanup(srv.Close)
+
+		list, err := newRevocationList(&config.CertificateRevocation{CRL: srv.URL, RefreshIntervalSeconds: 60}, []*x509.Certificate{issuer}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		now := time.Now()
+		list.now = func() time.Time { return now }
+		served.Store(crl(3))
+
+		Expect(list.revoked(certificate(3, issuer))).To(BeFalse())
+		now = now.Add(time.Minute)
+		list.revoked(certificate(3, issuer))
+		Eventually(func() bool { return list.revoked(certificate(3, issuer)) }).Should(BeTrue())
+		Expect(list.revoked(certificate(2, issuer))).To(BeFalse())
+	})
+
+	It("rejects lists not signed by a trusted ca", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "crl.der")
+		Expect(os.WriteFile(path, crl(2), 0600)).To(Succeed())
+
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		impostor := *issuer
+		impostor.PublicKey = &otherKey.PublicKey
+		_, err = newRevocationList(&config.CertificateRevocation{CRL: path}, []*x509.Certificate{&impostor}, logger)
+		Expect(err).To(MatchError(ContainSubstring("verification error")))
+
+		_, err = newRevocationList(&config.CertificateRevocation{CRL: path}, nil, logger)
+		Expect(err).To(MatchError(ContainSubstring("certificate revocation list not issued by a trusted ca")))
+	})
+
+	It("rejects lists past their next update and refreshes them at their next update", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "crl.der")
+		Expect(os.WriteFile(path, crlWithNextUpdate(time.Now().Add(-time.Minute), 2), 0600)).To(Succeed())
+		_, err := newRevocationList(&config.CertificateRevocation{CRL: path}, []*x509.Certificate{issuer}, logger)
+		Expect(err).To(MatchError(ContainSubstring("certificate revocation list expired at")))
+
+		nextUpdate := time.Now().Add(time.Minute)
+		Expect(os.WriteFile(path, crlWithNextUpdate(nextUpdate, 2), 0600)).To(Succeed())
+		list, err := newRevocationList(&config.CertificateRevocation{CRL: path}, []*x509.Certificate{issuer}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list.refreshAt).To(BeTemporally("~", nextUpdate, time.Second))
+	})
+
+	It("retries the failed refreshes with a backoff", func() {
+		var requests atomic.Int32
+		der := crl(2)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if requests.Add(1) > 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			_, _ = w.Write(der)
+		}))
+		DeferCleanup(srv.Close)
+
+		list, err := newRevocationList(&config.CertificateRevocation{CRL: srv.URL, RefreshIntervalSeconds: 3600}, []*x509.Certificate{issuer}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		now := time.Now().Add(time.Hour)
+		list.now = func() time.Time { return now }
+
+		list.revoked(certificate(2, issuer))
+		Eventually(requests.Load).Should(BeEquivalentTo(2))
+		Eventually(list.refreshing.Load).Should(BeFalse())
+		list.revoked(certificate(2, issuer))
+		Consistently(requests.Load, 100*time.Millisecond).Should(BeEquivalentTo(2))
+
+		now = now.Add(crlRetryBackoff)
+		list.revoked(certificate(2, issuer))
+		Eventually(requests.Load).Should(BeEquivalentTo(3))
+		Eventually(list.refreshing.Load).Should(BeFalse())
+		list.mutex.RLock()
+		defer list.mutex.RUnlock()
+		Expect(list.refreshAt).To(Equal(now.Add(2 * crlRetryBackoff)))
+	})
+
+	It("keeps the previous list when the refresh fails", func() {
+		status := atomic.Int32{}
+		status.Store(http.StatusOK)
+		der := crl(2)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(int(status.Load()))
+			_, _ = w.Write(der)
+		}))
+		DeferCleanup(srv.Close)
+
+		list, err := newRevocationList(&config.CertificateRevocation{CRL: srv.URL, RefreshIntervalSeconds: 1}, []*x509.Certificate{issuer}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		status.Store(http.StatusServiceUnavailable)
+		list.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+		list.revoked(certificate(2, issuer))
+		Eventually(list.refreshing.Load).Should(BeFalse())
+		Expect(list.revoked(certificate(2, issuer))).To(BeTrue())
+	})
+})
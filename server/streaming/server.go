@@ -2,17 +2,26 @@ package streaming
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"github.com/pkg/errors"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/beefsack/go-rate"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"google.golang.org/protobuf/proto"
@@ -25,35 +34,108 @@ import (
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
 	"github.com/teslamotors/fleet-telemetry/protos"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/audit"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		// disable origin checking on the websocket.  we're not serving browsers
-		CheckOrigin:     func(_ *http.Request) bool { return true },
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
-
-	serverMetricsRegistry ServerMetrics
-	serverMetricsOnce     sync.Once
+const (
+	unknownRegion = "unknown"
+	// defaultConnectivityTopic is the topic of the connectivity events when not configured
+	defaultConnectivityTopic = "connectivity"
+	// defaultConnectivityDeviceType is the device type of the connectivity events of clients of unknown type
+	defaultConnectivityDeviceType = "vehicle_device"
+	// defaultNetworkInterface is the network interface of the connectivity events of connections not reporting one when not configured
+	defaultNetworkInterface = "unknown"
+	// redactedLogValue replaces the redacted values in the logs
+	redactedLogValue = "[redacted]"
+	// defaultWebsocketBufferSize is the size in bytes of the read and write buffers of the connections when not configured
+	defaultWebsocketBufferSize = 1024
+	// debugInjectSocketID is the socket id of the records injected through the debug endpoint
+	debugInjectSocketID = "debug_inject"
+	// ackChannelDepthInterval is the time between the samples of the depth of the ack channel
+	ackChannelDepthInterval = time.Second
 )
 
-const (
-	connectitivityTopic = "connectivity"
+// reliableAckLatencyBuckets are the upper bounds in milliseconds of the buckets of reliable_ack_latency_ms
+var reliableAckLatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// connectivityBatchSizeBuckets are the upper bounds of the buckets of connectivity_batch_events
+var connectivityBatchSizeBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+var (
+	// serverMetrics are the server metrics registered against each collector
+	serverMetrics      = make(map[metrics.MetricCollector]*ServerMetrics)
+	serverMetricsMutex sync.Mutex
 )
 
 // ServerMetrics stores metrics reported from this package
 type ServerMetrics struct {
-	reliableAckCount     adapter.Counter
-	reliableAckMissCount adapter.Counter
+	reliableAckCount                 adapter.Counter
+	reliableAckMissCount             adapter.Counter
+	reliableAckLatency               adapter.Histogram
+	reliableAckToggleCount           adapter.Counter
+	reliableAckInvalidCount          adapter.Counter
+	reliableAckDroppedCount          adapter.Counter
+	websocketUpgradeErrorCount       adapter.Counter
+	warmupRejectedCount              adapter.Counter
+	sourceIPRejectedCount            adapter.Counter
+	partialOutageCount               adapter.Counter
+	passthroughDecodeErrorCount      adapter.Counter
+	reconnectCount                   adapter.Counter
+	identityChangedCount             adapter.Counter
+	sessionEndSentinelCount          adapter.Counter
+	passthroughUntrustedCount        adapter.Counter
+	closeReasonCount                 adapter.Counter
+	serializerVariantCount           adapter.Counter
+	serverDisconnectCount            adapter.Counter
+	sessionRestoredCount             adapter.Counter
+	unknownInterfaceCount            adapter.Counter
+	identityRejectedCount            adapter.Counter
+	malformedUpgradeCount            adapter.Counter
+	revokedCertRejectedCount         adapter.Counter
+	connectionsRejectedCount         adapter.Counter
+	connectionChurnCount             adapter.Counter
+	lastSeenLookupCount              adapter.Counter
+	debugInjectCount                 adapter.Counter
+	subprotocolRejectedCount         adapter.Counter
+	connectionsRejectedByPolicyCount adapter.Counter
+	connectivityBatchSize            adapter.Histogram
+	activeConnections                adapter.Gauge
+	ackChannelDepth                  adapter.Gauge
+	clientCertDaysToExpiry           adapter.Histogram
+	expiredCertRejectedCount         adapter.Counter
+	lastWillDisconnectCount          adapter.Counter
+}
+
+// serializerVariant are the settings applied to the serializers of a variant
+type serializerVariant struct {
+	defaultTopic         string
+	discardUnknownFields map[string]bool
 }
 
 // Server stores server resources
 type Server struct {
-	// DispatchRules is a mapping of topics (records type) to their dispatching methods (loaded from Records json)
-	DispatchRules map[string][]telemetry.Producer
+	// RegionDispatchRules is a mapping of regions to the dispatch rules of devices in that region
+	RegionDispatchRules map[string]map[string][]telemetry.Producer
+
+	// SequenceSource assigns per device sequence numbers to records, it can be replaced by a source shared between servers
+	SequenceSource telemetry.SequenceSource
+
+	// IdentityExtractor derives the identity of the clients from their requests in place of their certificate when set,
+	// for instance from a token in environments without mutual tls
+	IdentityExtractor func(r *http.Request, config *config.Config) (*telemetry.RequestIdentity, error)
+
+	// AuthorizeConnection is called with the identity of the clients when set, the connections it returns an error for
+	// are closed with a policy violation before they register, for instance to block the devices of a blocklist. The
+	// clients kept without identity by AllowAnonymousIdentity are authorized with an empty identity
+	AuthorizeConnection func(requestIdentity *telemetry.RequestIdentity) error
+
+	// CheckOrigin replaces the origin check of the allowed origins when set, it returns false to reject the upgrade
+	CheckOrigin func(r *http.Request) bool
+
+	// dispatchRules is a mapping of topics (records type) to their dispatching methods (loaded from Records json),
+	// replaced by ReloadDispatchRules
+	dispatchRules *telemetry.DispatchRulesSource
 
 	logger *logrus.Logger
 	// Metrics collects metrics for the application
@@ -63,51 +145,412 @@ type Server struct {
 
 	registry *SocketRegistry
 
+	// ctx is the root context of the connections, cancelled on shutdown to stop the work of the remaining ones
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	ackChan chan (*telemetry.Record)
+	// acksDone is closed once the ack workers processed the acks of the closed ack channel, nil when acks are disabled
+	acksDone chan struct{}
+	// acksHandled is the number of acks taken from the ack channel and not yet queued to their connection
+	acksHandled atomic.Int64
+	// ackWorkers is the number of goroutines running handleAcks
+	ackWorkers int
+
+	// reliableAckSources are the reliable ack sources of the record types, they can be disabled at runtime
+	reliableAckSources *reliableAckPolicy
+	// auditor records the actions made through the admin endpoints and the drain of the server
+	auditor *audit.Auditor
+
+	changeDetector *telemetry.ChangeDetector
+	compressor     *telemetry.Compressor
+	decompressor   *telemetry.Decompressor
+	transformer    *telemetry.Transformer
+	fieldPresence  *telemetry.FieldPresence
+
+	// messageTransformers are registered in code by integrators embedding the server
+	messageTransformers *telemetry.MessageTransformers
+	// router holds the routes registered in code by integrators embedding the server
+	router                *telemetry.Router
+	messageTransformFatal bool
+
+	discardUnknownFields map[string]bool
+
+	// gatewaySenders are the device ids of the gateways whose records keep their own device id
+	gatewaySenders map[string]bool
+
+	// serializerVariants are the serializer settings of the connections by certificate organizational unit
+	serializerVariants map[string]*serializerVariant
+
+	sentinelRecords []string
+
+	// connectivityTopic is the topic the connectivity events are dispatched to
+	connectivityTopic string
+	// unknownNetworkInterface replaces the empty network interface of the connectivity events
+	unknownNetworkInterface string
+
+	closeReasons *config.CloseReasons
+
+	// metrics are registered against the collector of this server
+	metrics *ServerMetrics
+
+	// passThroughRoots verify the certificate chains forwarded by the reverse proxy when configured
+	passThroughRoots *x509.CertPool
+
+	// certificateExpiryWarningDays is the number of days before expiry from which client certificates are logged
+	certificateExpiryWarningDays int
+
+	// deviceIDSource reads the device id from a subject alternative name, nil to read it from the common name
+	deviceIDSource *messages.DeviceIDSource
+
+	connectionWarmup *connectionWarmup
+	reconnectTracker *reconnectTracker
+	lastSeen         *lastSeenTracker
+	sourceIPLimiter  *sourceIPLimiter
+	revocationList   *revocationList
+	// connectivityBatcher batches the connectivity events, nil when they are dispatched one record per event
+	connectivityBatcher *connectivityBatcher
+	// deviceRateLimiter bounds the messages of each device, nil when unlimited
+	deviceRateLimiter *deviceRateLimiter
+	// deadLetterLimiter bounds the messages dispatched to the decode dead-letter topic, nil when unlimited
+	deadLetterLimiter *rate.RateLimiter
 
-	reliableAckSources map[string]telemetry.Dispatcher
+	// redactedCertificateComponents are the client certificate components not logged on connection
+	redactedCertificateComponents map[config.CertificateLogComponent]bool
+
+	upgrader *websocket.Upgrader
+
+	maxConnections int
+	draining       atomic.Bool
+	maintenance    atomic.Bool
+}
+
+// nilLoggerWarning is logged once per process when a server is initialized without logger
+var nilLoggerWarning sync.Once
+
+// defaultLogger returns logger, or a basic logger when embedders did not provide one
+func defaultLogger(logger *logrus.Logger) (*logrus.Logger, error) {
+	if logger != nil {
+		return logger, nil
+	}
+	logger, err := logrus.NewBasicLogrusLogger("fleet-telemetry")
+	if err != nil {
+		return nil, err
+	}
+	nilLoggerWarning.Do(func() {
+		logger.Log(logrus.WARN, "nil_logger_replaced", logrus.LogInfo{"logger": "default"})
+	})
+	return logger, nil
 }
 
 // InitServer initializes the main server
 func InitServer(c *config.Config, airbrakeHandler *airbrake.Handler, producerRules map[string][]telemetry.Producer, logger *logrus.Logger, registry *SocketRegistry) (*http.Server, *Server, error) {
+	logger, err := defaultLogger(logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	changeDetector, err := c.NewChangeDetector()
+	if err != nil {
+		return nil, nil, err
+	}
+	sequenceSource, err := c.NewSequenceSource()
+	if err != nil {
+		return nil, nil, err
+	}
+	compressor, err := c.NewCompressor()
+	if err != nil {
+		return nil, nil, err
+	}
+	decompressor, err := c.NewDecompressor()
+	if err != nil {
+		return nil, nil, err
+	}
+	transformer, err := c.NewTransformer()
+	if err != nil {
+		return nil, nil, err
+	}
+	fieldPresence, err := c.NewFieldPresence()
+	if err != nil {
+		return nil, nil, err
+	}
 
+	// the ack channel is created by ConfigureProducers along with the producers sending to it
+	acksEnabled := c.AckChan != nil
+	if !acksEnabled {
+		logger.ActivityLog("reliable_ack_disabled", logrus.LogInfo{"reason": "ack_channel_not_configured"})
+	}
 	socketServer := &Server{
-		DispatchRules:      producerRules,
+		upgrader:           newUpgrader(c),
+		dispatchRules:      telemetry.NewDispatchRulesSource(producerRules),
+		SequenceSource:     sequenceSource,
 		metricsCollector:   c.MetricCollector,
 		logger:             logger,
 		airbrakeHandler:    airbrakeHandler,
 		registry:           registry,
 		ackChan:            c.AckChan,
-		reliableAckSources: c.ReliableAckSources,
+		reliableAckSources: newReliableAckPolicy(c.ReliableAckSources),
+		changeDetector:     changeDetector,
+		compressor:         compressor,
+		decompressor:       decompressor,
+		transformer:        transformer,
+		connectionWarmup:   newConnectionWarmup(c.ConnectionWarmup, time.Now()),
+		maxConnections:     c.MaxConnections,
+		reconnectTracker:   newReconnectTracker(c.ReconnectTracking),
+		lastSeen:           newLastSeenTracker(c.LastSeen),
+		metrics:            serverMetricsFor(c.MetricCollector),
+		closeReasons:       c.CloseReasons,
+		sentinelRecords:    c.SessionEndSentinels,
 	}
-	registerServerMetricsOnce(socketServer.metricsCollector)
-
+	socketServer.ctx, socketServer.cancel = context.WithCancel(context.Background())
+	if socketServer.sourceIPLimiter, err = newSourceIPLimiter(c.SourceIPLimit); err != nil {
+		return nil, nil, err
+	}
+	if c.CertificateRevocation != nil {
+		cas, err := c.ClientCAs(logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		if socketServer.revocationList, err = newRevocationList(c.CertificateRevocation, cas, logger); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.ConnectionChurn {
+		registry.churn = socketServer.metrics.connectionChurnCount
+	}
+	registry.activeConnections = socketServer.metrics.activeConnections
+	configuredCheckOrigin := socketServer.upgrader.CheckOrigin
+	socketServer.upgrader.CheckOrigin = func(r *http.Request) bool {
+		if socketServer.CheckOrigin != nil {
+			return socketServer.CheckOrigin(r)
+		}
+		return configuredCheckOrigin(r)
+	}
+	socketServer.fieldPresence = fieldPresence
+	socketServer.deviceRateLimiter = newDeviceRateLimiter(c.PerDeviceMessagesPerSecond, c.PerDeviceBurst)
+	if c.DecodeDeadLetterPerSecond > 0 {
+		socketServer.deadLetterLimiter = rate.New(c.DecodeDeadLetterPerSecond, time.Second)
+	}
+	socketServer.connectivityTopic = defaultConnectivityTopic
+	if c.ConnectivityTopic != "" {
+		socketServer.connectivityTopic = c.ConnectivityTopic
+	}
+	if c.ConnectivityBatching != nil && len(producerRules[connectivityBatchTopic]) == 0 {
+		return nil, nil, fmt.Errorf("connectivity_batching requires dispatchers for the %s records", connectivityBatchTopic)
+	}
+	if socketServer.connectivityBatcher = newConnectivityBatcher(c.ConnectivityBatching, socketServer.dispatchConnectivityBatch); socketServer.connectivityBatcher != nil {
+		go socketServer.connectivityBatcher.run()
+	}
+	socketServer.unknownNetworkInterface = defaultNetworkInterface
+	if c.UnknownNetworkInterface != "" {
+		socketServer.unknownNetworkInterface = c.UnknownNetworkInterface
+	}
+	socketServer.messageTransformers = telemetry.NewMessageTransformers()
+	socketServer.router = telemetry.NewRouter()
+	switch c.MessageTransformFailurePolicy {
+	case "", config.MessageTransformSkip:
+	case config.MessageTransformFatal:
+		socketServer.messageTransformFatal = true
+	default:
+		return nil, nil, fmt.Errorf("invalid message_transform_failure_policy %s", c.MessageTransformFailurePolicy)
+	}
+	if c.CertificateLogRedaction != nil && !c.CertificateLogRedaction.Debug {
+		socketServer.redactedCertificateComponents = make(map[config.CertificateLogComponent]bool)
+		for _, component := range c.CertificateLogRedaction.Components {
+			if !component.IsValid() {
+				return nil, nil, fmt.Errorf("invalid certificate_log_redaction component %s", component)
+			}
+			socketServer.redactedCertificateComponents[component] = true
+		}
+	}
+	if !c.IdentityCertPosition.IsValid() {
+		return nil, nil, fmt.Errorf("invalid identity_cert_position %s", c.IdentityCertPosition)
+	}
+	socketServer.certificateExpiryWarningDays = defaultCertificateExpiryWarningDays
+	if c.CertificateExpiryWarningDays > 0 {
+		socketServer.certificateExpiryWarningDays = c.CertificateExpiryWarningDays
+	}
+	if c.IdentitySAN != nil {
+		switch c.IdentitySAN.Type {
+		case messages.SANTypeDNS, messages.SANTypeURI, messages.SANTypeEmail:
+			socketServer.deviceIDSource = &messages.DeviceIDSource{SANType: c.IdentitySAN.Type, Prefix: c.IdentitySAN.Prefix}
+		default:
+			return nil, nil, fmt.Errorf("invalid identity_san type %s", c.IdentitySAN.Type)
+		}
+	}
+	if c.OutboundQueue != nil && !c.OutboundQueue.DropPolicy.IsValid() {
+		return nil, nil, fmt.Errorf("invalid outbound_queue drop_policy %s", c.OutboundQueue.DropPolicy)
+	}
+	if c.TLSPassThrough != nil {
+		// the config only rejects unknown modes when unmarshalled, the server would panic on the first connection
+		if _, ok := headerExtractConfigMap[*c.TLSPassThrough]; !ok {
+			return nil, nil, fmt.Errorf("invalid tls_pass_through %s", *c.TLSPassThrough)
+		}
+	}
+	if c.TLSPassThroughVerification != nil {
+		if c.TLSPassThrough == nil {
+			return nil, nil, errors.New("tls_pass_through_verification requires tls_pass_through")
+		}
+		if socketServer.passThroughRoots, err = c.ClientCAPool(logger); err != nil {
+			return nil, nil, err
+		}
+	}
+	socketServer.discardUnknownFields = recordTypeSet(c.DiscardUnknownFields)
+	if c.Gateway != nil {
+		socketServer.gatewaySenders = make(map[string]bool, len(c.Gateway.Senders))
+		for _, sender := range c.Gateway.Senders {
+			socketServer.gatewaySenders[sender] = true
+		}
+	}
+	if len(c.SerializerVariants) > 0 {
+		socketServer.serializerVariants = make(map[string]*serializerVariant)
+		for unit, variant := range c.SerializerVariants {
+			settings := &serializerVariant{defaultTopic: c.DefaultTopic, discardUnknownFields: socketServer.discardUnknownFields}
+			if variant.DefaultTopic != "" {
+				settings.defaultTopic = variant.DefaultTopic
+			}
+			if variant.DiscardUnknownFields != nil {
+				settings.discardUnknownFields = recordTypeSet(variant.DiscardUnknownFields)
+			}
+			socketServer.serializerVariants[unit] = settings
+		}
+	}
+	socketServer.auditor = audit.NewAuditor(c.MetricCollector, logger)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", socketServer.ServeBinaryWs(c))
-	mux.Handle("/status", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.Status())))
+	if c.StatusIdentity {
+		mux.Handle("/status", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.StatusIdentity(c))))
+	} else {
+		mux.Handle("/status", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.Status())))
+	}
+	mux.Handle("/livez", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.Live())))
+	mux.Handle("/readyz", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.Ready(c))))
+	if c.ConnectionsEndpoint != nil {
+		if c.ConnectionsEndpoint.Token == "" {
+			return nil, nil, errors.New("connections_endpoint requires a token")
+		}
+		mux.Handle("/connections", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.Connections(c.ConnectionsEndpoint.Token))))
+	}
+	if c.ReliableAckEndpoint != nil {
+		if c.ReliableAckEndpoint.Token == "" {
+			return nil, nil, errors.New("reliable_ack_endpoint requires a token")
+		}
+		mux.Handle("/reliable_acks", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.ReliableAcks(c.ReliableAckEndpoint.Token))))
+	}
+	if c.EnableDebugInject {
+		if c.DebugInject == nil || c.DebugInject.Token == "" {
+			return nil, nil, errors.New("enable_debug_inject requires a debug_inject token")
+		}
+		mux.Handle("/debug/inject", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.DebugInject(c, c.DebugInject.Token))))
+		logger.ActivityLog("debug_inject_enabled", nil)
+	}
+	if c.LastSeen != nil {
+		if c.LastSeen.Token == "" {
+			return nil, nil, errors.New("last_seen requires a token")
+		}
+		mux.Handle("/last_seen", socketServer.airbrakeHandler.WithReporting(http.HandlerFunc(socketServer.LastSeen(c.LastSeen.Token))))
+	}
 
 	server := &http.Server{Addr: fmt.Sprintf("%v:%v", c.Host, c.Port), Handler: serveHTTPWithLogs(mux, logger)}
-	go socketServer.handleAcks()
+	if acksEnabled {
+		socketServer.startAckWorkers(c.AckWorkers)
+	}
 	return server, socketServer, nil
 }
 
+// startAckWorkers drains the ack channel with workers goroutines, at least one, acksDone is closed once they all exited.
+// The depth of the ack channel is sampled until then
+func (s *Server) startAckWorkers(workers int) {
+	s.ackWorkers = max(workers, 1)
+	s.acksDone = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < s.ackWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleAcks()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(s.acksDone)
+	}()
+	go s.sampleAckChannelDepth(ackChannelDepthInterval)
+}
+
+// sampleAckChannelDepth sets ack_channel_depth every interval until acksDone is closed, so that it does not go stale
+// while no ack is processed
+func (s *Server) sampleAckChannelDepth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.metrics.ackChannelDepth.Set(int64(len(s.ackChan)), map[string]string{})
+		select {
+		case <-s.acksDone:
+			s.metrics.ackChannelDepth.Set(0, map[string]string{})
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordTypeSet returns the set of the record types, nil if empty
+func recordTypeSet(recordTypes []string) map[string]bool {
+	if len(recordTypes) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(recordTypes))
+	for _, recordType := range recordTypes {
+		set[recordType] = true
+	}
+	return set
+}
+
+// handleAcks responds to the vehicles with the acks of the dispatchers until the ack channel is closed. It runs in
+// every ack worker: the socket registry and the reliable ack policy are safe for concurrent use, and the acks are
+// queued to the writer of their connection without blocking, which is the only goroutine writing to the websocket
 func (s *Server) handleAcks() {
 	for record := range s.ackChan {
-		reliableAckSource := string(s.reliableAckSources[record.TxType])
-		if record.Serializer != nil {
-			if socket := s.registry.GetSocket(record.SocketID); socket != nil {
-				serverMetricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
-				socket.respondToVehicle(record, nil)
-			} else {
-				serverMetricsRegistry.reliableAckMissCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
-			}
+		s.acksHandled.Add(1)
+		s.handleAck(record)
+		s.acksHandled.Add(-1)
+	}
+}
+
+// handleAck queues the reliable ack of the record to the writer of its connection
+func (s *Server) handleAck(record *telemetry.Record) {
+	// the producers do not send the acks of the records acked on receipt
+	dispatcher, _ := s.reliableAckSources.source(record.TxType)
+	reliableAckSource := string(dispatcher)
+	if record.SocketID == debugInjectSocketID {
+		// the injected records have no connection to ack
+		return
+	}
+	if record.Serializer == nil {
+		// the ack cannot be built without the serializer of the connection
+		s.metrics.reliableAckInvalidCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
+		s.logger.ErrorLog("reliable_ack_invalid_record", errors.New("record without serializer"), logrus.LogInfo{"record_type": record.TxType, "socket_id": record.SocketID, "dispatcher": reliableAckSource})
+		return
+	}
+	if socket := s.registry.GetSocket(record.SocketID); socket != nil {
+		s.metrics.reliableAckCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
+		if produceTime := record.ProduceTime(dispatcher); !produceTime.IsZero() {
+			s.metrics.reliableAckLatency.Observe(time.Since(produceTime).Milliseconds(), map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
 		}
+		if err := socket.ackReliably(record); errors.Is(err, errOutboundQueueFull) {
+			s.metrics.reliableAckDroppedCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
+		}
+	} else {
+		s.metrics.reliableAckMissCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
 	}
 }
 
-// serveHTTPWithLogs wraps a handler and logs the request
+// serveHTTPWithLogs wraps a handler and logs the request, websocket connections log their own summary when they close
 func serveHTTPWithLogs(h http.Handler, logger *logrus.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
 		urlPath := r.URL.Path
 		start := time.Now()
 		uuidStr := uuid.New().String()
@@ -122,27 +565,378 @@ func serveHTTPWithLogs(h http.Handler, logger *logrus.Logger) http.Handler {
 	})
 }
 
-// Status API shows server with mtls config is up
+// Status API shows server with mtls config is up, it responds with 503 and the reason
+// when the server is draining, in maintenance or overloaded
 func (s *Server) Status() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, _ *http.Request) {
+		if reason := s.unavailableReason(); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
 		_, _ = fmt.Fprint(w, "mtls ok")
 	}
 }
 
+// StatusIdentityResponse is the response of /status when the status identity is enabled. The identity is empty and
+// the error set when it could not be extracted from the certificate of the request
+type StatusIdentityResponse struct {
+	Status         string `json:"status"`
+	TLSPassThrough string `json:"tls_pass_through"`
+	DeviceID       string `json:"device_id,omitempty"`
+	SenderID       string `json:"sender_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// StatusIdentity API responds as Status with the active pass through mode and the identity the server extracts from
+// the certificate of the request, the status code only reflects the availability of the server
+func (s *Server) StatusIdentity(c *config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reason := s.unavailableReason(); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		response := StatusIdentityResponse{Status: "mtls ok", TLSPassThrough: "none"}
+		if c.TLSPassThrough != nil {
+			response.TLSPassThrough = string(*c.TLSPassThrough)
+		}
+		if c.TLSPassThrough == nil && r.TLS == nil {
+			response.Error = errMissingCertificate.Error()
+		} else if requestIdentity, err := s.identity(r, c, true); err != nil {
+			response.Error = identityErrorCode(err)
+		} else {
+			response.DeviceID = requestIdentity.DeviceID
+			response.SenderID = requestIdentity.SenderID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			s.logger.ErrorLog("status_identity_encode_error", err, nil)
+		}
+	}
+}
+
+// DebugInject dispatches the stream message of the body of POST requests as a vehicle connection would, with the
+// identity of its sender id. The topic query parameter replaces the topic of the message when set. Requests must
+// carry the token as bearer token
+func (s *Server) DebugInject(c *config.Config, token string) func(w http.ResponseWriter, r *http.Request) {
+	return requireBearerToken(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, telemetry.SizeLimit+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message, err := parseStreamMessage(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid stream message: %v", err), http.StatusBadRequest)
+			return
+		}
+		_, deviceID := messages.ParseSenderID(string(message.SenderID))
+		if deviceID == "" {
+			http.Error(w, "sender_id should be client_type.device_id", http.StatusBadRequest)
+			return
+		}
+		if topic := r.URL.Query().Get("topic"); topic != "" {
+			message = &messages.StreamMessage{
+				MessageTopic:       []byte(topic),
+				TXID:               message.TXID,
+				SenderID:           message.SenderID,
+				DeviceType:         message.DeviceType,
+				DeviceID:           message.DeviceID,
+				DeliveredAtEpochMs: message.DeliveredAtEpochMs,
+				CreatedAt:          message.CreatedAt,
+				Payload:            message.Payload,
+				EnvMessageID:       message.EnvMessageID,
+			}
+			if body, err = message.ToBytes(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		requestIdentity := &telemetry.RequestIdentity{DeviceID: deviceID, SenderID: string(message.SenderID)}
+		serializer, routingRegion := s.newSerializer(requestIdentity, c)
+		traceID := r.Header.Get(c.TraceIDHeaderName())
+		if !validTraceID(traceID) {
+			traceID = uuid.New().String()
+		}
+		pipeline := newRecordPipeline(requestIdentity, c, s.logger, debugInjectSocketID, traceID)
+		s.configurePipeline(&pipeline, routingRegion)
+		// the records go through the pipeline of the connections, with their response returned to the caller
+		var rejected error
+		pipeline.respond = func(_ *telemetry.Record, err error) {
+			rejected = err
+		}
+		record, err := pipeline.decodeRecord(serializer, body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid record: %v", err), http.StatusBadRequest)
+			return
+		}
+		pipeline.handleRecord(serializer, record)
+		if rejected != nil {
+			http.Error(w, fmt.Sprintf("rejected record: %v", rejected), http.StatusUnprocessableEntity)
+			return
+		}
+		s.metrics.debugInjectCount.Inc(map[string]string{"record_type": record.TxType})
+		injected := logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType, "device_id": record.Vin}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(injected); err != nil {
+			s.logger.ErrorLog("debug_inject_encode_error", err, nil)
+		}
+		injected["remote_ip"] = r.RemoteAddr
+		s.auditor.Record(r, "debug_inject", record.Vin, injected)
+	})
+}
+
+// requireBearerToken serves the requests carrying the bearer token with the handler, and responds 401 to the others
+func requireBearerToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// parseStreamMessage parses the stream message, malformed flatbuffers panic on decoding
+func parseStreamMessage(body []byte) (message *messages.StreamMessage, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			message, err = nil, fmt.Errorf("malformed message: %v", recovered)
+		}
+	}()
+	return messages.StreamMessageFromBytes(body)
+}
+
+// Readiness is the readiness of the server served on /readyz
+type Readiness struct {
+	Ready                bool     `json:"ready"`
+	AcksRunning          bool     `json:"acks_running"`
+	UnhealthyDispatchers []string `json:"unhealthy_dispatchers"`
+}
+
+// Live API responds as long as the process serves requests
+func (s *Server) Live() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}
+}
+
+// Ready API responds with 200 when connections are accepted given the health of the dispatchers and the acks are
+// processed, 503 otherwise. The body lists the unhealthy dispatchers as JSON
+func (s *Server) Ready(c *config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		readiness := s.readiness(c)
+		w.Header().Set("Content-Type", "application/json")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(readiness); err != nil {
+			s.logger.ErrorLog("readiness_encode_error", err, nil)
+		}
+	}
+}
+
+// readiness checks the health of the dispatchers, as the status server does, and whether the acks are still processed
+func (s *Server) readiness(c *config.Config) Readiness {
+	unhealthy, accepted := c.DispatcherReadiness()
+	acksRunning := s.acksRunning()
+	return Readiness{Ready: acksRunning && accepted, AcksRunning: acksRunning, UnhealthyDispatchers: unhealthy}
+}
+
+// acksRunning returns false once the ack workers exited, acks disabled are not considered stopped
+func (s *Server) acksRunning() bool {
+	if s.acksDone == nil {
+		return true
+	}
+	select {
+	case <-s.acksDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// Connections API lists the connected sockets as JSON. Requests must carry the token as bearer token
+func (s *Server) Connections(token string) func(w http.ResponseWriter, r *http.Request) {
+	return requireBearerToken(token, func(w http.ResponseWriter, r *http.Request) {
+		sockets := s.registry.ListSockets()
+		s.auditor.Record(r, "connections_list", "connections", logrus.LogInfo{"count": len(sockets), "remote_ip": r.RemoteAddr})
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sockets); err != nil {
+			s.logger.ErrorLog("connections_encode_error", err, nil)
+		}
+	})
+}
+
+// ReliableAcks serves the reliable ack state of the record types as JSON. POST requests with the record_type and
+// enabled query parameters enable or disable the reliable acks of the record type, the records of the record
+// types disabled are acked as soon as they are received. Requests must carry the token as bearer token
+func (s *Server) ReliableAcks(token string) func(w http.ResponseWriter, r *http.Request) {
+	return requireBearerToken(token, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			recordType := r.URL.Query().Get("record_type")
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "invalid enabled", http.StatusBadRequest)
+				return
+			}
+			changed, err := s.reliableAckSources.set(recordType, enabled)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if changed {
+				s.auditor.Record(r, "reliable_ack_toggle", recordType, logrus.LogInfo{"enabled": enabled})
+				s.metrics.reliableAckToggleCount.Inc(map[string]string{"record_type": recordType, "enabled": strconv.FormatBool(enabled)})
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.reliableAckSources.states()); err != nil {
+			s.logger.ErrorLog("reliable_acks_encode_error", err, nil)
+		}
+	})
+}
+
+// LastSeen serves the last activity of the device of the device_id query parameter as JSON, devices not seen by
+// this server are looked up in the session store when configured. Requests must carry the token as bearer token
+func (s *Server) LastSeen(token string) func(w http.ResponseWriter, r *http.Request) {
+	return requireBearerToken(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deviceID := r.URL.Query().Get("device_id")
+		if deviceID == "" {
+			http.Error(w, "missing device_id", http.StatusBadRequest)
+			return
+		}
+
+		lastSeen, source := s.lookupLastSeen(deviceID)
+		s.metrics.lastSeenLookupCount.Inc(map[string]string{"source": source})
+		s.auditor.Record(r, "last_seen_lookup", deviceID, logrus.LogInfo{"source": source, "remote_ip": r.RemoteAddr})
+		if lastSeen == nil {
+			http.Error(w, "device not seen", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lastSeen); err != nil {
+			s.logger.ErrorLog("last_seen_encode_error", err, nil)
+		}
+	})
+}
+
+// lookupLastSeen returns the last activity of the device and where it was found, "none" if it was not
+func (s *Server) lookupLastSeen(deviceID string) (*LastSeen, string) {
+	if lastSeen, ok := s.lastSeen.lookup(deviceID, time.Now()); ok {
+		return &lastSeen, "memory"
+	}
+	if s.registry.store == nil {
+		return nil, "none"
+	}
+	session, err := s.registry.store.Load(deviceID)
+	if err != nil {
+		s.logger.ErrorLog("last_seen_session_load_error", err, logrus.LogInfo{"device_id": deviceID})
+		return nil, "none"
+	}
+	if session == nil {
+		return nil, "none"
+	}
+	if session.DisconnectedAt.IsZero() {
+		// the server of the session stopped without deregistering the socket
+		return &LastSeen{DeviceID: deviceID, LastSeen: session.ConnectedAt, Event: LastSeenEventConnect}, "session_store"
+	}
+	return &LastSeen{DeviceID: deviceID, LastSeen: session.DisconnectedAt, Event: LastSeenEventDisconnect}, "session_store"
+}
+
+// RegisterTransformer registers a transformer of the decoded messages of the records of the topic, run before
+// dispatch after the transformers previously registered. Only V, alerts, errors and connectivity records are decoded
+func (s *Server) RegisterTransformer(topic string, transform telemetry.MessageTransformFunc) {
+	s.messageTransformers.Register(topic, transform)
+}
+
+// RegisterRoute dispatches the records of the topic matched by match to the producers in place of those of the dispatch
+// rules, for instance to send urgent alerts to a low latency dispatcher. Routes are matched in registration order,
+// records matching no route are dispatched with the dispatch rules. Connectivity events are not routed
+func (s *Server) RegisterRoute(topic string, match telemetry.RecordMatcher, producers ...telemetry.Producer) {
+	s.router.Register(topic, telemetry.Route{Match: match, Producers: producers})
+}
+
+// SetDraining marks the server as draining its connections before shutdown
+func (s *Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
+// SetMaintenance marks the server as in maintenance
+func (s *Server) SetMaintenance(maintenance bool) {
+	s.maintenance.Store(maintenance)
+}
+
+func (s *Server) unavailableReason() string {
+	switch {
+	case s.draining.Load():
+		return "draining"
+	case s.maintenance.Load():
+		return "maintenance"
+	case s.maxConnections > 0 && s.registry.NumAdmittedConnections() >= s.maxConnections:
+		return "overloaded"
+	default:
+		return ""
+	}
+}
+
 // ServeBinaryWs serves a http query and upgrades it to a websocket -- only serves binary data coming from the ws
 func (s *Server) ServeBinaryWs(config *config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := s.connectionWarmup.allow(time.Now()); !ok {
+			s.metrics.warmupRejectedCount.Inc(map[string]string{})
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "server warming up", http.StatusServiceUnavailable)
+			return
+		}
+		if s.draining.Load() {
+			http.Error(w, "server draining", http.StatusServiceUnavailable)
+			return
+		}
+		if !s.acceptDuringOutage(config) {
+			http.Error(w, "dispatchers unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !s.registry.admit(s.maxConnections) {
+			s.metrics.connectionsRejectedCount.Inc(map[string]string{})
+			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.registry.release()
+		if s.sourceIPLimiter != nil {
+			sourceIP := s.sourceIPLimiter.sourceIP(r)
+			if !s.sourceIPLimiter.acquire(sourceIP) {
+				s.metrics.sourceIPRejectedCount.Inc(map[string]string{})
+				s.logger.Log(logrus.WARN, "source_ip_limit_exceeded", logrus.LogInfo{"source_ip": sourceIP})
+				http.Error(w, "too many connections from source ip", http.StatusTooManyRequests)
+				return
+			}
+			defer s.sourceIPLimiter.release(sourceIP)
+		}
+
 		// Print the client certificates if available
 		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 			// For example, print details of the first certificate
 			clientCert := r.TLS.PeerCertificates[0]
 			// Print out subject common name, issuer and expiration time, etc.
-			s.logger.Log(logrus.INFO, "client_certificate", logrus.LogInfo{
-				"Subject":   clientCert.Subject.CommonName,
-				"Issuer":    clientCert.Issuer.CommonName,
-				"NotBefore": clientCert.NotBefore.String(),
-				"NotAfter":  clientCert.NotAfter.String(),
-			})
+			s.logger.Log(logrus.INFO, "client_certificate", s.clientCertificateLogInfo(clientCert))
 
 			chains := r.TLS.VerifiedChains
 			s.logger.Log(logrus.INFO, "chains_size", logrus.LogInfo{
@@ -155,42 +949,248 @@ func (s *Server) ServeBinaryWs(config *config.Config) func(w http.ResponseWriter
 				}
 				s.logger.Log(logrus.INFO, "chain_subject_common_name", logrus.LogInfo{
 					"idx":               idx,
-					"common_name_chain": strings.Join(chainCommonName, "|"),
+					"common_name_chain": s.chainLogValue(chainCommonName),
 				})
 			}
 		} else {
 			s.logger.Log(logrus.INFO, "client_certificate_not_found", logrus.LogInfo{})
 		}
 
-		if ws := s.promoteToWebsocket(w, r); ws != nil {
-			ctx := context.WithValue(context.Background(), SocketContext, map[string]interface{}{"request": r})
-			requestIdentity, err := extractIdentity(r, config)
-			if err != nil {
-				s.logger.ErrorLog("extract_sender_id_err", err, nil)
+		requestIdentity, err := s.identity(r, config, false)
+		if err != nil {
+			s.logger.ErrorLog("extract_sender_id_err", err, nil)
+			s.airbrakeHandler.ReportError(r, err)
+			if errors.Is(err, errUntrustedCertificate) && config.TLSPassThroughVerification.Strict {
+				http.Error(w, "untrusted client certificate", http.StatusForbidden)
+				return
 			}
+			if errors.Is(err, errRevokedCertificate) {
+				s.metrics.revokedCertRejectedCount.Inc(map[string]string{})
+				http.Error(w, "revoked client certificate", http.StatusForbidden)
+				return
+			}
+			if errors.Is(err, errExpiredCertificate) {
+				s.metrics.expiredCertRejectedCount.Inc(map[string]string{})
+				http.Error(w, "expired client certificate", http.StatusForbidden)
+				return
+			}
+			if !config.AllowAnonymousIdentity {
+				s.rejectIdentity(w, r)
+				return
+			}
+			// the connection is kept open with an anonymous identity
+			requestIdentity = &telemetry.RequestIdentity{}
+		}
+
+		if s.AuthorizeConnection != nil {
+			if err := s.AuthorizeConnection(requestIdentity); err != nil {
+				s.metrics.connectionsRejectedByPolicyCount.Inc(map[string]string{})
+				s.logger.ActivityLog("connection_rejected_by_policy", logrus.LogInfo{"device_id": requestIdentity.DeviceID, "error": err.Error()})
+				s.closeWithPolicyViolation(w, r, rejectedByPolicyCloseReason)
+				return
+			}
+		}
 
-			binarySerializer := telemetry.NewBinarySerializer(requestIdentity, s.DispatchRules, s.logger)
-			socketManager := NewSocketManager(ctx, requestIdentity, ws, config, s.logger)
+		if ws := s.promoteToWebsocket(w, r, affinityHeader(requestIdentity, config)); ws != nil {
+			ctx := context.WithValue(s.ctx, SocketContext, map[string]interface{}{"request": r})
+
+			binarySerializer, routingRegion := s.newSerializer(requestIdentity, config)
+			s.metrics.serializerVariantCount.Inc(map[string]string{"variant": binarySerializer.Variant})
+			socketManager := s.newSocketManager(ctx, requestIdentity, ws, config, routingRegion)
 			s.registerSocket(socketManager, binarySerializer)
-			defer s.deregisterSocket(socketManager, binarySerializer)
+			defer func() {
+				reason := socketManager.connectivityDisconnectReason()
+				s.deregisterSocket(socketManager, binarySerializer, reason)
+				s.logConnectionSummary(socketManager, r, reason)
+			}()
+			s.trackReconnect(requestIdentity, config)
 
 			socketManager.ProcessTelemetry(binarySerializer)
 		}
 	}
 }
 
-func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *telemetry.BinarySerializer, event protos.ConnectivityEvent) error {
-	connectivityDispatcher, ok := s.DispatchRules[connectitivityTopic]
+// newSocketManager returns the manager of a connection processing its records with the pipeline of the server
+func (s *Server) newSocketManager(ctx context.Context, requestIdentity *telemetry.RequestIdentity, ws *websocket.Conn, config *config.Config, routingRegion string) *SocketManager {
+	socketManager := NewSocketManager(ctx, requestIdentity, ws, config, s.logger)
+	s.configurePipeline(&socketManager.recordPipeline, routingRegion)
+	socketManager.decompressor = s.decompressor
+	socketManager.deviceRateLimiter = s.deviceRateLimiter
+	return socketManager
+}
+
+// configurePipeline sets the processing steps of the server on the record pipeline of a client
+func (s *Server) configurePipeline(pipeline *recordPipeline, routingRegion string) {
+	pipeline.changeDetector = s.changeDetector
+	pipeline.routingRegion = routingRegion
+	pipeline.sequenceSource = s.SequenceSource
+	pipeline.compressor = s.compressor
+	pipeline.transformer = s.transformer
+	pipeline.fieldPresence = s.fieldPresence
+	pipeline.reliableAcks = s.reliableAckSources
+	pipeline.deadLetterLimiter = s.deadLetterLimiter
+	pipeline.messageTransformers = s.messageTransformers
+	pipeline.messageTransformFatal = s.messageTransformFatal
+}
+
+// logConnectionSummary logs the identity, traffic and lifetime of a closed websocket connection
+func (s *Server) logConnectionSummary(sm *SocketManager, r *http.Request, reason string) {
+	deviceID := ""
+	if sm.requestIdentity != nil {
+		deviceID = sm.requestIdentity.DeviceID
+	}
+	s.logger.ActivityLog("connection_summary", logrus.LogInfo{
+		"device_id":         deviceID,
+		"device_type":       sm.deviceType(),
+		"connection_id":     sm.UUID,
+		"trace_id":          sm.traceID,
+		"remote_ip":         r.RemoteAddr,
+		"frames_read":       sm.FramesRead(),
+		"bytes_read":        sm.BytesRead(),
+		"lifetime_ms":       int(time.Since(sm.StartTime).Milliseconds()),
+		"disconnect_reason": reason,
+	})
+}
+
+// newSerializer returns the serializer of the records of the client and the region its records are routed to
+func (s *Server) newSerializer(requestIdentity *telemetry.RequestIdentity, config *config.Config) (*telemetry.BinarySerializer, string) {
+	dispatchRules, routingRegion := s.regionalDispatchRules(requestIdentity, config)
+	binarySerializer := telemetry.NewBinarySerializer(requestIdentity, dispatchRules, s.logger)
+	if routingRegion == "" || routingRegion == unknownRegion {
+		binarySerializer.RulesSource = s.dispatchRules
+	}
+	binarySerializer.DefaultTopic = config.DefaultTopic
+	binarySerializer.DiscardUnknownFields = s.discardUnknownFields
+	if variant, ok := s.serializerVariants[binarySerializer.Variant]; ok {
+		binarySerializer.DefaultTopic = variant.defaultTopic
+		binarySerializer.DiscardUnknownFields = variant.discardUnknownFields
+	}
+	binarySerializer.Gateway = requestIdentity != nil && s.gatewaySenders[requestIdentity.DeviceID]
+	binarySerializer.Router = s.router
+	return binarySerializer, routingRegion
+}
+
+// clientCertificateLogInfo returns the names and validity of the client certificate logged on connection
+func (s *Server) clientCertificateLogInfo(cert *x509.Certificate) logrus.LogInfo {
+	info := logrus.LogInfo{
+		"Subject":   s.certificateLogValue(config.CertificateLogSubject, cert.Subject.CommonName),
+		"Issuer":    s.certificateLogValue(config.CertificateLogIssuer, cert.Issuer.CommonName),
+		"NotBefore": s.certificateLogValue(config.CertificateLogValidity, cert.NotBefore.String()),
+		"NotAfter":  s.certificateLogValue(config.CertificateLogValidity, cert.NotAfter.String()),
+	}
+	if s.deviceIDSource != nil {
+		info["SubjectDeviceID"] = s.certificateLogValue(config.CertificateLogSubject, messages.DeviceIDFromCert(cert, s.deviceIDSource))
+	}
+	return info
+}
+
+// chainLogValue returns the common names of a verified chain logged on connection
+func (s *Server) chainLogValue(commonNames []string) string {
+	return s.certificateLogValue(config.CertificateLogChain, strings.Join(commonNames, "|"))
+}
+
+// certificateLogValue returns the value of the client certificate component for the connection logs, or the
+// redacted marker if the component is redacted
+func (s *Server) certificateLogValue(component config.CertificateLogComponent, value string) string {
+	if s.redactedCertificateComponents[component] {
+		return redactedLogValue
+	}
+	return value
+}
+
+// trackReconnect reports connections reconnecting a previous session of the same client certificate key
+func (s *Server) trackReconnect(requestIdentity *telemetry.RequestIdentity, c *config.Config) {
+	if s.reconnectTracker == nil || requestIdentity == nil || requestIdentity.KeyFingerprint == "" {
+		return
+	}
+	reconnect, identityChanged := s.reconnectTracker.track(requestIdentity.KeyFingerprint, requestIdentity.DeviceID, time.Now())
+	if identityChanged {
+		policy := c.ReconnectTracking.IdentityChangePolicy
+		if policy == "" {
+			policy = config.IdentityChangeNewDevice
+		}
+		s.metrics.identityChangedCount.Inc(map[string]string{"policy": policy})
+		s.logger.ActivityLog("identity_changed_on_reconnect", logrus.LogInfo{"device_id": requestIdentity.DeviceID, "policy": policy})
+	}
+	if reconnect {
+		s.metrics.reconnectCount.Inc(map[string]string{})
+	}
+}
+
+// acceptDuringOutage returns false if the connection should be rejected because of a partial dispatcher outage
+func (s *Server) acceptDuringOutage(c *config.Config) bool {
+	if _, partial := c.CachedUnhealthyDispatchers(); !partial {
+		return true
+	}
+	if c.PartialOutage.Policy == config.PartialOutageReject {
+		s.metrics.partialOutageCount.Inc(map[string]string{"action": "rejected"})
+		return false
+	}
+	s.metrics.partialOutageCount.Inc(map[string]string{"action": "accepted"})
+	return true
+}
+
+// regionalDispatchRules returns the dispatch rules of the device region when region routing is configured
+// along with the region used for routing, records of devices in unknown regions use the default rules
+func (s *Server) regionalDispatchRules(requestIdentity *telemetry.RequestIdentity, config *config.Config) (map[string][]telemetry.Producer, string) {
+	if config.RegionRouting == nil {
+		return s.DispatchRules(), ""
+	}
+	if requestIdentity != nil {
+		if rules, ok := s.RegionDispatchRules[requestIdentity.Region]; ok {
+			return rules, requestIdentity.Region
+		}
+	}
+	return s.DispatchRules(), unknownRegion
+}
+
+// DispatchRules returns the current default dispatch rules, which must not be modified
+func (s *Server) DispatchRules() map[string][]telemetry.Producer {
+	return s.dispatchRules.Load()
+}
+
+// ReloadDispatchRules atomically replaces the default dispatch rules, records are dispatched with either the previous
+// or the new rules and open connections use the new rules from their next record. The rules of region routing are not replaced
+func (s *Server) ReloadDispatchRules(rules map[string][]telemetry.Producer) {
+	s.dispatchRules.Store(rules)
+	s.logger.ActivityLog("dispatch_rules_reloaded", logrus.LogInfo{"record_types": len(rules)})
+}
+
+// dispatchConnectivityEvent dispatches the connectivity event of the connection, reason is the cause of disconnected events
+func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *telemetry.BinarySerializer, event protos.ConnectivityEvent, reason string) error {
+	topic := s.connectivityTopic
+	if s.connectivityBatcher != nil {
+		topic = connectivityBatchTopic
+	}
+	connectivityDispatcher, ok := serializer.Rules()[topic]
 	if !ok {
+		s.logger.Log(logrus.DEBUG, "connectivity_dispatch_disabled", logrus.LogInfo{"topic": topic, "event": event.String()})
 		return nil
 	}
 
+	networkInterface := sm.GetNetworkInterface()
+	if networkInterface == "" {
+		networkInterface = s.unknownNetworkInterface
+		s.metrics.unknownInterfaceCount.Inc(map[string]string{"event": event.String()})
+	}
+	deviceType := sm.requestIdentity.DeviceType
+	if deviceType == "" {
+		deviceType = defaultConnectivityDeviceType
+	}
+
 	connectivityMessage := &protos.VehicleConnectivity{
 		Vin:              sm.requestIdentity.DeviceID,
 		ConnectionId:     sm.UUID,
-		NetworkInterface: sm.GetNetworkInterface(),
+		NetworkInterface: networkInterface,
 		CreatedAt:        timestamppb.Now(),
 		Status:           event,
+		DisconnectReason: reason,
+		TraceId:          sm.traceID,
+		DeviceType:       deviceType,
+	}
+	if s.connectivityBatcher != nil {
+		s.connectivityBatcher.add(sm.routingRegion, serializer.Rules(), sm.transmitDecodedRecords, connectivityMessage)
+		return nil
 	}
 
 	payload, err := proto.Marshal(connectivityMessage)
@@ -203,8 +1203,8 @@ func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *teleme
 		TXID:         []byte(sm.UUID),
 		SenderID:     []byte(sm.requestIdentity.SenderID),
 		DeviceID:     []byte(sm.requestIdentity.DeviceID),
-		DeviceType:   []byte("vehicle_device"),
-		MessageTopic: []byte(connectitivityTopic),
+		DeviceType:   []byte(deviceType),
+		MessageTopic: []byte(defaultConnectivityTopic),
 		Payload:      payload,
 		CreatedAt:    uint32(connectivityMessage.CreatedAt.AsTime().Unix()),
 	}
@@ -213,10 +1213,14 @@ func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *teleme
 	if err != nil {
 		return err
 	}
-	record, err := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
+	decoded, err := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
 	if err != nil {
 		return err
 	}
+	// the record is decoded as a connectivity record and dispatched to the topic configured
+	record := decoded.WithTxType(s.connectivityTopic)
+	record.DisconnectReason = reason
+	record.TraceID = sm.traceID
 	for _, dispatcher := range connectivityDispatcher {
 		dispatcher.Produce(record)
 	}
@@ -225,27 +1229,137 @@ func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *teleme
 
 func (s *Server) registerSocket(sm *SocketManager, serializer *telemetry.BinarySerializer) {
 	s.registry.RegisterSocket(sm)
+	if s.deviceRateLimiter != nil && sm.requestIdentity != nil {
+		sm.rateBucket = s.deviceRateLimiter.acquire(sm.requestIdentity.DeviceID)
+	}
+	s.restoreSession(sm)
+	s.lastSeen.connected(sm)
 	event := protos.ConnectivityEvent_CONNECTED
-	if err := s.dispatchConnectivityEvent(sm, serializer, event); err != nil {
+	if err := s.dispatchConnectivityEvent(sm, serializer, event, ""); err != nil {
 		s.logger.ErrorLog("connectivity_registeration_error", err, logrus.LogInfo{"deviceID": sm.requestIdentity.DeviceID, "event": event})
 	}
 
 }
 
-func (s *Server) deregisterSocket(sm *SocketManager, serializer *telemetry.BinarySerializer) {
-	s.registry.DeregisterSocket(sm)
+// restoreSession resumes the reconnect tracking and the sequence numbers of the device from its previous session,
+// which may have been served by a pod since restarted
+func (s *Server) restoreSession(sm *SocketManager) {
+	previous := sm.previousSession
+	if previous == nil {
+		return
+	}
+	lastSeen := previous.DisconnectedAt
+	if lastSeen.IsZero() {
+		// the previous server stopped without deregistering the socket
+		lastSeen = previous.ConnectedAt
+	}
+	s.reconnectTracker.restore(previous.KeyFingerprint, previous.DeviceID, lastSeen)
+	if restorer, ok := s.SequenceSource.(telemetry.SequenceRestorer); ok && previous.LastSequence > 0 {
+		restorer.Restore(previous.DeviceID, previous.LastSequence)
+	}
+	s.metrics.sessionRestoredCount.Inc(map[string]string{})
+}
+
+// deregisterSocket dispatches the end of session records of the connection with the reason it disconnected, the
+// socket is removed from the registry last so that shutdown waits for the disconnected connectivity events
+func (s *Server) deregisterSocket(sm *SocketManager, serializer *telemetry.BinarySerializer, reason string) {
+	defer s.registry.DeregisterSocket(sm)
+	if s.deviceRateLimiter != nil && sm.requestIdentity != nil {
+		defer s.deviceRateLimiter.release(sm.requestIdentity.DeviceID)
+	}
+	s.lastSeen.disconnected(sm, time.Now())
+	s.dispatchSessionEndSentinels(sm, serializer)
 	event := protos.ConnectivityEvent_DISCONNECTED
-	if err := s.dispatchConnectivityEvent(sm, serializer, event); err != nil {
-		s.logger.ErrorLog("connectivity_deregisteration_error", err, logrus.LogInfo{"deviceID": sm.requestIdentity.DeviceID, "event": event})
+	if err := s.dispatchConnectivityEvent(sm, serializer, event, reason); err != nil {
+		s.logger.ErrorLog("connectivity_deregisteration_error", err, logrus.LogInfo{"deviceID": sm.requestIdentity.DeviceID, "event": event, "reason": reason})
+	}
+	if reason := sm.serverDisconnectReason(); reason != "" {
+		s.metrics.serverDisconnectCount.Inc(map[string]string{"reason": reason})
 	}
 }
 
-func (s *Server) promoteToWebsocket(w http.ResponseWriter, r *http.Request) *websocket.Conn {
-	ws, err := upgrader.Upgrade(w, r, nil)
+// dispatchSessionEndSentinels dispatches a sentinel record on the configured record types the device sent during the session
+func (s *Server) dispatchSessionEndSentinels(sm *SocketManager, serializer *telemetry.BinarySerializer) {
+	for _, recordType := range s.sentinelRecords {
+		if _, ok := sm.RecordsStats[recordType]; !ok {
+			continue
+		}
+		record := telemetry.NewSessionEndRecord(serializer, recordType, sm.UUID)
+		record.TraceID = sm.traceID
+		for _, producer := range serializer.Rules()[recordType] {
+			producer.Produce(record)
+		}
+		s.metrics.sessionEndSentinelCount.Inc(map[string]string{"record_type": recordType})
+	}
+}
+
+// newUpgrader returns the websocket upgrader of the configured buffer sizes and handshake timeout, accepting
+// the origins allowed or any origin when none is configured
+func newUpgrader(c *config.Config) *websocket.Upgrader {
+	// vehicles do not send an origin, it is only checked for browsers
+	checkOrigin := func(_ *http.Request) bool { return true }
+	if len(c.AllowedOrigins) > 0 {
+		allowed := make(map[string]bool, len(c.AllowedOrigins))
+		for _, origin := range c.AllowedOrigins {
+			allowed[origin] = true
+		}
+		checkOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && allowed[u.Host]
+		}
+	}
+	readBufferSize, writeBufferSize := defaultWebsocketBufferSize, defaultWebsocketBufferSize
+	if c.WebsocketReadBufferSize > 0 {
+		readBufferSize = c.WebsocketReadBufferSize
+	}
+	if c.WebsocketWriteBufferSize > 0 {
+		writeBufferSize = c.WebsocketWriteBufferSize
+	}
+	return &websocket.Upgrader{
+		CheckOrigin:      checkOrigin,
+		ReadBufferSize:   readBufferSize,
+		WriteBufferSize:  writeBufferSize,
+		HandshakeTimeout: time.Duration(c.WebsocketHandshakeTimeoutSeconds) * time.Second,
+		Subprotocols:     c.WebsocketSubprotocols,
+	}
+}
+
+func (s *Server) promoteToWebsocket(w http.ResponseWriter, r *http.Request, responseHeader http.Header) *websocket.Conn {
+	var malformed *malformedUpgradeError
+	if err := validateUpgradeHeaders(r); errors.As(err, &malformed) {
+		s.metrics.malformedUpgradeCount.Inc(map[string]string{"header": malformed.header})
+		s.logger.Log(logrus.DEBUG, "websocket_malformed_upgrade", logrus.LogInfo{"error": err.Error(), "remote_addr": r.RemoteAddr, "user_agent": r.UserAgent()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil
+	}
+
+	ws, err := s.upgrade(w, r, responseHeader)
 	if err != nil {
 		s.airbrakeHandler.ReportError(r, err)
-		if _, ok := err.(websocket.HandshakeError); !ok {
-			s.logger.ErrorLog("websocket_promotion_error", err, nil)
+		reason := "other"
+		if _, ok := err.(websocket.HandshakeError); ok {
+			reason = "handshake"
+		}
+		s.metrics.websocketUpgradeErrorCount.Inc(map[string]string{"reason": reason})
+		logInfo := logrus.LogInfo{"reason": reason, "remote_addr": r.RemoteAddr, "user_agent": r.UserAgent()}
+		if reason == "handshake" {
+			// handshake errors are the churn of clients sending invalid upgrade requests
+			s.logger.Log(logrus.DEBUG, "websocket_promotion_error", logInfo)
+		} else {
+			s.logger.ErrorLog("websocket_promotion_error", err, logInfo)
+		}
+		return nil
+	}
+	if s.unsupportedSubprotocol(ws, r) {
+		s.metrics.subprotocolRejectedCount.Inc(map[string]string{})
+		defer ws.Close()
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseProtocolError, unsupportedSubprotocolCloseReason)
+		if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeWriteTimeout)); err != nil {
+			s.logger.ErrorLog("websocket_close_frame_error", err, logrus.LogInfo{"reason": unsupportedSubprotocolCloseReason})
 		}
 		return nil
 	}
@@ -253,101 +1367,547 @@ func (s *Server) promoteToWebsocket(w http.ResponseWriter, r *http.Request) *web
 	return ws
 }
 
-type extractCertFunc func(r *http.Request) (*x509.Certificate, error)
+// unsupportedSubprotocol returns true if the client requested subprotocols and none is supported by the server,
+// clients requesting no subprotocol are served the legacy format
+func (s *Server) unsupportedSubprotocol(ws *websocket.Conn, r *http.Request) bool {
+	if len(s.upgrader.Subprotocols) == 0 || ws.Subprotocol() != "" {
+		return false
+	}
+	return len(websocket.Subprotocols(r)) > 0
+}
+
+// rejectIdentity closes the connection of a client whose identity could not be extracted with a policy violation
+func (s *Server) rejectIdentity(w http.ResponseWriter, r *http.Request) {
+	if s.closeWithPolicyViolation(w, r, invalidIdentityCloseReason) {
+		s.metrics.identityRejectedCount.Inc(map[string]string{})
+	}
+}
+
+// closeWithPolicyViolation promotes the connection to close it with a policy violation and the reason, it returns
+// false if the connection could not be promoted
+func (s *Server) closeWithPolicyViolation(w http.ResponseWriter, r *http.Request, reason string) bool {
+	ws := s.promoteToWebsocket(w, r, nil)
+	if ws == nil {
+		return false
+	}
+	defer ws.Close()
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeWriteTimeout)); err != nil {
+		s.logger.ErrorLog("websocket_close_frame_error", err, logrus.LogInfo{"reason": reason})
+	}
+	return true
+}
+
+// upgrade promotes the connection, recovering from panics of the upgrader on hostile requests
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (ws *websocket.Conn, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ws, err = nil, fmt.Errorf("websocket upgrade panic: %v", recovered)
+		}
+	}()
+	return s.upgrader.Upgrade(w, r, responseHeader)
+}
+
+// affinityHeader returns the upgrade response header carrying the affinity token of the device if configured
+func affinityHeader(requestIdentity *telemetry.RequestIdentity, config *config.Config) http.Header {
+	if config.Affinity == nil || requestIdentity == nil || requestIdentity.DeviceID == "" {
+		return nil
+	}
+	token := config.Affinity.Token(requestIdentity.DeviceID)
+	header := http.Header{}
+	if config.Affinity.HeaderName != "" {
+		header.Set(config.Affinity.HeaderName, token)
+	}
+	if config.Affinity.CookieName != "" {
+		cookie := &http.Cookie{Name: config.Affinity.CookieName, Value: token, HttpOnly: true, Secure: true}
+		header.Add("Set-Cookie", cookie.String())
+	}
+	return header
+}
+
+// errUntrustedCertificate is returned when a pass through certificate chain fails verification
+var errUntrustedCertificate = errors.New("untrusted_certificate_error")
+
+// errMissingCertificate is returned when the request carries no client certificate
+var errMissingCertificate = errors.New("missing_certificate_error")
+
+// identityErrorCode returns the code of an identity extraction failure without its details, such as the names of
+// the certificates, which are not disclosed to unauthenticated callers
+func identityErrorCode(err error) string {
+	for _, known := range []error{errMissingCertificate, errExpiredCertificate, errRevokedCertificate, errUntrustedCertificate} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "identity_error"
+}
+
+// errNoCertificates is returned when a pass through header holds no certificate, parseCertificateChain never
+// returns an empty chain so that the extractors can pick the leaf without checking
+var errNoCertificates = errors.New("no certificates found in header")
+
+// extractCertFunc returns the certificate chain forwarded by the reverse proxy, leaf first
+type extractCertFunc func(r *http.Request) ([]*x509.Certificate, error)
 
 var headerExtractConfigMap = map[config.TLSPassThrough]extractCertFunc{
 	config.RFC9440:                    extractCertRFC2440,
 	config.AWSApplicationLoadBalancer: extractCertAWSALB,
+	config.GCPApplicationLoadBalancer: extractCertGCPALB,
 }
 
-func extractIdentity(r *http.Request, config *config.Config) (*telemetry.RequestIdentity, error) {
-	var cert *x509.Certificate
+// identity derives the identity of the client with the identity extractor of the embedder when set, from its certificate otherwise.
+// The certificates of probes, which do not open a connection, are not reported
+func (s *Server) identity(r *http.Request, config *config.Config, probe bool) (*telemetry.RequestIdentity, error) {
+	if s.IdentityExtractor == nil {
+		return s.extractIdentity(r, config, probe)
+	}
+	requestIdentity, err := s.IdentityExtractor(r, config)
+	if err == nil && requestIdentity == nil {
+		err = errors.New("identity extractor returned no identity")
+	}
+	return requestIdentity, err
+}
+
+func (s *Server) extractIdentity(r *http.Request, config *config.Config, probe bool) (*telemetry.RequestIdentity, error) {
+	var chain []*x509.Certificate
 	var err error
 	if config.TLSPassThrough != nil {
-		cert, err = headerExtractConfigMap[*config.TLSPassThrough](r)
+		if chain, err = headerExtractConfigMap[*config.TLSPassThrough](r); err != nil {
+			var parseErr *passThroughParseError
+			if errors.As(err, &parseErr) && !probe {
+				s.metrics.passthroughDecodeErrorCount.Inc(map[string]string{"mode": string(parseErr.mode), "stage": parseErr.stage})
+			}
+			return nil, err
+		}
+		if err = s.verifyPassThroughChain(chain, config, probe); err != nil {
+			return nil, err
+		}
 	} else {
-		cert, err = extractCertFromTLS(r)
+		chain, err = extractCertFromTLS(r)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if err = s.checkRevocation(chain, probe); err != nil {
+		return nil, err
+	}
+	if err = s.checkExpiry(chain[0], config.TLSPassThrough != nil); err != nil {
+		return nil, err
+	}
+	if !probe {
+		s.reportExpiry(chain[0])
+	}
+	cert := identityCertificate(chain, config.IdentityCertPosition, config.TLSPassThrough != nil)
 
-	clientType, deviceID, err := messages.CreateIdentityFromCert(cert)
+	clientType, deviceID, err := messages.CreateIdentityFromCertSource(cert, s.deviceIDSource)
 	if err != nil {
-		return nil, fmt.Errorf("create_identity issuer: %s, common_name: %s, err: %v", cert.Issuer.CommonName, cert.Subject.CommonName, err)
+		return nil, fmt.Errorf("create_identity issuer: %s, common_name: %s, device_id: %s, err: %v", cert.Issuer.CommonName, cert.Subject.CommonName, messages.DeviceIDFromCert(cert, s.deviceIDSource), err)
 	}
+	keyFingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
 	return &telemetry.RequestIdentity{
-		DeviceID: deviceID,
-		SenderID: clientType + "." + deviceID,
+		DeviceID:          deviceID,
+		SenderID:          clientType + "." + deviceID,
+		DeviceType:        clientType,
+		Region:            config.RegionForIssuer(cert.Issuer.CommonName),
+		KeyFingerprint:    hex.EncodeToString(keyFingerprint[:]),
+		SerializerVariant: config.SerializerVariantForUnits(cert.Subject.OrganizationalUnit),
 	}, nil
 }
 
+// checkRevocation returns errRevokedCertificate if a certificate of the chain is on the certificate revocation list,
+// probes check the list as last loaded without refreshing it
+func (s *Server) checkRevocation(chain []*x509.Certificate, probe bool) error {
+	if s.revocationList == nil {
+		return nil
+	}
+	revoked := s.revocationList.revoked
+	if probe {
+		revoked = s.revocationList.listed
+	}
+	for _, cert := range chain {
+		if revoked(cert) {
+			return fmt.Errorf("%w: common_name: %s, serial: %s", errRevokedCertificate, cert.Subject.CommonName, cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// verifyPassThroughChain verifies the chain forwarded by the reverse proxy against the CA pool of the server,
+// failures are returned in strict mode and only reported otherwise. Failures of probes are not reported
+func (s *Server) verifyPassThroughChain(chain []*x509.Certificate, config *config.Config, probe bool) error {
+	if s.passThroughRoots == nil {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         s.passThroughRoots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err == nil {
+		return nil
+	}
+
+	strict := config.TLSPassThroughVerification.Strict
+	if !probe {
+		s.metrics.passthroughUntrustedCount.Inc(map[string]string{"mode": string(*config.TLSPassThrough), "strict": strconv.FormatBool(strict)})
+	}
+	if !strict {
+		if !probe {
+			s.logger.ErrorLog("passthrough_certificate_untrusted", err, logrus.LogInfo{"common_name": chain[0].Subject.CommonName})
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %v", errUntrustedCertificate, err)
+}
+
 // extractCertRFC2440 implements https://datatracker.ietf.org/doc/rfc9440/
-func extractCertRFC2440(r *http.Request) (*x509.Certificate, error) {
+func extractCertRFC2440(r *http.Request) ([]*x509.Certificate, error) {
 	raw := r.Header.Get("Client-Cert-Chain")
 	if raw == "" {
-		return nil, errors.New("missing_certificate_error")
+		return nil, errMissingCertificate
 	}
 	rest, err := base64.StdEncoding.DecodeString(raw)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificates: %w", err)
-	}
-	block, _ := pem.Decode(rest)
-	if block == nil {
-		return nil, fmt.Errorf("failed to parse certificates: %w", err)
-	}
-	certs, err := x509.ParseCertificates(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificates: %w", err)
+		return nil, certificateParseError(config.RFC9440, "base64_decode", err)
 	}
-	return certs[0], nil
+	return parseCertificateChain(config.RFC9440, rest)
 }
 
 // extractCertAWSALB implements https://docs.aws.amazon.com/elasticloadbalancing/latest/application/mutual-authentication.html#mtls-http-headers
-func extractCertAWSALB(r *http.Request) (*x509.Certificate, error) {
+func extractCertAWSALB(r *http.Request) ([]*x509.Certificate, error) {
 	raw := r.Header.Get("X-Amzn-Mtls-Clientcert")
 	if raw == "" {
-		return nil, errors.New("missing_certificate_error")
+		return nil, errMissingCertificate
 	}
 	rest, err := url.QueryUnescape(raw)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificates: %w", err)
+		return nil, certificateParseError(config.AWSApplicationLoadBalancer, "url_decode", err)
 	}
-	block, _ := pem.Decode([]byte(rest))
-	if block == nil {
-		return nil, fmt.Errorf("failed to parse certificates: %w", err)
+	return parseCertificateChain(config.AWSApplicationLoadBalancer, []byte(rest))
+}
+
+// extractCertGCPALB extracts the chain forwarded by the GCP external load balancer, a URL escaped base64 encoded PEM
+func extractCertGCPALB(r *http.Request) ([]*x509.Certificate, error) {
+	raw := r.Header.Get("X-Client-Cert-Chain")
+	if raw == "" {
+		return nil, errMissingCertificate
 	}
-	certs, err := x509.ParseCertificates(block.Bytes)
+	// the plus signs of the base64 encoding are not escaped spaces
+	unescaped, err := url.PathUnescape(raw)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificates: %w", err)
+		return nil, certificateParseError(config.GCPApplicationLoadBalancer, "url_decode", err)
+	}
+	rest, err := base64.StdEncoding.DecodeString(unescaped)
+	if err != nil {
+		return nil, certificateParseError(config.GCPApplicationLoadBalancer, "base64_decode", err)
+	}
+	return parseCertificateChain(config.GCPApplicationLoadBalancer, rest)
+}
+
+// parseCertificateChain parses the PEM encoded certificates, leaf first
+func parseCertificateChain(mode config.TLSPassThrough, data []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	blocks := 0
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		blocks++
+		certs, err := x509.ParseCertificates(block.Bytes)
+		if err != nil {
+			return nil, certificateParseError(mode, "x509_parse", err)
+		}
+		chain = append(chain, certs...)
+		data = rest
+	}
+	if blocks == 0 {
+		return nil, certificateParseError(mode, "pem_decode", errNoCertificates)
 	}
-	return certs[0], nil
+	// a PEM block with an empty body parses to no certificate without error
+	if len(chain) == 0 {
+		return nil, certificateParseError(mode, "x509_parse", errNoCertificates)
+	}
+	return chain, nil
+}
+
+// passThroughParseError is the failure of a pass through extractor at a given stage
+type passThroughParseError struct {
+	mode  config.TLSPassThrough
+	stage string
+	err   error
 }
 
-func extractCertFromTLS(r *http.Request) (*x509.Certificate, error) {
-	nbCerts := len(r.TLS.PeerCertificates)
-	if nbCerts == 0 {
-		return nil, fmt.Errorf("missing_certificate_error")
+func (e *passThroughParseError) Error() string {
+	return fmt.Sprintf("failed to parse certificates: %v", e.err)
+}
+
+func (e *passThroughParseError) Unwrap() error {
+	return e.err
+}
+
+// certificateParseError wraps the failure of a pass through extractor at the given stage
+func certificateParseError(mode config.TLSPassThrough, stage string, err error) error {
+	return &passThroughParseError{mode: mode, stage: stage, err: err}
+}
+
+// extractCertFromTLS returns the certificates presented by the client, leaf first
+func extractCertFromTLS(r *http.Request) ([]*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errMissingCertificate
 	}
+	return r.TLS.PeerCertificates, nil
+}
 
-	return r.TLS.PeerCertificates[nbCerts-1], nil
+// identityCertificate returns the certificate of the non empty chain the device identity is derived from. Without
+// position, the leaf of pass through chains and the last certificate presented over TLS are kept for compatibility
+func identityCertificate(chain []*x509.Certificate, position config.IdentityCertPosition, passThrough bool) *x509.Certificate {
+	switch position {
+	case config.IdentityCertLeaf:
+		return chain[0]
+	case config.IdentityCertChainRoot:
+		return chain[len(chain)-1]
+	}
+	if passThrough {
+		return chain[0]
+	}
+	return chain[len(chain)-1]
 }
 
-func registerServerMetricsOnce(metricsCollector metrics.MetricCollector) {
-	serverMetricsOnce.Do(func() { registerServerMetrics(metricsCollector) })
+// serverMetricsFor returns the server metrics registered against the collector, they are registered on first use
+// and shared by the servers reporting to the collector as a collector cannot register a metric twice
+func serverMetricsFor(metricsCollector metrics.MetricCollector) *ServerMetrics {
+	serverMetricsMutex.Lock()
+	defer serverMetricsMutex.Unlock()
+
+	if registered, ok := serverMetrics[metricsCollector]; ok {
+		return registered
+	}
+	registered := newServerMetrics(metricsCollector)
+	serverMetrics[metricsCollector] = registered
+	return registered
 }
 
-func registerServerMetrics(metricsCollector metrics.MetricCollector) {
+// newServerMetrics registers the metrics of a server against its collector
+func newServerMetrics(metricsCollector metrics.MetricCollector) *ServerMetrics {
+	serverMetrics := &ServerMetrics{}
 
-	serverMetricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	serverMetrics.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "reliable_ack",
 		Help:   "The number of reliable acknowledgements.",
 		Labels: []string{"record_type", "dispatcher"},
 	})
 
-	serverMetricsRegistry.reliableAckMissCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	serverMetrics.reliableAckMissCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "reliable_ack_miss",
 		Help:   "The number of missing reliable acknowledgements.",
 		Labels: []string{"record_type", "dispatcher"},
 	})
+
+	serverMetrics.reliableAckLatency = metricsCollector.RegisterHistogram(adapter.CollectorOptions{
+		Name:    "reliable_ack_latency_ms",
+		Help:    "The time in milliseconds from the production of records to their reliable acknowledgement.",
+		Labels:  []string{"record_type", "dispatcher"},
+		Buckets: reliableAckLatencyBuckets,
+	})
+
+	serverMetrics.reliableAckInvalidCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "reliable_ack_invalid",
+		Help:   "The number of reliable acknowledgements dropped because their record has no serializer.",
+		Labels: []string{"record_type", "dispatcher"},
+	})
+
+	serverMetrics.reliableAckDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "reliable_ack_dropped_total",
+		Help:   "The number of reliable acknowledgements dropped because the outbound queue of their connection was full.",
+		Labels: []string{"record_type", "dispatcher"},
+	})
+
+	serverMetrics.reliableAckToggleCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "reliable_ack_policy_change_total",
+		Help:   "The number of reliable acks of record types enabled or disabled at runtime.",
+		Labels: []string{"record_type", "enabled"},
+	})
+
+	serverMetrics.websocketUpgradeErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "websocket_upgrade_error_total",
+		Help:   "The number of connections failing the websocket upgrade, by reason.",
+		Labels: []string{"reason"},
+	})
+
+	serverMetrics.warmupRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connection_warmup_rejected_total",
+		Help:   "The number of connections rejected during the warm-up after startup.",
+		Labels: []string{},
+	})
+
+	serverMetrics.sourceIPRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "source_ip_limit_rejected_total",
+		Help:   "The number of connections rejected because their source ip reached its connection limit.",
+		Labels: []string{},
+	})
+
+	serverMetrics.partialOutageCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "partial_outage_connection_total",
+		Help:   "The number of connections accepted or rejected while some dispatchers are unhealthy.",
+		Labels: []string{"action"},
+	})
+
+	serverMetrics.passthroughDecodeErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "passthrough_decode_error_total",
+		Help:   "The number of client certificates from pass through headers which failed to decode.",
+		Labels: []string{"mode", "stage"},
+	})
+
+	serverMetrics.reconnectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "reconnect_total",
+		Help:   "The number of connections reconnecting a previous session of the same client certificate key.",
+		Labels: []string{},
+	})
+
+	serverMetrics.identityChangedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "identity_changed_on_reconnect_total",
+		Help:   "The number of reconnects whose device identity changed since the previous session.",
+		Labels: []string{"policy"},
+	})
+
+	serverMetrics.sessionEndSentinelCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "session_end_sentinel_total",
+		Help:   "The number of end of session sentinel records dispatched when devices disconnect.",
+		Labels: []string{"record_type"},
+	})
+
+	serverMetrics.passthroughUntrustedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "passthrough_certificate_untrusted_total",
+		Help:   "The number of pass through certificate chains failing verification against the server CA pool.",
+		Labels: []string{"mode", "strict"},
+	})
+
+	serverMetrics.closeReasonCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "websocket_close_total",
+		Help:   "The number of connections closed by the server by reason.",
+		Labels: []string{"reason"},
+	})
+
+	serverMetrics.serializerVariantCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "serializer_variant_connection_total",
+		Help:   "The number of connections by serializer variant selected from the client certificate.",
+		Labels: []string{"variant"},
+	})
+
+	serverMetrics.serverDisconnectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "server_disconnect_total",
+		Help:   "The number of connections deregistered after the server closed them, by reason.",
+		Labels: []string{"reason"},
+	})
+
+	serverMetrics.sessionRestoredCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "session_restored_total",
+		Help:   "The number of connections resuming a previous session loaded from the session store.",
+		Labels: []string{},
+	})
+
+	serverMetrics.unknownInterfaceCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "unknown_network_interface_total",
+		Help:   "The number of connectivity events of connections which did not report their network interface.",
+		Labels: []string{"event"},
+	})
+
+	serverMetrics.identityRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "identity_rejected_total",
+		Help:   "The number of connections closed because the identity of the client could not be extracted.",
+		Labels: []string{},
+	})
+
+	serverMetrics.malformedUpgradeCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "malformed_upgrade_rejected_total",
+		Help:   "The number of websocket upgrade requests rejected for a malformed header, by header.",
+		Labels: []string{"header"},
+	})
+
+	serverMetrics.revokedCertRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "revoked_certificate_rejected_total",
+		Help:   "The number of connections rejected because their client certificate is on the certificate revocation list.",
+		Labels: []string{},
+	})
+
+	serverMetrics.connectionsRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connections_rejected_total",
+		Help:   "The number of connections rejected because the server reached max_connections.",
+		Labels: []string{},
+	})
+
+	serverMetrics.connectionChurnCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connection_churn_total",
+		Help:   "The number of connections opened and closed, by device type and event.",
+		Labels: []string{"device_type", "event"},
+	})
+
+	serverMetrics.lastSeenLookupCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "last_seen_lookup_total",
+		Help:   "The number of lookups of the last activity of devices, by where it was found.",
+		Labels: []string{"source"},
+	})
+
+	serverMetrics.debugInjectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "debug_inject_total",
+		Help:   "The number of records injected through the debug endpoint.",
+		Labels: []string{"record_type"},
+	})
+
+	serverMetrics.subprotocolRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "websocket_subprotocol_rejected_total",
+		Help:   "The number of connections closed because they requested none of the subprotocols of the server.",
+		Labels: []string{},
+	})
+
+	serverMetrics.connectionsRejectedByPolicyCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connections_rejected_by_policy_total",
+		Help:   "The number of connections closed because the connection authorization of the embedder rejected their identity.",
+		Labels: []string{},
+	})
+
+	serverMetrics.connectivityBatchSize = metricsCollector.RegisterHistogram(adapter.CollectorOptions{
+		Name:    "connectivity_batch_events",
+		Help:    "The number of connectivity events of the batches dispatched.",
+		Labels:  []string{},
+		Buckets: connectivityBatchSizeBuckets,
+	})
+
+	serverMetrics.activeConnections = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "active_connections",
+		Help:   "The number of connected sockets, by device type and network interface.",
+		Labels: []string{"device_type", "network_interface"},
+	})
+
+	serverMetrics.ackChannelDepth = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "ack_channel_depth",
+		Help:   "The number of acks waiting in the ack channel for an ack worker, sampled every second.",
+		Labels: []string{},
+	})
+
+	serverMetrics.clientCertDaysToExpiry = metricsCollector.RegisterHistogram(adapter.CollectorOptions{
+		Name:    "client_cert_days_to_expiry",
+		Help:    "The number of days until the client certificates of the connections expire.",
+		Labels:  []string{},
+		Buckets: clientCertDaysToExpiryBuckets,
+	})
+
+	serverMetrics.expiredCertRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "expired_cert_rejected_total",
+		Help:   "The number of connections rejected because their pass through client certificate expired.",
+		Labels: []string{},
+	})
+
+	serverMetrics.lastWillDisconnectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "last_will_disconnect_total",
+		Help:   "The number of disconnected connectivity events dispatched on startup for the connections left open when the server died.",
+		Labels: []string{},
+	})
+
+	return serverMetrics
 }
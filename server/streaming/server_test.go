@@ -2,28 +2,42 @@ package streaming_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/teslamotors/fleet-telemetry/config"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
 	"github.com/teslamotors/fleet-telemetry/server/streaming"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
+	"google.golang.org/protobuf/proto"
 )
 
 var _ = Describe("Extract certificate from header test", func() {
@@ -138,7 +152,8 @@ var _ = Describe("Socket handler test", func() {
 				MessageLimit:              1,
 				MessageIntervalTimeSecond: 1 * time.Second,
 			},
-			MetricCollector: noop.NewCollector(),
+			AllowAnonymousIdentity: true,
+			MetricCollector:        noop.NewCollector(),
 		}
 
 		registry := streaming.NewSocketRegistry()
@@ -165,10 +180,1984 @@ var _ = Describe("Socket handler test", func() {
 		_, _, _ = conn.ReadMessage()
 		_ = conn.Close()
 
-		Expect(hook.AllEntries()).To(BeEmpty())
+		// the connection without certificate is kept open with an anonymous identity
+		messages := func() []string {
+			var messages []string
+			for _, entry := range hook.AllEntries() {
+				messages = append(messages, entry.Message)
+			}
+			return messages
+		}
+		Eventually(messages).Should(ContainElement("socket_connected"))
+		Expect(messages()).To(ContainElement("extract_sender_id_err"))
+		Eventually(registry.NumConnectedSockets).Should(Equal(0))
+	})
+})
+
+var _ = Describe("Admission", func() {
+	Describe("Pass through verification", func() {
+		var (
+			caKey  *rsa.PrivateKey
+			caCert *x509.Certificate
+			caFile string
+		)
+
+		newCertificate := func(commonName string, isCA bool) *x509.Certificate {
+			return &x509.Certificate{
+				SerialNumber:          big.NewInt(time.Now().UnixNano()),
+				Subject:               pkix.Name{CommonName: commonName},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(24 * time.Hour),
+				KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+				ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				BasicConstraintsValid: true,
+				IsCA:                  isCA,
+			}
+		}
+
+		clientCertChain := func(parent *x509.Certificate, parentKey *rsa.PrivateKey) string {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			if parent == nil {
+				parent, parentKey = newCertificate("Tesla Motors Products CA", true), key
+			}
+			certBytes, err := x509.CreateCertificate(rand.Reader, newCertificate("device-1", false), parent, &key.PublicKey, parentKey)
+			Expect(err).NotTo(HaveOccurred())
+			return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))
+		}
+
+		BeforeEach(func() {
+			var err error
+			caKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			caBytes, err := x509.CreateCertificate(rand.Reader, newCertificate("Tesla Motors Products CA", true), newCertificate("Tesla Motors Products CA", true), &caKey.PublicKey, caKey)
+			Expect(err).NotTo(HaveOccurred())
+			caCert, err = x509.ParseCertificate(caBytes)
+			Expect(err).NotTo(HaveOccurred())
+
+			caFile = filepath.Join(GinkgoT().TempDir(), "ca.pem")
+			Expect(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes}), 0600)).To(Succeed())
+		})
+
+		dial := func(strict bool, chain string) (*http.Response, error) {
+			s := newTestServer(&config.Config{
+				TLSPassThrough:             ptr(config.RFC9440),
+				TLSPassThroughVerification: &config.TLSPassThroughVerification{Strict: strict},
+				TLS:                        &config.TLS{CAFile: caFile},
+			}, nil)
+			conn, resp, err := s.dialCertChain(chain)
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return resp, err
+		}
+
+		It("accepts chains issued by the server CA", func() {
+			_, err := dial(true, clientCertChain(caCert, caKey))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects untrusted chains in strict mode", func() {
+			resp, err := dial(true, clientCertChain(nil, nil))
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("accepts untrusted chains otherwise", func() {
+			_, err := dial(false, clientCertChain(nil, nil))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("requires pass through", func() {
+			_, err := initTestServer(&config.Config{TLSPassThroughVerification: &config.TLSPassThroughVerification{}}, nil)
+			Expect(err).To(MatchError("tls_pass_through_verification requires tls_pass_through"))
+		})
+
+		It("rejects unknown identity certificate positions", func() {
+			_, err := initTestServer(&config.Config{IdentityCertPosition: "middle"}, nil)
+			Expect(err).To(MatchError("invalid identity_cert_position middle"))
+		})
+
+		It("rejects unknown pass through modes", func() {
+			_, err := initTestServer(&config.Config{TLSPassThrough: ptr(config.TLSPassThrough("rfc9441"))}, nil)
+			Expect(err).To(MatchError("invalid tls_pass_through rfc9441"))
+		})
+
+		It("starts with every supported pass through mode", func() {
+			for _, mode := range config.TLSPassThroughModes {
+				_, err := initTestServer(&config.Config{TLSPassThrough: ptr(mode)}, nil)
+				Expect(err).NotTo(HaveOccurred(), string(mode))
+			}
+		})
+	})
+
+	Describe("Certificate revocation", func() {
+		It("rejects the connections of revoked certificates", func() {
+			issuerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			issuerTemplate := &x509.Certificate{
+				SerialNumber:          big.NewInt(2),
+				Subject:               pkix.Name{CommonName: "Tesla Motors Products CA"},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}
+			issuerBytes, err := x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, &issuerKey.PublicKey, issuerKey)
+			Expect(err).NotTo(HaveOccurred())
+			issuer, err := x509.ParseCertificate(issuerBytes)
+			Expect(err).NotTo(HaveOccurred())
+			revoked := []x509.RevocationListEntry{{SerialNumber: big.NewInt(1), RevocationTime: time.Now()}}
+			crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1), RevokedCertificateEntries: revoked}, issuer, issuerKey)
+			Expect(err).NotTo(HaveOccurred())
+			crlFile := filepath.Join(GinkgoT().TempDir(), "crl.der")
+			Expect(os.WriteFile(crlFile, crl, 0600)).To(Succeed())
+			caFile := filepath.Join(GinkgoT().TempDir(), "ca.pem")
+			Expect(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuerBytes}), 0600)).To(Succeed())
+
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "revoked_certificate_rejected_total", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{
+				TLS:                   &config.TLS{CAFile: caFile},
+				TLSPassThrough:        ptr(config.RFC9440),
+				CertificateRevocation: &config.CertificateRevocation{CRL: crlFile},
+				MetricCollector:       collector,
+			}, nil)
+
+			_, resp, err := s.dialPassThroughResponse()
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{})))
+			Expect(s.registry.NumConnectedSockets()).To(Equal(0))
+		})
+	})
+
+	Describe("Certificate expiry", func() {
+		var (
+			collector *histogramCollector
+			s         *testServer
+		)
+
+		BeforeEach(func() {
+			collector = &histogramCollector{Collector: noop.NewCollector(), name: "client_cert_days_to_expiry", observations: make(chan histogramObservation, 1)}
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), CertificateExpiryWarningDays: 7, MetricCollector: collector}, nil)
+		})
+
+		chainExpiringAt := func(notAfter time.Time) string {
+			return passThroughCertChainOf(&x509.Certificate{
+				Subject:   pkix.Name{CommonName: "device-1"},
+				NotBefore: notAfter.Add(-365 * 24 * time.Hour),
+				NotAfter:  notAfter,
+			})
+		}
+
+		expiringLogs := func() int {
+			count := 0
+			for _, entry := range s.hook.AllEntries() {
+				if entry.Message == "client_certificate_expiring" {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("reports the days until the client certificate expires", func() {
+			conn, _, err := s.dialCertChain(chainExpiringAt(time.Now().Add(90*24*time.Hour + time.Hour)))
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			Eventually(collector.observations).Should(Receive(Equal(histogramObservation{value: 90, labels: adapter.Labels{}})))
+			Expect(expiringLogs()).To(BeZero())
+		})
+
+		It("warns about the client certificates expiring within the warning days", func() {
+			conn, _, err := s.dialCertChain(chainExpiringAt(time.Now().Add(3*24*time.Hour + time.Hour)))
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			Eventually(collector.observations).Should(Receive(Equal(histogramObservation{value: 3, labels: adapter.Labels{}})))
+			Expect(expiringLogs()).To(Equal(1))
+		})
+
+		It("rejects the expired pass through certificates", func() {
+			_, resp, err := s.dialCertChain(chainExpiringAt(time.Now().Add(-time.Hour)))
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(collector.observations).NotTo(Receive())
+		})
+
+		It("does not report the certificates of status identity probes", func() {
+			request := httptest.NewRequest("GET", "/status", nil)
+			request.Header.Set("Client-Cert-Chain", chainExpiringAt(time.Now().Add(3*24*time.Hour)))
+			recorder := httptest.NewRecorder()
+			s.StatusIdentity(s.conf)(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring("device-1"))
+			Expect(collector.observations).NotTo(Receive())
+			Expect(expiringLogs()).To(BeZero())
+		})
+	})
+
+	Describe("Invalid identity", func() {
+		It("closes the connections of clients without identity", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "identity_rejected_total", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), MetricCollector: collector}, nil)
+
+			conn, _, err := s.dial(nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			_, _, err = conn.ReadMessage()
+			var closeError *websocket.CloseError
+			Expect(errors.As(err, &closeError)).To(BeTrue())
+			Expect(closeError.Code).To(Equal(websocket.ClosePolicyViolation))
+			Expect(closeError.Text).To(Equal("invalid_identity"))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{})))
+			Expect(s.registry.NumConnectedSockets()).To(Equal(0))
+		})
+	})
+
+	Describe("Connection authorization", func() {
+		var (
+			collector    *labelCollector
+			connectivity *recordingProducer
+			s            *testServer
+		)
+
+		BeforeEach(func() {
+			collector = &labelCollector{Collector: noop.NewCollector(), name: "connections_rejected_by_policy_total", labels: make(chan adapter.Labels, 1)}
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), MetricCollector: collector}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+		})
+
+		It("closes the connections of the identities rejected by the hook", func() {
+			var authorized *telemetry.RequestIdentity
+			s.AuthorizeConnection = func(requestIdentity *telemetry.RequestIdentity) error {
+				authorized = requestIdentity
+				return errors.New("blocklisted")
+			}
+
+			conn := s.dialPassThrough()
+			_, _, err := conn.ReadMessage()
+			var closeError *websocket.CloseError
+			Expect(errors.As(err, &closeError)).To(BeTrue())
+			Expect(closeError.Code).To(Equal(websocket.ClosePolicyViolation))
+			Expect(closeError.Text).To(Equal("rejected_by_policy"))
+			Expect(authorized.DeviceID).To(Equal("device-1"))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{})))
+			Expect(s.registry.NumConnectedSockets()).To(Equal(0))
+			Consistently(connectivity.records, 100*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("registers the connections of the identities authorized by the hook", func() {
+			s.AuthorizeConnection = func(_ *telemetry.RequestIdentity) error { return nil }
+
+			s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Eventually(connectivity.records).Should(Receive())
+			Expect(collector.labels).NotTo(Receive())
+		})
+
+		It("authorizes the anonymous connections with the hook", func() {
+			s.conf.AllowAnonymousIdentity = true
+			var authorized *telemetry.RequestIdentity
+			s.AuthorizeConnection = func(requestIdentity *telemetry.RequestIdentity) error {
+				authorized = requestIdentity
+				if requestIdentity.DeviceID == "" {
+					return errors.New("anonymous")
+				}
+				return nil
+			}
+
+			conn, _, err := s.dial(nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			_, _, err = conn.ReadMessage()
+			var closeError *websocket.CloseError
+			Expect(errors.As(err, &closeError)).To(BeTrue())
+			Expect(closeError.Code).To(Equal(websocket.ClosePolicyViolation))
+			Expect(authorized).To(Equal(&telemetry.RequestIdentity{}))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{})))
+			Expect(s.registry.NumConnectedSockets()).To(Equal(0))
+		})
+	})
+
+	Describe("Max connections", func() {
+		It("rejects connections above the limit before the upgrade", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "connections_rejected_total", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), MaxConnections: 1, MetricCollector: collector}, nil)
+
+			conn, _, err := s.dialPassThroughResponse()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Expect(s.registry.NumAdmittedConnections()).To(Equal(1))
+
+			_, resp, err := s.dialPassThroughResponse()
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{})))
+			recorder := httptest.NewRecorder()
+			s.Status()(recorder, httptest.NewRequest("GET", "/status", nil))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Body.String()).To(ContainSubstring("overloaded"))
+
+			Expect(conn.Close()).To(Succeed())
+			Eventually(s.registry.NumAdmittedConnections).Should(Equal(0))
+		})
+	})
+
+	Describe("Source ip limit", func() {
+		It("rejects the connections of a source ip above its limit", func() {
+			s := newTestServer(&config.Config{
+				TLSPassThrough:         ptr(config.RFC9440),
+				SourceIPLimit:          &config.SourceIPLimit{MaxConnections: 1},
+				AllowAnonymousIdentity: true,
+			}, nil)
+
+			conn, _, err := s.dial(nil)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+
+			_, resp, err := s.dial(nil)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+
+			Expect(conn.Close()).To(Succeed())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(0))
+			conn, _, err = s.dial(nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+		})
+	})
+
+	Describe("Device rate limit", func() {
+		It("does not limit the connections without device identity", func() {
+			s := newTestServer(&config.Config{
+				TLSPassThrough:             ptr(config.RFC9440),
+				PerDeviceMessagesPerSecond: 1,
+				AllowAnonymousIdentity:     true,
+			}, nil)
+
+			conn, _, err := s.dial(nil)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Expect(conn.WriteMessage(websocket.BinaryMessage, []byte("message"))).To(Succeed())
+
+			Expect(conn.Close()).To(Succeed())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(0))
+		})
+	})
+
+	Describe("Allowed origins", func() {
+		dial := func(origin string) (*http.Response, error) {
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), AllowedOrigins: []string{"dashboard.example.com"}}, nil)
+			header := http.Header{}
+			if origin != "" {
+				header.Set("Origin", origin)
+			}
+			conn, resp, err := s.dial(header)
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return resp, err
+		}
+
+		It("accepts allowed origins and connections without origin", func() {
+			_, err := dial("https://dashboard.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = dial("")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects other origins", func() {
+			resp, err := dial("https://evil.example.com")
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Embedding", func() {
+		var (
+			s       *testServer
+			address string
+		)
+
+		BeforeEach(func() {
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), AllowedOrigins: []string{"dashboard.example.com"}}, nil)
+			address = s.address()
+		})
+
+		It("derives the identity with the identity extractor", func() {
+			s.IdentityExtractor = func(r *http.Request, _ *config.Config) (*telemetry.RequestIdentity, error) {
+				deviceID := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				return &telemetry.RequestIdentity{DeviceID: deviceID, SenderID: "vehicle_device." + deviceID}, nil
+			}
+			header := http.Header{}
+			header.Set("Authorization", "Bearer device-9")
+			conn, _, err := (&websocket.Dialer{HandshakeTimeout: time.Second}).Dial(address, header)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			Eventually(s.registry.ListSockets).Should(HaveLen(1))
+			Expect(s.registry.ListSockets()[0].DeviceID).To(Equal("device-9"))
+		})
+
+		It("rejects the clients without identity from the identity extractor", func() {
+			s.IdentityExtractor = func(_ *http.Request, _ *config.Config) (*telemetry.RequestIdentity, error) { return nil, nil }
+			conn, _, err := (&websocket.Dialer{HandshakeTimeout: time.Second}).Dial(address, nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			_, _, err = conn.ReadMessage()
+			Expect(websocket.IsCloseError(err, websocket.ClosePolicyViolation)).To(BeTrue())
+		})
+
+		It("checks the origin with the origin check", func() {
+			s.CheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == "https://tools.example.com" }
+			header := http.Header{}
+			header.Set("Origin", "https://dashboard.example.com")
+			_, resp, err := (&websocket.Dialer{HandshakeTimeout: time.Second}).Dial(address, header)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Subprotocols", func() {
+		var s *testServer
+
+		BeforeEach(func() {
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), WebsocketSubprotocols: []string{"tesla.telemetry.v2", "tesla.telemetry.v1"}}, nil)
+		})
+
+		dial := func(subprotocols ...string) *websocket.Conn {
+			header := http.Header{}
+			header.Set("Client-Cert-Chain", passThroughCertChain())
+			conn, _, err := (&websocket.Dialer{HandshakeTimeout: time.Second, Subprotocols: subprotocols}).Dial(s.address(), header)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+			return conn
+		}
+
+		connectedSocket := func() *streaming.SocketManager {
+			events, unsubscribe := s.registry.Subscribe(1)
+			DeferCleanup(unsubscribe)
+			var event streaming.ConnectionEvent
+			Eventually(events).Should(Receive(&event))
+			return s.registry.GetSocket(event.SocketID)
+		}
+
+		It("negotiates the preferred subprotocol of the server requested by the client", func() {
+			conn := dial("tesla.telemetry.v1", "tesla.telemetry.v2")
+			Expect(conn.Subprotocol()).To(Equal("tesla.telemetry.v2"))
+			Expect(connectedSocket().Subprotocol()).To(Equal("tesla.telemetry.v2"))
+		})
+
+		It("keeps the legacy format for clients requesting no subprotocol", func() {
+			conn := dial()
+			Expect(conn.Subprotocol()).To(BeEmpty())
+			Expect(connectedSocket().Subprotocol()).To(BeEmpty())
+		})
+
+		It("closes the connections requesting unsupported subprotocols", func() {
+			conn := dial("tesla.telemetry.v9")
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err := conn.ReadMessage()
+			var closeErr *websocket.CloseError
+			Expect(errors.As(err, &closeErr)).To(BeTrue())
+			Expect(closeErr.Code).To(Equal(websocket.CloseProtocolError))
+			Expect(closeErr.Text).To(Equal("unsupported_subprotocol"))
+			Expect(s.registry.NumConnectedSockets()).To(BeZero())
+		})
+	})
+
+	Describe("Websocket upgrade errors", func() {
+		It("counts failed upgrades by reason", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "websocket_upgrade_error_total", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), MetricCollector: collector}, nil)
+
+			// a plain request without the upgrade headers fails the handshake
+			resp, err := http.Get(s.serve().URL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{"reason": "handshake"})))
+		})
+
+		It("rejects upgrades with malformed headers", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "malformed_upgrade_rejected_total", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), MetricCollector: collector}, nil)
+
+			header := http.Header{}
+			header.Set("Sec-Websocket-Protocol", "v1 (beta)")
+			_, resp, err := s.dial(header)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{"header": "sec-websocket-protocol"})))
+		})
+	})
+})
+
+var _ = Describe("Connection lifecycle", func() {
+	Describe("Connection summary", func() {
+		It("logs the identity, traffic and lifetime of closed connections", func() {
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, nil)
+
+			conn, _, err := s.dialPassThroughResponse()
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(func() { _ = conn.Close() })
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Expect(conn.WriteMessage(websocket.BinaryMessage, []byte("first"))).To(Succeed())
+			Expect(conn.WriteMessage(websocket.BinaryMessage, []byte("second"))).To(Succeed())
+			Expect(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))).To(Succeed())
+
+			summary := func() *logrus.LogInfo {
+				for _, entry := range s.hook.AllEntries() {
+					if entry.Message == "connection_summary" {
+						info := logrus.LogInfo(entry.Data)
+						return &info
+					}
+				}
+				return nil
+			}
+			Eventually(summary).ShouldNot(BeNil())
+			info := *summary()
+			Expect(info).To(HaveKeyWithValue("device_id", "device-1"))
+			Expect(info).To(HaveKeyWithValue("device_type", "vehicle_device"))
+			Expect(info).To(HaveKeyWithValue("frames_read", uint64(2)))
+			Expect(info).To(HaveKeyWithValue("bytes_read", uint64(len("first")+len("second"))))
+			Expect(info).To(HaveKeyWithValue("disconnect_reason", streaming.DisconnectReasonClientClosed))
+			Expect(info).To(HaveKey("connection_id"))
+			Expect(info).To(HaveKey("lifetime_ms"))
+		})
+
+		It("logs the other requests with the http middleware", func() {
+			s := newTestServer(&config.Config{}, nil)
+
+			s.hook.Reset()
+			s.handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/status", nil))
+			Expect(s.hook.AllEntries()).To(HaveLen(2))
+			Expect(s.hook.LastEntry().Message).To(Equal("request_end"))
+			Expect(s.hook.LastEntry().Data).To(HaveKeyWithValue("urlPath", "/status"))
+		})
+	})
+
+	Describe("Disconnect reason", func() {
+		var (
+			s            *testServer
+			connectivity *recordingProducer
+			conn         *websocket.Conn
+		)
+
+		BeforeEach(func() {
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+
+			var err error
+			conn, _, err = s.dialPassThroughResponse()
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(func() { _ = conn.Close() })
+			Eventually(connectivity.records).Should(Receive())
+		})
+
+		disconnected := func() *protos.VehicleConnectivity {
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(0))
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive(&record))
+			message := record.GetProtoMessage().(*protos.VehicleConnectivity)
+			Expect(message.GetStatus()).To(Equal(protos.ConnectivityEvent_DISCONNECTED))
+			Expect(record.Metadata()).To(HaveKeyWithValue("disconnect_reason", message.GetDisconnectReason()))
+			return message
+		}
+
+		It("reports clean closes of the client", func() {
+			Expect(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))).To(Succeed())
+			Expect(disconnected().GetDisconnectReason()).To(Equal(streaming.DisconnectReasonClientClosed))
+		})
+
+		It("reports connections lost without a close frame", func() {
+			Expect(conn.UnderlyingConn().Close()).To(Succeed())
+			Expect(disconnected().GetDisconnectReason()).To(Equal(streaming.DisconnectReasonReadError))
+		})
+
+		It("reports messages of an unexpected type", func() {
+			Expect(conn.WriteMessage(websocket.TextMessage, []byte("text"))).To(Succeed())
+			Expect(disconnected().GetDisconnectReason()).To(Equal(streaming.DisconnectReasonUnexpectedMessageType))
+		})
+	})
+
+	Describe("Read deadline", func() {
+		It("closes connections on which nothing is received", func() {
+			connectivity := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough: ptr(config.RFC9440),
+				ReadDeadline:   &config.ReadDeadline{TimeoutSeconds: 1},
+			}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+
+			s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Eventually(s.registry.NumConnectedSockets, 3*time.Second).Should(Equal(0))
+
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive())
+			Expect(connectivity.records).To(Receive(&record))
+			Expect(record.Metadata()).To(HaveKeyWithValue("disconnect_reason", streaming.DisconnectReasonReadTimeout))
+		})
+	})
+
+	Describe("Keepalive", func() {
+		var (
+			s            *testServer
+			connectivity *recordingProducer
+		)
+
+		BeforeEach(func() {
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{
+				TLSPassThrough: ptr(config.RFC9440),
+				ReadDeadline:   &config.ReadDeadline{Disabled: true},
+				Keepalive:      &config.Keepalive{PingIntervalSeconds: 1},
+			}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+		})
+
+		It("keeps connections answering the pings open", func() {
+			conn := s.dialPassThrough()
+			pings := make(chan struct{}, 10)
+			conn.SetPingHandler(func(data string) error {
+				pings <- struct{}{}
+				return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			go func() {
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			Eventually(pings, 5*time.Second).Should(HaveLen(3))
+			Expect(s.registry.NumConnectedSockets()).To(Equal(1))
+		})
+
+		It("closes connections not answering a ping", func() {
+			s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Eventually(s.registry.NumConnectedSockets, 4*time.Second).Should(Equal(0))
+
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive())
+			Expect(connectivity.records).To(Receive(&record))
+			Expect(record.Metadata()).To(HaveKeyWithValue("disconnect_reason", streaming.DisconnectReasonPongTimeout))
+		})
+	})
+
+	Describe("Idle timeout", func() {
+		It("closes connections answering the pings without sending messages", func() {
+			connectivity := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:               ptr(config.RFC9440),
+				ReadDeadline:                 &config.ReadDeadline{Disabled: true},
+				Keepalive:                    &config.Keepalive{PingIntervalSeconds: 1},
+				IdleConnectionTimeoutSeconds: 1,
+			}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+
+			conn := s.dialPassThrough()
+			closed := make(chan error, 1)
+			go func() {
+				for {
+					// the pings are answered while reading
+					if _, _, err := conn.ReadMessage(); err != nil {
+						closed <- err
+						return
+					}
+				}
+			}()
+
+			var err error
+			Eventually(closed, 4*time.Second).Should(Receive(&err))
+			Expect(websocket.IsCloseError(err, websocket.CloseNormalClosure)).To(BeTrue())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(0))
+
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive())
+			Eventually(connectivity.records).Should(Receive(&record))
+			Expect(record.Metadata()).To(HaveKeyWithValue("disconnect_reason", streaming.DisconnectReasonIdleTimeout))
+		})
+	})
+
+	Describe("Close connections", func() {
+		var (
+			s            *testServer
+			conn         *websocket.Conn
+			connectivity *recordingProducer
+		)
+
+		BeforeEach(func() {
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{
+				TLSPassThrough: ptr(config.RFC9440),
+				CloseReasons:   &config.CloseReasons{Maintenance: "firmware_update_window"},
+			}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+			conn = s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+		})
+
+		readCloseError := func() *websocket.CloseError {
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			_, _, err := conn.ReadMessage()
+			closeError, ok := err.(*websocket.CloseError)
+			Expect(ok).To(BeTrue(), "unexpected error %v", err)
+			return closeError
+		}
+
+		It("sends the configured reason", func() {
+			Expect(s.CloseConnections(streaming.CloseCauseMaintenance)).To(Equal(1))
+			closeError := readCloseError()
+			Expect(closeError.Code).To(Equal(websocket.CloseTryAgainLater))
+			Expect(closeError.Text).To(Equal("firmware_update_window"))
+		})
+
+		It("drains the connections on shutdown", func() {
+			httpServer := &http.Server{}
+			done := make(chan error)
+			go func() { done <- s.Shutdown(context.Background(), httpServer) }()
+
+			closeError := readCloseError()
+			Expect(closeError.Code).To(Equal(websocket.CloseServiceRestart))
+			Expect(closeError.Text).To(Equal(streaming.DefaultDrainingCloseReason))
+			Eventually(done, 2*time.Second).Should(Receive(BeNil()))
+			Expect(s.registry.NumConnectedSockets()).To(Equal(0))
+		})
+
+		It("writes the acks of the dispatched records before closing the connections on shutdown", func() {
+			producer := &flushingProducer{recordingProducer: recordingProducer{records: make(chan *telemetry.Record, 10)}}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:     ptr(config.RFC9440),
+				ReliableAckSources: map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:            make(chan *telemetry.Record),
+			}, map[string][]telemetry.Producer{"V": {producer}})
+			conn := s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+
+			serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "device-1", SenderID: "vehicle_device.device-1"}, nil, s.logger)
+			socketID := s.registry.ListSockets()[0].ConnectionID
+			producer.flush = func() {
+				s.conf.AckChan <- &telemetry.Record{TxType: "V", Txid: "txid-1", Serializer: serializer, SocketID: socketID}
+			}
+			done := make(chan error)
+			go func() { done <- s.Shutdown(context.Background(), &http.Server{}) }()
+
+			Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			messageType, _, err := conn.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messageType).To(Equal(websocket.BinaryMessage))
+			_, _, err = conn.ReadMessage()
+			Expect(err).To(BeAssignableToTypeOf(&websocket.CloseError{}))
+			Eventually(done, 2*time.Second).Should(Receive(BeNil()))
+			Expect(s.CloseAcks(context.Background())).To(Succeed())
+		})
+
+		It("rejects new connections while draining", func() {
+			s.SetDraining(true)
+
+			_, resp, err := s.dial(nil)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("deregisters unresponsive connections with the shutdown reason", func() {
+			Expect((<-connectivity.records).Metadata()).NotTo(HaveKey("disconnect_reason"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			Expect(s.Shutdown(ctx, &http.Server{})).To(Succeed())
+			Expect(s.registry.NumConnectedSockets()).To(Equal(0))
+
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive(&record))
+			Expect(record.Metadata()).To(HaveKeyWithValue("disconnect_reason", streaming.DisconnectReasonShutdown))
+		})
+	})
+
+	Describe("Last will", func() {
+		var (
+			connectivity *recordingProducer
+			s            *testServer
+			path         string
+		)
+
+		BeforeEach(func() {
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+			path = filepath.Join(GinkgoT().TempDir(), "connections.json")
+		})
+
+		It("dispatches the disconnected events of the connections left open by the previous run", func() {
+			previous, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(previous.Close)
+			Expect(previous.Add(&sessionstore.Connection{DeviceID: "device-1", SocketID: "socket-1", SenderID: "energy_device.device-1", NetworkInterface: "wifi", TraceID: "trace-1"})).To(Succeed())
+
+			store, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			Expect(s.ReconcileConnections(store, s.conf)).To(Succeed())
+
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive(&record))
+			message, ok := record.GetProtoMessage().(*protos.VehicleConnectivity)
+			Expect(ok).To(BeTrue())
+			Expect(message.GetVin()).To(Equal("device-1"))
+			Expect(message.GetConnectionId()).To(Equal("socket-1"))
+			Expect(message.GetNetworkInterface()).To(Equal("wifi"))
+			Expect(message.GetStatus()).To(Equal(protos.ConnectivityEvent_DISCONNECTED))
+			Expect(message.GetDisconnectReason()).To(Equal(streaming.DisconnectReasonLastWill))
+			Expect(record.Metadata()).To(HaveKeyWithValue("trace_id", "trace-1"))
+			streamMessage, err := messages.StreamMessageFromBytes(record.Raw())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(streamMessage.DeviceType)).To(Equal("energy_device"))
+			Expect(store.List()).To(BeEmpty())
+		})
+
+		It("keeps the connections open in the store", func() {
+			store, err := sessionstore.NewFileConnectionStore(path, 0)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			s.registry.SetConnectionStore(store)
+
+			conn, _, err := s.dialPassThroughResponse()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			connections, err := store.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(connections).To(HaveLen(1))
+			Expect(connections[0].DeviceID).To(Equal("device-1"))
+
+			Expect(conn.Close()).To(Succeed())
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(0))
+			Expect(store.List()).To(BeEmpty())
+		})
+	})
+
+	Describe("Session end sentinels", func() {
+		It("dispatches a sentinel on the record types the device sent once it disconnects", func() {
+			canlogs := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			other := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), SessionEndSentinels: []string{"canlogs", "other"}}, map[string][]telemetry.Producer{"canlogs": {canlogs}, "other": {other}})
+
+			conn, _, err := s.dialPassThroughResponse()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.WriteMessage(websocket.BinaryMessage, streamMessage("1", "canlogs"))).To(Succeed())
+			var record *telemetry.Record
+			Eventually(canlogs.records).Should(Receive(&record))
+			Expect(record.SessionEnd).To(BeFalse())
+
+			Expect(conn.Close()).To(Succeed())
+			Eventually(canlogs.records).Should(Receive(&record))
+			Expect(record.SessionEnd).To(BeTrue())
+			Expect(record.Metadata()).To(HaveKeyWithValue("session_end", "true"))
+			payload := telemetry.SessionEndPayload{}
+			Expect(json.Unmarshal(record.Payload(), &payload)).To(Succeed())
+			Expect(payload.SessionEnd).To(BeTrue())
+			Expect(payload.Vin).To(Equal("device-1"))
+			Expect(payload.ConnectionID).To(Equal(record.SocketID))
+			Consistently(other.records, 100*time.Millisecond).ShouldNot(Receive())
+		})
 	})
 })
 
+var _ = Describe("Connectivity events", func() {
+	Describe("Trace id", func() {
+		var connectivity *recordingProducer
+
+		dial := func(conf *config.Config, header http.Header) {
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(conf, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+
+			header.Set("Client-Cert-Chain", passThroughCertChain())
+			conn, _, err := s.dial(header)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+		}
+
+		traceIDs := func() (string, string) {
+			var connected, disconnected *telemetry.Record
+			Eventually(connectivity.records).Should(Receive(&connected))
+			Eventually(connectivity.records).Should(Receive(&disconnected))
+			return connected.Metadata()["trace_id"], disconnected.Metadata()["trace_id"]
+		}
+
+		It("carries the trace id of the request in the connectivity events", func() {
+			dial(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, http.Header{"X-Trace-Id": {"trace-1"}})
+			connected, disconnected := traceIDs()
+			Expect(connected).To(Equal("trace-1"))
+			Expect(disconnected).To(Equal("trace-1"))
+		})
+
+		It("reads the trace id from the configured header", func() {
+			dial(&config.Config{TLSPassThrough: ptr(config.RFC9440), TraceIDHeader: "Traceparent"}, http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+			connected, _ := traceIDs()
+			Expect(connected).To(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+		})
+
+		It("generates the trace id of connections without a valid one", func() {
+			dial(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, http.Header{"X-Trace-Id": {"not a trace id"}})
+			connected, disconnected := traceIDs()
+			Expect(connected).NotTo(BeEmpty())
+			Expect(connected).NotTo(Equal("not a trace id"))
+			Expect(disconnected).To(Equal(connected))
+		})
+	})
+
+	Describe("Connectivity device type", func() {
+		connectedDeviceType := func(chain string) string {
+			connectivity := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+
+			conn, _, err := s.dialCertChain(chain)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			var record *telemetry.Record
+			Eventually(connectivity.records).Should(Receive(&record))
+			message, err := messages.StreamMessageFromBytes(record.Raw())
+			Expect(err).NotTo(HaveOccurred())
+			return string(message.DeviceType)
+		}
+
+		It("reports the client type of the certificate", func() {
+			chain := passThroughCertChainOf(&x509.Certificate{Subject: pkix.Name{CommonName: "device-1", OrganizationalUnit: []string{"Tesla Motors SN"}}})
+			Expect(connectedDeviceType(chain)).To(Equal("vehicle_board_device"))
+		})
+
+		It("reports vehicles as vehicle devices", func() {
+			Expect(connectedDeviceType(passThroughCertChain())).To(Equal("vehicle_device"))
+		})
+	})
+
+	Describe("Connectivity batching", func() {
+		var (
+			connectivity *recordingProducer
+			s            *testServer
+		)
+
+		start := func(maxEvents int) {
+			connectivity = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{
+				TLSPassThrough:       ptr(config.RFC9440),
+				ConnectivityBatching: &config.ConnectivityBatching{MaxEvents: maxEvents, FlushIntervalMs: 60000},
+			}, map[string][]telemetry.Producer{"connectivity_batch": {connectivity}})
+		}
+
+		batchEvents := func(record *telemetry.Record) []*protos.VehicleConnectivity {
+			Expect(record.TxType).To(Equal("connectivity_batch"))
+			Expect(record.Vin).To(Equal("server.connectivity_batch"))
+			batch, ok := record.GetProtoMessage().(*protos.VehicleConnectivityBatch)
+			Expect(ok).To(BeTrue())
+			return batch.GetEvents()
+		}
+
+		It("requires dispatchers for the batches", func() {
+			_, err := initTestServer(&config.Config{ConnectivityBatching: &config.ConnectivityBatching{}}, map[string][]telemetry.Producer{"connectivity": {&recordingProducer{}}})
+			Expect(err).To(MatchError("connectivity_batching requires dispatchers for the connectivity_batch records"))
+		})
+
+		It("dispatches the events in a record once the batch is full", func() {
+			start(2)
+			s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+			Consistently(connectivity.records, 100*time.Millisecond).ShouldNot(Receive())
+
+			s.dialPassThrough()
+			var record *telemetry.Record
+			Eventually(connectivity.records).Should(Receive(&record))
+			events := batchEvents(record)
+			Expect(events).To(HaveLen(2))
+			for _, event := range events {
+				Expect(event.GetVin()).To(Equal("device-1"))
+				Expect(event.GetStatus()).To(Equal(protos.ConnectivityEvent_CONNECTED))
+				Expect(event.GetTraceId()).NotTo(BeEmpty())
+				Expect(event.GetDeviceType()).To(Equal("vehicle_device"))
+			}
+			// each event carries the trace id of its connection
+			Expect(events[0].GetTraceId()).NotTo(Equal(events[1].GetTraceId()))
+		})
+
+		It("dispatches the pending events on shutdown", func() {
+			start(10)
+			s.dialPassThrough()
+			Eventually(s.registry.NumConnectedSockets).Should(Equal(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			Expect(s.Shutdown(ctx, &http.Server{})).To(Succeed())
+
+			var record *telemetry.Record
+			Expect(connectivity.records).To(Receive(&record))
+			events := batchEvents(record)
+			Expect(events).To(HaveLen(2))
+			Expect(events[1].GetStatus()).To(Equal(protos.ConnectivityEvent_DISCONNECTED))
+			Expect(events[1].GetDisconnectReason()).To(Equal(streaming.DisconnectReasonShutdown))
+		})
+	})
+
+	Describe("Connectivity topic", func() {
+		It("dispatches the connectivity events to every dispatcher of the configured topic", func() {
+			first := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			second := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), ConnectivityTopic: "vehicle_connectivity"}, map[string][]telemetry.Producer{"vehicle_connectivity": {first, second}})
+			s.dialPassThrough()
+
+			for _, producer := range []*recordingProducer{first, second} {
+				var record *telemetry.Record
+				Eventually(producer.records).Should(Receive(&record))
+				Expect(record.TxType).To(Equal("vehicle_connectivity"))
+				Expect(record.GetProtoMessage()).To(BeAssignableToTypeOf(&protos.VehicleConnectivity{}))
+			}
+		})
+	})
+
+	Describe("Unknown network interface", func() {
+		dispatchConnected := func(conf *config.Config) *protos.VehicleConnectivity {
+			connectivity := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(conf, map[string][]telemetry.Producer{"connectivity": {connectivity}})
+			s.dialPassThrough()
+
+			var record *telemetry.Record
+			Eventually(connectivity.records).Should(Receive(&record))
+			return record.GetProtoMessage().(*protos.VehicleConnectivity)
+		}
+
+		It("reports and counts the events of connections without network interface as unknown", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "unknown_network_interface_total", labels: make(chan adapter.Labels, 2)}
+			message := dispatchConnected(&config.Config{TLSPassThrough: ptr(config.RFC9440), MetricCollector: collector})
+			Expect(message.GetNetworkInterface()).To(Equal("unknown"))
+			Expect(collector.labels).To(Receive(Equal(adapter.Labels{"event": "CONNECTED"})))
+		})
+
+		It("reports the configured network interface", func() {
+			message := dispatchConnected(&config.Config{TLSPassThrough: ptr(config.RFC9440), UnknownNetworkInterface: "undetected"})
+			Expect(message.GetNetworkInterface()).To(Equal("undetected"))
+		})
+	})
+})
+
+var _ = Describe("Records", func() {
+	Describe("Decode dead-letter rate", func() {
+		It("dispatches the messages failing to decode up to the configured rate", func() {
+			deadLetters := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:            ptr(config.RFC9440),
+				DecodeDeadLetterTopic:     "dead_letters",
+				DecodeDeadLetterPerSecond: 1,
+			}, map[string][]telemetry.Producer{"V": nil, "dead_letters": {deadLetters}})
+			conn := s.dialPassThrough()
+
+			message, err := (&messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.device-1"), MessageTopic: []byte("V"), Payload: []byte{0xff}}).ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				Expect(conn.WriteMessage(websocket.BinaryMessage, message)).To(Succeed())
+				_, _, err = conn.ReadMessage()
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			var deadLetter *telemetry.Record
+			Expect(deadLetters.records).To(Receive(&deadLetter))
+			Expect(deadLetter.Metadata()).To(HaveKeyWithValue("vin", "device-1"))
+			Expect(deadLetters.records).NotTo(Receive())
+		})
+	})
+
+	Describe("Per device rate limit", func() {
+		It("drops the messages above the rate of the device without closing the connection", func() {
+			canlogs := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:             ptr(config.RFC9440),
+				PerDeviceMessagesPerSecond: 0.01,
+				PerDeviceBurst:             1,
+			}, map[string][]telemetry.Producer{"canlogs": {canlogs}})
+
+			conn := s.dialPassThrough()
+			for i := 0; i < 3; i++ {
+				Expect(conn.WriteMessage(websocket.BinaryMessage, streamMessage("1", "canlogs"))).To(Succeed())
+			}
+
+			Eventually(canlogs.records).Should(Receive())
+			Consistently(canlogs.records, 200*time.Millisecond).ShouldNot(Receive())
+			Expect(s.registry.NumConnectedSockets()).To(Equal(1))
+		})
+	})
+
+	Describe("Dispatch rules reload", func() {
+		It("dispatches the next records of open connections with the new rules", func() {
+			before := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			after := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, map[string][]telemetry.Producer{"canlogs": {before}})
+
+			conn := s.dialPassThrough()
+			Expect(conn.WriteMessage(websocket.BinaryMessage, streamMessage("1", "canlogs"))).To(Succeed())
+			Eventually(before.records).Should(Receive())
+
+			rules := map[string][]telemetry.Producer{"canlogs": {after}}
+			s.ReloadDispatchRules(rules)
+			Expect(s.DispatchRules()).To(Equal(rules))
+			Expect(conn.WriteMessage(websocket.BinaryMessage, streamMessage("1", "canlogs"))).To(Succeed())
+			Eventually(after.records).Should(Receive())
+			Expect(before.records).NotTo(Receive())
+		})
+	})
+
+	Describe("Message transformers", func() {
+		It("counts the panics of transformers as failures and dispatches the record unchanged", func() {
+			vehicleData := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "message_transform_error_total", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), MetricCollector: collector}, map[string][]telemetry.Producer{"V": {vehicleData}})
+			s.RegisterTransformer("V", func(_ string, _ proto.Message) (proto.Message, error) {
+				panic("boom")
+			})
+
+			conn := s.dialPassThrough()
+			message, err := (&messages.StreamMessage{TXID: []byte("1"), SenderID: []byte("vehicle_device.device-1"), MessageTopic: []byte("V")}).ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.WriteMessage(websocket.BinaryMessage, message)).To(Succeed())
+
+			Eventually(vehicleData.records).Should(Receive())
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{"record_type": "V", "policy": "skip"})))
+		})
+	})
+
+	Describe("Routes", func() {
+		It("dispatches the records matched by a route to its producers", func() {
+			bulk := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			urgent := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, map[string][]telemetry.Producer{"canlogs": {bulk}})
+			s.RegisterRoute("canlogs", func(record *telemetry.Record) bool { return record.Txid == "urgent" }, urgent)
+
+			conn := s.dialPassThrough()
+			for _, txid := range []string{"urgent", "bulk"} {
+				Expect(conn.WriteMessage(websocket.BinaryMessage, streamMessage(txid, "canlogs"))).To(Succeed())
+			}
+
+			var record *telemetry.Record
+			Eventually(urgent.records).Should(Receive(&record))
+			Expect(record.Txid).To(Equal("urgent"))
+			Eventually(bulk.records).Should(Receive(&record))
+			Expect(record.Txid).To(Equal("bulk"))
+			Consistently(urgent.records, 100*time.Millisecond).ShouldNot(Receive())
+			Expect(bulk.records).NotTo(Receive())
+		})
+	})
+
+	Describe("Gateway", func() {
+		It("counts the records of the gateways by device", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "gateway_record_total", labels: make(chan adapter.Labels, 10)}
+			canlogs := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:  ptr(config.RFC9440),
+				Gateway:         &config.Gateway{Senders: []string{"device-1"}},
+				MetricCollector: collector,
+			}, map[string][]telemetry.Producer{"canlogs": {canlogs}})
+
+			conn := s.dialPassThrough()
+			for _, deviceID := range []string{"device-2", "device-1"} {
+				message, err := (&messages.StreamMessage{TXID: []byte("1"), SenderID: []byte("vehicle_device.device-1"), DeviceID: []byte(deviceID), MessageTopic: []byte("canlogs"), Payload: []byte("data")}).ToBytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.WriteMessage(websocket.BinaryMessage, message)).To(Succeed())
+			}
+
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{"gateway": "device-1", "device_id": "device-2", "forwarded": "true"})))
+			Eventually(collector.labels).Should(Receive(Equal(adapter.Labels{"gateway": "device-1", "device_id": "device-1", "forwarded": "false"})))
+		})
+	})
+
+	Describe("Inbound compression", func() {
+		It("dispatches decompressed frames and drops corrupt frames without closing the connection", func() {
+			canlogs := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:     ptr(config.RFC9440),
+				InboundCompression: &config.InboundCompression{Scheme: telemetry.InboundCompressionGzip},
+			}, map[string][]telemetry.Producer{"canlogs": {canlogs}})
+
+			message := streamMessage("1", "canlogs")
+			var compressed bytes.Buffer
+			writer := gzip.NewWriter(&compressed)
+			_, err := writer.Write(message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+
+			conn := s.dialPassThrough()
+			Expect(conn.WriteMessage(websocket.BinaryMessage, message)).To(Succeed())
+			Expect(conn.WriteMessage(websocket.BinaryMessage, compressed.Bytes())).To(Succeed())
+
+			var record *telemetry.Record
+			Eventually(canlogs.records).Should(Receive(&record))
+			Expect(record.Payload()).To(Equal([]byte("data")))
+			Consistently(canlogs.records, 200*time.Millisecond).ShouldNot(Receive())
+			Expect(s.registry.NumConnectedSockets()).To(Equal(1))
+		})
+
+		It("rejects unknown schemes", func() {
+			_, err := initTestServer(&config.Config{InboundCompression: &config.InboundCompression{Scheme: "brotli"}}, nil)
+			Expect(err).To(MatchError("invalid inbound_compression scheme brotli"))
+		})
+	})
+
+	Describe("Ack channel", func() {
+		It("disables acks when the channel is not configured", func() {
+			conf := &config.Config{}
+			s := newTestServer(conf, nil)
+			Expect(conf.AckChan).To(BeNil())
+			Expect(s.hook.LastEntry().Message).To(Equal("reliable_ack_disabled"))
+		})
+
+		It("processes the acks left in the channel once closed", func() {
+			s := newTestServer(&config.Config{
+				ReliableAckSources: map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:            make(chan *telemetry.Record),
+			}, nil)
+
+			s.conf.AckChan <- &telemetry.Record{TxType: "V"}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Expect(s.CloseAcks(ctx)).To(Succeed())
+		})
+
+		It("observes the latency of the acks sent to connected sockets", func() {
+			collector := &histogramCollector{Collector: noop.NewCollector(), name: "reliable_ack_latency_ms", observations: make(chan histogramObservation, 1)}
+			s := newTestServer(&config.Config{
+				TLSPassThrough:     ptr(config.RFC9440),
+				MetricCollector:    collector,
+				ReliableAckSources: map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:            make(chan *telemetry.Record),
+			}, nil)
+			s.dialPassThrough()
+			Eventually(s.registry.ListSockets).Should(HaveLen(1))
+
+			serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "device-1", SenderID: "vehicle_device.device-1"}, nil, s.logger)
+			record := &telemetry.Record{TxType: "V", Serializer: serializer, SocketID: s.registry.ListSockets()[0].ConnectionID}
+			record.SetProduceTime(telemetry.Kafka, time.Now().Add(-time.Second))
+			// the produce times of the other dispatchers of the record are not observed
+			record.SetProduceTime(telemetry.Kinesis, time.Now().Add(-time.Hour))
+			s.conf.AckChan <- record
+
+			var observation histogramObservation
+			Eventually(collector.observations).Should(Receive(&observation))
+			Expect(observation.labels).To(Equal(adapter.Labels{"record_type": "V", "dispatcher": "kafka"}))
+			Expect(observation.value).To(BeNumerically(">=", 1000))
+			Expect(observation.value).To(BeNumerically("<", 60000))
+		})
+
+		It("counts and logs the acks of records without serializer", func() {
+			collector := &labelCollector{Collector: noop.NewCollector(), name: "reliable_ack_invalid", labels: make(chan adapter.Labels, 1)}
+			s := newTestServer(&config.Config{
+				MetricCollector:    collector,
+				ReliableAckSources: map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:            make(chan *telemetry.Record),
+			}, nil)
+
+			s.conf.AckChan <- &telemetry.Record{TxType: "V", SocketID: "socket-1"}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Expect(s.CloseAcks(ctx)).To(Succeed())
+
+			Expect(collector.labels).To(Receive(Equal(adapter.Labels{"record_type": "V", "dispatcher": "kafka"})))
+			entry := s.hook.LastEntry()
+			Expect(entry.Message).To(Equal("reliable_ack_invalid_record"))
+			Expect(entry.Data).To(HaveKeyWithValue("record_type", "V"))
+			Expect(entry.Data).To(HaveKeyWithValue("socket_id", "socket-1"))
+		})
+
+		It("closes no channel when acks are disabled", func() {
+			s := newTestServer(&config.Config{}, nil)
+			Expect(s.CloseAcks(context.Background())).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Admin endpoints", func() {
+	Describe("Status", func() {
+		var s *testServer
+
+		BeforeEach(func() {
+			s = newTestServer(&config.Config{MaxConnections: 1}, nil)
+		})
+
+		status := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			s.Status()(recorder, httptest.NewRequest("GET", "/status", nil))
+			return recorder
+		}
+
+		It("reports healthy servers", func() {
+			recorder := status()
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("mtls ok"))
+		})
+
+		It("reports draining servers", func() {
+			s.SetDraining(true)
+			recorder := status()
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Body.String()).To(ContainSubstring("draining"))
+
+			s.SetDraining(false)
+			Expect(status().Code).To(Equal(http.StatusOK))
+		})
+
+		It("reports servers in maintenance", func() {
+			s.SetMaintenance(true)
+			recorder := status()
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Body.String()).To(ContainSubstring("maintenance"))
+		})
+	})
+
+	Describe("Status identity", func() {
+		status := func(conf *config.Config, chain string) streaming.StatusIdentityResponse {
+			conf.StatusIdentity = true
+			s := newTestServer(conf, nil)
+
+			request := httptest.NewRequest("GET", "/status", nil)
+			if chain != "" {
+				request.Header.Set("Client-Cert-Chain", chain)
+			}
+			recorder := httptest.NewRecorder()
+			s.StatusIdentity(conf)(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			var response streaming.StatusIdentityResponse
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+			return response
+		}
+
+		It("reports the pass through mode and the identity of the forwarded certificate", func() {
+			Expect(status(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, passThroughCertChain())).To(Equal(streaming.StatusIdentityResponse{
+				Status:         "mtls ok",
+				TLSPassThrough: "rfc9440",
+				DeviceID:       "device-1",
+				SenderID:       "vehicle_device.device-1",
+			}))
+		})
+
+		It("reports why no identity was extracted", func() {
+			response := status(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, "")
+			Expect(response.DeviceID).To(BeEmpty())
+			Expect(response.Error).To(Equal("missing_certificate_error"))
+
+			response = status(&config.Config{}, "")
+			Expect(response.TLSPassThrough).To(Equal("none"))
+			Expect(response.Error).To(Equal("missing_certificate_error"))
+		})
+
+		It("does not disclose the details of the extraction errors", func() {
+			chain := base64.StdEncoding.EncodeToString([]byte("invalid"))
+			Expect(status(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, chain).Error).To(Equal("identity_error"))
+
+			expired := passThroughCertChainOf(&x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}, NotAfter: time.Now().Add(-time.Hour)})
+			response := status(&config.Config{TLSPassThrough: ptr(config.RFC9440)}, expired)
+			Expect(response.Error).To(Equal("expired_certificate_error"))
+			Expect(response.DeviceID).To(BeEmpty())
+		})
+
+		Context("with identity_san", func() {
+			vin := &url.URL{Scheme: "urn", Opaque: "vin:5YJ3E1EA7KF000001"}
+
+			It("reads the device id from the subject alternative name stripped of the prefix", func() {
+				conf := &config.Config{TLSPassThrough: ptr(config.RFC9440), IdentitySAN: &config.IdentitySAN{Type: "uri", Prefix: "urn:vin:"}}
+				response := status(conf, passThroughCertChainOf(&x509.Certificate{URIs: []*url.URL{vin}}))
+				Expect(response.DeviceID).To(Equal("5YJ3E1EA7KF000001"))
+				Expect(response.SenderID).To(Equal("vehicle_device.5YJ3E1EA7KF000001"))
+			})
+
+			It("falls back to the common name without a matching subject alternative name", func() {
+				conf := &config.Config{TLSPassThrough: ptr(config.RFC9440), IdentitySAN: &config.IdentitySAN{Type: "dns", Prefix: "vin."}}
+				chain := passThroughCertChainOf(&x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}, DNSNames: []string{"other.example.com"}, URIs: []*url.URL{vin}})
+				Expect(status(conf, chain).DeviceID).To(Equal("device-1"))
+			})
+
+			It("rejects unknown subject alternative name types", func() {
+				_, err := initTestServer(&config.Config{IdentitySAN: &config.IdentitySAN{Type: "ip"}}, nil)
+				Expect(err).To(MatchError("invalid identity_san type ip"))
+			})
+		})
+	})
+
+	Describe("Readiness", func() {
+		var (
+			conf     *config.Config
+			s        *testServer
+			kafka    *metrics.SuccessRatio
+			kinesis  *metrics.SuccessRatio
+			recorder *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			conf = &config.Config{
+				MetricCollector:    noop.NewCollector(),
+				Records:            map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka, telemetry.Kinesis}, "alerts": {telemetry.Kafka, telemetry.Logger}},
+				ReliableAckSources: map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:            make(chan *telemetry.Record),
+			}
+			kafka, kinesis = conf.NewSuccessRatio(telemetry.Kafka), conf.NewSuccessRatio(telemetry.Kinesis)
+			s = newTestServer(conf, map[string][]telemetry.Producer{"V": {&recordingProducer{}, &recordingProducer{}}, "alerts": {&recordingProducer{}, &recordingProducer{}}})
+		})
+
+		request := func(target string) streaming.Readiness {
+			recorder = httptest.NewRecorder()
+			s.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			var readiness streaming.Readiness
+			if target == "/readyz" {
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &readiness)).To(Succeed())
+			}
+			return readiness
+		}
+
+		It("is live as long as it serves requests", func() {
+			kafka.Failure()
+			request("/livez")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("is ready when the dispatchers are healthy", func() {
+			Expect(request("/readyz")).To(Equal(streaming.Readiness{Ready: true, AcksRunning: true, UnhealthyDispatchers: []string{}}))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("lists the unhealthy dispatchers", func() {
+			kafka.Failure()
+			kinesis.Failure()
+			Expect(request("/readyz")).To(Equal(streaming.Readiness{AcksRunning: true, UnhealthyDispatchers: []string{"kafka", "kinesis"}}))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("applies the partial outage policy and its minimum success ratio", func() {
+			kafka.Success()
+			kafka.Failure()
+			Expect(request("/readyz").Ready).To(BeTrue())
+
+			conf.PartialOutage = &config.PartialOutage{Policy: config.PartialOutageReject, MinSuccessRatio: 0.9}
+			Expect(request("/readyz")).To(Equal(streaming.Readiness{AcksRunning: true, UnhealthyDispatchers: []string{"kafka"}}))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+
+			conf.PartialOutage.Policy = config.PartialOutageAccept
+			Expect(request("/readyz")).To(Equal(streaming.Readiness{Ready: true, AcksRunning: true, UnhealthyDispatchers: []string{"kafka"}}))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("is not ready once the acks stopped", func() {
+			Expect(s.CloseAcks(context.Background())).To(Succeed())
+			Expect(request("/readyz")).To(Equal(streaming.Readiness{UnhealthyDispatchers: []string{}}))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
+	Describe("Reliable ack endpoint", func() {
+		var (
+			conf *config.Config
+			s    *testServer
+		)
+
+		BeforeEach(func() {
+			conf = &config.Config{
+				ReliableAckSources:  map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:             make(chan *telemetry.Record),
+				ReliableAckEndpoint: &config.ReliableAckEndpoint{Token: "secret"},
+			}
+			s = newTestServer(conf, nil)
+		})
+
+		request := func(method string, target string, token string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, target, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			recorder := httptest.NewRecorder()
+			s.handler.ServeHTTP(recorder, r)
+			return recorder
+		}
+
+		It("requires a token", func() {
+			_, err := initTestServer(&config.Config{ReliableAckEndpoint: &config.ReliableAckEndpoint{}}, nil)
+			Expect(err).To(MatchError("reliable_ack_endpoint requires a token"))
+			Expect(request(http.MethodGet, "/reliable_acks", "wrong").Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("disables and enables the reliable acks of record types", func() {
+			recorder := request(http.MethodPost, "/reliable_acks?record_type=V&enabled=false", "secret")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(MatchJSON(`[{"record_type": "V", "dispatcher": "kafka", "enabled": false}]`))
+
+			recorder = request(http.MethodGet, "/reliable_acks", "secret")
+			Expect(recorder.Body.String()).To(MatchJSON(`[{"record_type": "V", "dispatcher": "kafka", "enabled": false}]`))
+
+			Expect(request(http.MethodPost, "/reliable_acks?record_type=alerts&enabled=false", "secret").Code).To(Equal(http.StatusBadRequest))
+			Expect(request(http.MethodPost, "/reliable_acks?record_type=V", "secret").Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("acks the records of disabled record types on receipt only", func() {
+			producer := &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			conf.TLSPassThrough = ptr(config.RFC9440)
+			conf.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka}}
+			s = newTestServer(conf, map[string][]telemetry.Producer{"V": {producer}})
+			conn := s.dialPassThrough()
+			Eventually(s.registry.ListSockets).Should(HaveLen(1))
+
+			send := func(txid string) *telemetry.Record {
+				message, err := (&messages.StreamMessage{TXID: []byte(txid), SenderID: []byte("vehicle_device.device-1"), MessageTopic: []byte("V")}).ToBytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.WriteMessage(websocket.BinaryMessage, message)).To(Succeed())
+				var record *telemetry.Record
+				Eventually(producer.records).Should(Receive(&record))
+				return record
+			}
+			acked := func() bool {
+				Expect(conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))).To(Succeed())
+				_, _, err := conn.ReadMessage()
+				return err == nil
+			}
+
+			Expect(request(http.MethodPost, "/reliable_acks?record_type=V&enabled=false", "secret").Code).To(Equal(http.StatusOK))
+			record := send("1")
+			Expect(acked()).To(BeTrue())
+			// the record is not acked again by its reliable ack source once the acks are enabled
+			Expect(record.AckedOnReceipt).To(BeTrue())
+
+			Expect(request(http.MethodPost, "/reliable_acks?record_type=V&enabled=true", "secret").Code).To(Equal(http.StatusOK))
+			record = send("2")
+			Expect(record.AckedOnReceipt).To(BeFalse())
+			Expect(acked()).To(BeFalse())
+		})
+	})
+
+	Describe("Connections endpoint", func() {
+		serve := func(endpoint *config.ConnectionsEndpoint) (*httptest.Server, *testServer) {
+			s := newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), ConnectionsEndpoint: endpoint}, nil)
+			srv := httptest.NewServer(s.handler)
+			DeferCleanup(srv.Close)
+			return srv, s
+		}
+
+		get := func(srv *httptest.Server, token string) *http.Response {
+			request, err := http.NewRequest(http.MethodGet, srv.URL+"/connections", nil)
+			Expect(err).NotTo(HaveOccurred())
+			if token != "" {
+				request.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			return resp
+		}
+
+		It("lists the connected sockets", func() {
+			srv, s := serve(&config.ConnectionsEndpoint{Token: "secret"})
+			s.dialPassThrough()
+
+			var sockets []map[string]interface{}
+			Eventually(func() []map[string]interface{} {
+				resp := get(srv, "secret")
+				defer resp.Body.Close()
+				Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+				Expect(json.NewDecoder(resp.Body).Decode(&sockets)).To(Succeed())
+				return sockets
+			}).Should(HaveLen(1))
+			Expect(sockets[0]).To(HaveKeyWithValue("device_id", "device-1"))
+			Expect(sockets[0]).To(HaveKey("connection_id"))
+			Expect(sockets[0]).To(HaveKey("network_interface"))
+			Expect(sockets[0]).To(HaveKey("connected_at"))
+		})
+
+		It("rejects the requests without the token", func() {
+			srv, _ := serve(&config.ConnectionsEndpoint{Token: "secret"})
+			for _, token := range []string{"", "wrong"} {
+				resp := get(srv, token)
+				Expect(resp.Body.Close()).To(Succeed())
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+		})
+
+		It("requires a token", func() {
+			_, err := initTestServer(&config.Config{ConnectionsEndpoint: &config.ConnectionsEndpoint{}}, nil)
+			Expect(err).To(MatchError("connections_endpoint requires a token"))
+		})
+
+		It("is disabled by default", func() {
+			srv, _ := serve(nil)
+			resp := get(srv, "")
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).NotTo(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Last seen endpoint", func() {
+		var s *testServer
+
+		BeforeEach(func() {
+			s = newTestServer(&config.Config{TLSPassThrough: ptr(config.RFC9440), LastSeen: &config.LastSeen{Token: "secret"}}, nil)
+		})
+
+		request := func(target string, token string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			recorder := httptest.NewRecorder()
+			s.handler.ServeHTTP(recorder, r)
+			return recorder
+		}
+
+		lastSeen := func() streaming.LastSeen {
+			recorder := request("/last_seen?device_id=device-1", "secret")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			var lastSeen streaming.LastSeen
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &lastSeen)).To(Succeed())
+			Expect(lastSeen.DeviceID).To(Equal("device-1"))
+			return lastSeen
+		}
+
+		It("requires a token", func() {
+			_, err := initTestServer(&config.Config{LastSeen: &config.LastSeen{}}, nil)
+			Expect(err).To(MatchError("last_seen requires a token"))
+			Expect(request("/last_seen?device_id=device-1", "wrong").Code).To(Equal(http.StatusUnauthorized))
+			Expect(request("/last_seen", "secret").Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("audits the lookups", func() {
+			Expect(request("/last_seen?device_id=device-1", "secret").Code).To(Equal(http.StatusNotFound))
+			var audited []logrus.LogInfo
+			for _, entry := range s.hook.AllEntries() {
+				if entry.Message == "audit_event" {
+					audited = append(audited, logrus.LogInfo(entry.Data))
+				}
+			}
+			Expect(audited).To(ConsistOf(And(HaveKeyWithValue("action", "last_seen_lookup"), HaveKeyWithValue("resource", "device-1"))))
+		})
+
+		It("serves the last record and disconnect of the devices", func() {
+			Expect(request("/last_seen?device_id=device-1", "secret").Code).To(Equal(http.StatusNotFound))
+
+			conn := s.dialPassThrough()
+			Eventually(s.registry.ListSockets).Should(HaveLen(1))
+			Expect(lastSeen().Event).To(Equal(streaming.LastSeenEventConnect))
+
+			Expect(conn.WriteMessage(websocket.BinaryMessage, streamMessage("1", "canlogs"))).To(Succeed())
+			Eventually(func() string { return lastSeen().Event }).Should(Equal(streaming.LastSeenEventRecord))
+
+			Expect(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))).To(Succeed())
+			Eventually(s.registry.ListSockets).Should(BeEmpty())
+			Expect(lastSeen().Event).To(Equal(streaming.LastSeenEventDisconnect))
+			Expect(lastSeen().LastSeen).To(BeTemporally("~", time.Now(), time.Second))
+		})
+	})
+
+	Describe("Debug inject", func() {
+		var (
+			s              *testServer
+			canlogs, other *recordingProducer
+			message        []byte
+		)
+
+		BeforeEach(func() {
+			canlogs = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			other = &recordingProducer{records: make(chan *telemetry.Record, 10)}
+			s = newTestServer(&config.Config{EnableDebugInject: true, DebugInject: &config.DebugInject{Token: "secret"}}, map[string][]telemetry.Producer{"canlogs": {canlogs}, "other": {other}})
+			message = streamMessage("1", "canlogs")
+		})
+
+		inject := func(method string, target string, body []byte) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(method, target, bytes.NewReader(body))
+			request.Header.Set("Authorization", "Bearer secret")
+			s.handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		It("requires the token", func() {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/debug/inject", bytes.NewReader(message))
+			request.Header.Set("Authorization", "Bearer other")
+			s.handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(canlogs.records).NotTo(Receive())
+		})
+
+		It("requires a token to be configured", func() {
+			_, err := initTestServer(&config.Config{EnableDebugInject: true}, nil)
+			Expect(err).To(MatchError("enable_debug_inject requires a debug_inject token"))
+		})
+
+		It("is not served unless enabled", func() {
+			s = newTestServer(&config.Config{DebugInject: &config.DebugInject{Token: "secret"}}, map[string][]telemetry.Producer{"canlogs": {canlogs}})
+
+			Expect(inject(http.MethodPost, "/debug/inject", message).Code).NotTo(Equal(http.StatusAccepted))
+			Expect(canlogs.records).NotTo(Receive())
+		})
+
+		It("dispatches the injected messages as a vehicle connection would", func() {
+			recorder := inject(http.MethodPost, "/debug/inject", message)
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"txid": "1", "record_type": "canlogs", "device_id": "device-1"}`))
+
+			var record *telemetry.Record
+			Expect(canlogs.records).To(Receive(&record))
+			Expect(record.Vin).To(Equal("device-1"))
+			Expect(record.Payload()).To(Equal([]byte("data")))
+		})
+
+		It("processes the injected messages through the pipeline of the connections", func() {
+			s = newTestServer(&config.Config{EnableDebugInject: true, DebugInject: &config.DebugInject{Token: "secret"}, Sequencing: &config.Sequencing{Source: "clock"}}, map[string][]telemetry.Producer{"canlogs": {canlogs}})
+
+			Expect(inject(http.MethodPost, "/debug/inject", message).Code).To(Equal(http.StatusAccepted))
+			var record *telemetry.Record
+			Expect(canlogs.records).To(Receive(&record))
+			Expect(record.SocketID).To(Equal("debug_inject"))
+			Expect(record.Sequence).To(BeNumerically(">", 0))
+		})
+
+		It("replaces the topic of the message", func() {
+			Expect(inject(http.MethodPost, "/debug/inject?topic=other", message).Code).To(Equal(http.StatusAccepted))
+			Expect(other.records).To(Receive())
+			Expect(canlogs.records).NotTo(Receive())
+		})
+
+		It("rejects invalid requests", func() {
+			Expect(inject(http.MethodGet, "/debug/inject", nil).Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(inject(http.MethodPost, "/debug/inject", []byte("data")).Code).To(Equal(http.StatusBadRequest))
+
+			anonymous, err := (&messages.StreamMessage{TXID: []byte("1"), SenderID: []byte("device-1"), MessageTopic: []byte("canlogs"), Payload: []byte("data")}).ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(inject(http.MethodPost, "/debug/inject", anonymous).Code).To(Equal(http.StatusBadRequest))
+			Expect(canlogs.records).NotTo(Receive())
+		})
+	})
+})
+
+var _ = Describe("Server setup", func() {
+	Describe("Nil logger", func() {
+		It("serves requests with a default logger", func() {
+			conf := &config.Config{
+				TLSPassThrough:  ptr(config.RFC9440),
+				MetricCollector: noop.NewCollector(),
+			}
+			_, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, nil, streaming.NewSocketRegistry())
+			Expect(err).NotTo(HaveOccurred())
+			srv := httptest.NewServer(http.HandlerFunc(s.ServeBinaryWs(conf)))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("Outbound queue config", func() {
+		It("rejects unknown drop policies", func() {
+			_, err := initTestServer(&config.Config{OutboundQueue: &config.OutboundQueue{DropPolicy: "drop_all"}}, nil)
+			Expect(err).To(MatchError("invalid outbound_queue drop_policy drop_all"))
+		})
+	})
+
+	Describe("Server metrics", func() {
+		It("registers the metrics of each server against its collector", func() {
+			first := &countingCollector{Collector: noop.NewCollector()}
+			second := &countingCollector{Collector: noop.NewCollector()}
+
+			newTestServer(&config.Config{MetricCollector: first}, nil)
+			newTestServer(&config.Config{MetricCollector: second}, nil)
+
+			Expect(first.counters).To(BeNumerically(">", 0))
+			Expect(second.counters).To(BeNumerically(">", 0))
+		})
+
+		It("shares the metrics of a collector between its servers and sockets", func() {
+			collector := &countingCollector{Collector: noop.NewCollector()}
+			conf := &config.Config{MetricCollector: collector}
+
+			s := newTestServer(conf, nil)
+			streaming.NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: "42"}, nil, conf, s.logger)
+			registered := collector.counters
+
+			s = newTestServer(conf, nil)
+			streaming.NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: "43"}, nil, conf, s.logger)
+			Expect(collector.counters).To(Equal(registered))
+		})
+	})
+})
+
+// testServer is a server initialized for a spec with the socket registry, config and logger it was initialized with
+type testServer struct {
+	*streaming.Server
+	handler  http.Handler
+	registry *streaming.SocketRegistry
+	conf     *config.Config
+	logger   *logrus.Logger
+	hook     *test.Hook
+}
+
+// initTestServer initializes a server with a no-op logger and, unless the config sets one, a no-op metric collector
+func initTestServer(conf *config.Config, producerRules map[string][]telemetry.Producer) (*testServer, error) {
+	if conf.MetricCollector == nil {
+		conf.MetricCollector = noop.NewCollector()
+	}
+	logger, hook := logrus.NoOpLogger()
+	registry := streaming.NewSocketRegistry()
+	server, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), producerRules, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	return &testServer{Server: s, handler: server.Handler, registry: registry, conf: conf, logger: logger, hook: hook}, nil
+}
+
+// newTestServer initializes a server with initTestServer, failing the spec if the config is rejected
+func newTestServer(conf *config.Config, producerRules map[string][]telemetry.Producer) *testServer {
+	s, err := initTestServer(conf, producerRules)
+	Expect(err).NotTo(HaveOccurred())
+	return s
+}
+
+// serve serves the websocket handler of the server until the end of the spec
+func (s *testServer) serve() *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(s.ServeBinaryWs(s.conf)))
+	DeferCleanup(srv.Close)
+	return srv
+}
+
+// address serves the websocket handler of the server and returns its url
+func (s *testServer) address() string {
+	return "ws" + strings.TrimPrefix(s.serve().URL, "http")
+}
+
+// dial connects a client to the server with the header
+func (s *testServer) dial(header http.Header) (*websocket.Conn, *http.Response, error) {
+	return (&websocket.Dialer{HandshakeTimeout: time.Second}).Dial(s.address(), header)
+}
+
+// dialCertChain connects a client to the server with the RFC 9440 certificate chain
+func (s *testServer) dialCertChain(chain string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	header.Set("Client-Cert-Chain", chain)
+	return s.dial(header)
+}
+
+// dialPassThroughResponse connects a vehicle with the pass through certificate of device-1, serial 1
+func (s *testServer) dialPassThroughResponse() (*websocket.Conn, *http.Response, error) {
+	return s.dialCertChain(passThroughCertChain())
+}
+
+// dialPassThrough connects a vehicle with the pass through certificate of device-1 until the end of the spec
+func (s *testServer) dialPassThrough() *websocket.Conn {
+	conn, _, err := s.dialPassThroughResponse()
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(conn.Close)
+	return conn
+}
+
+// streamMessage returns the message of device-1 on the topic with the payload "data"
+func streamMessage(txid string, topic string) []byte {
+	message, err := (&messages.StreamMessage{TXID: []byte(txid), SenderID: []byte("vehicle_device.device-1"), MessageTopic: []byte(topic), Payload: []byte("data")}).ToBytes()
+	Expect(err).NotTo(HaveOccurred())
+	return message
+}
+
+// passThroughCertChain returns the RFC 9440 chain of the certificate of device-1, serial 1
+func passThroughCertChain() string {
+	return passThroughCertChainOf(&x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}})
+}
+
+// passThroughCertChainOf returns the RFC 9440 chain of the template, serial 1, issued by Tesla Motors Products CA.
+// The certificate is valid for the hour around now unless the template sets its validity
+func passThroughCertChainOf(template *x509.Certificate) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+	template.SerialNumber = big.NewInt(1)
+	template.Issuer = pkix.Name{CommonName: "Tesla Motors Products CA"}
+	if template.NotAfter.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	issuer := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "Tesla Motors Products CA"}}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))
+}
+
+// recordingProducer keeps the records produced to it
+type recordingProducer struct {
+	records chan *telemetry.Record
+}
+
+func (p *recordingProducer) Close() error { return nil }
+
+func (p *recordingProducer) Produce(entry *telemetry.Record) { p.records <- entry }
+
+func (p *recordingProducer) ProcessReliableAck(_ *telemetry.Record) {}
+
+func (p *recordingProducer) ReportError(_ string, _ error, _ logrus.LogInfo) {}
+
+// flushingProducer runs the flush set by the test, such as sending the acks of the records it dispatches
+type flushingProducer struct {
+	recordingProducer
+	flush func()
+}
+
+func (p *flushingProducer) Flush(_ context.Context) error {
+	p.flush()
+	return nil
+}
+
+// countingCollector counts the metrics registered against it
+type countingCollector struct {
+	*noop.Collector
+	counters int
+}
+
+func (c *countingCollector) RegisterCounter(options adapter.CollectorOptions) adapter.Counter {
+	c.counters++
+	return c.Collector.RegisterCounter(options)
+}
+
+// labelCollector records the labels of the increments of the counter named name
+type labelCollector struct {
+	*noop.Collector
+	name   string
+	labels chan adapter.Labels
+}
+
+func (c *labelCollector) RegisterCounter(options adapter.CollectorOptions) adapter.Counter {
+	if options.Name != c.name {
+		return c.Collector.RegisterCounter(options)
+	}
+	return labelCounter(c.labels)
+}
+
+type labelCounter chan adapter.Labels
+
+func (c labelCounter) Add(_ int64, labels adapter.Labels) { c <- labels }
+func (c labelCounter) Inc(labels adapter.Labels)          { c <- labels }
+
+// histogramCollector records the observations of the histogram named name
+type histogramCollector struct {
+	*noop.Collector
+	name         string
+	observations chan histogramObservation
+}
+
+type histogramObservation struct {
+	value  int64
+	labels adapter.Labels
+}
+
+func (c *histogramCollector) RegisterHistogram(options adapter.CollectorOptions) adapter.Histogram {
+	if options.Name != c.name {
+		return c.Collector.RegisterHistogram(options)
+	}
+	return recordingHistogram(c.observations)
+}
+
+type recordingHistogram chan histogramObservation
+
+func (h recordingHistogram) Observe(value int64, labels adapter.Labels) {
+	h <- histogramObservation{value: value, labels: labels}
+}
+
 func ptr[T any](x T) *T {
 	return &x
 }
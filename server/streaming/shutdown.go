@@ -0,0 +1,241 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// CloseCause is the reason the server closes the connections of the vehicles
+type CloseCause string
+
+const (
+	// CloseCauseDraining closes the connections before the server shuts down
+	CloseCauseDraining CloseCause = "draining"
+	// CloseCauseMaintenance closes the connections for maintenance
+	CloseCauseMaintenance CloseCause = "maintenance"
+
+	// DefaultDrainingCloseReason is sent to the vehicles when the server shuts down if not configured
+	DefaultDrainingCloseReason = "server_draining"
+	// DefaultMaintenanceCloseReason is sent to the vehicles during maintenance if not configured
+	DefaultMaintenanceCloseReason = "maintenance"
+	// invalidIdentityCloseReason is sent to the clients whose identity could not be extracted from their certificate
+	invalidIdentityCloseReason = "invalid_identity"
+	// rejectedByPolicyCloseReason is sent to the clients whose identity the connection authorization rejected
+	rejectedByPolicyCloseReason = "rejected_by_policy"
+	// unsupportedSubprotocolCloseReason is sent to the clients requesting none of the subprotocols of the server
+	unsupportedSubprotocolCloseReason = "unsupported_subprotocol"
+
+	// DisconnectReasonShutdown is the reason of the disconnected connectivity events of the connections closed on shutdown
+	DisconnectReasonShutdown = "server_shutdown"
+	// DisconnectReasonMaintenance is the reason of the disconnected connectivity events of the connections closed for maintenance
+	DisconnectReasonMaintenance = "maintenance"
+	// DisconnectReasonReadTimeout is the reason of the disconnected connectivity events of the connections closed by the read deadline
+	DisconnectReasonReadTimeout = "read_timeout"
+	// DisconnectReasonPongTimeout is the reason of the disconnected connectivity events of the connections closed for not answering a ping
+	DisconnectReasonPongTimeout = "pong_timeout"
+	// DisconnectReasonIdleTimeout is the reason of the disconnected connectivity events of the connections closed for not sending any message
+	DisconnectReasonIdleTimeout = "idle_timeout"
+	// DisconnectReasonAckWriteFailed is the reason of the disconnected connectivity events of the connections closed after an ack failed to be written
+	DisconnectReasonAckWriteFailed = "ack_write_failed"
+	// DisconnectReasonClientClosed is the reason of the disconnected connectivity events of the connections the clients closed with a normal or going away close frame
+	DisconnectReasonClientClosed = "client_closed"
+	// DisconnectReasonReadError is the reason of the disconnected connectivity events of the connections lost without a clean close, such as a reset
+	DisconnectReasonReadError = "read_error"
+	// DisconnectReasonUnexpectedMessageType is the reason of the disconnected connectivity events of the connections closed after a message of an unexpected type
+	DisconnectReasonUnexpectedMessageType = "unexpected_message_type"
+	// DisconnectReasonLastWill is the reason of the disconnected connectivity events of the connections left open when the server died,
+	// dispatched when it starts again
+	DisconnectReasonLastWill = "last_will"
+
+	// drainPollInterval is the interval at which shutdown checks whether the connections are closed
+	drainPollInterval = 100 * time.Millisecond
+	// forceCloseTimeout bounds the part of the shutdown deadline kept for the deregistration of the connections
+	// remaining once the vehicles were given time to disconnect, at most half of the deadline is kept
+	forceCloseTimeout = 5 * time.Second
+)
+
+// disconnectReason returns the reason reported in the disconnected connectivity events of the cause
+func disconnectReason(cause CloseCause) string {
+	if cause == CloseCauseMaintenance {
+		return DisconnectReasonMaintenance
+	}
+	return DisconnectReasonShutdown
+}
+
+// closeReason returns the close frame code and the configured reason text of the cause
+func closeReason(cause CloseCause, reasons *config.CloseReasons) (int, string) {
+	if cause == CloseCauseMaintenance {
+		if reasons != nil && reasons.Maintenance != "" {
+			return websocket.CloseTryAgainLater, reasons.Maintenance
+		}
+		return websocket.CloseTryAgainLater, DefaultMaintenanceCloseReason
+	}
+	if reasons != nil && reasons.Draining != "" {
+		return websocket.CloseServiceRestart, reasons.Draining
+	}
+	return websocket.CloseServiceRestart, DefaultDrainingCloseReason
+}
+
+// CloseConnections sends a close frame with the reason of the cause to every connected vehicle
+// and returns the number of connections closed
+func (s *Server) CloseConnections(cause CloseCause) int {
+	code, reason := closeReason(cause, s.closeReasons)
+	closed := 0
+	for _, socket := range s.registry.connectedSockets() {
+		socket.disconnectReason.Store(disconnectReason(cause))
+		if err := socket.CloseWithReason(code, reason); err != nil {
+			s.logger.ErrorLog("websocket_close_frame_error", err, logrus.LogInfo{"socket_id": socket.UUID, "reason": reason})
+			continue
+		}
+		closed++
+		s.metrics.closeReasonCount.Inc(map[string]string{"reason": reason})
+	}
+	s.logger.ActivityLog("connections_closed", logrus.LogInfo{"cause": cause, "reason": reason, "count": closed})
+	return closed
+}
+
+// Shutdown marks the server as draining so that new connections are rejected, sends the reliable acks of the records
+// dispatched so far, closes the connections with the draining reason and shuts down the http server once the vehicles
+// disconnected. The root context of the connections remaining when the drain deadline is reached is cancelled without
+// waiting for the vehicles, so that every connection is deregistered and its disconnected connectivity event dispatched
+// before the http server shuts down. The drain deadline keeps part of the deadline of ctx for this, the http server is
+// closed without waiting if ctx is done by then
+func (s *Server) Shutdown(ctx context.Context, server *http.Server) error {
+	s.SetDraining(true)
+	s.auditor.Record(nil, "drain", "server", logrus.LogInfo{"connections": s.registry.NumConnectedSockets()})
+	drainCtx, cancel := drainContext(ctx)
+	defer cancel()
+	s.drainAcks(drainCtx)
+	s.CloseConnections(CloseCauseDraining)
+
+	if !s.waitForDisconnects(drainCtx) {
+		s.logger.ActivityLog("shutdown_connections_remaining", logrus.LogInfo{"count": s.registry.NumConnectedSockets()})
+		// stops the work of the remaining connections, which close and deregister
+		s.cancel()
+		if !s.waitForDisconnects(ctx) {
+			s.logger.ActivityLog("shutdown_connections_not_deregistered", logrus.LogInfo{"count": s.registry.NumConnectedSockets()})
+		}
+	}
+	if s.connectivityBatcher != nil {
+		// the disconnected events of the connections closed above are still pending
+		s.connectivityBatcher.close()
+	}
+	s.cancel()
+	if ctx.Err() != nil {
+		return server.Close()
+	}
+	return server.Shutdown(ctx)
+}
+
+// drainContext returns the context of the drain of the connections, done forceCloseTimeout before ctx or halfway
+// to its deadline if closer
+func drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	forceClose := min(forceCloseTimeout, time.Until(deadline)/2)
+	return context.WithDeadline(ctx, deadline.Add(-forceClose))
+}
+
+// drainAcks flushes the producers dispatching asynchronously and waits for the reliable acks of their records to be
+// written to the connections, or the context to be done. The acks are sent while the connections are still registered,
+// the records received afterwards are resent by the vehicles once they reconnect
+func (s *Server) drainAcks(ctx context.Context) {
+	if s.acksDone == nil {
+		return
+	}
+	for _, flusher := range s.flushers() {
+		if err := flusher.Flush(ctx); err != nil {
+			s.logger.ErrorLog("shutdown_flush_error", err, logrus.LogInfo{"producer": fmt.Sprintf("%T", flusher)})
+		}
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	// the acks sent by the producers are checked after the first interval, once the ack workers took them
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.ActivityLog("shutdown_acks_pending", logrus.LogInfo{"count": len(s.ackChan)})
+			return
+		case <-ticker.C:
+		}
+		if s.acksWritten() {
+			return
+		}
+	}
+}
+
+// flushers returns the producers of the default and regional dispatch rules implementing telemetry.Flusher, once each
+func (s *Server) flushers() []telemetry.Flusher {
+	var flushers []telemetry.Flusher
+	seen := make(map[telemetry.Producer]bool)
+	add := func(rules map[string][]telemetry.Producer) {
+		for _, producers := range rules {
+			for _, producer := range producers {
+				flusher, ok := producer.(telemetry.Flusher)
+				if !ok || seen[producer] {
+					continue
+				}
+				seen[producer] = true
+				flushers = append(flushers, flusher)
+			}
+		}
+	}
+	add(s.DispatchRules())
+	for _, rules := range s.RegionDispatchRules {
+		add(rules)
+	}
+	return flushers
+}
+
+// acksWritten returns true once the acks of the ack channel are handled and the connections wrote their queued messages
+func (s *Server) acksWritten() bool {
+	if len(s.ackChan) > 0 || s.acksHandled.Load() > 0 {
+		return false
+	}
+	for _, socket := range s.registry.connectedSockets() {
+		if socket.writesPending() {
+			return false
+		}
+	}
+	return true
+}
+
+// CloseAcks closes the ack channel and waits for the acks buffered in it to be processed, or the context to be done.
+// It must be called once the producers writing to the ack channel are closed, after Shutdown: the producers stop
+// sending acks once their Close returned
+func (s *Server) CloseAcks(ctx context.Context) error {
+	if s.acksDone == nil {
+		return nil
+	}
+	close(s.ackChan)
+	select {
+	case <-s.acksDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForDisconnects returns true once every connection is deregistered, false if the context is done first
+func (s *Server) waitForDisconnects(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.registry.NumConnectedSockets() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package streaming
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drain context", func() {
+	It("keeps forceCloseTimeout of the deadline to force close the connections", func() {
+		deadline := time.Now().Add(time.Minute)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		drainCtx, cancelDrain := drainContext(ctx)
+		defer cancelDrain()
+		drainDeadline, ok := drainCtx.Deadline()
+		Expect(ok).To(BeTrue())
+		Expect(drainDeadline).To(Equal(deadline.Add(-forceCloseTimeout)))
+	})
+
+	It("keeps at most half of a short deadline", func() {
+		deadline := time.Now().Add(2 * time.Second)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		drainCtx, cancelDrain := drainContext(ctx)
+		defer cancelDrain()
+		drainDeadline, _ := drainCtx.Deadline()
+		Expect(drainDeadline).To(BeTemporally("~", deadline.Add(-time.Second), 50*time.Millisecond))
+	})
+
+	It("has no deadline without deadline", func() {
+		drainCtx, cancelDrain := drainContext(context.Background())
+		defer cancelDrain()
+		_, ok := drainCtx.Deadline()
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Close reason", func() {
+	It("keeps the reasons fitting in a close frame", func() {
+		Expect(truncateCloseReason("maintenance")).To(Equal("maintenance"))
+		reason := strings.Repeat("a", maxCloseReasonLength)
+		Expect(truncateCloseReason(reason + "b")).To(Equal(reason))
+	})
+
+	It("truncates the reasons at a rune boundary", func() {
+		reason := truncateCloseReason(strings.Repeat("a", maxCloseReasonLength-1) + "é")
+		Expect(reason).To(Equal(strings.Repeat("a", maxCloseReasonLength-1)))
+		Expect(utf8.ValidString(reason)).To(BeTrue())
+	})
+})
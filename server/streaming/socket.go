@@ -4,10 +4,16 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/beefsack/go-rate"
 	"github.com/google/uuid"
@@ -17,6 +23,7 @@ import (
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/metrics"
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
@@ -31,6 +38,29 @@ const ReadWriteExitDeadline = 50 * time.Millisecond
 // WriteLoopDeadline is the read/write deadline in the main loop
 const WriteLoopDeadline = 10 * time.Second
 
+const (
+	// closeWriteTimeout is the deadline to send a close frame
+	closeWriteTimeout = time.Second
+	// maxCloseReasonLength is the longest reason fitting in a close frame alongside its code
+	maxCloseReasonLength = 123
+	// maxTraceIDLength is the longest trace id read from the request, longer ones are replaced by a generated id
+	maxTraceIDLength = 128
+	// defaultOutboundQueueSize is the number of messages queued to the writer of a connection when not configured
+	defaultOutboundQueueSize = 1000
+	// defaultOutboundDropPolicy waits for the writer of a connection whose outbound queue is full when not configured
+	defaultOutboundDropPolicy = config.OutboundBlock
+)
+
+var (
+	// errWriterDone is returned when a message is queued to a connection whose writer exited
+	errWriterDone = errors.New("writer_done")
+	// errOutboundQueueFull is returned when a message is dropped from the full outbound queue of a connection
+	errOutboundQueueFull = errors.New("outbound_queue_full")
+)
+
+// outboundQueueDepthBuckets are the upper bounds of the buckets of outbound_queue_depth
+var outboundQueueDepthBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000}
+
 // SocketManager is a struct responsible for managing the socket connection with the clients
 type SocketManager struct {
 	Ws           *websocket.Conn
@@ -39,14 +69,52 @@ type SocketManager struct {
 	StartTime    time.Time
 	UUID         string
 
-	config                 *config.Config
-	logger                 *logrus.Logger
-	requestIdentity        *telemetry.RequestIdentity
-	requestInfo            map[string]interface{}
-	metricsCollector       metrics.MetricCollector
-	stopChan               chan struct{}
-	writeChan              chan SocketMessage
-	transmitDecodedRecords bool
+	// recordPipeline decodes and dispatches the records of the connection, its traceID identifies the connection
+	// in its logs and in the metadata of its records, read from the request or generated
+	recordPipeline
+
+	// ctx is cancelled when the server shuts down, the connection is then closed without waiting for the client
+	ctx                context.Context
+	requestInfo        map[string]interface{}
+	metricsCollector   metrics.MetricCollector
+	stopChan           chan struct{}
+	writeChan          chan SocketMessage
+	writeMutex         sync.Mutex
+	decompressor       *telemetry.Decompressor
+	readTimeout        time.Duration
+	pingInterval       time.Duration
+	pongTimeout        time.Duration
+	idleTimeout        time.Duration
+	outboundDropPolicy config.OutboundDropPolicy
+	// deviceRateLimiter bounds the messages of the device across its connections, nil when unlimited
+	deviceRateLimiter *deviceRateLimiter
+	// rateBucket is the token bucket of the device in the rate limiter, nil without device identity
+	rateBucket *deviceBucket
+	// connectedAt is the time the socket registered
+	connectedAt time.Time
+	// previousSession is the session of the device loaded from the session store when the socket registered
+	previousSession *sessionstore.Session
+	// nextWriter opens the writer of an ack, it is replaced in tests to fail writes
+	nextWriter func(messageType int) (io.WriteCloser, error)
+	// writerDone is closed when the writer exits, acks are no longer queued past that point
+	writerDone chan struct{}
+	// writing is set while the writer writes a message taken from the outbound queue
+	writing atomic.Bool
+
+	// lastFrameAt is the time in unix nanoseconds the last data frame was received, or the read loop started
+	lastFrameAt atomic.Int64
+	// lastReadAt is the time in unix nanoseconds anything, data frame or pong, was last received
+	lastReadAt atomic.Int64
+
+	// disconnectReason is set when the server closes the connection, it is reported in the disconnected connectivity event
+	disconnectReason atomic.Value
+	// readEndReason is why the read loop ended when the server did not close the connection, it is set by the read loop
+	readEndReason string
+	// framesRead and bytesRead count the data frames read from the connection, including those later dropped
+	framesRead atomic.Uint64
+	bytesRead  atomic.Uint64
+	// subprotocol is the wire version negotiated with the client, empty for the legacy format
+	subprotocol string
 }
 
 // SocketMessage represents incoming socket connection
@@ -58,6 +126,7 @@ type SocketMessage struct {
 // Metrics stores metrics reported from this package
 type Metrics struct {
 	rateLimitExceededCount       adapter.Counter
+	messagesRateLimitedCount     adapter.Counter
 	recordTooBigCount            adapter.Counter
 	unauthorizedSenderCount      adapter.Counter
 	unknownMessageTypeErrorCount adapter.Counter
@@ -66,40 +135,96 @@ type Metrics struct {
 	socketErrorCount             adapter.Counter
 	recordSizeBytesTotal         adapter.Counter
 	recordCount                  adapter.Counter
+	missingTopicCount            adapter.Counter
+	decodeDeadLetterCount        adapter.Counter
+	decodeDeadLetterLimitedCount adapter.Counter
+	unchangedRecordCount         adapter.Counter
+	recordCacheHitCount          adapter.Counter
+	recordCacheMissCount         adapter.Counter
+	recordCacheEvictionCount     adapter.Counter
+	regionDispatchCount          adapter.Counter
+	unknownFieldsCount           adapter.Counter
+	partialOutageDroppedCount    adapter.Counter
+	sequenceErrorCount           adapter.Counter
+	compressionBytesTotal        adapter.Counter
+	compressionCount             adapter.Counter
+	connectionEventDroppedCount  adapter.Counter
+	transformCount               adapter.Counter
+	transformErrorCount          adapter.Counter
+	gatewayRecordCount           adapter.Counter
+	readDeadlineCloseCount       adapter.Counter
+	pongTimeoutCloseCount        adapter.Counter
+	idleConnectionsClosedCount   adapter.Counter
+	messageTransformCount        adapter.Counter
+	messageTransformErrorCount   adapter.Counter
+	ackWriteErrorCount           adapter.Counter
+	sessionStoreErrorCount       adapter.Counter
+	connectionStoreErrorCount    adapter.Counter
+	fieldPresenceCount           adapter.Counter
+	outboundQueueDepth           adapter.Histogram
+	outboundDroppedCount         adapter.Counter
+	decompressionErrorCount      adapter.Counter
 }
 
 var (
-	metricsRegistry Metrics
-	metricsOnce     sync.Once
+	// socketMetrics are the socket metrics registered against each collector, the sockets of the servers sharing
+	// a collector share its metrics as a collector cannot register a metric twice
+	socketMetrics      = make(map[metrics.MetricCollector]*Metrics)
+	socketMetricsMutex sync.Mutex
 )
 
 // NewSocketManager instantiates a SocketManager
 func NewSocketManager(ctx context.Context, requestIdentity *telemetry.RequestIdentity, ws *websocket.Conn, config *config.Config, logger *logrus.Logger) *SocketManager {
-	registerMetricsOnce(config.MetricCollector)
+	requestLogInfo, socketUUID, traceID := buildRequestContext(ctx, config.TraceIDHeaderName())
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	requestLogInfo, socketUUID := buildRequestContext(ctx)
+	outboundQueueSize, outboundDropPolicy := defaultOutboundQueueSize, defaultOutboundDropPolicy
+	if config.OutboundQueue != nil {
+		if config.OutboundQueue.Size > 0 {
+			outboundQueueSize = config.OutboundQueue.Size
+		}
+		if config.OutboundQueue.DropPolicy != "" {
+			outboundDropPolicy = config.OutboundQueue.DropPolicy
+		}
+	}
 
-	return &SocketManager{
-		Ws:           ws,
-		MsgType:      websocket.BinaryMessage,
-		RecordsStats: make(map[string]int),
-		StartTime:    time.Now(),
-		UUID:         socketUUID.String(),
+	sm := &SocketManager{
+		Ws:        ws,
+		MsgType:   websocket.BinaryMessage,
+		StartTime: time.Now(),
+		UUID:      socketUUID.String(),
 
-		config:                 config,
-		metricsCollector:       config.MetricCollector,
-		logger:                 logger,
-		requestInfo:            requestLogInfo,
-		writeChan:              make(chan SocketMessage, 1000),
-		stopChan:               make(chan struct{}),
-		requestIdentity:        requestIdentity,
-		transmitDecodedRecords: config.TransmitDecodedRecords,
+		recordPipeline:     newRecordPipeline(requestIdentity, config, logger, socketUUID.String(), traceID),
+		ctx:                ctx,
+		metricsCollector:   config.MetricCollector,
+		requestInfo:        requestLogInfo,
+		writeChan:          make(chan SocketMessage, outboundQueueSize),
+		stopChan:           make(chan struct{}),
+		readTimeout:        config.ReadTimeout(),
+		pingInterval:       config.PingInterval(),
+		pongTimeout:        config.PongTimeout(),
+		idleTimeout:        config.IdleConnectionTimeout(),
+		outboundDropPolicy: outboundDropPolicy,
+		writerDone:         make(chan struct{}),
 	}
+	sm.RecordsStats = sm.recordsStats
+	sm.respond = sm.respondToVehicle
+	sm.nextWriter = func(messageType int) (io.WriteCloser, error) {
+		_ = sm.Ws.SetWriteDeadline(time.Now().Add(WriteLoopDeadline))
+		return sm.Ws.NextWriter(messageType)
+	}
+	if ws != nil {
+		sm.subprotocol = ws.Subprotocol()
+	}
+	return sm
 }
 
-func buildRequestContext(ctx context.Context) (logInfo map[string]interface{}, socketUUID uuid.UUID) {
+func buildRequestContext(ctx context.Context, traceIDHeader string) (logInfo map[string]interface{}, socketUUID uuid.UUID, traceID string) {
 	socketUUID = uuid.New()
-	logInfo = make(map[string]interface{})
+	traceID = uuid.New().String()
+	logInfo = map[string]interface{}{"trace_id": traceID}
 	if ctx == nil {
 		return
 	}
@@ -122,6 +247,11 @@ func buildRequestContext(ctx context.Context) (logInfo map[string]interface{}, s
 		socketUUID = txid
 	}
 
+	if requestTraceID := r.Header.Get(traceIDHeader); validTraceID(requestTraceID) {
+		traceID = requestTraceID
+		logInfo["trace_id"] = traceID
+	}
+
 	logInfo["network_interface"] = r.Header.Get("X-Network-Interface")
 	logInfo["txid"] = txid
 	logInfo["method"] = r.Method
@@ -132,6 +262,25 @@ func buildRequestContext(ctx context.Context) (logInfo map[string]interface{}, s
 	return
 }
 
+// validTraceID returns true if the trace id read from the request is not empty and made of at most maxTraceIDLength
+// printable ascii characters, so that it can be logged and carried in the record metadata as is
+func validTraceID(traceID string) bool {
+	if traceID == "" || len(traceID) > maxTraceIDLength {
+		return false
+	}
+	for i := 0; i < len(traceID); i++ {
+		if traceID[i] <= ' ' || traceID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// TraceID returns the trace id of the connection
+func (sm *SocketManager) TraceID() string {
+	return sm.traceID
+}
+
 // GetNetworkInterface returns value from request headers
 func (sm *SocketManager) GetNetworkInterface() string {
 	networkInterfaceData, ok := sm.requestInfo["network_interface"]
@@ -155,9 +304,70 @@ func (sm *SocketManager) Close() {
 
 	socketMetrics := sm.RecordsStatsToLogInfo()
 	socketMetrics["duration_sec"] = int(time.Since(sm.StartTime) / time.Second) // Result is in nanosecond, converting it to seconds
+	socketMetrics["trace_id"] = sm.traceID
 	sm.logger.ActivityLog("socket_disconnected", socketMetrics)
 }
 
+// CloseWithReason sends a close frame with the code and reason to the client, the connection
+// closes once the client acknowledges it
+func (sm *SocketManager) CloseWithReason(code int, reason string) error {
+	return sm.Ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, truncateCloseReason(reason)), time.Now().Add(closeWriteTimeout))
+}
+
+// truncateCloseReason cuts the reason to maxCloseReasonLength bytes at a rune boundary so it stays valid UTF-8
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReasonLength {
+		return reason
+	}
+	end := maxCloseReasonLength
+	for end > 0 && !utf8.RuneStart(reason[end]) {
+		end--
+	}
+	return reason[:end]
+}
+
+// serverDisconnectReason returns the reason the server closed the connection, empty if the client disconnected
+func (sm *SocketManager) serverDisconnectReason() string {
+	reason, _ := sm.disconnectReason.Load().(string)
+	return reason
+}
+
+// connectivityDisconnectReason returns the reason reported in the disconnected connectivity event, the reason the
+// server closed the connection or else why the read loop ended. It is called once ProcessTelemetry returned
+func (sm *SocketManager) connectivityDisconnectReason() string {
+	if reason := sm.serverDisconnectReason(); reason != "" {
+		return reason
+	}
+	return sm.readEndReason
+}
+
+// deviceType returns the type prefixing the sender id of the device, such as vehicle_device
+func (sm *SocketManager) deviceType() string {
+	if sm.requestIdentity == nil {
+		return "unknown"
+	}
+	deviceType, _, found := strings.Cut(sm.requestIdentity.SenderID, ".")
+	if !found || deviceType == "" {
+		return "unknown"
+	}
+	return deviceType
+}
+
+// Subprotocol returns the wire version negotiated with the client, empty for the legacy format
+func (sm *SocketManager) Subprotocol() string {
+	return sm.subprotocol
+}
+
+// FramesRead returns the number of data frames read from the connection
+func (sm *SocketManager) FramesRead() uint64 {
+	return sm.framesRead.Load()
+}
+
+// BytesRead returns the number of bytes of the data frames read from the connection, before decompression
+func (sm *SocketManager) BytesRead() uint64 {
+	return sm.bytesRead.Load()
+}
+
 // RecordsStatsToLogInfo formats the stats map into a string
 func (sm *SocketManager) RecordsStatsToLogInfo() map[string]interface{} {
 	total := 0
@@ -178,7 +388,15 @@ func (sm *SocketManager) ProcessTelemetry(serializer *telemetry.BinarySerializer
 	}()
 
 	sm.logger.ActivityLog("socket_connected", sm.requestInfo)
+	now := time.Now()
+	sm.lastFrameAt.Store(now.UnixNano())
+	sm.lastReadAt.Store(now.UnixNano())
+	sm.Ws.SetPongHandler(func(string) error {
+		sm.lastReadAt.Store(time.Now().UnixNano())
+		return nil
+	})
 	go sm.writer()
+	go sm.keepDeadlines(now)
 	var rl *rate.RateLimiter
 
 	if sm.config.RateLimit != nil && sm.config.RateLimit.Enabled {
@@ -193,9 +411,29 @@ func (sm *SocketManager) ProcessTelemetry(serializer *telemetry.BinarySerializer
 	// infinite loop until the client disconnects (keep accepting new messages)
 	for {
 		msgType, message, err := sm.Ws.ReadMessage()
-		if err != nil || msgType != sm.MsgType {
+		if err != nil {
+			sm.handleReadError(err)
 			return
 		}
+		if msgType != sm.MsgType {
+			sm.readEndReason = DisconnectReasonUnexpectedMessageType
+			return
+		}
+		now := time.Now().UnixNano()
+		sm.lastFrameAt.Store(now)
+		sm.lastReadAt.Store(now)
+		sm.framesRead.Add(1)
+		sm.bytesRead.Add(uint64(len(message)))
+
+		if sm.deviceRateLimiter != nil && !sm.deviceRateLimiter.allow(sm.rateBucket) {
+			sm.metrics.messagesRateLimitedCount.Inc(map[string]string{"device_type": sm.deviceType()})
+			continue
+		}
+		if sm.decompressor != nil {
+			if message, err = sm.decompress(message); err != nil {
+				continue
+			}
+		}
 
 		// check rate limit
 		if ok, _ := rl.Try(); !ok {
@@ -204,11 +442,12 @@ func (sm *SocketManager) ProcessTelemetry(serializer *telemetry.BinarySerializer
 			}
 			// client exceeded the rate limit
 			messagesRateLimited++
-			record, _ := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
-			metricsRegistry.rateLimitExceededCount.Inc(map[string]string{"device_id": sm.requestIdentity.DeviceID, "txtype": record.TxType})
+			record, err := sm.decodeRecord(serializer, message)
+			sm.metrics.rateLimitExceededCount.Inc(map[string]string{"device_id": sm.requestIdentity.DeviceID, "txtype": record.TxType})
 			if sm.config.RateLimit != nil && sm.config.RateLimit.Enabled {
 				continue
 			}
+			sm.recordCache.add(message, record, err)
 		}
 		if messagesRateLimited > 0 {
 			parts := bytes.Split(message, []byte(","))
@@ -223,56 +462,123 @@ func (sm *SocketManager) ProcessTelemetry(serializer *telemetry.BinarySerializer
 	}
 }
 
-// ParseAndProcessRecord reads incoming client message and dispatches to relevant producer
-func (sm *SocketManager) ParseAndProcessRecord(serializer *telemetry.BinarySerializer, message []byte) {
-	record, err := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
-	logInfo := logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType}
-
-	if err != nil {
-		if err == telemetry.ErrMessageTooBig {
-			sm.respondToVehicle(record, err)
-			metricsRegistry.recordTooBigCount.Inc(map[string]string{})
+// keepDeadlines owns the read deadline of the connection, it pings the connection and ends its read loop once
+// the read, pong or idle timeout expires or the writer exits
+func (sm *SocketManager) keepDeadlines(start time.Time) {
+	keepalive := newKeepalive(sm.readTimeout, sm.pingInterval, sm.pongTimeout, sm.idleTimeout, start)
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	schedule := func(at time.Time) {
+		timerC = nil
+		if at.IsZero() {
 			return
 		}
+		if timer == nil {
+			timer = time.NewTimer(time.Until(at))
+		} else {
+			timer.Reset(time.Until(at))
+		}
+		timerC = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
 
-		switch typedError := err.(type) {
-		case *telemetry.UnauthorizedSenderIDError:
-			logInfo["sender_id"] = typedError.ReceivedSenderID
-			logInfo["expected_sender_id"] = typedError.ExpectedSenderID
-			sm.logger.ErrorLog("unauthorized_sender_id", nil, logInfo)
-			metricsRegistry.unauthorizedSenderCount.Inc(map[string]string{})
-			sm.respondToVehicle(record, nil) // respond to the client message was accepted so they are not resending it over and over
+	_, at := keepalive.next(start, start, start)
+	schedule(at)
+	for {
+		select {
+		case <-sm.stopChan:
 			return
-		case *telemetry.UnknownMessageType:
-			logInfo["msg_txid"] = typedError.Txid
-			logInfo["msg_type"] = string(typedError.GuessedType)
-			sm.logger.ErrorLog("unknown_message_type_error", err, logInfo)
-			metricsRegistry.unknownMessageTypeErrorCount.Inc(map[string]string{"msg_type": string(typedError.GuessedType)})
-			sm.respondToVehicle(record, nil) // respond to the client message was accepted so they are not resending it over and over
-		default:
-			sm.respondToVehicle(record, err)
+		case <-sm.writerDone:
+			// the read loop is ended to close and deregister the connection
+			if err := sm.Ws.SetReadDeadline(time.Now().Add(ReadWriteExitDeadline)); err != nil {
+				sm.logger.ErrorLog("websocket_read_deadline_error", err, nil)
+			}
 			return
+		case <-timerC:
+			// the connection closed by the server is no longer pinged, the writer still ends its read loop
+			if sm.serverDisconnectReason() != "" {
+				timerC = nil
+				continue
+			}
+			action, at := keepalive.next(time.Now(), time.Unix(0, sm.lastReadAt.Load()), time.Unix(0, sm.lastFrameAt.Load()))
+			switch action {
+			case keepalivePing:
+				if err := sm.Ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(WriteLoopDeadline)); err != nil {
+					sm.logger.Log(logrus.DEBUG, "websocket_ping_error", logrus.LogInfo{"socket_id": sm.UUID, "error": err.Error()})
+				}
+			case keepaliveReadTimeout:
+				sm.metrics.readDeadlineCloseCount.Inc(map[string]string{})
+				sm.logger.ActivityLog("websocket_read_deadline_exceeded", logrus.LogInfo{"socket_id": sm.UUID, "read_timeout_sec": int(sm.readTimeout / time.Second)})
+				sm.endRead(DisconnectReasonReadTimeout)
+				return
+			case keepalivePongTimeout:
+				sm.metrics.pongTimeoutCloseCount.Inc(map[string]string{})
+				sm.logger.ActivityLog("websocket_pong_timeout", logrus.LogInfo{"socket_id": sm.UUID, "pong_timeout_sec": int(sm.pongTimeout / time.Second)})
+				sm.endRead(DisconnectReasonPongTimeout)
+				return
+			case keepaliveIdleTimeout:
+				sm.closeIdle()
+				return
+			}
+			schedule(at)
 		}
 	}
+}
 
-	// write the record out to kafka
-	sm.ReportMetricBytesPerRecords(record.TxType, record.Length())
-	sm.processRecord(record)
+// endRead ends the read loop of the connection closed by the server for the given reason
+func (sm *SocketManager) endRead(reason string) {
+	sm.disconnectReason.Store(reason)
+	if err := sm.Ws.SetReadDeadline(time.Now()); err != nil {
+		sm.logger.ErrorLog("websocket_read_deadline_error", err, nil)
+	}
+}
 
-	// respond instantly to the client if we are not doing reliable ACKs
-	if !sm.reliableAck(record) {
-		sm.respondToVehicle(record, nil)
+// closeIdle sends a close frame to the idle connection and ends its read loop without waiting for the client,
+// which may never answer
+func (sm *SocketManager) closeIdle() {
+	sm.disconnectReason.Store(DisconnectReasonIdleTimeout)
+	sm.metrics.idleConnectionsClosedCount.Inc(map[string]string{})
+	sm.logger.ActivityLog("websocket_idle_timeout", logrus.LogInfo{"socket_id": sm.UUID, "idle_timeout_sec": int(sm.idleTimeout / time.Second)})
+	if err := sm.CloseWithReason(websocket.CloseNormalClosure, DisconnectReasonIdleTimeout); err != nil {
+		sm.logger.Log(logrus.DEBUG, "websocket_close_frame_error", logrus.LogInfo{"socket_id": sm.UUID, "error": err.Error()})
+	}
+	if err := sm.Ws.SetReadDeadline(time.Now().Add(closeWriteTimeout)); err != nil {
+		sm.logger.ErrorLog("websocket_read_deadline_error", err, nil)
 	}
 }
 
-func (sm *SocketManager) reliableAck(record *telemetry.Record) bool {
-	_, ok := sm.config.ReliableAckSources[record.TxType]
-	return ok
+// handleReadError records whether the client closed the connection cleanly, the connections closed by the
+// server for a timeout already have their disconnect reason
+func (sm *SocketManager) handleReadError(err error) {
+	sm.readEndReason = DisconnectReasonReadError
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		sm.readEndReason = DisconnectReasonClientClosed
+	}
 }
 
-func (sm *SocketManager) processRecord(record *telemetry.Record) {
-	record.Dispatch()
-	metricsRegistry.dispatchCount.Inc(map[string]string{"record_type": record.TxType})
+// decompress returns the decompressed frame, frames which fail to decompress are counted and dropped
+// without closing the connection
+func (sm *SocketManager) decompress(frame []byte) ([]byte, error) {
+	decompressed, compression, err := sm.decompressor.Decompress(frame)
+	if err != nil {
+		sm.metrics.decompressionErrorCount.Inc(map[string]string{"compression": string(compression)})
+		sm.logger.Log(logrus.DEBUG, "inbound_decompression_error", logrus.LogInfo{"socket_id": sm.UUID, "compression": string(compression), "error": err.Error()})
+	}
+	return decompressed, err
+}
+
+// lastActivity returns the time of the last frame read from the device, or of its connection before any frame
+func (sm *SocketManager) lastActivity() LastSeen {
+	lastSeen := LastSeen{DeviceID: sm.requestIdentity.DeviceID, LastSeen: sm.connectedAt, Event: LastSeenEventConnect}
+	if sm.framesRead.Load() > 0 {
+		lastSeen.LastSeen = time.Unix(0, sm.lastFrameAt.Load())
+		lastSeen.Event = LastSeenEventRecord
+	}
+	return lastSeen
 }
 
 // respondToVehicle sends an ack message to the client to acknowledge that the records have been transmitted
@@ -284,7 +590,7 @@ func (sm *SocketManager) respondToVehicle(record *telemetry.Record, err error) {
 	if err != nil {
 		logInfo["client_id"] = sm.requestIdentity.DeviceID
 		sm.logger.ErrorLog("unexpected_record", err, logInfo)
-		metricsRegistry.unexpectedRecordErrorCount.Inc(map[string]string{})
+		sm.metrics.unexpectedRecordErrorCount.Inc(map[string]string{})
 		response = record.Error(errors.New("incorrect message format"))
 		logInfo["response_type"] = "error"
 	} else {
@@ -293,14 +599,94 @@ func (sm *SocketManager) respondToVehicle(record *telemetry.Record, err error) {
 	}
 
 	sm.logger.Log(logrus.DEBUG, "message_respond", logInfo)
-	sm.writeChan <- SocketMessage{sm.MsgType, response}
+	if err := sm.enqueue(SocketMessage{sm.MsgType, response}); err != nil {
+		// the client resends the records it did not get an ack for
+		logInfo["reason"] = err.Error()
+		sm.logger.Log(logrus.DEBUG, "ack_dropped", logInfo)
+	}
+}
+
+// writesPending returns true while messages are queued to the writer or being written
+func (sm *SocketManager) writesPending() bool {
+	return len(sm.writeChan) > 0 || sm.writing.Load()
+}
+
+// ackReliably queues the ack of a record dispatched by its reliable ack source without blocking, the ack is dropped
+// when the outbound queue of the connection is full so a slow client does not stall the acks of the other connections
+func (sm *SocketManager) ackReliably(record *telemetry.Record) error {
+	logInfo := logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType, "response_type": "ack"}
+	sm.logger.Log(logrus.DEBUG, "message_respond", logInfo)
+	if err := sm.tryEnqueue(SocketMessage{sm.MsgType, record.Ack()}); err != nil {
+		// the client resends the records it did not get an ack for
+		logInfo["reason"] = err.Error()
+		sm.logger.Log(logrus.DEBUG, "ack_dropped", logInfo)
+		return err
+	}
+	return nil
+}
+
+// Push queues a message written to the client by the writer of the connection, after the messages already queued.
+// It returns an error if the connection is closing or the message was dropped by the drop policy of the queue
+func (sm *SocketManager) Push(msgType int, msg []byte) error {
+	return sm.enqueue(SocketMessage{msgType, msg})
+}
+
+// enqueue queues a message to the writer, the drop policy of the outbound queue applies while it is full
+func (sm *SocketManager) enqueue(msg SocketMessage) error {
+	sm.metrics.outboundQueueDepth.Observe(int64(len(sm.writeChan)), map[string]string{})
+	dropping := sm.outboundDropPolicy == config.OutboundDropNewest || sm.outboundDropPolicy == config.OutboundDropOldest
+	if !dropping {
+		select {
+		case sm.writeChan <- msg:
+			return nil
+		case <-sm.writerDone:
+			return errWriterDone
+		}
+	}
+
+	select {
+	case <-sm.writerDone:
+		return errWriterDone
+	default:
+	}
+	for {
+		select {
+		case sm.writeChan <- msg:
+			return nil
+		default:
+		}
+		if sm.outboundDropPolicy == config.OutboundDropNewest {
+			sm.metrics.outboundDroppedCount.Inc(map[string]string{"policy": string(sm.outboundDropPolicy)})
+			return errOutboundQueueFull
+		}
+		select {
+		case <-sm.writeChan:
+			sm.metrics.outboundDroppedCount.Inc(map[string]string{"policy": string(sm.outboundDropPolicy)})
+		default:
+		}
+	}
+}
+
+// tryEnqueue queues a message to the writer unless the outbound queue is full, regardless of its drop policy
+func (sm *SocketManager) tryEnqueue(msg SocketMessage) error {
+	sm.metrics.outboundQueueDepth.Observe(int64(len(sm.writeChan)), map[string]string{})
+	select {
+	case <-sm.writerDone:
+		return errWriterDone
+	default:
+	}
+	select {
+	case sm.writeChan <- msg:
+		return nil
+	default:
+		return errOutboundQueueFull
+	}
 }
 
 func (sm *SocketManager) writer() {
 	defer func() {
-
 		sm.logger.Log(logrus.DEBUG, "writer_done", nil)
-		_ = sm.Ws.SetReadDeadline(time.Now().Add(ReadWriteExitDeadline))
+		close(sm.writerDone)
 	}()
 
 	for {
@@ -308,87 +694,347 @@ func (sm *SocketManager) writer() {
 		case <-sm.stopChan:
 			sm.logger.Log(logrus.DEBUG, "return_stop_chan", nil)
 			return
+		case <-sm.ctx.Done():
+			// the read deadline set once the writer exits interrupts the read loop, which closes and deregisters the connection
+			sm.disconnectReason.Store(DisconnectReasonShutdown)
+			return
 		case msg := <-sm.writeChan:
-			err := sm.writeMessage(msg.MsgType, msg.Msg)
+			sm.writing.Store(true)
+			err := sm.writeAck(msg)
+			sm.writing.Store(false)
 			if err != nil {
-				metricsRegistry.socketErrorCount.Inc(map[string]string{})
-				sm.logger.ErrorLog("socket_err", err, nil)
+				sm.failAck(err)
 				return
 			}
 		}
 	}
 }
 
-func (sm *SocketManager) writeMessage(msgType int, msg []byte) error {
+// partialWriteError is returned when an ack failed after part of it was handed to the connection
+type partialWriteError struct {
+	written int
+	err     error
+}
+
+func (e *partialWriteError) Error() string {
+	return fmt.Sprintf("ack failed after %d bytes: %v", e.written, e.err)
+}
+
+func (e *partialWriteError) Unwrap() error {
+	return e.err
+}
+
+// writeAck writes an ack to the websocket
+func (sm *SocketManager) writeAck(msg SocketMessage) error {
+	sm.writeMutex.Lock()
+	defer sm.writeMutex.Unlock()
+
+	w, err := sm.nextWriter(msg.MsgType)
+	if err != nil {
+		return err
+	}
+	written, err := w.Write(msg.Msg)
+	if err != nil {
+		_ = w.Close()
+		return &partialWriteError{written: written, err: err}
+	}
+	if err := w.Close(); err != nil {
+		return &partialWriteError{written: written, err: err}
+	}
+	return nil
+}
+
+// failAck reports an ack that could not be written, the connection is left in an unknown state
+// so it is closed once the writer exits and the client resends the records it did not get an ack for
+func (sm *SocketManager) failAck(err error) {
+	cause := ackWriteErrorCause(err)
+	sm.metrics.socketErrorCount.Inc(map[string]string{})
+	sm.metrics.ackWriteErrorCount.Inc(map[string]string{"cause": cause})
+	sm.logger.ErrorLog("socket_err", err, logrus.LogInfo{"cause": cause})
+	sm.disconnectReason.CompareAndSwap(nil, DisconnectReasonAckWriteFailed)
+}
+
+// ackWriteErrorCause returns the cause label of an ack write error
+func ackWriteErrorCause(err error) string {
+	var netErr net.Error
+	var partialErr *partialWriteError
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.As(err, &partialErr) && partialErr.written > 0:
+		return "partial_write"
+	default:
+		return "error"
+	}
+}
+
+// WriteMessage writes a message to the websocket, gorilla connections support a single
+// concurrent writer so every write to the connection must go through this method
+func (sm *SocketManager) WriteMessage(msgType int, msg []byte) error {
+	sm.writeMutex.Lock()
+	defer sm.writeMutex.Unlock()
+
 	_ = sm.Ws.SetWriteDeadline(time.Now().Add(WriteLoopDeadline))
 	return sm.Ws.WriteMessage(msgType, msg)
 }
 
 // ReportMetricBytesPerRecords records metrics for metric size
-func (sm SocketManager) ReportMetricBytesPerRecords(recordType string, byteSize int) {
-	sm.RecordsStats[recordType] += byteSize
-
-	metricsRegistry.recordSizeBytesTotal.Add(int64(byteSize), map[string]string{"record_type": recordType})
-	metricsRegistry.recordCount.Inc(map[string]string{"record_type": recordType})
+func (sm *SocketManager) ReportMetricBytesPerRecords(recordType string, byteSize int) {
+	sm.reportRecordSize(recordType, byteSize)
 }
 
-func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
-	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+// socketMetricsFor returns the socket metrics registered against the collector, they are registered on first use
+func socketMetricsFor(metricsCollector metrics.MetricCollector) *Metrics {
+	socketMetricsMutex.Lock()
+	defer socketMetricsMutex.Unlock()
+
+	if registered, ok := socketMetrics[metricsCollector]; ok {
+		return registered
+	}
+	registered := newSocketMetrics(metricsCollector)
+	socketMetrics[metricsCollector] = registered
+	return registered
 }
 
-func registerMetrics(metricsCollector metrics.MetricCollector) {
-	metricsRegistry.rateLimitExceededCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+func newSocketMetrics(metricsCollector metrics.MetricCollector) *Metrics {
+	socketMetrics := &Metrics{}
+
+	socketMetrics.rateLimitExceededCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "rate_limit_exceeded_total",
 		Help:   "The number of times a client has been rate limited.",
 		Labels: []string{"device_id", "txtype"},
 	})
 
-	metricsRegistry.recordTooBigCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.messagesRateLimitedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "messages_rate_limited_total",
+		Help:   "The number of messages dropped as their device exceeded its rate.",
+		Labels: []string{"device_type"},
+	})
+
+	socketMetrics.recordTooBigCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "record_too_big_total",
 		Help:   "The number of times the record was too large.",
 		Labels: []string{},
 	})
 
-	metricsRegistry.unauthorizedSenderCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.unauthorizedSenderCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "unauthorized_sender_id_total",
 		Help:   "The number of times the sender was not authorized.",
 		Labels: []string{},
 	})
 
-	metricsRegistry.unknownMessageTypeErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.unknownMessageTypeErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "unknown_message_type_error_total",
 		Help:   "The number of times the message type was not known.",
 		Labels: []string{"msg_type"},
 	})
 
-	metricsRegistry.dispatchCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.dispatchCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "dispatch_total",
 		Help:   "The number of records dispatched.",
 		Labels: []string{"record_type"},
 	})
 
-	metricsRegistry.unexpectedRecordErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.outboundQueueDepth = metricsCollector.RegisterHistogram(adapter.CollectorOptions{
+		Name:    "outbound_queue_depth",
+		Help:    "The number of messages already queued to the writer of a connection when a message is queued.",
+		Labels:  []string{},
+		Buckets: outboundQueueDepthBuckets,
+	})
+
+	socketMetrics.outboundDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "outbound_queue_dropped_total",
+		Help:   "The number of messages dropped from the full outbound queue of a connection, by drop policy.",
+		Labels: []string{"policy"},
+	})
+
+	socketMetrics.decompressionErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "inbound_decompression_error_total",
+		Help:   "The number of frames dropped because they failed to decompress, by compression.",
+		Labels: []string{"compression"},
+	})
+
+	socketMetrics.unexpectedRecordErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "unexpected_record_err_total",
 		Help:   "The number of unexpected records received.",
 		Labels: []string{},
 	})
 
-	metricsRegistry.socketErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.socketErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "socket_err_total",
 		Help:   "The number of socket errors.",
 		Labels: []string{},
 	})
 
-	metricsRegistry.recordSizeBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.ackWriteErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "ack_write_error_total",
+		Help:   "The number of acks that failed to be written, closing their connection.",
+		Labels: []string{"cause"},
+	})
+
+	socketMetrics.recordSizeBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "record_size_bytes_total",
 		Help:   "The total number of record bytes processed.",
 		Labels: []string{"record_type"},
 	})
 
-	metricsRegistry.recordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+	socketMetrics.recordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "record_total",
 		Help:   "The number of records processed.",
 		Labels: []string{"record_type"},
 	})
 
+	socketMetrics.decodeDeadLetterCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "decode_dead_letter_total",
+		Help:   "The number of messages which failed to decode dispatched to the decode dead-letter topic, by record type when known.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.decodeDeadLetterLimitedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "decode_dead_letter_rate_limited_total",
+		Help:   "The number of messages which failed to decode not dispatched to the decode dead-letter topic for exceeding its rate, by record type when known.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.missingTopicCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "missing_topic_total",
+		Help:   "The number of records received without a topic.",
+		Labels: []string{"action"},
+	})
+
+	socketMetrics.unchangedRecordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "unchanged_record_suppressed_total",
+		Help:   "The number of records not dispatched because their signals did not change.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.recordCacheHitCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "record_cache_hit_total",
+		Help:   "The number of decoded records reused from the cache.",
+		Labels: []string{},
+	})
+
+	socketMetrics.recordCacheMissCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "record_cache_miss_total",
+		Help:   "The number of records decoded because they were not cached.",
+		Labels: []string{},
+	})
+
+	socketMetrics.recordCacheEvictionCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "record_cache_eviction_total",
+		Help:   "The number of decoded records evicted from the cache.",
+		Labels: []string{"reason"},
+	})
+
+	socketMetrics.regionDispatchCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "region_dispatch_total",
+		Help:   "The number of records dispatched per device region, unknown regions use the default dispatchers.",
+		Labels: []string{"region", "record_type"},
+	})
+
+	socketMetrics.unknownFieldsCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "unknown_fields_total",
+		Help:   "The number of records carrying proto fields unknown to the server, nested fields are only inspected for the record types discarding them.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.partialOutageDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "partial_outage_dropped_total",
+		Help:   "The number of records dropped because they are dispatched to an unhealthy dispatcher.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.sequenceErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "sequence_error_total",
+		Help:   "The number of records dispatched without sequence number because the sequence source failed.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.compressionBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "compression_bytes_total",
+		Help:   "The number of payload bytes before and after compression.",
+		Labels: []string{"record_type", "stage"},
+	})
+
+	socketMetrics.compressionCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "compression_total",
+		Help:   "The number of compressed payloads, and of payloads dispatched uncompressed because compression was ineffective.",
+		Labels: []string{"record_type", "compressed"},
+	})
+
+	socketMetrics.transformCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "transform_total",
+		Help:   "The number of records rewritten by their transform rules.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.transformErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "transform_error_total",
+		Help:   "The number of records dispatched unchanged because their transform rules failed.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.gatewayRecordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "gateway_record_total",
+		Help:   "The number of records received from gateways, by device and whether they were forwarded for another device.",
+		Labels: []string{"gateway", "device_id", "forwarded"},
+	})
+
+	socketMetrics.readDeadlineCloseCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "read_deadline_close_total",
+		Help:   "The number of connections closed because nothing was received before the read deadline.",
+		Labels: []string{},
+	})
+
+	socketMetrics.pongTimeoutCloseCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "pong_timeout_close_total",
+		Help:   "The number of connections closed because no pong was received after a ping.",
+		Labels: []string{},
+	})
+
+	socketMetrics.idleConnectionsClosedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "idle_connections_closed_total",
+		Help:   "The number of connections closed because no message was received within the idle timeout.",
+		Labels: []string{},
+	})
+
+	socketMetrics.messageTransformCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "message_transform_total",
+		Help:   "The number of records transformed by the message transformers registered in code.",
+		Labels: []string{"record_type"},
+	})
+
+	socketMetrics.messageTransformErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "message_transform_error_total",
+		Help:   "The number of records whose message transformers failed, by failure policy.",
+		Labels: []string{"record_type", "policy"},
+	})
+
+	socketMetrics.connectionEventDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connection_event_dropped_total",
+		Help:   "The number of connection events dropped because a subscriber fell behind.",
+		Labels: []string{},
+	})
+
+	socketMetrics.sessionStoreErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "session_store_error_total",
+		Help:   "The number of failed reads and writes of the session store.",
+		Labels: []string{"operation"},
+	})
+
+	socketMetrics.connectionStoreErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "connection_store_error_total",
+		Help:   "The number of failed writes of the connection store of the last will.",
+		Labels: []string{"operation"},
+	})
+
+	socketMetrics.fieldPresenceCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "field_presence_total",
+		Help:   "The number of records in which the configured fields are populated or absent.",
+		Labels: []string{"record_type", "field", "present"},
+	})
+
+	return socketMetrics
 }
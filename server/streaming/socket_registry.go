@@ -1,39 +1,232 @@
 package streaming
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
-// SocketRegistry is a library to handle keeping track of connected sockets
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
+)
+
+// ConnectionEventType is the type of a connection event
+type ConnectionEventType string
+
+const (
+	// Connected is emitted when a socket registers
+	Connected ConnectionEventType = "connected"
+	// Disconnected is emitted when a socket deregisters
+	Disconnected ConnectionEventType = "disconnected"
+)
+
+// ConnectionEvent describes a socket connecting or disconnecting
+type ConnectionEvent struct {
+	Type     ConnectionEventType
+	SocketID string
+	DeviceID string
+	Time     time.Time
+}
+
+// knownNetworkInterfaces are the network interfaces labeling active_connections, the others are labeled other to
+// bound the cardinality of the metric
+var knownNetworkInterfaces = map[string]struct{}{
+	"wifi":     {},
+	"cellular": {},
+	"ethernet": {},
+}
+
+// SocketInfo describes a connected socket
+type SocketInfo struct {
+	DeviceID         string    `json:"device_id"`
+	ConnectionID     string    `json:"connection_id"`
+	NetworkInterface string    `json:"network_interface"`
+	ConnectedAt      time.Time `json:"connected_at"`
+}
+
+// SocketRegistry is a library to handle keeping track of connected sockets, it is safe for concurrent use by the
+// connections registering and the ack workers looking up their sockets
 type SocketRegistry struct {
-	mutex   sync.RWMutex
-	sockets map[string]*SocketManager
-	counter int
+	mutex       sync.RWMutex
+	sockets     map[string]*SocketManager
+	counter     int
+	subscribers map[chan ConnectionEvent]struct{}
+	store       sessionstore.Store
+	// connections durably keeps the registered sockets, nil when the last will of the server is disabled
+	connections sessionstore.ConnectionStore
+	// admitted counts the connections admitted and not yet closed, including those still upgrading
+	admitted atomic.Int64
+	// churn counts the sockets registered and deregistered, nil when the connection churn is not reported
+	churn adapter.Counter
+	// activeConnections counts the registered sockets by device type and network interface, nil when not reported
+	activeConnections adapter.Gauge
 }
 
 // NewSocketRegistry returns an empty socket registry
 func NewSocketRegistry() *SocketRegistry {
 	return &SocketRegistry{
-		sockets: make(map[string]*SocketManager),
+		sockets:     make(map[string]*SocketManager),
+		subscribers: make(map[chan ConnectionEvent]struct{}),
 	}
 }
 
-// RegisterSocket registers a new socket
+// SetSessionStore persists the sessions of the sockets to the store, it must be called before sockets register
+func (s *SocketRegistry) SetSessionStore(store sessionstore.Store) {
+	s.store = store
+}
+
+// SetConnectionStore keeps the registered sockets in the store, it must be called before sockets register and
+// once the connections left in the store by the previous run were reconciled
+func (s *SocketRegistry) SetConnectionStore(store sessionstore.ConnectionStore) {
+	s.connections = store
+}
+
+// NumAdmittedConnections returns the number of connections admitted by max_connections and not yet closed. Unlike
+// NumConnectedSockets, it includes the connections still upgrading or identifying which are not registered yet
+func (s *SocketRegistry) NumAdmittedConnections() int {
+	return int(s.admitted.Load())
+}
+
+// admit counts a new connection unless maxConnections are already admitted, connections are unlimited when 0
+func (s *SocketRegistry) admit(maxConnections int) bool {
+	for {
+		admitted := s.admitted.Load()
+		if maxConnections > 0 && admitted >= int64(maxConnections) {
+			return false
+		}
+		if s.admitted.CompareAndSwap(admitted, admitted+1) {
+			return true
+		}
+	}
+}
+
+// release uncounts a closed connection previously admitted
+func (s *SocketRegistry) release() {
+	s.admitted.Add(-1)
+}
+
+// RegisterSocket registers a new socket, the previous session of the device is loaded from the session store
 func (s *SocketRegistry) RegisterSocket(socket *SocketManager) {
+	s.loadSession(socket)
+	s.addConnection(socket)
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	socket.connectedAt = time.Now()
 	s.sockets[socket.UUID] = socket
 	s.counter++
+	s.publish(connectionEvent(Connected, socket, socket.connectedAt), socket.metrics)
+	if s.churn != nil {
+		s.churn.Inc(map[string]string{"device_type": socket.deviceType(), "event": string(Connected)})
+	}
+	if s.activeConnections != nil {
+		s.activeConnections.Inc(activeConnectionLabels(socket))
+	}
 }
 
-// DeregisterSocket removes a disconnecting socket
+// DeregisterSocket removes a disconnecting socket, its session is saved to the session store
 func (s *SocketRegistry) DeregisterSocket(socket *SocketManager) {
+	s.saveSession(socket, time.Now())
+	s.removeConnection(socket)
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if _, ok := s.sockets[socket.UUID]; ok && s.activeConnections != nil {
+		s.activeConnections.Sub(1, activeConnectionLabels(socket))
+	}
 	delete(s.sockets, socket.UUID)
 	if s.counter > 0 {
 		s.counter--
 	}
+	disconnectedAt := time.Now()
+	s.publish(connectionEvent(Disconnected, socket, disconnectedAt), socket.metrics)
+	if s.churn != nil {
+		s.churn.Inc(map[string]string{"device_type": socket.deviceType(), "event": string(Disconnected)})
+	}
+}
+
+// activeConnectionLabels returns the labels of the socket in active_connections
+func activeConnectionLabels(socket *SocketManager) adapter.Labels {
+	networkInterface := socket.GetNetworkInterface()
+	if networkInterface == "" {
+		networkInterface = "unknown"
+	} else if _, ok := knownNetworkInterfaces[networkInterface]; !ok {
+		networkInterface = "other"
+	}
+	return adapter.Labels{"device_type": socket.deviceType(), "network_interface": networkInterface}
+}
+
+// addConnection keeps the socket in the connection store, failures are reported and the socket is not reported
+// disconnected should the server die
+func (s *SocketRegistry) addConnection(socket *SocketManager) {
+	if s.connections == nil || socket.requestIdentity == nil {
+		return
+	}
+	err := s.connections.Add(&sessionstore.Connection{
+		DeviceID:         socket.requestIdentity.DeviceID,
+		SocketID:         socket.UUID,
+		SenderID:         socket.requestIdentity.SenderID,
+		Region:           socket.requestIdentity.Region,
+		NetworkInterface: socket.GetNetworkInterface(),
+		TraceID:          socket.traceID,
+		ConnectedAt:      socket.StartTime,
+	})
+	if err != nil {
+		socket.metrics.connectionStoreErrorCount.Inc(map[string]string{"operation": "add"})
+		socket.logger.ErrorLog("connection_store_add_error", err, logrus.LogInfo{"device_id": socket.requestIdentity.DeviceID})
+	}
+}
+
+// removeConnection forgets the socket in the connection store, failures are reported and the socket is reported
+// disconnected again by the next run of the server
+func (s *SocketRegistry) removeConnection(socket *SocketManager) {
+	if s.connections == nil || socket.requestIdentity == nil {
+		return
+	}
+	if err := s.connections.Remove(socket.UUID); err != nil {
+		socket.metrics.connectionStoreErrorCount.Inc(map[string]string{"operation": "remove"})
+		socket.logger.ErrorLog("connection_store_remove_error", err, logrus.LogInfo{"device_id": socket.requestIdentity.DeviceID})
+	}
+}
+
+// loadSession sets the previous session of the device of the socket and saves the new one,
+// failures are reported and the socket continues without previous session
+func (s *SocketRegistry) loadSession(socket *SocketManager) {
+	if s.store == nil || socket.requestIdentity == nil {
+		return
+	}
+	previous, err := s.store.Load(socket.requestIdentity.DeviceID)
+	if err != nil {
+		socket.metrics.sessionStoreErrorCount.Inc(map[string]string{"operation": "load"})
+		socket.logger.ErrorLog("session_store_load_error", err, logrus.LogInfo{"device_id": socket.requestIdentity.DeviceID})
+	}
+	socket.previousSession = previous
+	s.saveSession(socket, time.Time{})
+}
+
+// saveSession stores the session of the socket, disconnectedAt is zero while the socket is connected
+func (s *SocketRegistry) saveSession(socket *SocketManager, disconnectedAt time.Time) {
+	if s.store == nil || socket.requestIdentity == nil {
+		return
+	}
+	session := &sessionstore.Session{
+		DeviceID:       socket.requestIdentity.DeviceID,
+		SocketID:       socket.UUID,
+		KeyFingerprint: socket.requestIdentity.KeyFingerprint,
+		LastSequence:   socket.lastSequence.Load(),
+		ConnectedAt:    socket.StartTime,
+		DisconnectedAt: disconnectedAt,
+	}
+	if session.LastSequence == 0 && socket.previousSession != nil {
+		session.LastSequence = socket.previousSession.LastSequence
+	}
+	if err := s.store.Save(session); err != nil {
+		socket.metrics.sessionStoreErrorCount.Inc(map[string]string{"operation": "save"})
+		socket.logger.ErrorLog("session_store_save_error", err, logrus.LogInfo{"device_id": session.DeviceID})
+	}
 }
 
 // GetSocket returns a socket if connected
@@ -44,6 +237,35 @@ func (s *SocketRegistry) GetSocket(uuid string) *SocketManager {
 	return s.sockets[uuid]
 }
 
+// connectedSockets returns the sockets currently connected
+func (s *SocketRegistry) connectedSockets() []*SocketManager {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sockets := make([]*SocketManager, 0, len(s.sockets))
+	for _, socket := range s.sockets {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+// ListSockets returns a snapshot of the connected sockets, oldest connection first
+func (s *SocketRegistry) ListSockets() []SocketInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sockets := make([]SocketInfo, 0, len(s.sockets))
+	for _, socket := range s.sockets {
+		info := SocketInfo{ConnectionID: socket.UUID, NetworkInterface: socket.GetNetworkInterface(), ConnectedAt: socket.connectedAt}
+		if socket.requestIdentity != nil {
+			info.DeviceID = socket.requestIdentity.DeviceID
+		}
+		sockets = append(sockets, info)
+	}
+	sort.Slice(sockets, func(i, j int) bool { return sockets[i].ConnectedAt.Before(sockets[j].ConnectedAt) })
+	return sockets
+}
+
 // NumConnectedSockets returns the number of connected sockets
 func (s *SocketRegistry) NumConnectedSockets() int {
 	s.mutex.RLock()
@@ -51,3 +273,48 @@ func (s *SocketRegistry) NumConnectedSockets() int {
 
 	return s.counter
 }
+
+// Subscribe returns a Connected event for every socket currently connected followed by the live connection
+// events, and a function cancelling the subscription. Events are dropped when the subscriber falls behind by
+// more than buffer events.
+func (s *SocketRegistry) Subscribe(buffer int) (<-chan ConnectionEvent, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events := make(chan ConnectionEvent, len(s.sockets)+buffer)
+	for _, socket := range s.sockets {
+		events <- connectionEvent(Connected, socket, socket.StartTime)
+	}
+	s.subscribers[events] = struct{}{}
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+
+			delete(s.subscribers, events)
+			close(events)
+		})
+	}
+}
+
+// publish sends the event to the subscribers without blocking, events dropped are counted in the metrics of the socket.
+// It must be called with the mutex held
+func (s *SocketRegistry) publish(event ConnectionEvent, metrics *Metrics) {
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			metrics.connectionEventDroppedCount.Inc(map[string]string{})
+		}
+	}
+}
+
+func connectionEvent(eventType ConnectionEventType, socket *SocketManager, eventTime time.Time) ConnectionEvent {
+	event := ConnectionEvent{Type: eventType, SocketID: socket.UUID, Time: eventTime}
+	if socket.requestIdentity != nil {
+		event.DeviceID = socket.requestIdentity.DeviceID
+	}
+	return event
+}
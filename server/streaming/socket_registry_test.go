@@ -0,0 +1,243 @@
+package streaming
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/sessionstore"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Socket registry", func() {
+	var (
+		registry      *SocketRegistry
+		socketMetrics *Metrics
+	)
+
+	BeforeEach(func() {
+		socketMetrics = socketMetricsFor(noop.NewCollector())
+		registry = NewSocketRegistry()
+	})
+
+	newSocket := func(uuid string, deviceID string) *SocketManager {
+		return &SocketManager{
+			UUID:      uuid,
+			StartTime: time.Now(),
+			recordPipeline: recordPipeline{
+				requestIdentity: &telemetry.RequestIdentity{DeviceID: deviceID},
+				metrics:         socketMetrics,
+			},
+		}
+	}
+
+	It("sends connected sockets then live events to subscribers", func() {
+		registry.RegisterSocket(newSocket("socket-1", "device-1"))
+
+		events, cancel := registry.Subscribe(10)
+		defer cancel()
+
+		Expect(<-events).To(MatchFields(IgnoreExtras, Fields{"Type": Equal(Connected), "SocketID": Equal("socket-1"), "DeviceID": Equal("device-1")}))
+
+		socket := newSocket("socket-2", "device-2")
+		registry.RegisterSocket(socket)
+		registry.DeregisterSocket(socket)
+		Expect(<-events).To(MatchFields(IgnoreExtras, Fields{"Type": Equal(Connected), "SocketID": Equal("socket-2")}))
+		Expect(<-events).To(MatchFields(IgnoreExtras, Fields{"Type": Equal(Disconnected), "SocketID": Equal("socket-2")}))
+	})
+
+	It("drops events when the subscriber falls behind", func() {
+		events, cancel := registry.Subscribe(1)
+		defer cancel()
+
+		registry.RegisterSocket(newSocket("socket-1", "device-1"))
+		registry.RegisterSocket(newSocket("socket-2", "device-2"))
+
+		Expect(<-events).To(MatchFields(IgnoreExtras, Fields{"SocketID": Equal("socket-1")}))
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("closes the events once cancelled", func() {
+		events, cancel := registry.Subscribe(1)
+		cancel()
+		cancel()
+
+		Eventually(events).Should(BeClosed())
+		registry.RegisterSocket(newSocket("socket-1", "device-1"))
+	})
+
+	It("lists the connected sockets", func() {
+		first := newSocket("socket-1", "device-1")
+		first.requestInfo = map[string]interface{}{"network_interface": "wifi"}
+		registry.RegisterSocket(first)
+		second := newSocket("socket-2", "device-2")
+		second.requestInfo = map[string]interface{}{}
+		registry.RegisterSocket(second)
+		registry.DeregisterSocket(second)
+
+		sockets := registry.ListSockets()
+		Expect(sockets).To(HaveLen(1))
+		Expect(sockets[0]).To(MatchFields(IgnoreExtras, Fields{
+			"DeviceID":         Equal("device-1"),
+			"ConnectionID":     Equal("socket-1"),
+			"NetworkInterface": Equal("wifi"),
+			"ConnectedAt":      Not(BeZero()),
+		}))
+	})
+
+	It("counts the active connections by device type and network interface", func() {
+		gauge := &labelGauge{values: make(map[string]int64)}
+		registry.activeConnections = gauge
+
+		sockets := map[string]string{"socket-1": "wifi", "socket-2": "satellite", "socket-3": ""}
+		for uuid, networkInterface := range sockets {
+			socket := newSocket(uuid, uuid)
+			socket.requestIdentity.SenderID = "vehicle_device." + uuid
+			socket.requestInfo = map[string]interface{}{"network_interface": networkInterface}
+			registry.RegisterSocket(socket)
+			if uuid == "socket-1" {
+				registry.DeregisterSocket(socket)
+				registry.DeregisterSocket(socket)
+			}
+		}
+		Expect(gauge.values).To(Equal(map[string]int64{
+			"vehicle_device/wifi":    0,
+			"vehicle_device/other":   1,
+			"vehicle_device/unknown": 1,
+		}))
+	})
+
+	It("counts the connections opened and closed by device type", func() {
+		churn := &churnCounter{counts: make(map[string]int64)}
+		registry.churn = churn
+
+		vehicle := newSocket("socket-1", "device-1")
+		vehicle.requestIdentity.SenderID = "vehicle_device.device-1"
+		energy := newSocket("socket-2", "device-2")
+		energy.requestIdentity.SenderID = "energy_device.device-2"
+		registry.RegisterSocket(vehicle)
+		registry.RegisterSocket(energy)
+		registry.DeregisterSocket(vehicle)
+		Expect(churn.counts).To(Equal(map[string]int64{
+			"vehicle_device/connected":    1,
+			"vehicle_device/disconnected": 1,
+			"energy_device/connected":     1,
+		}))
+	})
+
+	It("loads and saves the sessions of the sockets", func() {
+		store := &memorySessionStore{sessions: map[string]*sessionstore.Session{
+			"device-1": {DeviceID: "device-1", SocketID: "socket-0", LastSequence: 42},
+		}}
+		registry.SetSessionStore(store)
+
+		socket := newSocket("socket-1", "device-1")
+		registry.RegisterSocket(socket)
+		Expect(socket.previousSession).To(PointTo(MatchFields(IgnoreExtras, Fields{"SocketID": Equal("socket-0")})))
+		Expect(store.sessions["device-1"]).To(PointTo(MatchFields(IgnoreExtras, Fields{
+			"SocketID":       Equal("socket-1"),
+			"LastSequence":   Equal(uint64(42)),
+			"DisconnectedAt": BeZero(),
+		})))
+
+		socket.lastSequence.Store(43)
+		registry.DeregisterSocket(socket)
+		Expect(store.sessions["device-1"]).To(PointTo(MatchFields(IgnoreExtras, Fields{
+			"LastSequence":   Equal(uint64(43)),
+			"DisconnectedAt": Not(BeZero()),
+		})))
+	})
+
+	It("registers sockets when the session store fails", func() {
+		registry.SetSessionStore(&memorySessionStore{err: errors.New("unavailable")})
+
+		socket := newSocket("socket-1", "device-1")
+		socket.logger, _ = logrus.NoOpLogger()
+		registry.RegisterSocket(socket)
+		Expect(socket.previousSession).To(BeNil())
+		Expect(registry.NumConnectedSockets()).To(Equal(1))
+		registry.DeregisterSocket(socket)
+		Expect(registry.NumConnectedSockets()).To(Equal(0))
+	})
+
+	It("admits concurrent connections up to the limit", func() {
+		var wg sync.WaitGroup
+		var admitted atomic.Int32
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if registry.admit(10) {
+					admitted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(admitted.Load()).To(BeEquivalentTo(10))
+		Expect(registry.NumAdmittedConnections()).To(Equal(10))
+
+		registry.release()
+		Expect(registry.NumAdmittedConnections()).To(Equal(9))
+		Expect(registry.admit(10)).To(BeTrue())
+		Expect(registry.admit(0)).To(BeTrue())
+		Expect(registry.NumAdmittedConnections()).To(Equal(11))
+	})
+})
+
+// memorySessionStore keeps the sessions in memory, failing every request when err is set
+type memorySessionStore struct {
+	sessions map[string]*sessionstore.Session
+	err      error
+}
+
+func (s *memorySessionStore) Load(deviceID string) (*sessionstore.Session, error) {
+	return s.sessions[deviceID], s.err
+}
+
+func (s *memorySessionStore) Save(session *sessionstore.Session) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sessions[session.DeviceID] = session
+	return nil
+}
+
+func (s *memorySessionStore) Close() error {
+	return nil
+}
+
+// labelGauge keeps the values of the gauge by device type and network interface
+type labelGauge struct {
+	values map[string]int64
+}
+
+func (g *labelGauge) Add(value int64, labels adapter.Labels) {
+	g.values[labels["device_type"]+"/"+labels["network_interface"]] += value
+}
+
+func (g *labelGauge) Sub(value int64, labels adapter.Labels) { g.Add(-value, labels) }
+
+func (g *labelGauge) Inc(labels adapter.Labels) { g.Add(1, labels) }
+
+func (g *labelGauge) Set(value int64, labels adapter.Labels) {
+	g.values[labels["device_type"]+"/"+labels["network_interface"]] = value
+}
+
+// churnCounter keeps the counts of the connection churn by device type and event
+type churnCounter struct {
+	counts map[string]int64
+}
+
+func (c *churnCounter) Add(value int64, labels adapter.Labels) {
+	c.counts[labels["device_type"]+"/"+labels["event"]] += value
+}
+
+func (c *churnCounter) Inc(labels adapter.Labels) { c.Add(1, labels) }
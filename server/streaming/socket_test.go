@@ -3,6 +3,12 @@ package streaming_test
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -130,6 +136,41 @@ var _ = Describe("Socket test", func() {
 			Expect(string(streamMessage.MessageTopic)).To(Equal("canlogs"))
 		})
 
+		It("dispatches messages failing to decode to the decode dead-letter topic", func() {
+			deadLetters := &recordingProducer{records: make(chan *telemetry.Record, 1)}
+			conf.DecodeDeadLetterTopic = "dead_letters"
+			serializer = telemetry.NewBinarySerializer(requestIdentity, map[string][]telemetry.Producer{"V": nil, "dead_letters": {deadLetters}}, logger)
+			record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: []byte{0xff}}
+			recordMsg, err := record.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			sm.ParseAndProcessRecord(serializer, recordMsg)
+			msg := sm.ListenToWriteChannel()
+			streamMessage, err := messages.StreamMessageFromBytes(msg.Msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(streamMessage.Payload)).To(Equal("incorrect message format"))
+
+			var deadLetter *telemetry.Record
+			Expect(deadLetters.records).To(Receive(&deadLetter))
+			Expect(deadLetter.Payload()).To(Equal(recordMsg))
+			Expect(deadLetter.Metadata()).To(HaveKeyWithValue("txtype", "dead_letters"))
+			Expect(deadLetter.Metadata()).To(HaveKeyWithValue("failed_txtype", "V"))
+			Expect(deadLetter.Metadata()).To(HaveKey("decode_error"))
+			Expect(deadLetter.Metadata()).To(HaveKeyWithValue("trace_id", sm.TraceID()))
+		})
+
+		It("rejects record without topic", func() {
+			record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), Payload: []byte("data")}
+			recordMsg, err := record.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			sm.ParseAndProcessRecord(serializer, recordMsg)
+			msg := sm.ListenToWriteChannel()
+			streamMessage, err := messages.StreamMessageFromBytes(msg.Msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(streamMessage.Payload)).To(Equal("incorrect message format"))
+		})
+
 		It("empty network interface", func() {
 			Expect(sm.GetNetworkInterface()).To(BeEmpty())
 		})
@@ -143,4 +184,129 @@ var _ = Describe("Socket test", func() {
 			Expect(sm.GetNetworkInterface()).To(Equal("cellular"))
 		})
 	})
+
+	Describe("Outbound queue", func() {
+		push := func(sm *streaming.SocketManager, messages ...string) []error {
+			errs := make([]error, 0, len(messages))
+			for _, message := range messages {
+				errs = append(errs, sm.Push(websocket.BinaryMessage, []byte(message)))
+			}
+			return errs
+		}
+
+		queued := func(sm *streaming.SocketManager, count int) []string {
+			messages := make([]string, 0, count)
+			for i := 0; i < count; i++ {
+				messages = append(messages, string(sm.ListenToWriteChannel().Msg))
+			}
+			return messages
+		}
+
+		It("drops the newest messages once full", func() {
+			conf.OutboundQueue = &config.OutboundQueue{Size: 2, DropPolicy: config.OutboundDropNewest}
+			sm := streaming.NewSocketManager(context.Background(), requestIdentity, nil, conf, logger)
+
+			errs := push(sm, "1", "2", "3")
+			Expect(errs[:2]).To(HaveEach(BeNil()))
+			Expect(errs[2]).To(MatchError("outbound_queue_full"))
+			Expect(queued(sm, 2)).To(Equal([]string{"1", "2"}))
+		})
+
+		It("drops the oldest messages once full", func() {
+			conf.OutboundQueue = &config.OutboundQueue{Size: 2, DropPolicy: config.OutboundDropOldest}
+			sm := streaming.NewSocketManager(context.Background(), requestIdentity, nil, conf, logger)
+
+			Expect(push(sm, "1", "2", "3")).To(HaveEach(BeNil()))
+			Expect(queued(sm, 2)).To(Equal([]string{"2", "3"}))
+		})
+
+		It("blocks until the writer makes room by default", func() {
+			conf.OutboundQueue = &config.OutboundQueue{Size: 1}
+			sm := streaming.NewSocketManager(context.Background(), requestIdentity, nil, conf, logger)
+			Expect(push(sm, "1")).To(HaveEach(BeNil()))
+
+			pushed := make(chan error, 1)
+			go func() { pushed <- sm.Push(websocket.BinaryMessage, []byte("2")) }()
+			Consistently(pushed, 50*time.Millisecond).ShouldNot(Receive())
+			Expect(queued(sm, 1)).To(Equal([]string{"1"}))
+			Eventually(pushed).Should(Receive(BeNil()))
+			Expect(queued(sm, 1)).To(Equal([]string{"2"}))
+		})
+	})
+
+	It("serializes concurrent writes", func() {
+		upgrader := websocket.Upgrader{}
+		received := make(chan int, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = ws.Close() }()
+
+			count := 0
+			for count < 100 {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					break
+				}
+				count++
+			}
+			received <- count
+		}))
+		defer srv.Close()
+
+		u, err := url.Parse(srv.URL)
+		Expect(err).NotTo(HaveOccurred())
+		u.Scheme = "ws"
+		conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = conn.Close() }()
+
+		sm := streaming.NewSocketManager(context.Background(), requestIdentity, conn, conf, logger)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					Expect(sm.WriteMessage(websocket.BinaryMessage, []byte("ack"))).To(Succeed())
+				}
+			}()
+		}
+		wg.Wait()
+		Eventually(received).Should(Receive(Equal(100)))
+	})
+
+	It("stops processing telemetry once its context is cancelled", func() {
+		upgrader := websocket.Upgrader{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = ws.Close() }()
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+		defer srv.Close()
+
+		u, err := url.Parse(srv.URL)
+		Expect(err).NotTo(HaveOccurred())
+		u.Scheme = "ws"
+		conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = conn.Close() }()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sm := streaming.NewSocketManager(ctx, requestIdentity, conn, conf, logger)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sm.ProcessTelemetry(serializer)
+		}()
+		Consistently(done, 100*time.Millisecond).ShouldNot(BeClosed())
+
+		cancel()
+		Eventually(done, time.Second).Should(BeClosed())
+	})
 })
@@ -0,0 +1,98 @@
+package streaming
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+// sourceIPLimiter bounds the concurrent connections of each source ip. The source ip of requests
+// forwarded by trusted proxies is the last address of X-Forwarded-For not belonging to a trusted proxy.
+type sourceIPLimiter struct {
+	maxConnections int
+	trustedProxies []*net.IPNet
+
+	mutex       sync.Mutex
+	connections map[string]int
+}
+
+// newSourceIPLimiter returns nil when the connections are unlimited
+func newSourceIPLimiter(c *config.SourceIPLimit) (*sourceIPLimiter, error) {
+	if c == nil || c.MaxConnections <= 0 {
+		return nil, nil
+	}
+	limiter := &sourceIPLimiter{maxConnections: c.MaxConnections, connections: make(map[string]int)}
+	for _, proxy := range c.TrustedProxies {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_ip_limit trusted proxy %s: %w", proxy, err)
+		}
+		limiter.trustedProxies = append(limiter.trustedProxies, network)
+	}
+	return limiter, nil
+}
+
+// acquire counts a connection of the source ip, it returns false if the source ip is at its limit
+func (l *sourceIPLimiter) acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.connections[ip] >= l.maxConnections {
+		return false
+	}
+	l.connections[ip]++
+	return true
+}
+
+// release uncounts a connection of the source ip previously acquired
+func (l *sourceIPLimiter) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.connections[ip] <= 1 {
+		delete(l.connections, ip)
+		return
+	}
+	l.connections[ip]--
+}
+
+// sourceIP returns the address of the client of the request, resolved through the trusted proxies
+func (l *sourceIPLimiter) sourceIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !l.trusted(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (l *sourceIPLimiter) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range l.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package streaming
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+var _ = Describe("Source ip limiter", func() {
+	It("is disabled without limit", func() {
+		limiter, err := newSourceIPLimiter(&config.SourceIPLimit{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(limiter).To(BeNil())
+	})
+
+	It("rejects invalid trusted proxies", func() {
+		_, err := newSourceIPLimiter(&config.SourceIPLimit{MaxConnections: 1, TrustedProxies: []string{"10.0.0.1"}})
+		Expect(err).To(MatchError(ContainSubstring("invalid source_ip_limit trusted proxy 10.0.0.1")))
+	})
+
+	It("bounds the connections of each source ip", func() {
+		limiter, err := newSourceIPLimiter(&config.SourceIPLimit{MaxConnections: 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(limiter.acquire("1.2.3.4")).To(BeTrue())
+		Expect(limiter.acquire("1.2.3.4")).To(BeTrue())
+		Expect(limiter.acquire("1.2.3.4")).To(BeFalse())
+		Expect(limiter.acquire("5.6.7.8")).To(BeTrue())
+
+		limiter.release("1.2.3.4")
+		Expect(limiter.acquire("1.2.3.4")).To(BeTrue())
+	})
+
+	It("resolves the source ip through the trusted proxies", func() {
+		limiter, err := newSourceIPLimiter(&config.SourceIPLimit{MaxConnections: 1, TrustedProxies: []string{"10.0.0.0/8"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Add("X-Forwarded-For", "9.9.9.9, 1.2.3.4")
+		r.Header.Add("X-Forwarded-For", "10.0.0.2")
+		Expect(limiter.sourceIP(r)).To(Equal("1.2.3.4"))
+
+		r.RemoteAddr = "5.6.7.8:1234"
+		Expect(limiter.sourceIP(r)).To(Equal("5.6.7.8"))
+	})
+})
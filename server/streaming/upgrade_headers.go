@@ -0,0 +1,95 @@
+package streaming
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// websocketKeyLength is the length in bytes of the decoded Sec-WebSocket-Key nonce (RFC 6455 section 4.1)
+const websocketKeyLength = 16
+
+// malformedUpgradeError is the error of an upgrade request with a malformed header
+type malformedUpgradeError struct {
+	header string
+	err    error
+}
+
+func (e *malformedUpgradeError) Error() string {
+	return fmt.Sprintf("malformed %s header: %v", e.header, e.err)
+}
+
+// validateUpgradeHeaders checks the syntax of the websocket headers present on the upgrade request. Missing
+// headers are left to the upgrader, which rejects the requests they are required for
+func validateUpgradeHeaders(r *http.Request) error {
+	if values := r.Header.Values("Sec-Websocket-Key"); len(values) > 0 {
+		if err := validateWebsocketKey(values); err != nil {
+			return &malformedUpgradeError{header: "sec-websocket-key", err: err}
+		}
+	}
+	for _, value := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if !isToken(strings.TrimSpace(protocol)) {
+				return &malformedUpgradeError{header: "sec-websocket-protocol", err: fmt.Errorf("invalid subprotocol %q", protocol)}
+			}
+		}
+	}
+	if values := r.Header.Values("Origin"); len(values) > 0 {
+		if err := validateOrigin(values); err != nil {
+			return &malformedUpgradeError{header: "origin", err: err}
+		}
+	}
+	return nil
+}
+
+func validateWebsocketKey(values []string) error {
+	if len(values) != 1 {
+		return fmt.Errorf("%d values", len(values))
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(values[0]))
+	if err != nil {
+		return err
+	}
+	if len(key) != websocketKeyLength {
+		return fmt.Errorf("decoded length %d", len(key))
+	}
+	return nil
+}
+
+// validateOrigin accepts a single serialized origin, or null for opaque origins (RFC 6454 section 7)
+func validateOrigin(values []string) error {
+	if len(values) != 1 {
+		return fmt.Errorf("%d values", len(values))
+	}
+	if values[0] == "null" {
+		return nil
+	}
+	u, err := url.Parse(values[0])
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return errors.New("missing scheme or host")
+	}
+	return nil
+}
+
+// isToken returns true if s is a token as defined in RFC 7230 section 3.2.6
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package streaming
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+)
+
+const validWebsocketKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func upgradeRequest(key, protocol, origin string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Version", "13")
+	r.Header.Set("Sec-Websocket-Key", key)
+	if protocol != "" {
+		r.Header.Set("Sec-Websocket-Protocol", protocol)
+	}
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+var _ = Describe("Upgrade headers", func() {
+	It("accepts valid upgrade headers", func() {
+		Expect(validateUpgradeHeaders(upgradeRequest(validWebsocketKey, "", ""))).To(Succeed())
+		Expect(validateUpgradeHeaders(upgradeRequest(validWebsocketKey, "v1.telemetry, v2", "https://dashboard.example.com"))).To(Succeed())
+		Expect(validateUpgradeHeaders(upgradeRequest(validWebsocketKey, "", "null"))).To(Succeed())
+	})
+
+	It("leaves missing headers to the upgrader", func() {
+		Expect(validateUpgradeHeaders(httptest.NewRequest("GET", "/", nil))).To(Succeed())
+	})
+
+	DescribeTable("rejects malformed headers",
+		func(r *http.Request, header string) {
+			err := validateUpgradeHeaders(r)
+			var malformed *malformedUpgradeError
+			Expect(err).To(BeAssignableToTypeOf(malformed))
+			Expect(err.(*malformedUpgradeError).header).To(Equal(header))
+		},
+		Entry("key not base64", upgradeRequest("not base64!", "", ""), "sec-websocket-key"),
+		Entry("key of the wrong length", upgradeRequest("c2hvcnQ=", "", ""), "sec-websocket-key"),
+		Entry("empty subprotocol", upgradeRequest(validWebsocketKey, "v1,,v2", ""), "sec-websocket-protocol"),
+		Entry("subprotocol with separators", upgradeRequest(validWebsocketKey, "v1 (beta)", ""), "sec-websocket-protocol"),
+		Entry("origin without host", upgradeRequest(validWebsocketKey, "", "dashboard"), "origin"),
+		Entry("unparsable origin", upgradeRequest(validWebsocketKey, "", "http://[::1"), "origin"),
+	)
+})
+
+// FuzzPromoteToWebsocket feeds random websocket headers to the upgrade, which must not panic
+// and must reject the requests with malformed headers with a 400
+func FuzzPromoteToWebsocket(f *testing.F) {
+	f.Add(validWebsocketKey, "", "")
+	f.Add(validWebsocketKey, "v1, v2", "https://dashboard.example.com")
+	f.Add("", ",", "null")
+	f.Add("====", "v1\x00", "http://[::1")
+	f.Add("dGhlIHNhbXBsZSBub25jZQ", "\xff", "://")
+
+	logger, _ := logrus.NoOpLogger()
+	s := &Server{
+		upgrader:        newUpgrader(&config.Config{AllowedOrigins: []string{"dashboard.example.com"}}),
+		metrics:         newServerMetrics(noop.NewCollector()),
+		logger:          logger,
+		airbrakeHandler: airbrake.NewAirbrakeHandler(nil),
+	}
+	f.Fuzz(func(t *testing.T, key, protocol, origin string) {
+		r := upgradeRequest(key, protocol, origin)
+		recorder := httptest.NewRecorder()
+		if ws := s.promoteToWebsocket(recorder, r, nil); ws != nil {
+			t.Fatal("recorder connections cannot be upgraded")
+		}
+		if validateUpgradeHeaders(r) != nil && recorder.Code != http.StatusBadRequest {
+			t.Fatalf("malformed upgrade answered %d", recorder.Code)
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+var _ = Describe("Upgrader", func() {
+	It("defaults the buffer sizes", func() {
+		upgrader := newUpgrader(&config.Config{})
+		Expect(upgrader.ReadBufferSize).To(Equal(1024))
+		Expect(upgrader.WriteBufferSize).To(Equal(1024))
+		Expect(upgrader.HandshakeTimeout).To(BeZero())
+	})
+
+	It("uses the configured buffer sizes and handshake timeout", func() {
+		upgrader := newUpgrader(&config.Config{
+			WebsocketReadBufferSize:          4096,
+			WebsocketWriteBufferSize:         65536,
+			WebsocketHandshakeTimeoutSeconds: 5,
+		})
+		Expect(upgrader.ReadBufferSize).To(Equal(4096))
+		Expect(upgrader.WriteBufferSize).To(Equal(65536))
+		Expect(upgrader.HandshakeTimeout).To(Equal(5 * time.Second))
+	})
+
+	It("supports the configured subprotocols", func() {
+		upgrader := newUpgrader(&config.Config{WebsocketSubprotocols: []string{"tesla.telemetry.v1"}})
+		Expect(upgrader.Subprotocols).To(Equal([]string{"tesla.telemetry.v1"}))
+	})
+})
@@ -0,0 +1,65 @@
+package streaming
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+// connectionWarmup is a token bucket limiting accepted connections after startup, its rate
+// increases linearly from the initial rate to the target rate over the warm-up duration
+type connectionWarmup struct {
+	mutex       sync.Mutex
+	startedAt   time.Time
+	duration    time.Duration
+	initialRate float64
+	targetRate  float64
+	tokens      float64
+	refilledAt  time.Time
+}
+
+func newConnectionWarmup(c *config.ConnectionWarmup, startedAt time.Time) *connectionWarmup {
+	if c == nil || c.DurationSeconds <= 0 || c.TargetRate <= 0 {
+		return nil
+	}
+	return &connectionWarmup{
+		startedAt:   startedAt,
+		duration:    time.Duration(c.DurationSeconds) * time.Second,
+		initialRate: math.Max(c.InitialRate, 0),
+		targetRate:  c.TargetRate,
+		refilledAt:  startedAt,
+	}
+}
+
+// allow returns true if a connection can be accepted at the given time,
+// otherwise it returns the duration after which the client should retry
+func (w *connectionWarmup) allow(now time.Time) (bool, time.Duration) {
+	if w == nil || now.Sub(w.startedAt) >= w.duration {
+		return true, 0
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	rate := w.rate(now)
+	w.tokens = math.Min(w.tokens+now.Sub(w.refilledAt).Seconds()*rate, math.Max(rate, 1))
+	w.refilledAt = now
+	if w.tokens >= 1 {
+		w.tokens--
+		return true, 0
+	}
+
+	retryAfter := w.duration - now.Sub(w.startedAt)
+	if rate > 0 {
+		retryAfter = time.Duration(math.Min((1-w.tokens)/rate*float64(time.Second), float64(retryAfter)))
+	}
+	return false, retryAfter
+}
+
+// rate returns the number of connections per second accepted at the given time
+func (w *connectionWarmup) rate(now time.Time) float64 {
+	progress := now.Sub(w.startedAt).Seconds() / w.duration.Seconds()
+	return w.initialRate + (w.targetRate-w.initialRate)*progress
+}
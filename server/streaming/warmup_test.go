@@ -0,0 +1,60 @@
+package streaming
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+var _ = Describe("Connection warmup", func() {
+	var startedAt time.Time
+
+	BeforeEach(func() {
+		startedAt = time.Now()
+	})
+
+	It("is disabled without configuration", func() {
+		warmup := newConnectionWarmup(nil, startedAt)
+		Expect(warmup).To(BeNil())
+		ok, _ := warmup.allow(startedAt)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("rejects connections exceeding the initial rate", func() {
+		warmup := newConnectionWarmup(&config.ConnectionWarmup{DurationSeconds: 60, InitialRate: 1, TargetRate: 1}, startedAt)
+		now := startedAt.Add(time.Second)
+		ok, _ := warmup.allow(now)
+		Expect(ok).To(BeTrue())
+		ok, retryAfter := warmup.allow(now)
+		Expect(ok).To(BeFalse())
+		Expect(retryAfter).To(BeNumerically(">", 0))
+		Expect(retryAfter).To(BeNumerically("<=", time.Second))
+	})
+
+	It("increases the rate over time", func() {
+		warmup := newConnectionWarmup(&config.ConnectionWarmup{DurationSeconds: 10, InitialRate: 0, TargetRate: 100}, startedAt)
+		ok, retryAfter := warmup.allow(startedAt)
+		Expect(ok).To(BeFalse())
+		Expect(retryAfter).To(Equal(10 * time.Second))
+
+		now := startedAt.Add(5 * time.Second)
+		accepted := 0
+		for i := 0; i < 100; i++ {
+			if ok, _ := warmup.allow(now); ok {
+				accepted++
+			}
+		}
+		Expect(accepted).To(Equal(50))
+	})
+
+	It("accepts every connection after the warm-up", func() {
+		warmup := newConnectionWarmup(&config.ConnectionWarmup{DurationSeconds: 10, InitialRate: 0, TargetRate: 1}, startedAt)
+		for i := 0; i < 10; i++ {
+			ok, _ := warmup.allow(startedAt.Add(10 * time.Second))
+			Expect(ok).To(BeTrue())
+		}
+	})
+})
@@ -0,0 +1,112 @@
+package telemetry
+
+import (
+	"math"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/internal/lru"
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+// DefaultChangeDetectorMaxDevices bounds the number of devices tracked when not configured
+const DefaultChangeDetectorMaxDevices = 100000
+
+// ChangeDetector keeps the last dispatched value of vehicle signals per device in order to
+// suppress records for which none of the signals changed beyond their configured delta
+type ChangeDetector struct {
+	deltas map[protos.Field]float64
+
+	mutex   sync.Mutex
+	devices *lru.Cache[string, *deviceSignals]
+}
+
+type deviceSignals struct {
+	values map[protos.Field]*protos.Value
+}
+
+// NewChangeDetector returns a ChangeDetector tracking the signals in deltas for at most maxDevices devices
+func NewChangeDetector(deltas map[protos.Field]float64, maxDevices int) *ChangeDetector {
+	if maxDevices <= 0 {
+		maxDevices = DefaultChangeDetectorMaxDevices
+	}
+	return &ChangeDetector{
+		deltas:  deltas,
+		devices: lru.New[string, *deviceSignals](maxDevices),
+	}
+}
+
+// Unchanged returns true if every signal of the record is tracked and did not change beyond its delta
+// since it was last dispatched. Otherwise the record values are stored as the last dispatched ones.
+func (d *ChangeDetector) Unchanged(record *Record) bool {
+	payload, ok := record.GetProtoMessage().(*protos.Payload)
+	if !ok || len(payload.GetData()) == 0 {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	signals := d.deviceSignals(record.Vin)
+	if !d.changed(signals, payload.GetData()) {
+		return true
+	}
+	for _, datum := range payload.GetData() {
+		if _, ok := d.deltas[datum.GetKey()]; ok {
+			signals.values[datum.GetKey()] = datum.GetValue()
+		}
+	}
+	return false
+}
+
+func (d *ChangeDetector) changed(signals *deviceSignals, data []*protos.Datum) bool {
+	for _, datum := range data {
+		delta, ok := d.deltas[datum.GetKey()]
+		if !ok {
+			return true
+		}
+		last, ok := signals.values[datum.GetKey()]
+		if !ok || valueChanged(last, datum.GetValue(), delta) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceSignals returns the signals of the device, evicting the least recently used device when full
+func (d *ChangeDetector) deviceSignals(deviceID string) *deviceSignals {
+	if signals, ok := d.devices.Get(deviceID); ok {
+		return signals
+	}
+	signals := &deviceSignals{values: make(map[protos.Field]*protos.Value)}
+	d.devices.Add(deviceID, signals)
+	return signals
+}
+
+func valueChanged(last *protos.Value, current *protos.Value, delta float64) bool {
+	lastNumber, lastOk := numericValue(last)
+	currentNumber, currentOk := numericValue(current)
+	if lastOk && currentOk {
+		if delta == 0 {
+			return lastNumber != currentNumber
+		}
+		return math.Abs(currentNumber-lastNumber) > delta
+	}
+	return !proto.Equal(last, current)
+}
+
+func numericValue(value *protos.Value) (float64, bool) {
+	switch v := value.GetValue().(type) {
+	case *protos.Value_IntValue:
+		return float64(v.IntValue), true
+	case *protos.Value_LongValue:
+		return float64(v.LongValue), true
+	case *protos.Value_FloatValue:
+		return float64(v.FloatValue), true
+	case *protos.Value_DoubleValue:
+		return v.DoubleValue, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,63 @@
+package telemetry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("ChangeDetector", func() {
+	var (
+		detector   *telemetry.ChangeDetector
+		serializer *telemetry.BinarySerializer
+	)
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		serializer = telemetry.NewBinarySerializer(
+			&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"},
+			map[string][]telemetry.Producer{"V": nil},
+			logger,
+		)
+		detector = telemetry.NewChangeDetector(map[protos.Field]float64{
+			protos.Field_VehicleName: 0,
+			protos.Field_Odometer:    1.5,
+		}, 1)
+	})
+
+	newRecord := func(deviceID string, data ...*protos.Datum) *telemetry.Record {
+		serializer.RequestIdentity = &telemetry.RequestIdentity{DeviceID: deviceID, SenderID: "vehicle_device." + deviceID}
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device." + deviceID), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", deviceID, nil, data...)}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	odometer := func(value float64) *protos.Datum {
+		return &protos.Datum{Key: protos.Field_Odometer, Value: &protos.Value{Value: &protos.Value_DoubleValue{DoubleValue: value}}}
+	}
+
+	It("suppresses records within delta", func() {
+		Expect(detector.Unchanged(newRecord("42", odometer(10)))).To(BeFalse())
+		Expect(detector.Unchanged(newRecord("42", odometer(11)))).To(BeTrue())
+		Expect(detector.Unchanged(newRecord("42", odometer(12)))).To(BeFalse())
+		Expect(detector.Unchanged(newRecord("42", odometer(12)))).To(BeTrue())
+	})
+
+	It("dispatches records with untracked signals", func() {
+		Expect(detector.Unchanged(newRecord("42", stringDatum(protos.Field_Gear, "D")))).To(BeFalse())
+		Expect(detector.Unchanged(newRecord("42", stringDatum(protos.Field_Gear, "D")))).To(BeFalse())
+	})
+
+	It("evicts least recently used devices", func() {
+		Expect(detector.Unchanged(newRecord("42", odometer(10)))).To(BeFalse())
+		Expect(detector.Unchanged(newRecord("43", odometer(10)))).To(BeFalse())
+		Expect(detector.Unchanged(newRecord("42", odometer(10)))).To(BeFalse())
+	})
+})
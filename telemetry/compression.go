@@ -0,0 +1,140 @@
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+)
+
+// CompressionMode selects how the payload of a record type is compressed before dispatch
+type CompressionMode string
+
+const (
+	// CompressionNone dispatches payloads uncompressed
+	CompressionNone CompressionMode = "none"
+	// CompressionGzip compresses every payload with gzip
+	CompressionGzip CompressionMode = "gzip"
+	// CompressionAuto compresses payloads with gzip while it is effective
+	CompressionAuto CompressionMode = "auto"
+
+	// DefaultCompressionMaxRatio is the compressed to original size ratio above which compression is ineffective
+	DefaultCompressionMaxRatio = 0.9
+
+	// GzipEncoding is the content encoding of gzip compressed payloads
+	GzipEncoding = "gzip"
+
+	// compressionSampleInterval is the number of records after which auto mode measures an ineffective record type again
+	compressionSampleInterval = 100
+	// compressionRatioWeight is the weight of the last record in the moving compression ratio of auto mode
+	compressionRatioWeight = 0.1
+)
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// Compressor compresses record payloads according to the compression mode of their record type
+type Compressor struct {
+	modes    map[string]CompressionMode
+	maxRatio float64
+
+	mutex sync.Mutex
+	stats map[string]*compressionStats
+}
+
+type compressionStats struct {
+	records int64
+	ratio   float64
+}
+
+// CompressionResult describes the outcome of the compression of a record payload
+type CompressionResult struct {
+	OriginalBytes   int
+	CompressedBytes int
+	Compressed      bool
+}
+
+// NewCompressor returns a Compressor using the compression mode of each record type
+func NewCompressor(modes map[string]CompressionMode, maxRatio float64) *Compressor {
+	if maxRatio <= 0 {
+		maxRatio = DefaultCompressionMaxRatio
+	}
+	return &Compressor{
+		modes:    modes,
+		maxRatio: maxRatio,
+		stats:    make(map[string]*compressionStats),
+	}
+}
+
+// Compress replaces the payload of the record with its gzip compression if its record type is configured
+// for it, payloads are left unchanged when compression does not reduce their size below the max ratio
+func (c *Compressor) Compress(record *Record) (CompressionResult, error) {
+	result := CompressionResult{OriginalBytes: len(record.PayloadBytes)}
+	mode := c.modes[record.TxType]
+	if mode != CompressionGzip && !(mode == CompressionAuto && c.shouldSample(record.TxType)) {
+		return result, nil
+	}
+
+	compressed, err := gzipBytes(record.PayloadBytes)
+	if err != nil {
+		return result, err
+	}
+	result.CompressedBytes = len(compressed)
+
+	ratio := 1.0
+	if result.OriginalBytes > 0 {
+		ratio = float64(result.CompressedBytes) / float64(result.OriginalBytes)
+	}
+	if mode == CompressionAuto {
+		c.updateRatio(record.TxType, ratio)
+	}
+	if ratio >= c.maxRatio {
+		return result, nil
+	}
+
+	record.PayloadBytes = compressed
+	record.ContentEncoding = GzipEncoding
+	result.Compressed = true
+	return result, nil
+}
+
+// shouldSample returns true if compression is effective for the record type, or if it is time to measure it again
+func (c *Compressor) shouldSample(recordType string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats, ok := c.stats[recordType]
+	if !ok {
+		stats = &compressionStats{}
+		c.stats[recordType] = stats
+	}
+	stats.records++
+	return stats.ratio < c.maxRatio || stats.records%compressionSampleInterval == 0
+}
+
+func (c *Compressor) updateRatio(recordType string, ratio float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats[recordType]
+	if stats.ratio == 0 {
+		stats.ratio = ratio
+		return
+	}
+	stats.ratio = (1-compressionRatioWeight)*stats.ratio + compressionRatioWeight*ratio
+}
+
+func gzipBytes(payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(writer)
+
+	writer.Reset(&buffer)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package telemetry_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Compressor", func() {
+	var (
+		compressible   []byte
+		incompressible []byte
+	)
+
+	BeforeEach(func() {
+		compressible = bytes.Repeat([]byte("cybertruck"), 100)
+		incompressible = make([]byte, 1000)
+		_, _ = rand.Read(incompressible)
+	})
+
+	gunzip := func(payload []byte) []byte {
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	It("compresses configured record types", func() {
+		compressor := telemetry.NewCompressor(map[string]telemetry.CompressionMode{"V": telemetry.CompressionGzip}, 0)
+		record := &telemetry.Record{TxType: "V", PayloadBytes: compressible}
+		result, err := compressor.Compress(record)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Compressed).To(BeTrue())
+		Expect(result.OriginalBytes).To(Equal(len(compressible)))
+		Expect(result.CompressedBytes).To(Equal(len(record.Payload())))
+		Expect(record.Metadata()).To(HaveKeyWithValue("content_encoding", "gzip"))
+		Expect(gunzip(record.Payload())).To(Equal(compressible))
+	})
+
+	It("leaves other record types unchanged", func() {
+		compressor := telemetry.NewCompressor(map[string]telemetry.CompressionMode{"V": telemetry.CompressionGzip, "alerts": telemetry.CompressionNone}, 0)
+		for _, recordType := range []string{"alerts", "errors"} {
+			record := &telemetry.Record{TxType: recordType, PayloadBytes: compressible}
+			result, err := compressor.Compress(record)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Compressed).To(BeFalse())
+			Expect(record.Payload()).To(Equal(compressible))
+			Expect(record.Metadata()).NotTo(HaveKey("content_encoding"))
+		}
+	})
+
+	It("does not dispatch ineffective compression", func() {
+		compressor := telemetry.NewCompressor(map[string]telemetry.CompressionMode{"V": telemetry.CompressionGzip}, 0)
+		record := &telemetry.Record{TxType: "V", PayloadBytes: incompressible}
+		result, err := compressor.Compress(record)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Compressed).To(BeFalse())
+		Expect(result.CompressedBytes).To(BeNumerically(">", 0))
+		Expect(record.Payload()).To(Equal(incompressible))
+	})
+
+	It("stops measuring ineffective record types in auto mode", func() {
+		compressor := telemetry.NewCompressor(map[string]telemetry.CompressionMode{"V": telemetry.CompressionAuto}, 0)
+		result, err := compressor.Compress(&telemetry.Record{TxType: "V", PayloadBytes: incompressible})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.CompressedBytes).To(BeNumerically(">", 0))
+
+		result, err = compressor.Compress(&telemetry.Record{TxType: "V", PayloadBytes: compressible})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.CompressedBytes).To(Equal(0))
+		Expect(result.Compressed).To(BeFalse())
+	})
+})
@@ -0,0 +1,42 @@
+package telemetry
+
+import logrus "github.com/teslamotors/fleet-telemetry/logger"
+
+// DecodeOptions configures the decoding of raw stream messages with DecodeRecord
+type DecodeOptions struct {
+	// DeviceID is the vin set on decoded records, defaults to the device id of the stream message
+	DeviceID string
+
+	// DefaultTopic is applied to messages without topic, they are rejected when empty
+	DefaultTopic string
+
+	// DiscardUnknownFields is the set of record types for which unknown proto fields are removed
+	DiscardUnknownFields map[string]bool
+
+	// TransmitDecodedRecords decodes the payload of the records to json
+	TransmitDecodedRecords bool
+
+	// Logger defaults to a logger discarding every message
+	Logger *logrus.Logger
+}
+
+// DecodeRecord decodes raw StreamMessage bytes into a record the same way the server does,
+// without validating the sender of the message nor dispatching the record. It can be used
+// by downstream tools to decode archived raw frames.
+func DecodeRecord(msg []byte, options DecodeOptions) (*Record, error) {
+	logger := options.Logger
+	if logger == nil {
+		logger, _ = logrus.NoOpLogger()
+	}
+	serializer := NewBinarySerializer(&RequestIdentity{DeviceID: options.DeviceID}, nil, logger)
+	serializer.DefaultTopic = options.DefaultTopic
+	serializer.DiscardUnknownFields = options.DiscardUnknownFields
+
+	return newRecord(serializer, msg, options.TransmitDecodedRecords, func() (*Record, error) {
+		record, streamMessage, err := serializer.deserialize(msg, "")
+		if err == nil && record.Vin == "" {
+			record.Vin = string(streamMessage.DeviceID)
+		}
+		return record, err
+	})
+}
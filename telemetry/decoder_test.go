@@ -0,0 +1,68 @@
+package telemetry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("DecodeRecord", func() {
+	var message messages.StreamMessage
+
+	BeforeEach(func() {
+		message = messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), DeviceID: []byte("42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
+	})
+
+	It("decodes records like the server", func() {
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		record, err := telemetry.DecodeRecord(recordMsg, telemetry.DecodeOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.TxType).To(Equal("V"))
+		Expect(record.Txid).To(Equal("1234"))
+		Expect(record.Vin).To(Equal("42"))
+
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{"V": nil}, logger)
+		serverRecord, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(proto.Equal(record.GetProtoMessage(), serverRecord.GetProtoMessage())).To(BeTrue())
+		Expect(record.Payload()).To(Equal(serverRecord.Payload()))
+	})
+
+	It("decodes records to json", func() {
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		record, err := telemetry.DecodeRecord(recordMsg, telemetry.DecodeOptions{DeviceID: "43", TransmitDecodedRecords: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record.Payload())).To(MatchJSON(`{"data":[{"key":"VehicleName","value":{"stringValue":"cybertruck"}}],"createdAt":null,"vin":"43"}`))
+		Expect(record.GetProtoMessage().(*protos.Payload).GetVin()).To(Equal("43"))
+	})
+
+	It("rejects messages without topic", func() {
+		message.MessageTopic = nil
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = telemetry.DecodeRecord(recordMsg, telemetry.DecodeOptions{})
+		Expect(err).To(MatchError(telemetry.ErrMissingTopic))
+	})
+
+	It("rejects messages above the size limit", func() {
+		_, err := telemetry.DecodeRecord(make([]byte, telemetry.SizeLimit+1), telemetry.DecodeOptions{})
+		Expect(err).To(MatchError(telemetry.ErrMessageTooBig))
+	})
+
+	It("rejects invalid messages", func() {
+		_, err := telemetry.DecodeRecord([]byte("test,1234,type"), telemetry.DecodeOptions{})
+		Expect(err).To(HaveOccurred())
+	})
+})
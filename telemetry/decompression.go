@@ -0,0 +1,119 @@
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// InboundCompression is the compression of the frames sent by the vehicles
+type InboundCompression string
+
+const (
+	// InboundCompressionNone hands the frames to the serializer unchanged
+	InboundCompressionNone InboundCompression = "none"
+	// InboundCompressionGzip decompresses every frame with gzip
+	InboundCompressionGzip InboundCompression = "gzip"
+	// InboundCompressionZstd decompresses every frame with zstd
+	InboundCompressionZstd InboundCompression = "zstd"
+	// InboundCompressionDetect decompresses the frames starting with the gzip or zstd magic number, other frames are
+	// unchanged. Serialized messages cannot start with them as their root offset would exceed any frame size
+	InboundCompressionDetect InboundCompression = "detect"
+
+	// DefaultMaxDecompressedBytes is the size above which decompressed frames are dropped when not configured
+	DefaultMaxDecompressedBytes = 4 << 20
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// ErrDecompressedTooLarge is returned for frames decompressing above the max decompressed size
+	ErrDecompressedTooLarge = errors.New("decompressed frame too large")
+)
+
+// IsValid returns whether the compression is supported, empty defaults to none
+func (c InboundCompression) IsValid() bool {
+	switch c {
+	case "", InboundCompressionNone, InboundCompressionGzip, InboundCompressionZstd, InboundCompressionDetect:
+		return true
+	default:
+		return false
+	}
+}
+
+// Decompressor decompresses the frames sent by the vehicles before they are deserialized
+type Decompressor struct {
+	compression InboundCompression
+	maxBytes    int
+	// zstdDecoder decodes the zstd frames, it is safe for concurrent use by the connections
+	zstdDecoder *zstd.Decoder
+}
+
+// NewDecompressor returns a Decompressor of the compression, or nil when frames are not compressed
+func NewDecompressor(compression InboundCompression, maxBytes int) *Decompressor {
+	if compression == "" || compression == InboundCompressionNone {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxDecompressedBytes
+	}
+	// the decoder rejects windows above its max memory, which cannot be below the minimum window of a frame,
+	// and only fails to be created on invalid options
+	decoderMaxBytes := uint64(max(maxBytes, zstd.MinWindowSize))
+	zstdDecoder, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(decoderMaxBytes), zstd.WithDecoderConcurrency(0))
+	return &Decompressor{compression: compression, maxBytes: maxBytes, zstdDecoder: zstdDecoder}
+}
+
+// Decompress returns the decompressed frame and its compression, frames which are not compressed are returned
+// unchanged with the none compression
+func (d *Decompressor) Decompress(frame []byte) ([]byte, InboundCompression, error) {
+	compression := d.compression
+	if compression == InboundCompressionDetect {
+		switch {
+		case bytes.HasPrefix(frame, gzipMagic):
+			compression = InboundCompressionGzip
+		case bytes.HasPrefix(frame, zstdMagic):
+			compression = InboundCompressionZstd
+		default:
+			return frame, InboundCompressionNone, nil
+		}
+	}
+
+	switch compression {
+	case InboundCompressionGzip:
+		decompressed, err := d.decompressGzip(frame)
+		return decompressed, compression, err
+	case InboundCompressionZstd:
+		decompressed, err := d.zstdDecoder.DecodeAll(frame, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || (err == nil && len(decompressed) > d.maxBytes) {
+			return nil, compression, ErrDecompressedTooLarge
+		}
+		if err != nil {
+			return nil, compression, err
+		}
+		return decompressed, compression, nil
+	default:
+		return nil, compression, fmt.Errorf("unknown inbound compression %s", compression)
+	}
+}
+
+// decompressGzip returns the decompressed gzip frame, or ErrDecompressedTooLarge once it exceeds the max size
+func (d *Decompressor) decompressGzip(frame []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := io.ReadAll(io.LimitReader(reader, int64(d.maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > d.maxBytes {
+		return nil, ErrDecompressedTooLarge
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,138 @@
+package telemetry_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// zstdFrame is "cybertruck" repeated 100 times compressed by the zstd cli
+var zstdFrame = []byte{
+	0x28, 0xb5, 0x2f, 0xfd, 0x64, 0xe8, 0x02, 0x8d, 0x00, 0x00, 0x50, 0x63,
+	0x79, 0x62, 0x65, 0x72, 0x74, 0x72, 0x75, 0x63, 0x6b, 0x01, 0x00, 0xdb,
+	0x5b, 0x15, 0x24, 0xc6, 0xd5, 0x92, 0xd3,
+}
+
+func gzipFrame(data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	return buffer.Bytes()
+}
+
+func streamMessage() []byte {
+	message, _ := (&messages.StreamMessage{TXID: []byte("1"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: bytes.Repeat([]byte("data"), 100)}).ToBytes()
+	return message
+}
+
+var _ = Describe("Decompressor", func() {
+	var plain []byte
+
+	BeforeEach(func() {
+		plain = bytes.Repeat([]byte("cybertruck"), 100)
+	})
+
+	It("returns no decompressor for uncompressed frames", func() {
+		Expect(telemetry.NewDecompressor("", 0)).To(BeNil())
+		Expect(telemetry.NewDecompressor(telemetry.InboundCompressionNone, 0)).To(BeNil())
+	})
+
+	It("decompresses gzip frames", func() {
+		data, compression, err := telemetry.NewDecompressor(telemetry.InboundCompressionGzip, 0).Decompress(gzipFrame(plain))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(compression).To(Equal(telemetry.InboundCompressionGzip))
+		Expect(data).To(Equal(plain))
+	})
+
+	It("decompresses zstd frames", func() {
+		data, compression, err := telemetry.NewDecompressor(telemetry.InboundCompressionZstd, 0).Decompress(zstdFrame)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(compression).To(Equal(telemetry.InboundCompressionZstd))
+		Expect(data).To(Equal(plain))
+	})
+
+	It("detects the compression of each frame", func() {
+		decompressor := telemetry.NewDecompressor(telemetry.InboundCompressionDetect, 0)
+		for frame, expected := range map[string]telemetry.InboundCompression{
+			string(gzipFrame(plain)): telemetry.InboundCompressionGzip,
+			string(zstdFrame):        telemetry.InboundCompressionZstd,
+			string(plain):            telemetry.InboundCompressionNone,
+		} {
+			data, compression, err := decompressor.Decompress([]byte(frame))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(compression).To(Equal(expected))
+			Expect(data).To(Equal(plain))
+		}
+	})
+
+	It("leaves serialized messages unchanged when detecting", func() {
+		message := streamMessage()
+		data, compression, err := telemetry.NewDecompressor(telemetry.InboundCompressionDetect, 0).Decompress(message)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(compression).To(Equal(telemetry.InboundCompressionNone))
+		Expect(data).To(Equal(message))
+	})
+
+	It("fails on corrupt frames", func() {
+		corrupt := gzipFrame(plain)
+		corrupt = corrupt[:len(corrupt)/2]
+		_, compression, err := telemetry.NewDecompressor(telemetry.InboundCompressionDetect, 0).Decompress(corrupt)
+		Expect(err).To(HaveOccurred())
+		Expect(compression).To(Equal(telemetry.InboundCompressionGzip))
+
+		_, _, err = telemetry.NewDecompressor(telemetry.InboundCompressionZstd, 0).Decompress(plain)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on frames decompressing above the max size", func() {
+		decompressor := telemetry.NewDecompressor(telemetry.InboundCompressionGzip, len(plain)-1)
+		_, _, err := decompressor.Decompress(gzipFrame(plain))
+		Expect(err).To(MatchError(telemetry.ErrDecompressedTooLarge))
+
+		_, _, err = telemetry.NewDecompressor(telemetry.InboundCompressionGzip, len(plain)).Decompress(gzipFrame(plain))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = telemetry.NewDecompressor(telemetry.InboundCompressionZstd, len(plain)-1).Decompress(zstdFrame)
+		Expect(err).To(MatchError(telemetry.ErrDecompressedTooLarge))
+
+		_, _, err = telemetry.NewDecompressor(telemetry.InboundCompressionZstd, len(plain)).Decompress(zstdFrame)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+func BenchmarkDeserializeUncompressed(b *testing.B) {
+	benchmarkDeserialize(b, nil, streamMessage())
+}
+
+func BenchmarkDeserializeDetectUncompressed(b *testing.B) {
+	benchmarkDeserialize(b, telemetry.NewDecompressor(telemetry.InboundCompressionDetect, 0), streamMessage())
+}
+
+func BenchmarkDeserializeGzip(b *testing.B) {
+	benchmarkDeserialize(b, telemetry.NewDecompressor(telemetry.InboundCompressionGzip, 0), gzipFrame(streamMessage()))
+}
+
+// benchmarkDeserialize decodes frames as the socket manager does, decompressing them first if decompressor is set
+func benchmarkDeserialize(b *testing.B, decompressor *telemetry.Decompressor, frame []byte) {
+	serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, nil, nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		message := frame
+		if decompressor != nil {
+			var err error
+			if message, _, err = decompressor.Decompress(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, err := serializer.Deserialize(message, "socket-1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package telemetry
+
+import "sync/atomic"
+
+// DispatchRulesSource holds the dispatch rules shared by serializers. The rules are an immutable snapshot
+// replaced as a whole when reloaded, so records decoded concurrently see either the old or the new rules
+type DispatchRulesSource struct {
+	rules atomic.Pointer[map[string][]Producer]
+}
+
+// NewDispatchRulesSource returns a source holding a copy of the rules
+func NewDispatchRulesSource(rules map[string][]Producer) *DispatchRulesSource {
+	source := &DispatchRulesSource{}
+	source.Store(rules)
+	return source
+}
+
+// Load returns the current rules, which must not be modified
+func (s *DispatchRulesSource) Load() map[string][]Producer {
+	return *s.rules.Load()
+}
+
+// Store replaces the rules with a copy of rules, later changes to rules are not seen by the serializers
+func (s *DispatchRulesSource) Store(rules map[string][]Producer) {
+	snapshot := make(map[string][]Producer, len(rules))
+	for recordType, producers := range rules {
+		snapshot[recordType] = append([]Producer(nil), producers...)
+	}
+	s.rules.Store(&snapshot)
+}
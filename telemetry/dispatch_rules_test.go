@@ -0,0 +1,95 @@
+package telemetry_test
+
+import (
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// generationRecorder keeps the generations of the rules each record was produced with
+type generationRecorder struct {
+	mutex       sync.Mutex
+	generations map[*telemetry.Record][]int
+}
+
+func (r *generationRecorder) add(record *telemetry.Record, generation int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.generations[record] = append(r.generations[record], generation)
+}
+
+// generationProducer records the generation of the rules it belongs to
+type generationProducer struct {
+	generation int
+	recorder   *generationRecorder
+}
+
+func (p *generationProducer) Close() error { return nil }
+
+func (p *generationProducer) Produce(record *telemetry.Record) { p.recorder.add(record, p.generation) }
+
+func (p *generationProducer) ProcessReliableAck(_ *telemetry.Record) {}
+
+func (p *generationProducer) ReportError(_ string, _ error, _ logrus.LogInfo) {}
+
+var _ = Describe("DispatchRulesSource", func() {
+	var recorder *generationRecorder
+
+	BeforeEach(func() {
+		recorder = &generationRecorder{generations: make(map[*telemetry.Record][]int)}
+	})
+
+	rules := func(generation int) map[string][]telemetry.Producer {
+		producer := &generationProducer{generation: generation, recorder: recorder}
+		return map[string][]telemetry.Producer{"T": {producer, producer}}
+	}
+
+	It("copies the rules stored", func() {
+		stored := rules(0)
+		source := telemetry.NewDispatchRulesSource(stored)
+		stored["T"][0] = &generationProducer{generation: 1, recorder: recorder}
+		delete(stored, "T")
+
+		Expect(source.Load()).To(HaveKey("T"))
+		Expect(source.Load()["T"][0].(*generationProducer).generation).To(Equal(0))
+	})
+
+	It("dispatches each record with either the previous or the new rules while reloading", func() {
+		logger, _ := logrus.NoOpLogger()
+		source := telemetry.NewDispatchRulesSource(rules(0))
+		msg, err := (&messages.StreamMessage{MessageTopic: []byte("T"), TXID: []byte("1"), Payload: []byte("data"), SenderID: []byte("vehicle_device.42")}).ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		const dispatchers, records = 4, 200
+		wg := sync.WaitGroup{}
+		for i := 0; i < dispatchers; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, nil, logger)
+				bs.RulesSource = source
+				for j := 0; j < records; j++ {
+					record, err := bs.Deserialize(msg, "socket-1")
+					Expect(err).NotTo(HaveOccurred())
+					bs.Dispatch(record)
+				}
+			}()
+		}
+		for generation := 1; generation <= records; generation++ {
+			source.Store(rules(generation))
+		}
+		wg.Wait()
+
+		Expect(recorder.generations).To(HaveLen(dispatchers * records))
+		for _, generations := range recorder.generations {
+			Expect(generations).To(HaveLen(2))
+			Expect(generations[0]).To(Equal(generations[1]))
+		}
+	})
+})
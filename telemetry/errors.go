@@ -5,6 +5,9 @@ import "fmt"
 // ErrMessageTooBig handles error when incoming payload is too large
 var ErrMessageTooBig = fmt.Errorf("can't process message, size above 1mb")
 
+// ErrMissingTopic handles error when incoming message has no topic and no default topic is configured
+var ErrMissingTopic = fmt.Errorf("can't process message, topic is missing")
+
 // UnauthorizedSenderIDError is an error struct representing mismatch ID
 type UnauthorizedSenderIDError struct {
 	ExpectedSenderID string
@@ -0,0 +1,334 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MaxExpressionLength bounds the size of a transform expression
+const MaxExpressionLength = 1024
+
+// expressionFunctions are the only functions expressions can call
+var expressionFunctions = map[string]func(args []interface{}) (interface{}, error){
+	"lower": func(args []interface{}) (interface{}, error) {
+		s, err := stringArgument(args)
+		return strings.ToLower(s), err
+	},
+	"upper": func(args []interface{}) (interface{}, error) {
+		s, err := stringArgument(args)
+		return strings.ToUpper(s), err
+	},
+	"round": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("round expects one argument")
+		}
+		n, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("round expects a number, got %T", args[0])
+		}
+		return math.Round(n), nil
+	},
+	"has": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("has expects one argument")
+		}
+		return args[0] != nil, nil
+	},
+}
+
+// Expression is a side effect free expression over the fields of a decoded record. It supports
+// literals, field references (`vin`, `data[0].key`), arithmetic, comparisons, boolean operators
+// and the lower, upper, round and has functions. Expressions cannot loop, allocate beyond their
+// result or reach anything outside of the record they are evaluated on.
+type Expression struct {
+	source string
+	root   ast.Expr
+}
+
+// CompileExpression parses the expression and checks it only uses the supported syntax
+func CompileExpression(source string) (*Expression, error) {
+	if len(source) > MaxExpressionLength {
+		return nil, fmt.Errorf("expression longer than %d characters", MaxExpressionLength)
+	}
+	root, err := parser.ParseExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	if err = checkExpression(root); err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate returns the value of the expression for the decoded record
+func (e *Expression) Evaluate(record map[string]interface{}) (interface{}, error) {
+	return evaluate(e.root, record)
+}
+
+func checkExpression(node ast.Expr) error {
+	switch n := node.(type) {
+	case *ast.BasicLit:
+		if n.Kind == token.CHAR || n.Kind == token.IMAG {
+			return fmt.Errorf("unsupported literal %s", n.Value)
+		}
+		if _, err := literal(n); err != nil {
+			return fmt.Errorf("invalid number %s", n.Value)
+		}
+		return nil
+	case *ast.Ident:
+		return nil
+	case *ast.ParenExpr:
+		return checkExpression(n.X)
+	case *ast.SelectorExpr:
+		return checkExpression(n.X)
+	case *ast.IndexExpr:
+		if err := checkExpression(n.X); err != nil {
+			return err
+		}
+		return checkExpression(n.Index)
+	case *ast.UnaryExpr:
+		if n.Op != token.SUB && n.Op != token.NOT {
+			return fmt.Errorf("unsupported operator %s", n.Op)
+		}
+		return checkExpression(n.X)
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
+			token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+			token.LAND, token.LOR:
+		default:
+			return fmt.Errorf("unsupported operator %s", n.Op)
+		}
+		if err := checkExpression(n.X); err != nil {
+			return err
+		}
+		return checkExpression(n.Y)
+	case *ast.CallExpr:
+		name, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			return errors.New("unsupported function call")
+		}
+		if _, ok := expressionFunctions[name.Name]; !ok {
+			return fmt.Errorf("unknown function %s", name.Name)
+		}
+		for _, arg := range n.Args {
+			if err := checkExpression(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported syntax %T", node)
+	}
+}
+
+func evaluate(node ast.Expr, record map[string]interface{}) (interface{}, error) {
+	switch n := node.(type) {
+	case *ast.BasicLit:
+		return literal(n)
+	case *ast.Ident:
+		switch n.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return record[n.Name], nil
+	case *ast.ParenExpr:
+		return evaluate(n.X, record)
+	case *ast.SelectorExpr:
+		parent, err := evaluate(n.X, record)
+		if err != nil {
+			return nil, err
+		}
+		object, ok := parent.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		return object[n.Sel.Name], nil
+	case *ast.IndexExpr:
+		return evaluateIndex(n, record)
+	case *ast.UnaryExpr:
+		value, err := evaluate(n.X, record)
+		if err != nil {
+			return nil, err
+		}
+		if n.Op == token.NOT {
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("operator ! expects a boolean, got %T", value)
+			}
+			return !b, nil
+		}
+		number, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("operator - expects a number, got %T", value)
+		}
+		return -number, nil
+	case *ast.BinaryExpr:
+		return evaluateBinary(n, record)
+	case *ast.CallExpr:
+		args := make([]interface{}, 0, len(n.Args))
+		for _, arg := range n.Args {
+			value, err := evaluate(arg, record)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, value)
+		}
+		return expressionFunctions[n.Fun.(*ast.Ident).Name](args)
+	default:
+		return nil, fmt.Errorf("unsupported syntax %T", node)
+	}
+}
+
+func literal(n *ast.BasicLit) (interface{}, error) {
+	if n.Kind == token.STRING {
+		return strconv.Unquote(n.Value)
+	}
+	return strconv.ParseFloat(n.Value, 64)
+}
+
+func evaluateIndex(n *ast.IndexExpr, record map[string]interface{}) (interface{}, error) {
+	parent, err := evaluate(n.X, record)
+	if err != nil {
+		return nil, err
+	}
+	index, err := evaluate(n.Index, record)
+	if err != nil {
+		return nil, err
+	}
+	switch collection := parent.(type) {
+	case []interface{}:
+		i, ok := index.(float64)
+		if !ok || i < 0 || int(i) >= len(collection) {
+			return nil, nil
+		}
+		return collection[int(i)], nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, nil
+		}
+		return collection[key], nil
+	default:
+		return nil, nil
+	}
+}
+
+func evaluateBinary(n *ast.BinaryExpr, record map[string]interface{}) (interface{}, error) {
+	left, err := evaluate(n.X, record)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op == token.LAND || n.Op == token.LOR {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s expects booleans, got %T", n.Op, left)
+		}
+		if (n.Op == token.LAND && !l) || (n.Op == token.LOR && l) {
+			return l, nil
+		}
+		right, err := evaluate(n.Y, record)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s expects booleans, got %T", n.Op, right)
+		}
+		return r, nil
+	}
+
+	right, err := evaluate(n.Y, record)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Op {
+	case token.EQL:
+		return left == right, nil
+	case token.NEQ:
+		return left != right, nil
+	}
+
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator %s expects strings, got %T", n.Op, right)
+		}
+		return compareStrings(n.Op, l, r)
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("operator %s expects numbers, got %T and %T", n.Op, left, right)
+	}
+	switch n.Op {
+	case token.ADD:
+		return l + r, nil
+	case token.SUB:
+		return l - r, nil
+	case token.MUL:
+		return l * r, nil
+	case token.QUO:
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return l / r, nil
+	case token.REM:
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(l, r), nil
+	case token.LSS:
+		return l < r, nil
+	case token.LEQ:
+		return l <= r, nil
+	case token.GTR:
+		return l > r, nil
+	default:
+		return l >= r, nil
+	}
+}
+
+func compareStrings(op token.Token, l string, r string) (interface{}, error) {
+	switch op {
+	case token.ADD:
+		return l + r, nil
+	case token.LSS:
+		return l < r, nil
+	case token.LEQ:
+		return l <= r, nil
+	case token.GTR:
+		return l > r, nil
+	case token.GEQ:
+		return l >= r, nil
+	default:
+		return nil, fmt.Errorf("operator %s is not supported on strings", op)
+	}
+}
+
+func stringArgument(args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected one argument")
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %T", args[0])
+	}
+	return s, nil
+}
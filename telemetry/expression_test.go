@@ -0,0 +1,143 @@
+package telemetry_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Expression", func() {
+	record := map[string]interface{}{
+		"vin":   "ABC",
+		"count": float64(4),
+		"ok":    true,
+		"data":  []interface{}{map[string]interface{}{"key": "speed", "value": float64(10)}},
+		"tags":  map[string]interface{}{"region": "eu"},
+	}
+
+	evaluate := func(source string) (interface{}, error) {
+		expression, err := telemetry.CompileExpression(source)
+		Expect(err).NotTo(HaveOccurred())
+		return expression.Evaluate(record)
+	}
+
+	DescribeTable("evaluates",
+		func(source string, expected interface{}) {
+			value, err := evaluate(source)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal(expected))
+		},
+		Entry("number", "1.5", 1.5),
+		Entry("string", `"a"`, "a"),
+		Entry("raw string", "`a`", "a"),
+		Entry("booleans", "true", true),
+		Entry("field", "vin", "ABC"),
+		Entry("nested field", "tags.region", "eu"),
+		Entry("list index", "data[0].key", "speed"),
+		Entry("map index", `tags["region"]`, "eu"),
+		Entry("negation", "-count", float64(-4)),
+		Entry("not", "!ok", false),
+		Entry("string concatenation", `vin + "D"`, "ABCD"),
+		Entry("string comparison", `vin < "ABD"`, true),
+		Entry("equality of different types", `count == "4"`, false),
+		Entry("inequality", "count != 3", true),
+		Entry("remainder", "count % 3", float64(1)),
+		Entry("functions", `upper(lower(vin)) == "ABC" && round(2.5) == 3 && has(vin) && !has(absent)`, true),
+	)
+
+	DescribeTable("evaluates to null",
+		func(source string) {
+			value, err := evaluate(source)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(BeNil())
+		},
+		Entry("null", "null"),
+		Entry("missing field", "absent"),
+		Entry("field of a missing object", "absent.region"),
+		Entry("field of a value", "vin.region"),
+		Entry("list index out of range", "data[1]"),
+		Entry("negative list index", "data[-1]"),
+		Entry("string list index", `data["0"]`),
+		Entry("index of a value", "vin[0]"),
+	)
+
+	DescribeTable("applies the precedence of the operators",
+		func(source string, expected interface{}) {
+			value, err := evaluate(source)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal(expected))
+		},
+		Entry("multiplication before addition", "1 + 2 * 3", float64(7)),
+		Entry("division before subtraction", "10 - 6 / 2", float64(7)),
+		Entry("remainder before addition", "1 + 7 % 4", float64(4)),
+		Entry("left associative subtraction", "10 - 4 - 3", float64(3)),
+		Entry("left associative division", "24 / 4 / 2", float64(3)),
+		Entry("parentheses", "(1 + 2) * 3", float64(9)),
+		Entry("unary minus before multiplication", "-2 * 3", float64(-6)),
+		Entry("arithmetic before comparison", "count * 2 > 7", true),
+		Entry("comparison before and", "count > 3 && count < 5", true),
+		Entry("and before or", "true || false && false", true),
+		Entry("parenthesized or", "(true || false) && false", false),
+		Entry("not before and", "!false && false", false),
+	)
+
+	It("short circuits the boolean operators", func() {
+		Expect(evaluate("false && count / 0 > 1")).To(BeFalse())
+		Expect(evaluate("true || count / 0 > 1")).To(BeTrue())
+	})
+
+	DescribeTable("rejects invalid expressions",
+		func(source string, message string) {
+			_, err := telemetry.CompileExpression(source)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("empty", "", "invalid expression"),
+		Entry("incomplete", "1 +", "invalid expression"),
+		Entry("unbalanced parentheses", "(1 + 2", "invalid expression"),
+		Entry("statement", "x := 1", "invalid expression"),
+		Entry("too long", strings.Repeat("1+", telemetry.MaxExpressionLength)+"1", "expression longer than"),
+		Entry("character literal", "'a'", "unsupported literal"),
+		Entry("imaginary literal", "2i", "unsupported literal"),
+		Entry("hexadecimal literal", "0x10", "invalid number"),
+		Entry("unknown function", "exec(vin)", "unknown function exec"),
+		Entry("unknown function in argument", "lower(exec(vin))", "unknown function exec"),
+		Entry("method call", "vin.String()", "unsupported function call"),
+		Entry("closure", "func() int { for {} }()", "unsupported"),
+		Entry("composite literal", "[]int{1}", "unsupported syntax"),
+		Entry("slice", "data[0:1]", "unsupported syntax"),
+		Entry("type assertion", "vin.(string)", "unsupported syntax"),
+		Entry("shift", "count << 2", "unsupported operator"),
+		Entry("bitwise and", "count & 1", "unsupported operator"),
+		Entry("bitwise or", "count | 1", "unsupported operator"),
+		Entry("xor", "count ^ 1", "unsupported operator"),
+		Entry("unary plus", "+count", "unsupported operator"),
+		Entry("address", "&count", "unsupported operator"),
+		Entry("unsupported operator in operand", "1 + (count << 2)", "unsupported operator"),
+	)
+
+	DescribeTable("fails to evaluate",
+		func(source string, message string) {
+			_, err := evaluate(source)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("division by zero", "count / 0", "division by zero"),
+		Entry("remainder by zero", "count % 0", "division by zero"),
+		Entry("arithmetic on a string", "2 * vin", "expects numbers"),
+		Entry("arithmetic on a missing field", "absent + 1", "expects numbers"),
+		Entry("string and number", `vin + 1`, "expects strings"),
+		Entry("string operator", `vin - "A"`, "not supported on strings"),
+		Entry("negation of a string", "-vin", "operator - expects a number"),
+		Entry("not of a number", "!count", "operator ! expects a boolean"),
+		Entry("and of numbers", "count && true", "expects booleans"),
+		Entry("or with a number", "false || count", "expects booleans"),
+		Entry("lower of a number", "lower(count)", "expected a string"),
+		Entry("upper without argument", "upper()", "expected one argument"),
+		Entry("round of a string", "round(vin)", "round expects a number"),
+		Entry("round with two arguments", "round(1, 2)", "round expects one argument"),
+		Entry("has with two arguments", "has(vin, count)", "has expects one argument"),
+		Entry("error in a nested operand", "1 + (count / 0)", "division by zero"),
+	)
+})
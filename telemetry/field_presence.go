@@ -0,0 +1,89 @@
+package telemetry
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+// presenceMessages are the messages of the record types whose fields presence can be counted, other than V
+var presenceMessages = map[string]proto.Message{
+	"alerts":       &protos.VehicleAlerts{},
+	"errors":       &protos.VehicleErrors{},
+	"connectivity": &protos.VehicleConnectivity{},
+}
+
+// FieldPresence reports whether the configured fields of each record type are populated in the records.
+// The fields of V records are signal names, the fields of the other record types are top level proto fields.
+type FieldPresence struct {
+	signals map[protos.Field]string
+	fields  map[string][]protoreflect.FieldDescriptor
+}
+
+// NewFieldPresence returns a FieldPresence observing the fields of each record type
+func NewFieldPresence(recordFields map[string][]string) (*FieldPresence, error) {
+	presence := &FieldPresence{
+		signals: make(map[protos.Field]string),
+		fields:  make(map[string][]protoreflect.FieldDescriptor),
+	}
+	for recordType, fields := range recordFields {
+		if recordType == "V" {
+			for _, field := range fields {
+				signal, ok := protos.Field_value[field]
+				if !ok {
+					return nil, fmt.Errorf("unknown signal for field presence: %s", field)
+				}
+				presence.signals[protos.Field(signal)] = field
+			}
+			continue
+		}
+
+		message, ok := presenceMessages[recordType]
+		if !ok {
+			return nil, fmt.Errorf("field presence not supported for record type %s", recordType)
+		}
+		descriptors := message.ProtoReflect().Descriptor().Fields()
+		for _, field := range fields {
+			descriptor := descriptors.ByName(protoreflect.Name(field))
+			if descriptor == nil {
+				return nil, fmt.Errorf("unknown field for field presence of %s records: %s", recordType, field)
+			}
+			presence.fields[recordType] = append(presence.fields[recordType], descriptor)
+		}
+	}
+	return presence, nil
+}
+
+// Observe calls report with the presence of every configured field of the record type
+func (p *FieldPresence) Observe(record *Record, report func(field string, present bool)) {
+	message := record.GetProtoMessage()
+	if message == nil {
+		return
+	}
+
+	if payload, ok := message.(*protos.Payload); ok {
+		if len(p.signals) == 0 {
+			return
+		}
+		present := make(map[protos.Field]bool, len(payload.GetData()))
+		for _, datum := range payload.GetData() {
+			present[datum.GetKey()] = true
+		}
+		for signal, name := range p.signals {
+			report(name, present[signal])
+		}
+		return
+	}
+
+	descriptors := p.fields[record.TxType]
+	reflected := message.ProtoReflect()
+	if len(descriptors) == 0 || reflected.Descriptor() != descriptors[0].ContainingMessage() {
+		return
+	}
+	for _, descriptor := range descriptors {
+		report(string(descriptor.Name()), reflected.Has(descriptor))
+	}
+}
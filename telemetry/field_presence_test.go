@@ -0,0 +1,64 @@
+package telemetry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("FieldPresence", func() {
+	var serializer *telemetry.BinarySerializer
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		serializer = telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{}, logger)
+	})
+
+	newRecord := func(topic string, payload []byte) *telemetry.Record {
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte(topic), Payload: payload}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	observe := func(presence *telemetry.FieldPresence, record *telemetry.Record) map[string]bool {
+		observed := make(map[string]bool)
+		presence.Observe(record, func(field string, present bool) { observed[field] = present })
+		return observed
+	}
+
+	It("rejects unknown fields and record types", func() {
+		_, err := telemetry.NewFieldPresence(map[string][]string{"V": {"NotASignal"}})
+		Expect(err).To(MatchError("unknown signal for field presence: NotASignal"))
+		_, err = telemetry.NewFieldPresence(map[string][]string{"connectivity": {"not_a_field"}})
+		Expect(err).To(MatchError("unknown field for field presence of connectivity records: not_a_field"))
+		_, err = telemetry.NewFieldPresence(map[string][]string{"D4": {"field"}})
+		Expect(err).To(MatchError("field presence not supported for record type D4"))
+	})
+
+	It("reports the presence of the signals of V records", func() {
+		presence, err := telemetry.NewFieldPresence(map[string][]string{"V": {"Location", "BatteryLevel"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		record := newRecord("V", generatePayload("cybertruck", "42", nil, stringDatum(protos.Field_Location, "(37.412374 N, 122.145867 W)")))
+		Expect(observe(presence, record)).To(Equal(map[string]bool{"Location": true, "BatteryLevel": false}))
+	})
+
+	It("reports the presence of the fields of the other record types", func() {
+		presence, err := telemetry.NewFieldPresence(map[string][]string{"connectivity": {"network_interface", "connection_id"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		payload, err := proto.Marshal(&protos.VehicleConnectivity{Vin: "42", NetworkInterface: "wifi"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(observe(presence, newRecord("connectivity", payload))).To(Equal(map[string]bool{"network_interface": true, "connection_id": false}))
+		Expect(observe(presence, newRecord("V", generatePayload("cybertruck", "42", nil)))).To(BeEmpty())
+	})
+})
@@ -0,0 +1,77 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// MessageTransformFunc rewrites the decoded message of a record of the topic before dispatch
+type MessageTransformFunc func(topic string, decoded proto.Message) (proto.Message, error)
+
+// MessageTransformers are the transformers registered in code by integrators for each topic, they run in
+// registration order on the decoded messages of the records
+type MessageTransformers struct {
+	mutex        sync.RWMutex
+	transformers map[string][]MessageTransformFunc
+}
+
+// NewMessageTransformers returns an empty registry of message transformers
+func NewMessageTransformers() *MessageTransformers {
+	return &MessageTransformers{transformers: make(map[string][]MessageTransformFunc)}
+}
+
+// Register appends a transformer of the records of the topic
+func (t *MessageTransformers) Register(topic string, transform MessageTransformFunc) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.transformers[topic] = append(t.transformers[topic], transform)
+}
+
+// Applies returns true if transformers are registered for the topic
+func (t *MessageTransformers) Applies(topic string) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return len(t.transformers[topic]) > 0
+}
+
+// Transform runs the transformers of the topic of the record on a copy of its decoded message and re-encodes
+// the payload with the result. The record is left unchanged if any transformer fails or panics, records without
+// decoded message are not transformed
+func (t *MessageTransformers) Transform(record *Record) error {
+	if record.GetProtoMessage() == nil {
+		return nil
+	}
+	t.mutex.RLock()
+	transformers := t.transformers[record.TxType]
+	t.mutex.RUnlock()
+	if len(transformers) == 0 {
+		return nil
+	}
+
+	message := proto.Clone(record.GetProtoMessage())
+	for _, transform := range transformers {
+		var err error
+		if message, err = runTransform(transform, record.TxType, message); err != nil {
+			return err
+		}
+		if message == nil {
+			return errors.New("transformer returned no message")
+		}
+	}
+	return record.setProtoMessage(message)
+}
+
+// runTransform calls the transformer, a panic of the transformer is returned as an error
+func runTransform(transform MessageTransformFunc, topic string, message proto.Message) (transformed proto.Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in message transformer: %v", r)
+		}
+	}()
+	return transform(topic, message)
+}
@@ -1,6 +1,7 @@
 package telemetry
 
 import (
+	"context"
 	"fmt"
 
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -20,6 +21,12 @@ const (
 	Logger Dispatcher = "logger"
 	// ZMQ registers a zmq logger
 	ZMQ Dispatcher = "zmq"
+	// BigQuery registers a Google BigQuery dispatcher
+	BigQuery Dispatcher = "bigquery"
+	// EventHubs registers an Azure Event Hubs dispatcher
+	EventHubs Dispatcher = "eventhubs"
+	// Pulsar registers an Apache Pulsar dispatcher
+	Pulsar Dispatcher = "pulsar"
 )
 
 // BuildTopicName creates a topic from a namespace and a recordName
@@ -34,3 +41,14 @@ type Producer interface {
 	ProcessReliableAck(entry *Record)
 	ReportError(message string, err error, logInfo logrus.LogInfo)
 }
+
+// Flusher is implemented by the producers dispatching the records asynchronously, Flush returns once the records
+// produced before it was called are dispatched and their reliable acks sent to the ack channel, or the context is done
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// ReliableAckSource is implemented by the producers sending the reliable acks of record types to the ack channel
+type ReliableAckSource interface {
+	ReliableAcks(recordType string) bool
+}
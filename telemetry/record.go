@@ -1,10 +1,12 @@
 package telemetry
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -12,6 +14,7 @@ import (
 
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -33,30 +36,61 @@ var (
 // Record is a structs that represents the telemetry records vehicles send to the backend
 // vin is used as kafka produce partitioning key by default, can be configured to random
 type Record struct {
-	ProduceTime            time.Time
+	// AckedOnReceipt is set when the reliable acks of the record type were disabled at runtime when the record was
+	// received. The record was acked then, its reliable ack source does not ack it again
+	AckedOnReceipt         bool
+	ContentEncoding        string
 	ReceivedTimestamp      int64
+	Sequence               uint64
+	SessionEnd             bool
+	DisconnectReason       string
+	DecodeError            string
+	FailedTxType           string
 	Serializer             *BinarySerializer
 	SocketID               string
 	Timestamp              int64
 	Txid                   string
 	TxType                 string
 	TripID                 string
+	TraceID                string
 	Version                int
 	Vin                    string
 	PayloadBytes           []byte
 	RawBytes               []byte
 	transmitDecodedRecords bool
 	protoMessage           proto.Message
+	missingTopic           bool
+	unknownFields          bool
+	// dispatchRules are the rules of the rules source of the serializer when the record was decoded, it is dispatched with them
+	dispatchRules map[string][]Producer
+	// routed is set once the record is dispatched to the producers of a route in place of its dispatch rules
+	routed bool
+	// produceTimes are the times the record was produced to each of its dispatchers
+	produceTimes *produceTimes
+}
+
+// produceTimes are the times a record was produced to its dispatchers, read by the delivery and ack goroutines
+type produceTimes struct {
+	mutex sync.Mutex
+	times map[Dispatcher]time.Time
 }
 
 // NewRecord Sanitizes and instantiates a Record from a message
 // !! caller expect *Record to not be nil !!
 func NewRecord(ts *BinarySerializer, msg []byte, socketID string, transmitDecodedRecords bool) (*Record, error) {
+	return newRecord(ts, msg, transmitDecodedRecords, func() (*Record, error) {
+		return ts.Deserialize(msg, socketID)
+	})
+}
+
+// newRecord decodes the message with deserialize and applies the record transforms, messages above the size limit
+// are rejected before they are decoded. It is shared by the server and DecodeRecord
+func newRecord(ts *BinarySerializer, msg []byte, transmitDecodedRecords bool, deserialize func() (*Record, error)) (*Record, error) {
 	if len(msg) > SizeLimit {
 		return &Record{Serializer: ts, transmitDecodedRecords: transmitDecodedRecords}, ErrMessageTooBig
 	}
 
-	rec, err := ts.Deserialize(msg, socketID)
+	rec, err := deserialize()
 	rec.transmitDecodedRecords = transmitDecodedRecords
 	if err != nil {
 		return rec, err
@@ -65,6 +99,59 @@ func NewRecord(ts *BinarySerializer, msg []byte, socketID string, transmitDecode
 	return rec, err
 }
 
+// SessionEndPayload is the payload of the sentinel records marking the end of the session of a device, a JSON object
+// with the session_end key so that consumers of the dispatchers without metadata tell it from the records of the device
+type SessionEndPayload struct {
+	SessionEnd   bool   `json:"session_end"`
+	Vin          string `json:"vin"`
+	ConnectionID string `json:"connection_id"`
+	EndedAtMs    int64  `json:"ended_at_ms"`
+}
+
+// NewSessionEndRecord returns the sentinel record marking the end of the session of the device on the topic
+// of the record type, its payload is a SessionEndPayload and its metadata carries "session_end"
+func NewSessionEndRecord(ts *BinarySerializer, recordType string, socketID string) *Record {
+	now := time.Now().UnixMilli()
+	record := &Record{
+		Serializer:        ts,
+		SocketID:          socketID,
+		Txid:              socketID,
+		TxType:            recordType,
+		ReceivedTimestamp: now,
+		Timestamp:         now,
+		SessionEnd:        true,
+	}
+	if ts.RequestIdentity != nil {
+		record.Vin = ts.RequestIdentity.DeviceID
+	}
+	record.PayloadBytes, _ = json.Marshal(SessionEndPayload{SessionEnd: true, Vin: record.Vin, ConnectionID: socketID, EndedAtMs: now})
+	return record
+}
+
+// NewDecodeErrorRecord returns the dead-letter record of a message which could not be decoded, dispatched on the
+// topic of the record type. Its payload is the raw message and its metadata carries the decode error and the
+// record type of the message, empty when it could not be determined
+func NewDecodeErrorRecord(ts *BinarySerializer, recordType string, message []byte, failed *Record, decodeErr error, socketID string) *Record {
+	now := time.Now().UnixMilli()
+	record := &Record{
+		Serializer:        ts,
+		SocketID:          socketID,
+		Txid:              failed.Txid,
+		TraceID:           failed.TraceID,
+		TxType:            recordType,
+		FailedTxType:      failed.TxType,
+		DecodeError:       decodeErr.Error(),
+		ReceivedTimestamp: now,
+		Timestamp:         now,
+		PayloadBytes:      message,
+		RawBytes:          message,
+	}
+	if ts.RequestIdentity != nil {
+		record.Vin = ts.RequestIdentity.DeviceID
+	}
+	return record
+}
+
 // Ack returns an ack response from the serializer
 func (record *Record) Ack() []byte {
 	return record.Serializer.Ack(record)
@@ -75,6 +162,51 @@ func (record *Record) Error(err error) []byte {
 	return record.Serializer.Error(err, record)
 }
 
+// MissingTopic returns true if the record was received without a topic and the default topic was applied
+func (record *Record) MissingTopic() bool {
+	return record.missingTopic
+}
+
+// Routed returns true if the record was dispatched to the producers of a route in place of its dispatch rules
+func (record *Record) Routed() bool {
+	return record.routed
+}
+
+// HasUnknownFields returns true if the decoded payload carried fields unknown to the proto definitions
+func (record *Record) HasUnknownFields() bool {
+	return record.unknownFields
+}
+
+// WithTxType returns a copy of the record of the record type, the record itself is left unchanged for the
+// dispatchers it is shared with
+func (record *Record) WithTxType(txType string) *Record {
+	copied := *record
+	copied.TxType = txType
+	copied.produceTimes = nil
+	return &copied
+}
+
+// SetProduceTime records the time the record is produced to the dispatcher. The records are produced to their
+// dispatchers one after the other by the goroutine dispatching them
+func (record *Record) SetProduceTime(dispatcher Dispatcher, produceTime time.Time) {
+	if record.produceTimes == nil {
+		record.produceTimes = &produceTimes{times: make(map[Dispatcher]time.Time)}
+	}
+	record.produceTimes.mutex.Lock()
+	defer record.produceTimes.mutex.Unlock()
+	record.produceTimes.times[dispatcher] = produceTime
+}
+
+// ProduceTime returns the time the record was produced to the dispatcher, zero if it was not
+func (record *Record) ProduceTime(dispatcher Dispatcher) time.Time {
+	if record.produceTimes == nil {
+		return time.Time{}
+	}
+	record.produceTimes.mutex.Lock()
+	defer record.produceTimes.mutex.Unlock()
+	return record.produceTimes.times[dispatcher]
+}
+
 // Metadata converts record to metadata map
 func (record *Record) Metadata() map[string]string {
 	metadata := make(map[string]string)
@@ -84,6 +216,25 @@ func (record *Record) Metadata() map[string]string {
 	metadata["txid"] = record.Txid
 	metadata["txtype"] = record.TxType
 	metadata["version"] = fmt.Sprint(record.Version)
+	if record.Sequence > 0 {
+		metadata["sequence"] = fmt.Sprint(record.Sequence)
+	}
+	if record.ContentEncoding != "" {
+		metadata["content_encoding"] = record.ContentEncoding
+	}
+	if record.SessionEnd {
+		metadata["session_end"] = "true"
+	}
+	if record.DisconnectReason != "" {
+		metadata["disconnect_reason"] = record.DisconnectReason
+	}
+	if record.TraceID != "" {
+		metadata["trace_id"] = record.TraceID
+	}
+	if record.DecodeError != "" {
+		metadata["decode_error"] = record.DecodeError
+		metadata["failed_txtype"] = record.FailedTxType
+	}
 	return metadata
 }
 
@@ -139,7 +290,7 @@ func (record *Record) applyProtoRecordTransforms() error {
 	switch record.TxType {
 	case "alerts":
 		message := &protos.VehicleAlerts{}
-		err := proto.Unmarshal(record.Payload(), message)
+		err := record.unmarshalPayload(message)
 		if err != nil {
 			return err
 		}
@@ -150,7 +301,7 @@ func (record *Record) applyProtoRecordTransforms() error {
 		return err
 	case "errors":
 		message := &protos.VehicleErrors{}
-		err := proto.Unmarshal(record.Payload(), message)
+		err := record.unmarshalPayload(message)
 		if err != nil {
 			return err
 		}
@@ -160,7 +311,7 @@ func (record *Record) applyProtoRecordTransforms() error {
 		return err
 	case "V":
 		message := &protos.Payload{}
-		err := proto.Unmarshal(record.Payload(), message)
+		err := record.unmarshalPayload(message)
 		if err != nil {
 			return err
 		}
@@ -172,7 +323,16 @@ func (record *Record) applyProtoRecordTransforms() error {
 		return err
 	case "connectivity":
 		message := &protos.VehicleConnectivity{}
-		err := proto.Unmarshal(record.Payload(), message)
+		err := record.unmarshalPayload(message)
+		if err != nil {
+			return err
+		}
+		record.PayloadBytes, err = proto.Marshal(message)
+		record.protoMessage = message
+		return err
+	case "connectivity_batch":
+		message := &protos.VehicleConnectivityBatch{}
+		err := record.unmarshalPayload(message)
 		if err != nil {
 			return err
 		}
@@ -184,6 +344,50 @@ func (record *Record) applyProtoRecordTransforms() error {
 	}
 }
 
+// unmarshalPayload decodes the payload into message, unknown fields are kept unless the serializer is configured
+// to discard them for the record type. Only the record types discarding them are walked for nested unknown fields,
+// the others are flagged from the unknown fields of the top level message
+func (record *Record) unmarshalPayload(message proto.Message) error {
+	if err := proto.Unmarshal(record.Payload(), message); err != nil {
+		return err
+	}
+	if record.Serializer != nil && record.Serializer.DiscardUnknownFields[record.TxType] {
+		record.unknownFields = walkUnknownFields(message.ProtoReflect(), true)
+		return nil
+	}
+	record.unknownFields = len(message.ProtoReflect().GetUnknown()) > 0
+	return nil
+}
+
+// walkUnknownFields returns true if the message or any nested message has unknown fields, clearing them if discard is set
+func walkUnknownFields(message protoreflect.Message, discard bool) bool {
+	found := false
+	if len(message.GetUnknown()) > 0 {
+		found = true
+		if discard {
+			message.SetUnknown(nil)
+		}
+	}
+	message.Range(func(fd protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				found = walkUnknownFields(list.Get(i).Message(), discard) || found
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			value.Map().Range(func(_ protoreflect.MapKey, mapValue protoreflect.Value) bool {
+				found = walkUnknownFields(mapValue.Message(), discard) || found
+				return true
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			found = walkUnknownFields(value.Message(), discard) || found
+		}
+		return true
+	})
+	return found
+}
+
 func (record *Record) applyRecordTransforms() error {
 	var err error
 	if err = record.applyProtoRecordTransforms(); err != nil {
@@ -201,6 +405,23 @@ func (record *Record) GetProtoMessage() proto.Message {
 	return record.protoMessage
 }
 
+// setProtoMessage replaces the decoded message of the record and encodes its payload from it
+func (record *Record) setProtoMessage(message proto.Message) error {
+	var payload []byte
+	var err error
+	if record.transmitDecodedRecords {
+		payload, err = jsonOptions.Marshal(message)
+	} else {
+		payload, err = proto.Marshal(message)
+	}
+	if err != nil {
+		return err
+	}
+	record.protoMessage = message
+	record.PayloadBytes = payload
+	return nil
+}
+
 // ToJSON serializes the record to a JSON data in bytes
 func (record *Record) toJSON() ([]byte, error) {
 	return jsonOptions.Marshal(record.protoMessage)
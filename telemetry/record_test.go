@@ -2,6 +2,8 @@ package telemetry_test
 
 import (
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
 	"time"
@@ -302,6 +304,13 @@ var _ = Describe("Socket handler test", func() {
 				}
 				return myMsg.GetVin() == "testConnectivityVin"
 			}),
+			Entry("for txType connectivity_batch", "connectivity_batch", "testConnectivityVin", &protos.VehicleConnectivityBatch{Events: []*protos.VehicleConnectivity{{Vin: "testConnectivityVin"}}}, func(msg proto.Message) bool {
+				myMsg, ok := msg.(*protos.VehicleConnectivityBatch)
+				if !ok {
+					return false
+				}
+				return len(myMsg.GetEvents()) == 1 && myMsg.GetEvents()[0].GetVin() == "testConnectivityVin"
+			}),
 			Entry("for txType V", "V", "testPayloadVIN", &protos.Payload{Vin: "testPayloadVIN"}, func(msg proto.Message) bool {
 				myMsg, ok := msg.(*protos.Payload)
 				if !ok {
@@ -327,6 +336,105 @@ var _ = Describe("Socket handler test", func() {
 		})
 	})
 
+	Describe("unknown fields", func() {
+		// field number 999 with varint value 1 is not part of the payload definition
+		unknownField := []byte{0xb8, 0x3e, 0x01}
+
+		newRecord := func() *telemetry.Record {
+			payload := append(generatePayload("cybertruck", "42", nil), unknownField...)
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: payload}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+			Expect(err).NotTo(HaveOccurred())
+			return record
+		}
+
+		It("passes unknown fields through by default", func() {
+			record := newRecord()
+			Expect(record.HasUnknownFields()).To(BeTrue())
+			Expect(record.Payload()).To(ContainSubstring(string(unknownField)))
+		})
+
+		It("discards unknown fields of configured record types", func() {
+			serializer.DiscardUnknownFields = map[string]bool{"V": true}
+			record := newRecord()
+			Expect(record.HasUnknownFields()).To(BeTrue())
+			Expect(record.Payload()).NotTo(ContainSubstring(string(unknownField)))
+		})
+
+		It("keeps the unknown fields of the other record types", func() {
+			serializer.DiscardUnknownFields = map[string]bool{"alerts": true}
+			record := newRecord()
+			Expect(record.Payload()).To(ContainSubstring(string(unknownField)))
+		})
+
+		It("does not flag records without unknown fields", func() {
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.HasUnknownFields()).To(BeFalse())
+		})
+	})
+
+	Describe("session end", func() {
+		It("marks sentinel records in their metadata", func() {
+			record := telemetry.NewSessionEndRecord(serializer, "V", "socket-1")
+			Expect(record.Vin).To(Equal("42"))
+			payload := telemetry.SessionEndPayload{}
+			Expect(json.Unmarshal(record.Payload(), &payload)).To(Succeed())
+			Expect(payload.SessionEnd).To(BeTrue())
+			Expect(payload.Vin).To(Equal("42"))
+			Expect(payload.ConnectionID).To(Equal("socket-1"))
+			Expect(payload.EndedAtMs).To(Equal(record.Timestamp))
+			Expect(record.Metadata()).To(HaveKeyWithValue("session_end", "true"))
+			Expect(record.Metadata()).To(HaveKeyWithValue("txtype", "V"))
+			Expect(record.Metadata()).NotTo(HaveKey("trace_id"))
+		})
+	})
+
+	Describe("WithTxType", func() {
+		It("copies the record of the record type", func() {
+			record := &telemetry.Record{Txid: "1234", TxType: "connectivity", Vin: "42"}
+			copied := record.WithTxType("connectivity_v2")
+			Expect(copied.TxType).To(Equal("connectivity_v2"))
+			Expect(copied.Txid).To(Equal("1234"))
+			Expect(copied.Vin).To(Equal("42"))
+			Expect(record.TxType).To(Equal("connectivity"))
+		})
+	})
+
+	Describe("ProduceTime", func() {
+		It("keeps the produce time of each dispatcher", func() {
+			record := &telemetry.Record{TxType: "V"}
+			Expect(record.ProduceTime(telemetry.Kafka)).To(BeZero())
+
+			produced := time.Now().Add(-time.Second)
+			record.SetProduceTime(telemetry.Kafka, produced)
+			record.SetProduceTime(telemetry.Kinesis, time.Now())
+			Expect(record.ProduceTime(telemetry.Kafka)).To(Equal(produced))
+			Expect(record.WithTxType("V2").ProduceTime(telemetry.Kafka)).To(BeZero())
+		})
+	})
+
+	Describe("decode error", func() {
+		It("carries the raw message and the error in its metadata", func() {
+			failed := &telemetry.Record{Txid: "1234", TxType: "V", TraceID: "trace-1"}
+			record := telemetry.NewDecodeErrorRecord(serializer, "dead_letters", []byte("malformed"), failed, errors.New("proto: cannot parse"), "socket-1")
+			Expect(record.Vin).To(Equal("42"))
+			Expect(record.Payload()).To(Equal([]byte("malformed")))
+			Expect(record.Metadata()).To(HaveKeyWithValue("txtype", "dead_letters"))
+			Expect(record.Metadata()).To(HaveKeyWithValue("txid", "1234"))
+			Expect(record.Metadata()).To(HaveKeyWithValue("failed_txtype", "V"))
+			Expect(record.Metadata()).To(HaveKeyWithValue("decode_error", "proto: cannot parse"))
+			Expect(record.Metadata()).To(HaveKeyWithValue("trace_id", "trace-1"))
+		})
+	})
+
 	Describe("json record", func() {
 		It("outputs json with all data", func() {
 			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
@@ -0,0 +1,46 @@
+package telemetry
+
+import "sync"
+
+// RecordMatcher selects the records dispatched by a route, it must not modify the record
+type RecordMatcher func(record *Record) bool
+
+// Route dispatches the records of its topic selected by its matcher to its producers
+type Route struct {
+	Match     RecordMatcher
+	Producers []Producer
+}
+
+// Router holds the routes registered in code by integrators for each topic. A record is dispatched to the
+// producers of the first route matching it, or to the producers of the dispatch rules when no route matches
+type Router struct {
+	mutex  sync.RWMutex
+	routes map[string][]Route
+}
+
+// NewRouter returns a router without routes
+func NewRouter() *Router {
+	return &Router{routes: make(map[string][]Route)}
+}
+
+// Register appends a route of the records of the topic, routes are matched in registration order
+func (r *Router) Register(topic string, route Route) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.routes[topic] = append(r.routes[topic], route)
+}
+
+// Producers returns the producers of the first route matching the record, false if no route matches it
+func (r *Router) Producers(record *Record) ([]Producer, bool) {
+	r.mutex.RLock()
+	routes := r.routes[record.TxType]
+	r.mutex.RUnlock()
+
+	for _, route := range routes {
+		if route.Match(record) {
+			return route.Producers, true
+		}
+	}
+	return nil, false
+}
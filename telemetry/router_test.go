@@ -0,0 +1,83 @@
+package telemetry_test
+
+import (
+	"slices"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// reliableAckTester is a producer sending the reliable acks of its record types
+type reliableAckTester struct {
+	CallbackTester
+	recordTypes []string
+}
+
+func (r *reliableAckTester) ReliableAcks(recordType string) bool {
+	return slices.Contains(r.recordTypes, recordType)
+}
+
+var _ = Describe("Router", func() {
+	var (
+		bulk, urgent, fallback *CallbackTester
+		serializer             *telemetry.BinarySerializer
+	)
+
+	BeforeEach(func() {
+		bulk, urgent, fallback = &CallbackTester{}, &CallbackTester{}, &CallbackTester{}
+		logger, _ := logrus.NoOpLogger()
+		serializer = telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{"alerts": {fallback}, "V": {fallback}}, logger)
+		serializer.Router = telemetry.NewRouter()
+	})
+
+	isUrgent := func(record *telemetry.Record) bool { return record.Txid == "urgent" }
+	dispatch := func(txType string, txid string) {
+		serializer.Dispatch(&telemetry.Record{TxType: txType, Txid: txid, Vin: "42", Serializer: serializer})
+	}
+
+	It("dispatches the records to the producers of the first route matching them", func() {
+		serializer.Router.Register("alerts", telemetry.Route{Match: isUrgent, Producers: []telemetry.Producer{urgent}})
+		serializer.Router.Register("alerts", telemetry.Route{Match: func(_ *telemetry.Record) bool { return true }, Producers: []telemetry.Producer{bulk}})
+
+		dispatch("alerts", "urgent")
+		dispatch("alerts", "bulk")
+		Expect(urgent.counter).To(Equal(1))
+		Expect(bulk.counter).To(Equal(1))
+		Expect(fallback.counter).To(Equal(0))
+	})
+
+	It("dispatches the records matching no route with the dispatch rules", func() {
+		serializer.Router.Register("alerts", telemetry.Route{Match: isUrgent, Producers: []telemetry.Producer{urgent}})
+
+		dispatch("alerts", "bulk")
+		dispatch("V", "urgent")
+		Expect(urgent.counter).To(Equal(0))
+		Expect(fallback.counter).To(Equal(2))
+	})
+
+	It("dispatches the routed records to the reliable ack source of their rules", func() {
+		source := &reliableAckTester{recordTypes: []string{"alerts"}}
+		serializer.DispatchRules = map[string][]telemetry.Producer{"alerts": {fallback, source}}
+		serializer.Router.Register("alerts", telemetry.Route{Match: isUrgent, Producers: []telemetry.Producer{urgent}})
+
+		record := &telemetry.Record{TxType: "alerts", Txid: "urgent", Vin: "42", Serializer: serializer}
+		serializer.Dispatch(record)
+		Expect(record.Routed()).To(BeTrue())
+		Expect(urgent.counter).To(Equal(1))
+		Expect(source.counter).To(Equal(1))
+		Expect(fallback.counter).To(Equal(0))
+	})
+
+	It("dispatches the routed records once to a route including the reliable ack source", func() {
+		source := &reliableAckTester{recordTypes: []string{"alerts"}}
+		serializer.DispatchRules = map[string][]telemetry.Producer{"alerts": {source}}
+		serializer.Router.Register("alerts", telemetry.Route{Match: isUrgent, Producers: []telemetry.Producer{urgent, source}})
+
+		dispatch("alerts", "urgent")
+		Expect(urgent.counter).To(Equal(1))
+		Expect(source.counter).To(Equal(1))
+	})
+})
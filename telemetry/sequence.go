@@ -0,0 +1,83 @@
+package telemetry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/internal/lru"
+)
+
+// DefaultSequenceMaxDevices bounds the number of devices tracked by ClockSequence when not configured
+const DefaultSequenceMaxDevices = 100000
+
+// SequenceSource assigns monotonic sequence numbers to the records of a device so downstream
+// consumers can reorder them or detect gaps. Implementations backed by a store shared between
+// the servers keep the ordering when a device reconnects to another server.
+type SequenceSource interface {
+	Next(deviceID string) (uint64, error)
+}
+
+// SequenceRestorer is implemented by the sequence sources able to resume the sequence numbers of a device
+// from the last one assigned before a restart
+type SequenceRestorer interface {
+	Restore(deviceID string, last uint64)
+}
+
+// ClockSequence is a per device hybrid logical clock: sequence numbers are the current time in
+// microseconds, or the last sequence number of the device plus one when the clock did not move
+// forward. Records of a device reconnecting to another server stay ordered as long as the clocks
+// of the servers drift less than the time it takes to reconnect.
+type ClockSequence struct {
+	now func() time.Time
+
+	mutex   sync.Mutex
+	devices *lru.Cache[string, *deviceSequence]
+}
+
+type deviceSequence struct {
+	last uint64
+}
+
+// NewClockSequence returns a ClockSequence keeping the last sequence number of at most maxDevices devices
+func NewClockSequence(maxDevices int) *ClockSequence {
+	if maxDevices <= 0 {
+		maxDevices = DefaultSequenceMaxDevices
+	}
+	return &ClockSequence{
+		now:     time.Now,
+		devices: lru.New[string, *deviceSequence](maxDevices),
+	}
+}
+
+// Next returns the next sequence number of the device
+func (s *ClockSequence) Next(deviceID string) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sequence := s.deviceSequence(deviceID)
+	next := uint64(s.now().UnixMicro())
+	if next <= sequence.last {
+		next = sequence.last + 1
+	}
+	sequence.last = next
+	return next, nil
+}
+
+// Restore makes the next sequence numbers of the device greater than last
+func (s *ClockSequence) Restore(deviceID string, last uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sequence := s.deviceSequence(deviceID)
+	sequence.last = max(sequence.last, last)
+}
+
+// deviceSequence returns the sequence of the device, evicting the least recently used device when full
+func (s *ClockSequence) deviceSequence(deviceID string) *deviceSequence {
+	if sequence, ok := s.devices.Get(deviceID); ok {
+		return sequence
+	}
+	sequence := &deviceSequence{}
+	s.devices.Add(deviceID, sequence)
+	return sequence
+}
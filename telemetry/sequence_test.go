@@ -0,0 +1,41 @@
+package telemetry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("ClockSequence", func() {
+	It("assigns increasing sequence numbers per device", func() {
+		sequence := telemetry.NewClockSequence(10)
+		last := uint64(0)
+		for i := 0; i < 1000; i++ {
+			next, err := sequence.Next("42")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(next).To(BeNumerically(">", last))
+			last = next
+		}
+	})
+
+	It("stays monotonic after evicting devices", func() {
+		sequence := telemetry.NewClockSequence(1)
+		first, err := sequence.Next("42")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = sequence.Next("43")
+		Expect(err).NotTo(HaveOccurred())
+		second, err := sequence.Next("42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).To(BeNumerically(">=", first))
+	})
+
+	It("resumes after the restored sequence number", func() {
+		sequence := telemetry.NewClockSequence(10)
+		restored := uint64(1) << 62
+		sequence.Restore("42", restored)
+		next, err := sequence.Next("42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next).To(Equal(restored + 1))
+	})
+})
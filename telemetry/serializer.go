@@ -2,6 +2,7 @@ package telemetry
 
 import (
 	"fmt"
+	"slices"
 	"time"
 
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -13,21 +14,50 @@ import (
 type RequestIdentity struct {
 	DeviceID string
 	SenderID string
+	// DeviceType is the client type of the certificate, such as vehicle_device, empty when unknown
+	DeviceType string
+	// Region of the device, empty when unknown
+	Region string
+	// KeyFingerprint is the hash of the public key of the client certificate
+	KeyFingerprint string
+	// SerializerVariant is the certificate organizational unit selecting the serializer settings, empty for the defaults
+	SerializerVariant string
 }
 
+// DefaultSerializerVariant is the variant of the serializers of connections without a configured variant
+const DefaultSerializerVariant = "default"
+
 // BinarySerializer serializes records
 type BinarySerializer struct {
 	DispatchRules   map[string][]Producer
 	RequestIdentity *RequestIdentity
+	// RulesSource replaces DispatchRules when set, each record is routed with the rules current when it was decoded
+	RulesSource *DispatchRulesSource
+	// DefaultTopic is applied to messages received without a topic, they are rejected when empty
+	DefaultTopic string
+	// DiscardUnknownFields is the set of record types for which unknown proto fields are removed, they are passed through otherwise
+	DiscardUnknownFields map[string]bool
+	// Variant is the serializer variant selected by the client certificate of the connection
+	Variant string
+	// Gateway is set for connections aggregating several devices, the device id of their records is trusted
+	// instead of the identity of the connection
+	Gateway bool
+	// Router selects the producers of the records matched by its routes in place of the dispatch rules when set
+	Router *Router
 
 	logger *logrus.Logger
 }
 
 // NewBinarySerializer returns a dedicated serializer for a current socket connection
 func NewBinarySerializer(requestIdentity *RequestIdentity, dispatchRules map[string][]Producer, logger *logrus.Logger) *BinarySerializer {
+	variant := DefaultSerializerVariant
+	if requestIdentity != nil && requestIdentity.SerializerVariant != "" {
+		variant = requestIdentity.SerializerVariant
+	}
 	return &BinarySerializer{
 		DispatchRules:   dispatchRules,
 		RequestIdentity: requestIdentity,
+		Variant:         variant,
 		logger:          logger,
 	}
 }
@@ -40,10 +70,49 @@ func (bs *BinarySerializer) Deserialize(msg []byte, socketID string) (record *Re
 		}
 	}()
 
+	rules := bs.DispatchRules
+	if bs.RulesSource != nil {
+		rules = bs.RulesSource.Load()
+	}
+	record, streamMessage, err := bs.deserialize(msg, socketID)
+	if bs.RulesSource != nil {
+		// the record keeps the rules it was checked against so a reload before its dispatch does not apply to it
+		record.dispatchRules = rules
+	}
+	if err != nil {
+		return record, err
+	}
+
+	if _, ok := rules[record.TxType]; ok {
+		return record, nil
+	}
+
+	if string(streamMessage.SenderID) != bs.RequestIdentity.SenderID && string(streamMessage.SenderID) != bs.RequestIdentity.DeviceID {
+		bs.logger.ErrorLog("unexpected_sender_id", err, logrus.LogInfo{"sender_id": string(streamMessage.SenderID), "expected_sender_id": bs.RequestIdentity.SenderID, "txid": record.Txid, "record_type": record.TxType})
+		return record, fmt.Errorf("message SenderID: %s do not match vehicleID: %s", string(streamMessage.SenderID), bs.RequestIdentity.SenderID)
+	}
+
+	return record, err
+}
+
+// deserialize decodes the raw stream message into a record without validating the sender of the message
+func (bs *BinarySerializer) deserialize(msg []byte, socketID string) (record *Record, streamMessage *messages.StreamMessage, err error) {
 	record = &Record{Serializer: bs, RawBytes: msg, SocketID: socketID}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while serializing binary hermes stream: %v", r)
+		}
+	}()
+
+	streamMessage, err = bs.decode(record, msg)
+	return record, streamMessage, err
+}
+
+// decode fills the record from the raw stream message bytes, it does not validate the sender of the message
+func (bs *BinarySerializer) decode(record *Record, msg []byte) (*messages.StreamMessage, error) {
 	streamMessage, err := messages.StreamMessageFromBytes(msg)
 	if err != nil {
-		return record, bs.guessError(record, msg)
+		return nil, bs.guessError(record, msg)
 	}
 
 	streamMessage.SetDeliveredAt(time.Now())
@@ -54,20 +123,21 @@ func (bs *BinarySerializer) Deserialize(msg []byte, socketID string) (record *Re
 
 	record.TxType = streamMessage.Topic()
 	record.Txid = string(streamMessage.TXID)
-	record.Vin = string(bs.RequestIdentity.DeviceID)
+	record.Vin = bs.RequestIdentity.DeviceID
+	if bs.Gateway && len(streamMessage.DeviceID) > 0 {
+		record.Vin = string(streamMessage.DeviceID)
+	}
 	record.PayloadBytes = streamMessage.Payload
 	record.ReceivedTimestamp = time.Now().Unix() * 1000
 
-	if _, ok := bs.DispatchRules[streamMessage.Topic()]; ok {
-		return record, nil
-	}
-
-	if string(streamMessage.SenderID) != bs.RequestIdentity.SenderID && string(streamMessage.SenderID) != bs.RequestIdentity.DeviceID {
-		bs.logger.ErrorLog("unexpected_sender_id", err, logrus.LogInfo{"sender_id": string(streamMessage.SenderID), "expected_sender_id": bs.RequestIdentity.SenderID, "txid": record.Txid, "record_type": record.TxType})
-		return record, fmt.Errorf("message SenderID: %s do not match vehicleID: %s", string(streamMessage.SenderID), bs.RequestIdentity.SenderID)
+	if record.TxType == "" {
+		if bs.DefaultTopic == "" {
+			return streamMessage, ErrMissingTopic
+		}
+		record.TxType = bs.DefaultTopic
+		record.missingTopic = true
 	}
-
-	return record, err
+	return streamMessage, nil
 }
 
 // Ack returns an ack response
@@ -84,13 +154,41 @@ func (bs *BinarySerializer) Error(err error, record *Record) []byte {
 	return b
 }
 
-// Dispatch pushes the record to kafka for every rule associated to it
+// Dispatch pushes the record to kafka for every rule associated to it, or to the producers of the route matching it.
+// Routes take precedence over the rules of the serializer, regional or not, but routed records are still produced to
+// the reliable ack source of their rules so that they are acked once dispatched
 func (bs *BinarySerializer) Dispatch(record *Record) {
-	for _, producer := range bs.DispatchRules[record.TxType] {
+	rules := record.dispatchRules
+	if rules == nil {
+		rules = bs.Rules()
+	}
+	if bs.Router != nil {
+		if producers, ok := bs.Router.Producers(record); ok {
+			record.routed = true
+			for _, producer := range producers {
+				producer.Produce(record)
+			}
+			for _, producer := range rules[record.TxType] {
+				if source, ok := producer.(ReliableAckSource); ok && source.ReliableAcks(record.TxType) && !slices.Contains(producers, producer) {
+					producer.Produce(record)
+				}
+			}
+			return
+		}
+	}
+	for _, producer := range rules[record.TxType] {
 		producer.Produce(record)
 	}
 }
 
+// Rules returns the current dispatch rules of the serializer, from its rules source when set
+func (bs *BinarySerializer) Rules() map[string][]Producer {
+	if bs.RulesSource != nil {
+		return bs.RulesSource.Load()
+	}
+	return bs.DispatchRules
+}
+
 // Logger returns logger for the serializer
 func (bs *BinarySerializer) Logger() *logrus.Logger {
 	return bs.logger
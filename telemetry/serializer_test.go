@@ -235,6 +235,56 @@ var _ = Describe("BinarySerializer", func() {
 		Expect(errors.As(err, &unknownError))
 	})
 
+	It("Rejects messages without topic", func() {
+		logger, _ := logrus.NoOpLogger()
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "VIN42", SenderID: "client_type.VIN42"}, DispatchRules, logger)
+		msg := messages.StreamMessage{TXID: []byte("test-42"), Payload: []byte("disiz a test"), SenderID: []byte("client_type.VIN42")}
+
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).To(MatchError(telemetry.ErrMissingTopic))
+		Expect(record.MissingTopic()).To(BeFalse())
+	})
+
+	It("Applies default topic to messages without topic", func() {
+		logger, _ := logrus.NoOpLogger()
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "VIN42", SenderID: "client_type.VIN42"}, DispatchRules, logger)
+		bs.DefaultTopic = "T"
+		msg := messages.StreamMessage{TXID: []byte("test-42"), Payload: []byte("disiz a test"), SenderID: []byte("client_type.VIN42")}
+
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.TxType).To(Equal("T"))
+		Expect(record.MissingTopic()).To(BeTrue())
+	})
+
+	It("trusts the device id of the records of gateways", func() {
+		logger, _ := logrus.NoOpLogger()
+		msg := messages.StreamMessage{MessageTopic: []byte("T"), TXID: []byte("test-42"), Payload: []byte("disiz a test"), SenderID: []byte("client_type.GW1"), DeviceID: []byte("VIN42")}
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "GW1", SenderID: "client_type.GW1"}, DispatchRules, logger)
+		record, err := bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Vin).To(Equal("GW1"))
+
+		bs.Gateway = true
+		record, err = bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Vin).To(Equal("VIN42"))
+	})
+
+	It("selects the serializer variant of the request identity", func() {
+		logger, _ := logrus.NoOpLogger()
+		Expect(telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42"}, DispatchRules, logger).Variant).To(Equal(telemetry.DefaultSerializerVariant))
+		Expect(telemetry.NewBinarySerializer(nil, DispatchRules, logger).Variant).To(Equal(telemetry.DefaultSerializerVariant))
+		Expect(telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SerializerVariant: "gen2"}, DispatchRules, logger).Variant).To(Equal("gen2"))
+	})
+
 	It("Serializer Acks", func() {
 		bs := &telemetry.BinarySerializer{DispatchRules: DispatchRules}
 		msg := &telemetry.Record{Txid: "1234", TxType: "test-topic"}
@@ -0,0 +1,146 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TransformRule sets a field of the decoded records of a record type
+type TransformRule struct {
+	// Field is the dot separated path of the field written by the rule
+	Field string `json:"field"`
+
+	// Expression computes the value of the field, see Expression for the supported syntax
+	Expression string `json:"expression,omitempty"`
+
+	// RenameFrom moves the value of this dot separated path to Field
+	RenameFrom string `json:"rename_from,omitempty"`
+}
+
+type compiledTransformRule struct {
+	field      []string
+	expression *Expression
+	renameFrom []string
+}
+
+// Transformer applies the transform rules of their record type to decoded records
+type Transformer struct {
+	rules map[string][]compiledTransformRule
+}
+
+// NewTransformer compiles the transform rules of each record type
+func NewTransformer(rules map[string][]TransformRule) (*Transformer, error) {
+	transformer := &Transformer{rules: make(map[string][]compiledTransformRule)}
+	for recordType, recordRules := range rules {
+		for _, rule := range recordRules {
+			compiled, err := compileTransformRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform for record %s: %v", recordType, err)
+			}
+			transformer.rules[recordType] = append(transformer.rules[recordType], compiled)
+		}
+	}
+	return transformer, nil
+}
+
+func compileTransformRule(rule TransformRule) (compiledTransformRule, error) {
+	if rule.Field == "" {
+		return compiledTransformRule{}, errors.New("missing field")
+	}
+	if (rule.Expression == "") == (rule.RenameFrom == "") {
+		return compiledTransformRule{}, fmt.Errorf("field %s requires either an expression or rename_from", rule.Field)
+	}
+	compiled := compiledTransformRule{field: strings.Split(rule.Field, ".")}
+	if rule.RenameFrom != "" {
+		compiled.renameFrom = strings.Split(rule.RenameFrom, ".")
+		return compiled, nil
+	}
+	expression, err := CompileExpression(rule.Expression)
+	if err != nil {
+		return compiledTransformRule{}, err
+	}
+	compiled.expression = expression
+	return compiled, nil
+}
+
+// Applies returns true if the record type has transform rules
+func (t *Transformer) Applies(recordType string) bool {
+	return len(t.rules[recordType]) > 0
+}
+
+// Transform applies the rules of the record type to the JSON payload of the record in order,
+// the payload is left unchanged if any rule fails
+func (t *Transformer) Transform(record *Record) error {
+	rules := t.rules[record.TxType]
+	if len(rules) == 0 {
+		return nil
+	}
+
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(record.PayloadBytes, &document); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := rule.apply(document); err != nil {
+			return err
+		}
+	}
+	payload, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	record.PayloadBytes = payload
+	return nil
+}
+
+func (rule compiledTransformRule) apply(document map[string]interface{}) error {
+	if rule.renameFrom != nil {
+		value, ok := removePath(document, rule.renameFrom)
+		if !ok {
+			return nil
+		}
+		return setPath(document, rule.field, value)
+	}
+	value, err := rule.expression.Evaluate(document)
+	if err != nil {
+		return fmt.Errorf("expression %q: %v", rule.expression, err)
+	}
+	return setPath(document, rule.field, value)
+}
+
+// setPath sets the value at the path, creating the intermediate objects
+func setPath(document map[string]interface{}, path []string, value interface{}) error {
+	object := document
+	for _, key := range path[:len(path)-1] {
+		child, ok := object[key]
+		if !ok {
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		childObject, ok := child.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("field %s is not an object", key)
+		}
+		object = childObject
+	}
+	object[path[len(path)-1]] = value
+	return nil
+}
+
+// removePath removes the value at the path and returns it
+func removePath(document map[string]interface{}, path []string) (interface{}, bool) {
+	object := document
+	for _, key := range path[:len(path)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		object = child
+	}
+	key := path[len(path)-1]
+	value, ok := object[key]
+	delete(object, key)
+	return value, ok
+}
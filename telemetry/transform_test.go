@@ -0,0 +1,136 @@
+package telemetry_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Transformer", func() {
+	transform := func(rules []telemetry.TransformRule, payload string) (string, error) {
+		transformer, err := telemetry.NewTransformer(map[string][]telemetry.TransformRule{"V": rules})
+		Expect(err).NotTo(HaveOccurred())
+		record := &telemetry.Record{TxType: "V", PayloadBytes: []byte(payload)}
+		err = transformer.Transform(record)
+		return string(record.PayloadBytes), err
+	}
+
+	It("computes fields from expressions", func() {
+		payload, err := transform([]telemetry.TransformRule{
+			{Field: "speed.kmh", Expression: "round(data[0].value * 1.609)"},
+			{Field: "vin", Expression: "lower(vin)"},
+			{Field: "fast", Expression: "speed.kmh > 100 && has(vin)"},
+		}, `{"vin":"ABC","data":[{"value":100}]}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(payload).To(MatchJSON(`{"vin":"abc","data":[{"value":100}],"speed":{"kmh":161},"fast":true}`))
+	})
+
+	It("renames fields", func() {
+		payload, err := transform([]telemetry.TransformRule{
+			{Field: "vehicle.vin", RenameFrom: "vin"},
+			{Field: "missing", RenameFrom: "absent"},
+		}, `{"vin":"ABC"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(payload).To(MatchJSON(`{"vehicle":{"vin":"ABC"}}`))
+	})
+
+	It("leaves the payload unchanged on errors", func() {
+		payload, err := transform([]telemetry.TransformRule{
+			{Field: "vin", Expression: "lower(vin)"},
+			{Field: "ratio", Expression: "count / 0"},
+		}, `{"vin":"ABC","count":1}`)
+		Expect(err).To(MatchError(ContainSubstring("division by zero")))
+		Expect(payload).To(Equal(`{"vin":"ABC","count":1}`))
+	})
+
+	It("ignores other record types", func() {
+		transformer, err := telemetry.NewTransformer(map[string][]telemetry.TransformRule{"V": {{Field: "a", Expression: "1"}}})
+		Expect(err).NotTo(HaveOccurred())
+		record := &telemetry.Record{TxType: "alerts", PayloadBytes: []byte("not json")}
+		Expect(transformer.Transform(record)).To(Succeed())
+		Expect(transformer.Applies("alerts")).To(BeFalse())
+	})
+
+	DescribeTable("rejects invalid rules",
+		func(rule telemetry.TransformRule, message string) {
+			_, err := telemetry.NewTransformer(map[string][]telemetry.TransformRule{"V": {rule}})
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("missing field", telemetry.TransformRule{Expression: "1"}, "missing field"),
+		Entry("expression and rename", telemetry.TransformRule{Field: "a", Expression: "1", RenameFrom: "b"}, "either an expression or rename_from"),
+		Entry("syntax error", telemetry.TransformRule{Field: "a", Expression: "1 +"}, "invalid expression"),
+		Entry("unknown function", telemetry.TransformRule{Field: "a", Expression: "exec(vin)"}, "unknown function exec"),
+		Entry("method call", telemetry.TransformRule{Field: "a", Expression: "vin.String()"}, "unsupported function call"),
+		Entry("closure", telemetry.TransformRule{Field: "a", Expression: "func() int { for {} }()"}, "unsupported"),
+		Entry("unsupported operator", telemetry.TransformRule{Field: "a", Expression: "count << 2"}, "unsupported operator"),
+	)
+})
+
+var _ = Describe("MessageTransformers", func() {
+	newRecord := func() *telemetry.Record {
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{"V": nil}, logger)
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	setVin := func(vin string) telemetry.MessageTransformFunc {
+		return func(_ string, decoded proto.Message) (proto.Message, error) {
+			decoded.(*protos.Payload).Vin += vin
+			return decoded, nil
+		}
+	}
+
+	It("runs the transformers of the topic in order", func() {
+		transformers := telemetry.NewMessageTransformers()
+		transformers.Register("V", setVin("-a"))
+		transformers.Register("V", setVin("-b"))
+		transformers.Register("alerts", setVin("-c"))
+
+		record := newRecord()
+		Expect(transformers.Transform(record)).To(Succeed())
+
+		data := &protos.Payload{}
+		Expect(proto.Unmarshal(record.Payload(), data)).To(Succeed())
+		Expect(data.Vin).To(Equal("42-a-b"))
+		Expect(record.GetProtoMessage().(*protos.Payload).Vin).To(Equal("42-a-b"))
+	})
+
+	It("leaves the record unchanged on errors", func() {
+		transformers := telemetry.NewMessageTransformers()
+		transformers.Register("V", setVin("-a"))
+		transformers.Register("V", func(_ string, _ proto.Message) (proto.Message, error) {
+			return nil, errors.New("boom")
+		})
+
+		record := newRecord()
+		payload := record.Payload()
+		Expect(transformers.Transform(record)).To(MatchError("boom"))
+		Expect(record.Payload()).To(Equal(payload))
+		Expect(record.GetProtoMessage().(*protos.Payload).Vin).To(Equal("42"))
+	})
+
+	It("returns the panics of transformers as errors", func() {
+		transformers := telemetry.NewMessageTransformers()
+		transformers.Register("V", setVin("-a"))
+		transformers.Register("V", func(_ string, _ proto.Message) (proto.Message, error) {
+			panic("boom")
+		})
+
+		record := newRecord()
+		payload := record.Payload()
+		Expect(transformers.Transform(record)).To(MatchError("panic in message transformer: boom"))
+		Expect(record.Payload()).To(Equal(payload))
+	})
+})